@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"fmt"
+)
+
+// MultiBind puts a UDP bind and the stream binds together.
+// host:port goes to the UDP bind, which decides the port, and tcp:// or ws(s):// to the stream bind of the transport.
+type MultiBind struct {
+	udp     Bind
+	streams []Bind
+}
+
+var _ Bind = (*MultiBind)(nil)
+
+func NewMultiBind(udp Bind, streams ...Bind) *MultiBind {
+	return &MultiBind{udp: udp, streams: streams}
+}
+
+// UDP returns the UDP bind
+func (bind *MultiBind) UDP() Bind {
+	return bind.udp
+}
+
+func (bind *MultiBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := bind.udp.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, stream := range bind.streams {
+		streamFns, _, err := stream.Open(actualPort)
+		if err != nil {
+			bind.udp.Close()
+			for _, opened := range bind.streams[:i] {
+				opened.Close()
+			}
+			return nil, 0, err
+		}
+		fns = append(fns, streamFns...)
+	}
+	return fns, actualPort, nil
+}
+
+func (bind *MultiBind) Close() error {
+	err := bind.udp.Close()
+	for _, stream := range bind.streams {
+		if e := stream.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (bind *MultiBind) SetMark(mark uint32) error {
+	if err := bind.udp.SetMark(mark); err != nil {
+		return err
+	}
+	for _, stream := range bind.streams {
+		if err := stream.SetMark(mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *MultiBind) Send(buff []byte, endpoint Endpoint) error {
+	if _, ok := endpoint.(*StreamEndpoint); !ok {
+		return bind.udp.Send(buff, endpoint)
+	}
+	for _, stream := range bind.streams {
+		if err := stream.Send(buff, endpoint); err != ErrWrongEndpointType {
+			return err
+		}
+	}
+	return ErrWrongEndpointType
+}
+
+func (bind *MultiBind) ParseEndpoint(s string) (Endpoint, error) {
+	scheme, _ := SplitScheme(s)
+	if scheme == "" {
+		return bind.udp.ParseEndpoint(s)
+	}
+	for _, stream := range bind.streams {
+		if endpoint, err := stream.ParseEndpoint(s); err != ErrWrongEndpointType {
+			return endpoint, err
+		}
+	}
+	return nil, fmt.Errorf("unsupported transport: %v", scheme)
+}
+
+func (bind *MultiBind) EnabledAf() EnabledAf {
+	return bind.udp.EnabledAf()
+}
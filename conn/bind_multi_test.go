@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStreamBinds(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpPort := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	ws := NewWSBind()
+	srv := httptest.NewServer(ws)
+	defer srv.Close()
+	loopback := EnabledAf{IPv4: true, ListenIPv4: "127.0.0.1"}
+	server := NewMultiBind(NewStdNetBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0), NewTCPBind(loopback, tcpPort), ws)
+	serverFns, _, err := server.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := NewMultiBind(NewStdNetBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0), NewTCPBind(loopback, ""), NewWSBind())
+	clientFns, _, err := client.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	receive := func(fn ReceiveFunc) (string, Endpoint) {
+		buf := make([]byte, 1500)
+		n, endpoint, err := fn(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n]), endpoint
+	}
+	// one receive function for UDP, then TCP and WebSocket
+	for i, url := range []string{"tcp://127.0.0.1:" + tcpPort, "ws" + strings.TrimPrefix(srv.URL, "http") + "/edge/ws4"} {
+		endpoint, err := client.ParseEndpoint(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, packet := range []string{"ping", strings.Repeat("x", 1400)} {
+			if err := client.Send([]byte(packet), endpoint); err != nil {
+				t.Fatal(err)
+			}
+			got, from := receive(serverFns[i+1])
+			if got != packet {
+				t.Fatalf("%v: received %q", url, got)
+			}
+			if err := server.Send([]byte("pong"), from); err != nil {
+				t.Fatal(err)
+			}
+			got, from = receive(clientFns[i+1])
+			if got != "pong" || from.DstToString() != url {
+				t.Fatalf("%v: received %q from %v", url, got, from.DstToString())
+			}
+		}
+	}
+	if _, err := client.ParseEndpoint("quic://127.0.0.1:1"); err == nil {
+		t.Error("parsed an unknown transport")
+	}
+}
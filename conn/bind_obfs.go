@@ -0,0 +1,193 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	ObfsMaxPadding_Default = 64
+	ObfsMaxPadding_Max     = 1024
+
+	obfsNonceSize = chacha20.NonceSize
+	obfsLenSize   = 2
+	ObfsOverhead  = obfsNonceSize + obfsLenSize // plus the padding, see Overhead
+	obfsHeadLen   = 256                         // bytes of each packet that we encrypt, whole handshakes and the header of data packets
+	obfsKeyLabel  = "EtherGuard obfuscation key"
+)
+
+var errObfsTooLarge = errors.New("packet too large to obfuscate")
+
+// ObfsBind hides the packets of the inner bind from DPI, with a key derived from a secret shared by the whole network.
+// Each packet goes out as nonce | chacha20(length | head) | rest | padding:
+// the head hides the message types and the indexes, and the random padding hides the sizes of the handshakes.
+// The padding is never more than maxPadding, so a packet grows by Overhead at most.
+// It is no encryption, the packets inside are encrypted already. Packets that don't decode are dropped.
+// The endpoints are the ones of the inner bind. The device doesn't see the sticky sockets behind it,
+// so a route change is picked up when sending from the old source fails.
+type ObfsBind struct {
+	inner      Bind
+	key        [chacha20.KeySize]byte
+	maxPadding int
+
+	rmu sync.Mutex // protects rng
+	rng *mrand.Rand
+}
+
+var _ Bind = (*ObfsBind)(nil)
+
+var obfsBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 2048)
+		return &b
+	},
+}
+
+// NewObfsBind wraps inner. maxPadding is the most random bytes added to a packet, 0 for ObfsMaxPadding_Default.
+func NewObfsBind(inner Bind, secret string, maxPadding int) (*ObfsBind, error) {
+	if secret == "" {
+		return nil, errors.New("Obfuscation.Secret is required")
+	}
+	if maxPadding < 0 || maxPadding > ObfsMaxPadding_Max {
+		return nil, fmt.Errorf("Obfuscation.MaxPadding must between 0 and %v: %v", ObfsMaxPadding_Max, maxPadding)
+	}
+	if maxPadding == 0 {
+		maxPadding = ObfsMaxPadding_Default
+	}
+	return &ObfsBind{
+		inner:      inner,
+		key:        blake2s.Sum256([]byte(obfsKeyLabel + secret)),
+		maxPadding: maxPadding,
+		rng:        mrand.New(mrand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// Inner returns the wrapped bind
+func (bind *ObfsBind) Inner() Bind {
+	return bind.inner
+}
+
+// Overhead is the most bytes added to a packet, the frames and the PMTU probes leave room for it
+func (bind *ObfsBind) Overhead() int {
+	return ObfsOverhead + bind.maxPadding
+}
+
+func (bind *ObfsBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := bind.inner.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	wrapped := make([]ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		wrapped[i] = bind.makeReceiveFunc(fn)
+	}
+	return wrapped, actualPort, nil
+}
+
+func (bind *ObfsBind) makeReceiveFunc(fn ReceiveFunc) ReceiveFunc {
+	return func(buff []byte) (int, Endpoint, error) {
+		for {
+			n, endpoint, err := fn(buff)
+			if err != nil {
+				return n, endpoint, err
+			}
+			if n, ok := bind.Deobfuscate(buff[:n]); ok {
+				return n, endpoint, nil
+			}
+		}
+	}
+}
+
+func (bind *ObfsBind) Close() error {
+	return bind.inner.Close()
+}
+
+func (bind *ObfsBind) SetMark(mark uint32) error {
+	return bind.inner.SetMark(mark)
+}
+
+func (bind *ObfsBind) Send(buff []byte, endpoint Endpoint) error {
+	if len(buff) > 0xffff {
+		return errObfsTooLarge
+	}
+	bp := obfsBufPool.Get().(*[]byte)
+	defer obfsBufPool.Put(bp)
+	packet := bind.Obfuscate((*bp)[:0], buff)
+	*bp = packet[:0]
+	return bind.inner.Send(packet, endpoint)
+}
+
+func (bind *ObfsBind) ParseEndpoint(s string) (Endpoint, error) {
+	return bind.inner.ParseEndpoint(s)
+}
+
+func (bind *ObfsBind) EnabledAf() EnabledAf {
+	return bind.inner.EnabledAf()
+}
+
+// paddingLen picks the padding of a packet, up to maxPadding
+func (bind *ObfsBind) paddingLen() int {
+	bind.rmu.Lock()
+	defer bind.rmu.Unlock()
+	return bind.rng.Intn(bind.maxPadding + 1)
+}
+
+// Obfuscate appends the obfuscated packet to dst
+func (bind *ObfsBind) Obfuscate(dst []byte, packet []byte) []byte {
+	padding := bind.paddingLen()
+	total := ObfsOverhead + len(packet) + padding
+	if cap(dst) < total {
+		dst = make([]byte, 0, total)
+	}
+	out := dst[:total]
+	nonce := out[:obfsNonceSize]
+	rand.Read(nonce)
+	binary.BigEndian.PutUint16(out[obfsNonceSize:], uint16(len(packet)))
+	copy(out[ObfsOverhead:], packet)
+	pad := out[ObfsOverhead+len(packet):]
+	for i := range pad {
+		pad[i] = 0
+	}
+	cipher, _ := chacha20.NewUnauthenticatedCipher(bind.key[:], nonce)
+	head := len(packet)
+	if head > obfsHeadLen {
+		head = obfsHeadLen
+	}
+	cipher.XORKeyStream(out[obfsNonceSize:ObfsOverhead+head], out[obfsNonceSize:ObfsOverhead+head])
+	cipher.XORKeyStream(pad, pad) // the keystream makes random padding
+	return out
+}
+
+// Deobfuscate restores the packet to the start of b, and returns its length
+func (bind *ObfsBind) Deobfuscate(b []byte) (int, bool) {
+	if len(b) < ObfsOverhead {
+		return 0, false
+	}
+	cipher, _ := chacha20.NewUnauthenticatedCipher(bind.key[:], b[:obfsNonceSize])
+	var lenbuf [obfsLenSize]byte
+	cipher.XORKeyStream(lenbuf[:], b[obfsNonceSize:ObfsOverhead])
+	size := int(binary.BigEndian.Uint16(lenbuf[:]))
+	if size > len(b)-ObfsOverhead {
+		return 0, false
+	}
+	packet := b[ObfsOverhead : ObfsOverhead+size]
+	head := size
+	if head > obfsHeadLen {
+		head = obfsHeadLen
+	}
+	cipher.XORKeyStream(packet[:head], packet[:head])
+	return copy(b, packet), true
+}
@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestObfsBind(t *testing.T) {
+	newBind := func(secret string) (*ObfsBind, ReceiveFunc, uint16) {
+		bind, err := NewObfsBind(NewStdNetBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0), secret, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fns, port, err := bind.Open(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bind, fns[0], port
+	}
+	server, serverRecv, serverPort := newBind("secret")
+	defer server.Close()
+	raw := NewStdNetBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0)
+	rawFns, rawPort, err := raw.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	client, clientRecv, _ := newBind("secret")
+	defer client.Close()
+	wrong, _, _ := newBind("wrong")
+	defer wrong.Close()
+
+	toServer, _ := client.ParseEndpoint("127.0.0.1:" + strconv.Itoa(int(serverPort)))
+	toRaw, _ := client.ParseEndpoint("127.0.0.1:" + strconv.Itoa(int(rawPort)))
+	buf := make([]byte, 2048)
+
+	// a handshake on the wire has random first bytes and a random size, but never grows by more than the overhead
+	initiation := make([]byte, 148) // the handshake initiation of WireGuard
+	initiation[0] = 1
+	sizes := make(map[int]bool)
+	firsts := make(map[byte]bool)
+	for i := 0; i < 32; i++ {
+		if err := client.Send(initiation, toRaw); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := rawFns[0](buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > len(initiation)+client.Overhead() {
+			t.Fatalf("%v bytes on the wire, more than the overhead of %v", n, client.Overhead())
+		}
+		sizes[n] = true
+		firsts[buf[0]] = true
+	}
+
+	// the NATProbes to DetectPort are obfuscated by hand
+	probe := client.Obfuscate(nil, []byte("probe"))
+	if n, ok := server.Deobfuscate(probe); !ok || string(probe[:n]) != "probe" {
+		t.Fatalf("deobfuscated %q", probe[:n])
+	}
+	if len(sizes) < 2 || len(firsts) < 2 {
+		t.Errorf("handshakes not disguised: %v sizes, %v first bytes", len(sizes), len(firsts))
+	}
+
+	// a packet of the wrong secret is dropped, the next one gets through
+	if err := wrong.Send([]byte("hidden"), toServer); err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range []string{"ping", strings.Repeat("x", 1400)} {
+		if err := client.Send([]byte(packet), toServer); err != nil {
+			t.Fatal(err)
+		}
+		n, from, err := serverRecv(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != packet {
+			t.Fatalf("received %q", buf[:n])
+		}
+		if err := server.Send([]byte("pong"), from); err != nil {
+			t.Fatal(err)
+		}
+		if n, _, err = clientRecv(buf); err != nil || string(buf[:n]) != "pong" {
+			t.Fatalf("received %q, %v", buf[:n], err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transports other than UDP, as the scheme of a ConnURL: tcp://host:port, ws://host/path or wss://host/path
+const (
+	SchemeTCP = "tcp"
+	SchemeWS  = "ws"
+	SchemeWSS = "wss"
+
+	StreamDialTimeout = time.Second * 10
+	streamQueueSize   = 1024
+)
+
+var errStreamClosedByPeer = errors.New("the connection from this endpoint is closed")
+
+// SplitScheme splits a ConnURL into its transport and the rest. The transport of host:port is "", which is UDP.
+func SplitScheme(connurl string) (scheme string, rest string) {
+	i := strings.Index(connurl, "://")
+	if i < 0 {
+		return "", connurl
+	}
+	return strings.ToLower(connurl[:i]), connurl[i+3:]
+}
+
+// IsStreamURL tells if the ConnURL goes over TCP or WebSocket. Other peers can't punch a hole to it.
+func IsStreamURL(connurl string) bool {
+	scheme, _ := SplitScheme(connurl)
+	return scheme != ""
+}
+
+// StreamEndpoint is an endpoint of TCPBind or WSBind.
+// It is the URL to dial, or the remote address of a connection that we accepted.
+type StreamEndpoint struct {
+	URL      string
+	Addr     *net.TCPAddr // nil if the host is a name that we leave to the proxy
+	accepted bool         // can't be dialed, we only answer on the connection
+}
+
+var _ Endpoint = (*StreamEndpoint)(nil)
+
+func (*StreamEndpoint) ClearSrc() {}
+
+func (*StreamEndpoint) SrcToString() string {
+	return ""
+}
+
+func (e *StreamEndpoint) DstToString() string {
+	return e.URL
+}
+
+func (e *StreamEndpoint) DstToBytes() []byte {
+	return []byte(e.URL)
+}
+
+func (e *StreamEndpoint) DstIP() net.IP {
+	if e.Addr == nil {
+		return nil
+	}
+	return e.Addr.IP
+}
+
+func (*StreamEndpoint) SrcIP() net.IP {
+	return nil
+}
+
+// packetConn is a connection that keeps the boundaries of the packets
+type packetConn interface {
+	ReadPacket() ([]byte, error)
+	WritePacket(b []byte) error
+	Close() error
+}
+
+type streamPacket struct {
+	data     []byte
+	endpoint *StreamEndpoint
+}
+
+type streamConn struct {
+	sync.Mutex // serializes the dial and the writes
+	pc         packetConn
+}
+
+// streamBind keeps a connection for each endpoint, dialed on the first send or accepted, and receives from all of them
+type streamBind struct {
+	mu      sync.Mutex // protects following fields
+	conns   map[string]*streamConn
+	recv    chan streamPacket
+	closing chan struct{} // nil if not open
+	fwmark  uint32
+
+	dial func(endpoint *StreamEndpoint, fwmark uint32) (packetConn, error)
+}
+
+func (b *streamBind) open() ([]ReceiveFunc, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing != nil {
+		return nil, ErrBindAlreadyOpen
+	}
+	b.conns = make(map[string]*streamConn)
+	b.recv = make(chan streamPacket, streamQueueSize)
+	b.closing = make(chan struct{})
+	recv, closing := b.recv, b.closing
+	return []ReceiveFunc{func(buff []byte) (int, Endpoint, error) {
+		select {
+		case packet := <-recv:
+			return copy(buff, packet.data), packet.endpoint, nil
+		case <-closing:
+			return 0, nil, net.ErrClosed
+		}
+	}}, nil
+}
+
+func (b *streamBind) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing == nil {
+		return
+	}
+	close(b.closing)
+	for _, sc := range b.conns {
+		if sc.pc != nil {
+			sc.pc.Close()
+		}
+	}
+	b.conns = nil
+	b.closing = nil
+}
+
+func (b *streamBind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	b.fwmark = mark // for the connections dialed from now on
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *streamBind) send(buff []byte, endpoint *StreamEndpoint) error {
+	b.mu.Lock()
+	if b.closing == nil {
+		b.mu.Unlock()
+		return net.ErrClosed
+	}
+	sc := b.conns[endpoint.URL]
+	if sc == nil {
+		if endpoint.accepted {
+			b.mu.Unlock()
+			return errStreamClosedByPeer
+		}
+		sc = &streamConn{}
+		b.conns[endpoint.URL] = sc
+	}
+	fwmark := b.fwmark
+	b.mu.Unlock()
+
+	sc.Lock()
+	defer sc.Unlock()
+	if sc.pc == nil {
+		pc, err := b.dial(endpoint, fwmark)
+		if err != nil {
+			b.remove(endpoint.URL, sc)
+			return err
+		}
+		b.mu.Lock()
+		if b.conns[endpoint.URL] != sc {
+			b.mu.Unlock()
+			pc.Close()
+			return net.ErrClosed
+		}
+		sc.pc = pc
+		recv, closing := b.recv, b.closing
+		b.mu.Unlock()
+		go b.read(endpoint, sc, pc, recv, closing)
+	}
+	if err := sc.pc.WritePacket(buff); err != nil {
+		sc.pc.Close()
+		b.remove(endpoint.URL, sc)
+		return err
+	}
+	return nil
+}
+
+// serve receives from a connection accepted from endpoint until it fails, replies go back on it
+func (b *streamBind) serve(endpoint *StreamEndpoint, pc packetConn) {
+	endpoint.accepted = true
+	sc := &streamConn{pc: pc}
+	b.mu.Lock()
+	if b.closing == nil {
+		b.mu.Unlock()
+		pc.Close()
+		return
+	}
+	if old := b.conns[endpoint.URL]; old != nil && old.pc != nil {
+		old.pc.Close()
+	}
+	b.conns[endpoint.URL] = sc
+	recv, closing := b.recv, b.closing
+	b.mu.Unlock()
+	b.read(endpoint, sc, pc, recv, closing)
+}
+
+func (b *streamBind) read(endpoint *StreamEndpoint, sc *streamConn, pc packetConn, recv chan streamPacket, closing chan struct{}) {
+	defer b.remove(endpoint.URL, sc)
+	defer pc.Close()
+	for {
+		packet, err := pc.ReadPacket()
+		if err != nil {
+			return
+		}
+		select {
+		case recv <- streamPacket{data: packet, endpoint: endpoint}:
+		case <-closing:
+			return
+		}
+	}
+}
+
+func (b *streamBind) remove(key string, sc *streamConn) {
+	b.mu.Lock()
+	if b.conns[key] == sc {
+		delete(b.conns, key)
+	}
+	b.mu.Unlock()
+}
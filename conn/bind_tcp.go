@@ -0,0 +1,168 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// TCPBind carries the packets over TCP for networks that block UDP, each packet after its length in 2 bytes.
+// It dials tcp://ip:port endpoints, and accepts connections if it has a port to listen on.
+type TCPBind struct {
+	streamBind
+	af     EnabledAf
+	listen string // "" to only dial
+
+	lmu       sync.Mutex // protects listeners
+	listeners []net.Listener
+}
+
+var _ Bind = (*TCPBind)(nil)
+
+func NewTCPBind(af EnabledAf, listen string) *TCPBind {
+	bind := &TCPBind{af: af, listen: listen}
+	bind.dial = dialTCP
+	return bind
+}
+
+func (bind *TCPBind) ParseEndpoint(s string) (Endpoint, error) {
+	scheme, hostport := SplitScheme(s)
+	if scheme != SchemeTCP {
+		return nil, ErrWrongEndpointType
+	}
+	addr, err := parseEndpoint(hostport)
+	if err != nil {
+		return nil, err
+	}
+	tcpaddr := &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	return &StreamEndpoint{URL: SchemeTCP + "://" + tcpaddr.String(), Addr: tcpaddr}, nil
+}
+
+func (bind *TCPBind) EnabledAf() EnabledAf {
+	return bind.af
+}
+
+// Open listens on the port of the bind, the UDP port is not ours
+func (bind *TCPBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, err := bind.open()
+	if err != nil {
+		return nil, 0, err
+	}
+	if bind.listen == "" {
+		return fns, port, nil
+	}
+	bind.lmu.Lock()
+	defer bind.lmu.Unlock()
+	for _, l := range []struct {
+		use     bool
+		network string
+		ip      string
+	}{{bind.af.IPv4, "tcp4", bind.af.ListenIPv4}, {bind.af.IPv6, "tcp6", bind.af.ListenIPv6}} {
+		if !l.use {
+			continue
+		}
+		listener, err := net.Listen(l.network, net.JoinHostPort(l.ip, bind.listen))
+		if err != nil {
+			bind.closeLocked()
+			return nil, 0, err
+		}
+		bind.listeners = append(bind.listeners, listener)
+		go bind.accept(listener)
+	}
+	return fns, port, nil
+}
+
+func (bind *TCPBind) accept(listener net.Listener) {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		addr := c.RemoteAddr().(*net.TCPAddr)
+		go bind.serve(&StreamEndpoint{URL: SchemeTCP + "://" + addr.String(), Addr: addr}, newTCPPacketConn(c))
+	}
+}
+
+func (bind *TCPBind) Close() error {
+	bind.lmu.Lock()
+	defer bind.lmu.Unlock()
+	return bind.closeLocked()
+}
+
+func (bind *TCPBind) closeLocked() error {
+	var err error
+	for _, listener := range bind.listeners {
+		if e := listener.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	bind.listeners = nil
+	bind.close()
+	return err
+}
+
+func (bind *TCPBind) Send(buff []byte, endpoint Endpoint) error {
+	nend, ok := endpoint.(*StreamEndpoint)
+	if !ok || nend.Addr == nil || !isTCPURL(nend.URL) {
+		return ErrWrongEndpointType
+	}
+	if len(buff) > 0xffff {
+		return errors.New("packet too large for TCP framing")
+	}
+	return bind.send(buff, nend)
+}
+
+func isTCPURL(url string) bool {
+	scheme, _ := SplitScheme(url)
+	return scheme == SchemeTCP
+}
+
+func dialTCP(endpoint *StreamEndpoint, fwmark uint32) (packetConn, error) {
+	dialer := &net.Dialer{Timeout: StreamDialTimeout, Control: markControl(fwmark)}
+	c, err := dialer.Dial("tcp", endpoint.Addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return newTCPPacketConn(c), nil
+}
+
+type tcpPacketConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newTCPPacketConn(c net.Conn) *tcpPacketConn {
+	return &tcpPacketConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *tcpPacketConn) ReadPacket() ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(c.r, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// WritePacket writes the length and the packet at once, so the packet leaves in one segment if it fits
+func (c *tcpPacketConn) WritePacket(b []byte) error {
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := c.Write(frame)
+	return err
+}
@@ -0,0 +1,214 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const wsMaxPayload = 0xffff
+
+// WSBind carries the packets over WebSocket, one packet in each binary message, which gets through HTTP proxies.
+// It dials ws:// and wss:// endpoints through the proxy of HTTPS_PROXY or HTTP_PROXY, and accepts connections with ServeHTTP.
+type WSBind struct {
+	streamBind
+}
+
+var _ Bind = (*WSBind)(nil)
+var _ http.Handler = (*WSBind)(nil)
+
+func NewWSBind() *WSBind {
+	bind := &WSBind{}
+	bind.dial = dialWS
+	return bind
+}
+
+func (bind *WSBind) ParseEndpoint(s string) (Endpoint, error) {
+	u, err := parseWSURL(s)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := &StreamEndpoint{URL: u.String()}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		endpoint.Addr, _ = net.ResolveTCPAddr("tcp", wsHostPort(u))
+	}
+	return endpoint, nil
+}
+
+func parseWSURL(s string) (*url.URL, error) {
+	scheme, _ := SplitScheme(s)
+	if scheme != SchemeWS && scheme != SchemeWSS {
+		return nil, ErrWrongEndpointType
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %v", s)
+	}
+	return u, nil
+}
+
+// wsHostPort returns the host and port to connect to, the default port of the scheme if the URL has none
+func wsHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == SchemeWSS {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func (bind *WSBind) EnabledAf() EnabledAf {
+	return EnabledAf46
+}
+
+// Open doesn't listen, the connections come from the HTTP server that ServeHTTP is mounted on
+func (bind *WSBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, err := bind.open()
+	return fns, port, err
+}
+
+func (bind *WSBind) Close() error {
+	bind.close()
+	return nil
+}
+
+func (bind *WSBind) Send(buff []byte, endpoint Endpoint) error {
+	nend, ok := endpoint.(*StreamEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	if scheme, _ := SplitScheme(nend.URL); scheme != SchemeWS && scheme != SchemeWSS {
+		return ErrWrongEndpointType
+	}
+	return bind.send(buff, nend)
+}
+
+// ServeHTTP accepts a WebSocket connection, the endpoint is ws://ip:port of the client or the proxy in front of us
+func (bind *WSBind) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		ws.MaxPayloadBytes = wsMaxPayload
+		endpoint := &StreamEndpoint{URL: SchemeWS + "://" + r.RemoteAddr}
+		endpoint.Addr, _ = net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		bind.serve(endpoint, wsPacketConn{ws})
+	}}.ServeHTTP(w, r)
+}
+
+func dialWS(endpoint *StreamEndpoint, fwmark uint32) (packetConn, error) {
+	u, err := parseWSURL(endpoint.URL)
+	if err != nil {
+		return nil, err
+	}
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == SchemeWSS {
+		origin.Scheme = "https"
+	}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: StreamDialTimeout, Control: markControl(fwmark)}
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: origin})
+	if err != nil {
+		return nil, err
+	}
+	var c net.Conn
+	if proxy != nil {
+		c, err = dialHTTPConnect(dialer, proxy, wsHostPort(u))
+	} else {
+		c, err = dialer.Dial("tcp", wsHostPort(u))
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(StreamDialTimeout))
+	if u.Scheme == SchemeWSS {
+		tlsconn := tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsconn.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tlsconn
+	}
+	ws, err := websocket.NewClient(config, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = wsMaxPayload
+	return wsPacketConn{ws}, nil
+}
+
+// dialHTTPConnect opens a tunnel to hostport through an HTTP proxy
+func dialHTTPConnect(dialer *net.Dialer, proxy *url.URL, hostport string) (net.Conn, error) {
+	if proxy.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme: %v", proxy.Scheme)
+	}
+	proxyHost := proxy.Host
+	if proxy.Port() == "" {
+		proxyHost = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	c, err := dialer.Dial("tcp", proxyHost)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: hostport},
+		Host:   hostport,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+password)))
+	}
+	c.SetDeadline(time.Now().Add(StreamDialTimeout))
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("proxy %v: CONNECT %v: %v", proxy.Host, hostport, resp.Status)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+type wsPacketConn struct {
+	*websocket.Conn
+}
+
+func (c wsPacketConn) ReadPacket() ([]byte, error) {
+	var packet []byte
+	err := websocket.Message.Receive(c.Conn, &packet)
+	return packet, err
+}
+
+func (c wsPacketConn) WritePacket(b []byte) error {
+	return websocket.Message.Send(c.Conn, b)
+}
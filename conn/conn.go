@@ -108,6 +108,11 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// BindOverhead is implemented by Bind objects that make the packets larger on the wire.
+type BindOverhead interface {
+	Overhead() int // the most bytes added to a packet
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst: the remote address of a peer ("endpoint" in uapi terminology)
@@ -199,10 +204,29 @@ func parseEndpoint(s string) (*net.UDPAddr, error) {
 	return addr, err
 }
 
+// LookupIP resolves the host of a ConnURL to an IP address of an enabled address family, and returns the network and the ConnURL with the IP.
+// tcp://host:port is resolved the same way. ws:// and wss:// are returned as they are, the proxy may be the only one that can resolve them.
 func LookupIP(host_port string, Af EnabledAf, AfPrefer int) (string, string, error) {
 	if host_port == "" {
 		return "", "", fmt.Errorf("error lookup ip from empty string")
 	}
+	switch scheme, rest := SplitScheme(host_port); scheme {
+	case "":
+	case SchemeTCP:
+		NetStr, addr, err := LookupIP(rest, Af, AfPrefer)
+		if err != nil {
+			return "", "", err
+		}
+		return strings.Replace(NetStr, "udp", "tcp", 1), SchemeTCP + "://" + addr, nil
+	case SchemeWS, SchemeWSS:
+		u, err := parseWSURL(host_port)
+		if err != nil {
+			return "", "", err
+		}
+		return scheme, u.String(), nil
+	default:
+		return "", "", fmt.Errorf("unsupported transport: %v", scheme)
+	}
 	var conn net.Conn
 	var err error
 	var af_try_order []string
@@ -7,6 +7,12 @@
 
 package conn
 
+import "syscall"
+
 func (bind *StdNetBind) SetMark(mark uint32) error {
 	return nil
 }
+
+func markControl(mark uint32) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
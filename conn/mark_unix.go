@@ -9,6 +9,7 @@ package conn
 
 import (
 	"runtime"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -26,6 +27,22 @@ func init() {
 	}
 }
 
+// markControl sets the mark on the sockets of a net.Dialer or net.ListenConfig, nil if there is no mark
+func markControl(mark uint32) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 || fwmarkIoctl == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var operr error
+		if err := c.Control(func(fd uintptr) {
+			operr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, fwmarkIoctl, int(mark))
+		}); err != nil {
+			return err
+		}
+		return operr
+	}
+}
+
 func (bind *StdNetBind) SetMark(mark uint32) error {
 	var operr error
 	if fwmarkIoctl == 0 {
@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// ACL is the compiled mtypes.ACLInfo. A nil *ACL allows everything.
+type ACL struct {
+	rules []aclRule
+}
+
+type aclRule struct {
+	src        map[mtypes.Vertex]bool // nil matches all
+	dst        map[mtypes.Vertex]bool
+	ethertypes map[uint16]bool
+	vlans      map[uint16]bool
+}
+
+func CheckACL(info mtypes.ACLInfo) error {
+	for i, rule := range info.Rules {
+		for _, id := range append(append([]mtypes.Vertex{}, rule.Src...), rule.Dst...) {
+			if id.IsSpecial() {
+				return fmt.Errorf("ACL.Rules[%v]: ID %v is a special NodeID", i, id)
+			}
+		}
+		for _, vid := range rule.VLANs {
+			if vid > VLANID_Max {
+				return fmt.Errorf("ACL.Rules[%v]: VLAN must <= %v: %v", i, VLANID_Max, vid)
+			}
+		}
+	}
+	return nil
+}
+
+// NewACL compiles the ACL, nil if it is disabled
+func NewACL(info mtypes.ACLInfo) *ACL {
+	if !info.Enabled {
+		return nil
+	}
+	acl := &ACL{
+		rules: make([]aclRule, len(info.Rules)),
+	}
+	for i, rule := range info.Rules {
+		acl.rules[i] = aclRule{
+			src:        acl_set(rule.Src),
+			dst:        acl_set(rule.Dst),
+			ethertypes: acl_set16(rule.EtherTypes),
+			vlans:      acl_set16(rule.VLANs),
+		}
+	}
+	return acl
+}
+
+func acl_set(ids []mtypes.Vertex) map[mtypes.Vertex]bool {
+	if len(ids) == 0 {
+		return nil
+	}
+	ret := make(map[mtypes.Vertex]bool, len(ids))
+	for _, id := range ids {
+		ret[id] = true
+	}
+	return ret
+}
+
+func acl_set16(vals []uint16) map[uint16]bool {
+	if len(vals) == 0 {
+		return nil
+	}
+	ret := make(map[uint16]bool, len(vals))
+	for _, v := range vals {
+		ret[v] = true
+	}
+	return ret
+}
+
+// Allowed reports whether a rule allows the frame from src to dst
+func (acl *ACL) Allowed(src mtypes.Vertex, dst mtypes.Vertex, frame []byte) bool {
+	if acl == nil {
+		return true
+	}
+	ethertype := tap.GetEtherType(frame)
+	vid := tap.GetVlanID(frame)
+	for _, rule := range acl.rules {
+		if rule.src != nil && !rule.src[src] {
+			continue
+		}
+		if rule.dst != nil && !rule.dst[dst] {
+			continue
+		}
+		if rule.ethertypes != nil && !rule.ethertypes[ethertype] {
+			continue
+		}
+		if rule.vlans != nil && !rule.vlans[vid] {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// SetACL replaces the ACL, it applies to the next packet
+func (device *Device) SetACL(info mtypes.ACLInfo) {
+	device.acl.Store(NewACL(info))
+}
+
+// aclAllowed checks a NormalPacket frame from src to dst against the ACL, and counts the drop
+func (device *Device) aclAllowed(src mtypes.Vertex, dst mtypes.Vertex, frame []byte) bool {
+	acl, _ := device.acl.Load().(*ACL)
+	if acl.Allowed(src, dst, frame) {
+		return true
+	}
+	atomic.AddUint64(&device.counters.aclDropped, 1)
+	return false
+}
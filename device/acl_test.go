@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestACL(t *testing.T) {
+	device := &Device{ID: 3}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{})
+	ipv6 := vlanFrame(10)
+	ipv6[16], ipv6[17] = 0x86, 0xdd
+	if !device.aclAllowed(1, 3, vlanFrame(0)) {
+		t.Fatal("denied without an ACL")
+	}
+
+	info := mtypes.ACLInfo{
+		Enabled: true,
+		Rules: []mtypes.ACLRule{
+			{Src: []mtypes.Vertex{1, 2}, Dst: []mtypes.Vertex{1, 2}},
+			{Src: []mtypes.Vertex{1}, Dst: []mtypes.Vertex{3}, EtherTypes: []uint16{0x0800}, VLANs: []uint16{10}},
+		},
+	}
+	if err := CheckACL(info); err != nil {
+		t.Fatal(err)
+	}
+	device.SetACL(info)
+	for _, c := range []struct {
+		src, dst mtypes.Vertex
+		frame    []byte
+		allowed  bool
+	}{
+		{1, 2, vlanFrame(0), true},
+		{2, 1, vlanFrame(20), true},
+		{1, 3, vlanFrame(10), true}, // the EtherType behind the VLAN tag
+		{1, 3, vlanFrame(0), false},
+		{3, 1, vlanFrame(10), false},
+		{2, 3, vlanFrame(10), false},
+		{1, 3, ipv6, false},
+	} {
+		if allowed := device.aclAllowed(c.src, c.dst, c.frame); allowed != c.allowed {
+			t.Errorf("aclAllowed(%v, %v, % x) = %v", c.src, c.dst, c.frame, allowed)
+		}
+	}
+	if m := device.GetMetrics(); m.ACLDropped != 4 {
+		t.Errorf("ACLDropped = %v", m.ACLDropped)
+	}
+
+	device.SetACL(mtypes.ACLInfo{Enabled: false, Rules: info.Rules})
+	if !device.aclAllowed(3, 1, vlanFrame(0)) {
+		t.Error("denied by a disabled ACL")
+	}
+	if err := CheckACL(mtypes.ACLInfo{Rules: []mtypes.ACLRule{{Dst: []mtypes.Vertex{mtypes.NodeID_Broadcast}}}}); err == nil {
+		t.Error("accepted a special NodeID")
+	}
+}
@@ -8,6 +8,7 @@ package device
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -17,12 +18,15 @@ import (
 	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/portmap"
 	"github.com/KusakabeSi/EtherGuard-VPN/ratelimiter"
 	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
 	fixed_time_cache "github.com/KusakabeSi/go-cache"
+	"golang.org/x/crypto/blake2s"
 )
 
 type Device struct {
@@ -49,6 +53,7 @@ type Device struct {
 		stopping sync.WaitGroup
 		sync.RWMutex
 		bind          conn.Bind // bind interface
+		overhead      int       // the most bytes the bind adds to a packet, never changed
 		netlinkCancel *rwcancel.RWCancel
 		port          uint16 // listening port
 		fwmark        uint32 // mark value (0 = disabled)
@@ -74,17 +79,23 @@ type Device struct {
 		LocalV6      net.IP
 	}
 
-	state_hashes mtypes.StateHash
+	state_hashes  mtypes.StateHash
+	super_edgeapi atomic.Value // string, EdgeAPI of the supernode that pushes updates to us
 
 	event_tryendpoint chan struct{}
 	chan_send_packet  chan *packet_send_params
+	chan_send_control chan *packet_send_params // control messages, taken before chan_send_packet
 
 	EdgeConfigPath  string
-	EdgeConfig      *mtypes.EdgeConfig
 	SuperConfigPath string
 	SuperConfig     *mtypes.SuperConfig
 	enabledAf       conn.EnabledAf
 
+	edgeconfig struct {
+		sync.Mutex              // serializes the updates
+		current    atomic.Value // *mtypes.EdgeConfig, never changed once stored
+	}
+
 	Chan_server_register    chan mtypes.RegisterMsg
 	Chan_server_pong        chan mtypes.PongMsg
 	Chan_save_config        chan struct{}
@@ -92,6 +103,7 @@ type Device struct {
 	Chan_SendPingStart      chan struct{}
 	Chan_SendRegisterStart  chan struct{}
 	Chan_HttpPostStart      chan struct{}
+	Chan_Reload             chan struct{} // config reload requested through UAPI
 
 	indexTable    IndexTable
 	cookieChecker CookieChecker
@@ -99,13 +111,49 @@ type Device struct {
 	IsSuperNode bool
 	ID          mtypes.Vertex
 	graph       *path.IG
-	l2fib       sync.Map
+	l2fib       sync.Map     // L2FIBKey -> *IdAndTime
+	mcastfib    sync.Map     // L2FIBKey of the group -> *McastGroup
+	neighbors   sync.Map     // neighborKey -> *NeighborEntry, for the ARP/ND proxy
+	acl         atomic.Value // *ACL from the SuperParams, nil allows everything
+	firewall    atomic.Value // *Firewall from EdgeConfig.Firewall, nil accepts everything
+	shaping     atomic.Value // *Shaping from EdgeConfig.Shaping, nil shapes nothing
+	relay       atomic.Value // *Relay from SuperConfig.Relay, nil relays nothing
 	LogLevel    mtypes.LoggerInfo
 	DupData     fixed_time_cache.Cache
 	Version     string
 
 	HttpPostCount uint64
 	JWTSecret     mtypes.JWTSecret
+	wire_codec    uint32 // mtypes.WireCodec announced by the supernode
+	ping_seq      uint32 // RequestID of the last ping sent by RoutineSendPing, the peers count the missed ones
+
+	counters struct { // dropped packets, exported by GetMetrics
+		dupHits         uint64
+		ttlExpired      uint64
+		noRoute         uint64
+		neighborProxied uint64 // ARP/NS answered by the neighbor proxy
+		aclDropped      uint64
+		shapingDropped  uint64 // the queue of a shaper was full
+		fragmented      uint64 // packets split into fragments, not dropped
+		reassembled     uint64 // packets put back together, not dropped
+		icmpTooBig      uint64 // frames larger than the PMTU answered with ICMP too big
+		holePunches     uint64 // PunchHole commands carried out, not dropped
+		relayed         uint64 // NormalPacket relayed by the supernode, not dropped
+		relayDropped    uint64 // over the Bandwidth of the relay
+	}
+
+	nat struct {
+		sync.Mutex // protects probes
+		probes     map[natProbeNonce]chan *net.UDPAddr
+		natType    uint32 // mtypes.NATType, accessed atomically
+	}
+
+	portmapping struct {
+		sync.Mutex // held while asking the router, so Close deletes the last mapping
+		mapper     *portmap.Mapper
+		closed     bool
+		mapping    atomic.Value // *portmap.Mapping of our port on the router, nil if none
+	}
 
 	pool struct {
 		messageBuffers   *WaitPool
@@ -124,14 +172,21 @@ type Device struct {
 		mtu    int32
 	}
 
+	vnets struct {
+		sync.RWMutex
+		m map[uint16]*VNet // VNI -> virtual network, 0 is the main network on tap.device
+	}
+
 	ipcMutex sync.RWMutex
-	closed   chan int
+	closed   chan int      // the exit code of a Shutdown or ThrowError from the supernode goes to main on it, Close closes it
+	done     chan struct{} // closed by Close, the routines stop on it so they never take the exit code from closed
 	log      *Logger
 }
 
 type IdAndTime struct {
 	ID   mtypes.Vertex
 	Time time.Time
+	Kind L2FIBKind
 }
 
 // deviceState represents the state of a Device.
@@ -324,12 +379,44 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	return nil
 }
 
+// EdgeConfig returns the running config. It is shared by all routines, don't change it, use UpdateEdgeConfig.
+func (device *Device) EdgeConfig() *mtypes.EdgeConfig {
+	econfig, _ := device.edgeconfig.current.Load().(*mtypes.EdgeConfig)
+	return econfig
+}
+
+// SetEdgeConfig replaces the running config, econfig must not be changed afterwards
+func (device *Device) SetEdgeConfig(econfig *mtypes.EdgeConfig) {
+	device.edgeconfig.Lock()
+	device.edgeconfig.current.Store(econfig)
+	device.edgeconfig.Unlock()
+}
+
+// UpdateEdgeConfig changes a copy of the running config and replaces it.
+// update must assign new slices and maps instead of changing the ones in the copy, they are shared with the old config.
+func (device *Device) UpdateEdgeConfig(update func(econfig *mtypes.EdgeConfig)) {
+	device.edgeconfig.Lock()
+	defer device.edgeconfig.Unlock()
+	econfig := *device.EdgeConfig()
+	update(&econfig)
+	device.edgeconfig.current.Store(&econfig)
+}
+
+// maxContentSize is MaxContentSize less the overhead of the bind
+func (device *Device) maxContentSize() int {
+	return MaxContentSize - device.net.overhead
+}
+
 func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *Logger, graph *path.IG, IsSuperNode bool, configpath string, econfig *mtypes.EdgeConfig, sconfig *mtypes.SuperConfig, superevents *mtypes.SUPER_Events, version string) *Device {
 	device := new(Device)
 	device.state.state = uint32(deviceStateDown)
 	device.closed = make(chan int)
+	device.done = make(chan struct{})
 	device.log = logger
 	device.net.bind = bind
+	if b, ok := bind.(conn.BindOverhead); ok {
+		device.net.overhead = b.Overhead()
+	}
 	device.tap.device = tapDevice
 	mtu, err := device.tap.device.MTU()
 	if err != nil {
@@ -337,10 +424,13 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		mtu = DefaultMTU
 	}
 	device.tap.mtu = int32(mtu)
+	device.vnets.m = map[uint16]*VNet{0: NewVNet(0, tapDevice, nil)}
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 	device.peers.IDMap = make(map[mtypes.Vertex]*Peer)
 	device.peers.SuperPeer = make(map[NoisePublicKey]*Peer)
+	device.nat.probes = make(map[natProbeNonce]chan *net.UDPAddr)
 	device.IsSuperNode = IsSuperNode
+	device.ping_seq, _ = randUint32() // so the peers can tell that we restarted
 	device.ID = id
 	device.graph = graph
 	device.Version = version
@@ -355,19 +445,23 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 	device.indexTable.Init()
 	device.PopulatePools()
 	device.Chan_Device_Initialized = make(chan struct{}, 1<<5)
+	device.Chan_Reload = make(chan struct{}, 1)
 	device.chan_send_packet = make(chan *packet_send_params, 1<<15)
+	device.chan_send_control = make(chan *packet_send_params, 1<<12)
 	if IsSuperNode {
 		device.SuperConfigPath = configpath
 		device.SuperConfig = sconfig
-		device.EdgeConfig = &mtypes.EdgeConfig{}
-		device.EdgeConfig.Interface.MTU = DefaultMTU
-		device.EdgeConfig.DynamicRoute.PeerAliveTimeout = device.SuperConfig.PeerAliveTimeout
+		dummy := &mtypes.EdgeConfig{}
+		dummy.Interface.MTU = DefaultMTU
+		dummy.DynamicRoute.PeerAliveTimeout = device.SuperConfig.PeerAliveTimeout
+		device.SetEdgeConfig(dummy)
 		device.Chan_server_pong = superevents.Event_server_pong
 		device.Chan_server_register = superevents.Event_server_register
 		device.LogLevel = sconfig.LogLevel
 	} else {
 		device.EdgeConfigPath = configpath
-		device.EdgeConfig = econfig
+		running := *econfig // the caller keeps its own
+		device.SetEdgeConfig(&running)
 		device.SuperConfig = &mtypes.SuperConfig{}
 		device.DupData = *fixed_time_cache.NewCache(mtypes.S2TD(econfig.DynamicRoute.DupCheckTimeout), false, mtypes.S2TD(1))
 		device.event_tryendpoint = make(chan struct{}, 1<<6)
@@ -376,15 +470,14 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		device.Chan_SendRegisterStart = make(chan struct{}, 1<<5)
 		device.Chan_HttpPostStart = make(chan struct{}, 1<<5)
 		device.LogLevel = econfig.LogLevel
-		device.SuperConfig.DampingFilterRadius = device.EdgeConfig.DynamicRoute.DampingFilterRadius
+		device.super_edgeapi.Store(econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl)
+		device.SuperConfig.DampingFilterRadius = device.EdgeConfig().DynamicRoute.DampingFilterRadius
 
 	}
 	go device.RoutineSendPacket()
 	go func() {
 		<-device.Chan_Device_Initialized
-		if device.LogLevel.LogInternal {
-			fmt.Printf("Internal: initialized, start background loops\n")
-		}
+		elog.Info(elog.Internal, "initialized, start background loops")
 		if IsSuperNode {
 			go device.RoutineResetEndpoint()
 		} else {
@@ -395,8 +488,13 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 			go device.RoutineSpreadAllMyNeighbor()
 			go device.RoutineResetEndpoint()
 			go device.RoutineClearL2FIB()
+			go device.RoutineClearMcastFIB()
+			go device.RoutineClearNeighborCache()
 			go device.RoutineRecalculateNhTable()
 			go device.RoutinePostPeerInfo(device.Chan_HttpPostStart)
+			go device.RoutinePMTUProbe()
+			go device.RoutineDetectNAT()
+			go device.RoutinePortMapping()
 		}
 	}()
 
@@ -440,10 +538,10 @@ func (device *Device) LookupPeerIDAtConfig(pk NoisePublicKey) (ID mtypes.Vertex,
 		}
 	} else {
 		var peerlist []mtypes.PeerInfo
-		if device.EdgeConfig == nil {
+		if device.EdgeConfig() == nil {
 			return 0, errors.New("edgeconfig is nil")
 		}
-		peerlist = device.EdgeConfig.Peers
+		peerlist = device.EdgeConfig().Peers
 		pkstr := pk.ToString()
 		for _, peerinfo := range peerlist {
 			if peerinfo.PubKey == pkstr {
@@ -460,7 +558,15 @@ type VPair struct {
 	d mtypes.Vertex
 }
 type PSKDB struct {
-	db sync.Map
+	db   sync.Map
+	seed []byte
+}
+
+// SetSeed makes GetPSK derive the keys from seed instead of generating random ones,
+// so that every supernode sharing the seed hands out the same PSK for a pair.
+func (D *PSKDB) SetSeed(seed []byte) {
+	D.seed = seed
+	D.db = sync.Map{}
 }
 
 func (D *PSKDB) GetPSK(s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey) {
@@ -473,7 +579,21 @@ func (D *PSKDB) GetPSK(s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey)
 	}
 	pski, ok := D.db.Load(vp)
 	if !ok {
-		psk = RandomPSK()
+		if len(D.seed) > 0 {
+			var pair []byte
+			if s <= mtypes.NodeID_MaxNarrow && d <= mtypes.NodeID_MaxNarrow { // same key as the nodes with 16 bit IDs
+				pair = make([]byte, 4)
+				binary.LittleEndian.PutUint16(pair[0:2], uint16(s))
+				binary.LittleEndian.PutUint16(pair[2:4], uint16(d))
+			} else {
+				pair = make([]byte, 8)
+				binary.LittleEndian.PutUint32(pair[0:4], uint32(s))
+				binary.LittleEndian.PutUint32(pair[4:8], uint32(d))
+			}
+			psk = blake2s.Sum256(append(append([]byte{}, D.seed...), pair...))
+		} else {
+			psk = RandomPSK()
+		}
 		pski, _ = D.db.LoadOrStore(vp, psk)
 		return pski.(NoisePresharedKey)
 	}
@@ -614,7 +734,15 @@ func (device *Device) Close() {
 	device.log.Verbosef("Device closing")
 
 	device.tap.device.Close()
+	device.vnets.RLock()
+	for vni, vn := range device.vnets.m {
+		if vni != 0 {
+			vn.tap.Close()
+		}
+	}
+	device.vnets.RUnlock()
 	device.downLocked()
+	device.deletePortMapping()
 
 	// Remove peers before closing queues,
 	// because peers assume that queues are active.
@@ -631,6 +759,7 @@ func (device *Device) Close() {
 	device.rate.limiter.Close()
 
 	device.log.Verbosef("Device closed")
+	close(device.done)
 	close(device.closed)
 }
 
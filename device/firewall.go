@@ -0,0 +1,325 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const (
+	FirewallAction_Accept    = "accept"
+	FirewallAction_Drop      = "drop"
+	FirewallAction_RateLimit = "ratelimit"
+
+	FirewallDir_In  = "in"  // from the overlay to the tap device
+	FirewallDir_Out = "out" // from the tap device to the overlay
+)
+
+var firewall_protocols = map[string]uint8{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+	"sctp":   132,
+}
+
+// Firewall is the compiled mtypes.FirewallInfo. A nil *Firewall accepts everything.
+type Firewall struct {
+	defaultDrop bool
+	rules       []*FirewallRule
+}
+
+type portRange struct {
+	lo, hi uint16
+}
+
+type FirewallRule struct {
+	hits  uint64 // frames matched by this rule, first for the 64 bit alignment
+	drops uint64 // frames dropped by this rule
+
+	Name   string
+	Action string
+	in     bool
+	out    bool
+
+	srcMac       *tap.MacAddress
+	dstMac       *tap.MacAddress
+	dstMulticast bool
+	ethertype    uint16
+	srcNet       *net.IPNet
+	dstNet       *net.IPNet
+	protocol     int // -1 for all
+	srcPort      *portRange
+	dstPort      *portRange
+
+	bucket struct {
+		sync.Mutex
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+}
+
+// FirewallRuleStats is the hit counters of a rule, in the order of the config
+type FirewallRuleStats struct {
+	Name   string
+	Action string
+	Hits   uint64
+	Drops  uint64
+}
+
+// CheckFirewall validates EdgeConfig.Firewall and compiles it, nil if it has no rules
+func CheckFirewall(info mtypes.FirewallInfo) (*Firewall, error) {
+	fw := &Firewall{}
+	switch info.DefaultAction {
+	case "", FirewallAction_Accept:
+	case FirewallAction_Drop:
+		fw.defaultDrop = true
+	default:
+		return nil, fmt.Errorf("Firewall.DefaultAction must be %v or %v: %v", FirewallAction_Accept, FirewallAction_Drop, info.DefaultAction)
+	}
+	for i, conf := range info.Rules {
+		rule, err := newFirewallRule(conf)
+		if err != nil {
+			return nil, fmt.Errorf("Firewall.Rules[%v]: %v", i, err)
+		}
+		fw.rules = append(fw.rules, rule)
+	}
+	if len(fw.rules) == 0 && !fw.defaultDrop {
+		return nil, nil
+	}
+	return fw, nil
+}
+
+func newFirewallRule(conf mtypes.FirewallRule) (rule *FirewallRule, err error) {
+	rule = &FirewallRule{
+		Name:      conf.Name,
+		Action:    conf.Action,
+		ethertype: conf.EtherType,
+		protocol:  -1,
+	}
+	switch conf.Direction {
+	case "":
+		rule.in, rule.out = true, true
+	case FirewallDir_In:
+		rule.in = true
+	case FirewallDir_Out:
+		rule.out = true
+	default:
+		return nil, fmt.Errorf("Direction must be %v, %v or empty: %v", FirewallDir_In, FirewallDir_Out, conf.Direction)
+	}
+	switch conf.Action {
+	case FirewallAction_Accept, FirewallAction_Drop:
+	case FirewallAction_RateLimit:
+		if conf.RateLimit <= 0 {
+			return nil, fmt.Errorf("RateLimit must > 0: %v", conf.RateLimit)
+		}
+		if conf.Burst < 0 {
+			return nil, fmt.Errorf("Burst must >= 0: %v", conf.Burst)
+		}
+		rule.bucket.rate = conf.RateLimit
+		rule.bucket.burst = float64(conf.Burst)
+		if conf.Burst == 0 {
+			rule.bucket.burst = conf.RateLimit
+		}
+		if rule.bucket.burst < 1 {
+			rule.bucket.burst = 1
+		}
+		rule.bucket.tokens = rule.bucket.burst
+	default:
+		return nil, fmt.Errorf("Action must be %v, %v or %v: %v", FirewallAction_Accept, FirewallAction_Drop, FirewallAction_RateLimit, conf.Action)
+	}
+	if conf.SrcMac != "" {
+		if rule.srcMac, err = firewall_parse_mac(conf.SrcMac); err != nil {
+			return nil, fmt.Errorf("SrcMac: %v", err)
+		}
+	}
+	if conf.DstMac == "multicast" {
+		rule.dstMulticast = true
+	} else if conf.DstMac != "" {
+		if rule.dstMac, err = firewall_parse_mac(conf.DstMac); err != nil {
+			return nil, fmt.Errorf("DstMac: %v", err)
+		}
+	}
+	if conf.SrcIP != "" {
+		if _, rule.srcNet, err = net.ParseCIDR(conf.SrcIP); err != nil {
+			return nil, fmt.Errorf("SrcIP: %v", err)
+		}
+	}
+	if conf.DstIP != "" {
+		if _, rule.dstNet, err = net.ParseCIDR(conf.DstIP); err != nil {
+			return nil, fmt.Errorf("DstIP: %v", err)
+		}
+	}
+	if conf.Protocol != "" {
+		if proto, has := firewall_protocols[strings.ToLower(conf.Protocol)]; has {
+			rule.protocol = int(proto)
+		} else if proto, err := strconv.ParseUint(conf.Protocol, 10, 8); err == nil {
+			rule.protocol = int(proto)
+		} else {
+			return nil, fmt.Errorf("unknown Protocol: %v", conf.Protocol)
+		}
+	}
+	if conf.SrcPort != "" {
+		if rule.srcPort, err = firewall_parse_port(conf.SrcPort); err != nil {
+			return nil, fmt.Errorf("SrcPort: %v", err)
+		}
+	}
+	if conf.DstPort != "" {
+		if rule.dstPort, err = firewall_parse_port(conf.DstPort); err != nil {
+			return nil, fmt.Errorf("DstPort: %v", err)
+		}
+	}
+	return rule, nil
+}
+
+func firewall_parse_mac(s string) (*tap.MacAddress, error) {
+	hw, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, err
+	}
+	var mac tap.MacAddress
+	if len(hw) != len(mac) {
+		return nil, fmt.Errorf("not an ethernet MAC address: %v", s)
+	}
+	copy(mac[:], hw)
+	return &mac, nil
+}
+
+// firewall_parse_port parses a port like 445 or a range like 137-139
+func firewall_parse_port(s string) (*portRange, error) {
+	ports := strings.SplitN(s, "-", 2)
+	lo, err := strconv.ParseUint(strings.TrimSpace(ports[0]), 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	hi := lo
+	if len(ports) == 2 {
+		if hi, err = strconv.ParseUint(strings.TrimSpace(ports[1]), 10, 16); err != nil {
+			return nil, err
+		}
+		if hi < lo {
+			return nil, fmt.Errorf("invalid port range: %v", s)
+		}
+	}
+	return &portRange{uint16(lo), uint16(hi)}, nil
+}
+
+func (r *portRange) has(port uint16) bool {
+	return port >= r.lo && port <= r.hi
+}
+
+func (rule *FirewallRule) match(h *tap.FrameHeader) bool {
+	if rule.srcMac != nil && *rule.srcMac != h.SrcMac {
+		return false
+	}
+	if rule.dstMac != nil && *rule.dstMac != h.DstMac {
+		return false
+	}
+	if rule.dstMulticast && !tap.IsNotUnicast(h.DstMac) {
+		return false
+	}
+	if rule.ethertype != 0 && rule.ethertype != h.EtherType {
+		return false
+	}
+	if rule.srcNet != nil && (h.SrcIP == nil || !rule.srcNet.Contains(h.SrcIP)) {
+		return false
+	}
+	if rule.dstNet != nil && (h.DstIP == nil || !rule.dstNet.Contains(h.DstIP)) {
+		return false
+	}
+	if rule.protocol >= 0 && (h.SrcIP == nil || rule.protocol != int(h.Protocol)) {
+		return false
+	}
+	if rule.srcPort != nil && (!h.HasPorts || !rule.srcPort.has(h.SrcPort)) {
+		return false
+	}
+	if rule.dstPort != nil && (!h.HasPorts || !rule.dstPort.has(h.DstPort)) {
+		return false
+	}
+	return true
+}
+
+// takeToken takes a token from the bucket of a ratelimit rule, false if it is empty
+func (rule *FirewallRule) takeToken(now time.Time) bool {
+	b := &rule.bucket
+	b.Lock()
+	defer b.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Allowed runs the frame through the rules of the direction and counts the hits
+func (fw *Firewall) Allowed(out bool, frame []byte) bool {
+	if fw == nil {
+		return true
+	}
+	h, ok := tap.ParseFrameHeader(frame)
+	if !ok {
+		return !fw.defaultDrop
+	}
+	for _, rule := range fw.rules {
+		if (out && !rule.out) || (!out && !rule.in) || !rule.match(&h) {
+			continue
+		}
+		atomic.AddUint64(&rule.hits, 1)
+		allowed := rule.Action == FirewallAction_Accept || (rule.Action == FirewallAction_RateLimit && rule.takeToken(time.Now()))
+		if !allowed {
+			atomic.AddUint64(&rule.drops, 1)
+		}
+		return allowed
+	}
+	return !fw.defaultDrop
+}
+
+// SetFirewall replaces the firewall, the counters start from 0
+func (device *Device) SetFirewall(fw *Firewall) {
+	device.firewall.Store(fw)
+}
+
+// firewallAllowed checks a frame read from a tap device if out, or a frame to be written to it
+func (device *Device) firewallAllowed(out bool, frame []byte) bool {
+	fw, _ := device.firewall.Load().(*Firewall)
+	return fw.Allowed(out, frame)
+}
+
+// GetFirewallStats returns the hit counters of the firewall rules
+func (device *Device) GetFirewallStats() []FirewallRuleStats {
+	fw, _ := device.firewall.Load().(*Firewall)
+	if fw == nil {
+		return nil
+	}
+	ret := make([]FirewallRuleStats, len(fw.rules))
+	for i, rule := range fw.rules {
+		ret[i] = FirewallRuleStats{
+			Name:   rule.Name,
+			Action: rule.Action,
+			Hits:   atomic.LoadUint64(&rule.hits),
+			Drops:  atomic.LoadUint64(&rule.drops),
+		}
+	}
+	return ret
+}
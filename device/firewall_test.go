@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func tcpFrame(vid uint16, dst net.IP, dport uint16) []byte {
+	frame := []byte{0x02, 0, 0, 0, 0, 2, 0x02, 0, 0, 0, 0, 1}
+	if vid != 0 {
+		frame = append(frame, 0x81, 0x00, byte(vid>>8), byte(vid))
+	}
+	frame = append(frame, 0x08, 0x00)
+	ip := []byte{0x45, 0, 0, 40, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1}
+	ip = append(ip, dst.To4()...)
+	return append(append(frame, ip...), 0xc0, 0x00, byte(dport>>8), byte(dport), 0, 0, 0, 0)
+}
+
+func TestFirewall(t *testing.T) {
+	device := &Device{
+		log: NewLogger(LogLevelSilent, ""),
+	}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{})
+	fw, err := CheckFirewall(mtypes.FirewallInfo{
+		DefaultAction: "accept",
+		Rules: []mtypes.FirewallRule{
+			{Name: "ssh", Direction: "in", DstIP: "10.0.0.0/24", Protocol: "tcp", DstPort: "22", Action: "accept"},
+			{Name: "smb", Protocol: "tcp", DstPort: "137-139", Action: "drop"},
+			{Name: "lan", Direction: "in", DstIP: "10.0.0.0/24", Action: "drop"},
+			{Name: "bcast", DstMac: "multicast", Action: "ratelimit", RateLimit: 0.001, Burst: 2},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.SetFirewall(fw)
+	lan := net.ParseIP("10.0.0.5")
+	wan := net.ParseIP("192.168.1.1")
+	for i, c := range []struct {
+		out     bool
+		frame   []byte
+		allowed bool
+	}{
+		{false, tcpFrame(0, lan, 22), true},
+		{false, tcpFrame(10, lan, 80), false}, // behind the VLAN tag
+		{true, tcpFrame(0, lan, 80), true},
+		{true, tcpFrame(0, wan, 138), false},
+		{false, tcpFrame(0, wan, 445), true},
+		{false, vlanFrame(0), true},
+		{false, udpFrame(net.ParseIP("239.1.1.1")), true},
+		{true, udpFrame(net.ParseIP("239.1.1.1")), true},
+		{false, udpFrame(net.ParseIP("239.1.1.1")), false},
+	} {
+		if allowed := device.firewallAllowed(c.out, c.frame); allowed != c.allowed {
+			t.Errorf("case %v: firewallAllowed() = %v", i, allowed)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := device.IpcGetOperation(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"firewall_rule=0,accept,1,0,ssh", "firewall_rule=1,drop,1,1,smb", "firewall_rule=2,drop,1,1,lan", "firewall_rule=3,ratelimit,3,1,bcast"} {
+		if !strings.Contains(buf.String(), "\n"+line+"\n") {
+			t.Errorf("missing %v in:\n%v", line, buf.String())
+		}
+	}
+
+	if fw, err := CheckFirewall(mtypes.FirewallInfo{DefaultAction: "drop"}); err != nil || fw.Allowed(false, vlanFrame(0)) {
+		t.Error("DefaultAction drop accepted a frame")
+	}
+	for _, rule := range []mtypes.FirewallRule{
+		{Action: "reject"},
+		{Action: "ratelimit"},
+		{Action: "drop", DstPort: "139-137"},
+		{Action: "drop", Protocol: "gre"},
+		{Action: "drop", Direction: "both"},
+	} {
+		if _, err := CheckFirewall(mtypes.FirewallInfo{Rules: []mtypes.FirewallRule{rule}}); err == nil {
+			t.Errorf("accepted %+v", rule)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+type L2FIBKind int
+
+const (
+	L2FIB_Learned L2FIBKind = iota
+	L2FIB_Static            // from EdgeConfig.StaticL2FIB
+	L2FIB_Pinned            // set by the UAPI or the manage API
+)
+
+func (k L2FIBKind) ToString() string {
+	switch k {
+	case L2FIB_Static:
+		return "static"
+	case L2FIB_Pinned:
+		return "pinned"
+	}
+	return "learned"
+}
+
+// ParseL2FIBEntry parses a MAC address and the node it is pinned to
+func ParseL2FIBEntry(macstr string, id mtypes.Vertex) (mac tap.MacAddress, err error) {
+	hw, err := net.ParseMAC(macstr)
+	if err != nil {
+		return mac, err
+	}
+	if len(hw) != len(mac) {
+		return mac, fmt.Errorf("not an ethernet MAC address: %v", macstr)
+	}
+	copy(mac[:], hw)
+	if tap.IsNotUnicast(mac) {
+		return mac, fmt.Errorf("not a unicast MAC address: %v", macstr)
+	}
+	if id.IsSpecial() {
+		return mac, fmt.Errorf("MAC address %v: ID %v is a special NodeID", macstr, id)
+	}
+	return mac, nil
+}
+
+// CheckStaticL2FIB validates EdgeConfig.StaticL2FIB and converts it to a map
+func CheckStaticL2FIB(entries []mtypes.StaticL2FIBEntry) (map[L2FIBKey]mtypes.Vertex, error) {
+	ret := make(map[L2FIBKey]mtypes.Vertex, len(entries))
+	for _, e := range entries {
+		mac, err := ParseL2FIBEntry(e.MacAddress, e.NodeID)
+		if err != nil {
+			return nil, fmt.Errorf("StaticL2FIB: %v", err)
+		}
+		if e.VLAN > VLANID_Max {
+			return nil, fmt.Errorf("StaticL2FIB: MAC address %v: VLAN must <= %v: %v", e.MacAddress, VLANID_Max, e.VLAN)
+		}
+		key := L2FIBKey{e.VNI, e.VLAN, mac}
+		if _, has := ret[key]; has {
+			return nil, fmt.Errorf("StaticL2FIB: duplicate MAC address: %v", key.String())
+		}
+		ret[key] = e.NodeID
+	}
+	return ret, nil
+}
+
+// SetStaticL2FIB replaces the static entries of the L2FIB. Learned and pinned entries of the same MAC are overwritten.
+func (device *Device) SetStaticL2FIB(entries map[L2FIBKey]mtypes.Vertex) {
+	device.l2fib.Range(func(k interface{}, v interface{}) bool {
+		key := k.(L2FIBKey)
+		if _, has := entries[key]; !has && v.(*IdAndTime).Kind == L2FIB_Static {
+			device.l2fib.Delete(k)
+			elog.Info(elog.Internal, "L2FIB static entry removed", "mac", key.String())
+		}
+		return true
+	})
+	for key, id := range entries {
+		if val, ok := device.l2fib.Load(key); ok && val.(*IdAndTime).Kind == L2FIB_Static && val.(*IdAndTime).ID == id {
+			continue
+		}
+		device.l2fib.Store(key, &IdAndTime{
+			ID:   id,
+			Kind: L2FIB_Static,
+		})
+		elog.Info(elog.Internal, "L2FIB static entry added", "mac", key.String(), "node", id)
+	}
+}
+
+// PinL2FIB points a MAC address to a node until it is flushed. Static entries can't be changed.
+func (device *Device) PinL2FIB(key L2FIBKey, id mtypes.Vertex) error {
+	var lastseen time.Time
+	if val, ok := device.l2fib.Load(key); ok {
+		if val.(*IdAndTime).Kind == L2FIB_Static {
+			return fmt.Errorf("%v is a static entry", key.String())
+		}
+		lastseen = val.(*IdAndTime).Time
+	}
+	device.l2fib.Store(key, &IdAndTime{
+		ID:   id,
+		Time: lastseen,
+		Kind: L2FIB_Pinned,
+	})
+	elog.Info(elog.Internal, "L2FIB pinned", "mac", key.String(), "node", id)
+	return nil
+}
+
+// FlushL2FIB removes the learned and pinned entries of a MAC address in a virtual network and VLAN.
+// vni < 0 or vlan < 0 matches all of them. All entries are removed if mac is nil.
+// Static entries stay until they are removed from the config. It returns the number of removed entries.
+func (device *Device) FlushL2FIB(mac *tap.MacAddress, vni int, vlan int) int {
+	flushed := 0
+	device.l2fib.Range(func(k interface{}, v interface{}) bool {
+		key := k.(L2FIBKey)
+		match := mac == nil || (*mac == key.MAC && (vni < 0 || vni == int(key.VNI)) && (vlan < 0 || vlan == int(key.VLAN)))
+		if match && v.(*IdAndTime).Kind != L2FIB_Static {
+			device.l2fib.Delete(k)
+			flushed++
+		}
+		return true
+	})
+	if mac == nil {
+		elog.Info(elog.Internal, "L2FIB flushed", "entries", flushed)
+	} else if flushed > 0 {
+		elog.Info(elog.Internal, "L2FIB flushed", "mac", mac.String(), "entries", flushed)
+	}
+	return flushed
+}
+
+// GetL2FIB returns a copy of the L2FIB, sorted by MAC address, VNI and VLAN.
+// LastSeen is the last time a frame from the MAC address was received, zero if never.
+func (device *Device) GetL2FIB() []mtypes.API_L2FIBEntry {
+	type entry struct {
+		key L2FIBKey
+		val IdAndTime
+	}
+	var entries []entry
+	device.l2fib.Range(func(k interface{}, v interface{}) bool {
+		entries = append(entries, entry{k.(L2FIBKey), *v.(*IdAndTime)})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if c := bytes.Compare(entries[i].key.MAC[:], entries[j].key.MAC[:]); c != 0 {
+			return c < 0
+		}
+		if entries[i].key.VNI != entries[j].key.VNI {
+			return entries[i].key.VNI < entries[j].key.VNI
+		}
+		return entries[i].key.VLAN < entries[j].key.VLAN
+	})
+	ret := make([]mtypes.API_L2FIBEntry, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, mtypes.API_L2FIBEntry{
+			MacAddress: e.key.MAC.String(),
+			VNI:        e.key.VNI,
+			VLAN:       e.key.VLAN,
+			NodeID:     e.val.ID,
+			Kind:       e.val.Kind.ToString(),
+			LastSeen:   e.val.Time,
+		})
+	}
+	return ret
+}
+
+// learnL2FIB records that a frame from the MAC address came from src_nodeID. Static and pinned entries keep their node.
+func (device *Device) learnL2FIB(src_macaddr L2FIBKey, src_nodeID mtypes.Vertex) {
+	val, ok := device.l2fib.Load(src_macaddr)
+	if ok {
+		idtime := val.(*IdAndTime)
+		if idtime.ID != src_nodeID {
+			if idtime.Kind != L2FIB_Learned {
+				elog.Debug(elog.Internal, "L2FIB "+idtime.Kind.ToString()+" entry mismatch", "mac", src_macaddr.String(), "node", idtime.ID, "src", src_nodeID)
+			} else {
+				idtime.ID = src_nodeID
+				elog.Info(elog.Internal, "L2FIB updated", "mac", src_macaddr.String(), "node", src_nodeID)
+			}
+		}
+		idtime.Time = time.Now()
+	} else {
+		device.l2fib.Store(src_macaddr, &IdAndTime{
+			ID:   src_nodeID,
+			Time: time.Now(),
+		}) // Write to l2fib table
+		elog.Info(elog.Internal, "L2FIB added", "mac", src_macaddr.String(), "node", src_nodeID)
+	}
+}
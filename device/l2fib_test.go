@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+func TestL2FIB(t *testing.T) {
+	device := &Device{
+		ID:  1,
+		log: NewLogger(LogLevelSilent, ""),
+	}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{})
+	lookup := func(mac tap.MacAddress) (mtypes.Vertex, L2FIBKind) {
+		val, ok := device.l2fib.Load(L2FIBKey{0, 0, mac})
+		if !ok {
+			return mtypes.NodeID_Invalid, L2FIB_Learned
+		}
+		return val.(*IdAndTime).ID, val.(*IdAndTime).Kind
+	}
+	vm := tap.MacAddress{0x02, 0, 0, 0, 0, 5}
+	gw := tap.MacAddress{0x02, 0, 0, 0, 0, 6}
+
+	static, err := CheckStaticL2FIB([]mtypes.StaticL2FIBEntry{{MacAddress: gw.String(), NodeID: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.SetStaticL2FIB(static)
+	device.learnL2FIB(L2FIBKey{0, 0, gw}, 4)
+	if id, kind := lookup(gw); id != 3 || kind != L2FIB_Static {
+		t.Fatalf("static entry moved by learning: %v %v", id, kind)
+	}
+
+	device.learnL2FIB(L2FIBKey{0, 0, vm}, 2)
+	if err := device.IpcSet("l2fib_pin=02:00:00:00:00:05,4\n"); err != nil {
+		t.Fatal(err)
+	}
+	device.learnL2FIB(L2FIBKey{0, 0, vm}, 2)
+	if id, kind := lookup(vm); id != 4 || kind != L2FIB_Pinned {
+		t.Fatalf("pinned entry moved by learning: %v %v", id, kind)
+	}
+	if err := device.PinL2FIB(L2FIBKey{0, 0, gw}, 4); err == nil {
+		t.Fatal("pinned a static entry")
+	}
+
+	var buf bytes.Buffer
+	if err := device.IpcGetOperation(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"l2fib=02:00:00:00:00:05,4,pinned,", "l2fib=02:00:00:00:00:06,3,static,"} {
+		if !strings.Contains(buf.String(), "\n"+line) {
+			t.Errorf("missing %v in:\n%v", line, buf.String())
+		}
+	}
+
+	if err := device.IpcSet("l2fib_flush=all\n"); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := lookup(vm); id != mtypes.NodeID_Invalid {
+		t.Fatal("pinned entry not flushed")
+	}
+	if id, _ := lookup(gw); id != 3 {
+		t.Fatal("static entry flushed")
+	}
+
+	device.SetStaticL2FIB(nil)
+	if id, _ := lookup(gw); id != mtypes.NodeID_Invalid {
+		t.Fatal("static entry not removed from the config")
+	}
+	if _, err := CheckStaticL2FIB([]mtypes.StaticL2FIBEntry{{MacAddress: "01:00:5e:00:00:01", NodeID: 3}}); err == nil {
+		t.Fatal("accepted a multicast MAC address")
+	}
+}
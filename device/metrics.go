@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+type PeerMetrics struct {
+	ID               mtypes.Vertex
+	PubKey           string
+	Endpoint         string
+	RxBytes          uint64
+	TxBytes          uint64
+	LastHandshake    time.Time // zero if never
+	SingleWayLatency float64
+	PingLoss         float64 // ratio of the pings from the peer we missed
+	Throughput       float64 // Mbit/s, 0 if not measured
+	IsAlive          bool
+	PMTU             int    // the largest IP packet sent unfragmented, 0 if not probed
+	PMTUEndpoint     string // the endpoint the PMTU was probed on
+}
+
+type DeviceMetrics struct {
+	Peers           []PeerMetrics
+	L2FIBSize       int
+	McastGroups     int    // multicast groups learned by snooping
+	DupHits         uint64 // packets dropped by the duplicate check of NodeID_Spread
+	TTLExpired      uint64 // packets dropped in transit because the TTL reached 0
+	NoRoute         uint64 // packets dropped because the NhTable has no next hop
+	NeighborProxied uint64 // ARP requests and neighbor solicitations answered locally
+	ACLDropped      uint64 // NormalPacket frames dropped by the ACL
+	ShapingDropped  uint64 // NormalPacket dropped because the queue of a shaper was full
+	Fragmented      uint64 // packets larger than the PMTU sent in fragments
+	Reassembled     uint64 // packets put back together from fragments
+	ICMPTooBig      uint64 // frames larger than the PMTU answered with ICMP too big
+	HolePunches     uint64 // PunchHole commands from the supernode carried out
+	Relayed         uint64 // NormalPacket relayed between edges by the supernode
+	RelayDropped    uint64 // NormalPacket dropped because the relay was over its Bandwidth
+	NATType         mtypes.NATType
+}
+
+func (device *Device) GetMetrics() (ret DeviceMetrics) {
+	ret.DupHits = atomic.LoadUint64(&device.counters.dupHits)
+	ret.TTLExpired = atomic.LoadUint64(&device.counters.ttlExpired)
+	ret.NoRoute = atomic.LoadUint64(&device.counters.noRoute)
+	ret.NeighborProxied = atomic.LoadUint64(&device.counters.neighborProxied)
+	ret.ACLDropped = atomic.LoadUint64(&device.counters.aclDropped)
+	ret.ShapingDropped = atomic.LoadUint64(&device.counters.shapingDropped)
+	ret.Fragmented = atomic.LoadUint64(&device.counters.fragmented)
+	ret.Reassembled = atomic.LoadUint64(&device.counters.reassembled)
+	ret.ICMPTooBig = atomic.LoadUint64(&device.counters.icmpTooBig)
+	ret.HolePunches = atomic.LoadUint64(&device.counters.holePunches)
+	ret.Relayed = atomic.LoadUint64(&device.counters.relayed)
+	ret.RelayDropped = atomic.LoadUint64(&device.counters.relayDropped)
+	ret.NATType = device.NATType()
+	device.l2fib.Range(func(k, v interface{}) bool {
+		ret.L2FIBSize++
+		return true
+	})
+	device.mcastfib.Range(func(k, v interface{}) bool {
+		ret.McastGroups++
+		return true
+	})
+
+	PeerAliveTimeout := mtypes.S2TD(device.EdgeConfig().DynamicRoute.PeerAliveTimeout)
+	if device.IsSuperNode {
+		PeerAliveTimeout = mtypes.S2TD(device.SuperConfig.PeerAliveTimeout)
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for pk, peer := range device.peers.keyMap {
+		pm := PeerMetrics{
+			ID:               peer.ID,
+			PubKey:           pk.ToString(),
+			Endpoint:         peer.GetEndpointDstStr(),
+			RxBytes:          atomic.LoadUint64(&peer.stats.rxBytes),
+			TxBytes:          atomic.LoadUint64(&peer.stats.txBytes),
+			SingleWayLatency: peer.SingleWayLatency.GetVal(),
+			PingLoss:         peer.PingLoss.GetVal(),
+			Throughput:       peer.Throughput.GetVal(),
+		}
+		if pm.Endpoint != "" {
+			pm.IsAlive = peer.LastPacketReceivedAdd1Sec.Load().(*time.Time).Add(PeerAliveTimeout).After(time.Now())
+		}
+		if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 {
+			pm.LastHandshake = time.Unix(0, nano)
+		}
+		pm.PMTU, pm.PMTUEndpoint = peer.PMTUInfo()
+		ret.Peers = append(ret.Peers, pm)
+	}
+	return
+}
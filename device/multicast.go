@@ -0,0 +1,200 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const (
+	McastMode_Flood    = "flood"
+	McastMode_Snooping = "snooping"
+
+	McastGroupTimeout_Default = 260 // IGMP/MLD group membership interval
+)
+
+func CheckMulticastInfo(info mtypes.MulticastInfo) error {
+	switch info.Mode {
+	case "", McastMode_Flood, McastMode_Snooping:
+	default:
+		return fmt.Errorf("unknown Multicast.Mode: %v, must be %v or %v", info.Mode, McastMode_Flood, McastMode_Snooping)
+	}
+	if info.GroupTimeout < 0 {
+		return fmt.Errorf("Multicast.GroupTimeout must >= 0: %v", info.GroupTimeout)
+	}
+	return nil
+}
+
+// McastGroup is the nodes that have subscribers of a multicast group, and when each reporter reported
+type McastGroup struct {
+	sync.Mutex
+	members map[mtypes.Vertex]map[tap.MacAddress]time.Time
+	deleted bool // removed from mcastfib by RoutineClearMcastFIB
+}
+
+func (device *Device) mcastGroupTimeout() time.Duration {
+	if device.EdgeConfig().Multicast.GroupTimeout > 0 {
+		return mtypes.S2TD(device.EdgeConfig().Multicast.GroupTimeout)
+	}
+	return mtypes.S2TD(McastGroupTimeout_Default)
+}
+
+// SnoopMcast learns the group memberships from the IGMP/MLD reports of the hosts behind src_nodeID
+func (device *Device) SnoopMcast(vn *VNet, src_nodeID mtypes.Vertex, frame []byte) {
+	if device.EdgeConfig().Multicast.Mode != McastMode_Snooping {
+		return
+	}
+	reports, _ := tap.ParseMcastMembership(frame)
+	reporter := tap.GetSrcMacAddr(frame)
+	vlan := tap.GetVlanID(frame)
+	for _, r := range reports {
+		key := L2FIBKey{vn.VNI, vlan, r.Group}
+		var group *McastGroup
+		for {
+			val, ok := device.mcastfib.Load(key)
+			if !ok {
+				if r.Action == tap.McastLeave {
+					break
+				}
+				val, _ = device.mcastfib.LoadOrStore(key, &McastGroup{members: make(map[mtypes.Vertex]map[tap.MacAddress]time.Time)})
+			}
+			group = val.(*McastGroup)
+			group.Lock()
+			if !group.deleted {
+				break
+			}
+			group.Unlock() // removed just now, take the new one
+			group = nil
+		}
+		if group == nil {
+			continue
+		}
+		switch r.Action {
+		case tap.McastJoin:
+			if _, ok := group.members[src_nodeID]; !ok {
+				group.members[src_nodeID] = make(map[tap.MacAddress]time.Time)
+				elog.Info(elog.Internal, "Multicast group joined", "group", key.String(), "node", src_nodeID)
+			}
+			group.members[src_nodeID][reporter] = time.Now()
+		case tap.McastLeave:
+			if reporters, ok := group.members[src_nodeID]; ok {
+				delete(reporters, reporter)
+				if len(reporters) == 0 {
+					delete(group.members, src_nodeID)
+					elog.Info(elog.Internal, "Multicast group left", "group", key.String(), "node", src_nodeID)
+				}
+			}
+		}
+		group.Unlock()
+	}
+}
+
+// McastTargets decides where a non-unicast frame from the tap device goes.
+// It returns flood=true if the frame must go along the broadcast tree, or the nodes with subscribers otherwise.
+// An empty list with flood=false means nobody wants it.
+func (device *Device) McastTargets(vn *VNet, frame []byte) (targets []mtypes.Vertex, flood bool) {
+	mcast := device.EdgeConfig().Multicast
+	if mcast.Mode != McastMode_Snooping {
+		return nil, true
+	}
+	dst, _ := GetL2FIBKey(vn.VNI, frame)
+	if !tap.IsSnoopableMcast(dst.MAC) {
+		return nil, true
+	}
+	if _, isControl := tap.ParseMcastMembership(frame); isControl {
+		return nil, true
+	}
+	val, ok := device.mcastfib.Load(dst)
+	if !ok {
+		return nil, mcast.FloodUnknown
+	}
+	group := val.(*McastGroup)
+	group.Lock()
+	for id := range group.members {
+		if id != device.ID && vn.Allowed(id) {
+			targets = append(targets, id)
+		}
+	}
+	group.Unlock()
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+	return targets, false
+}
+
+// SendMcastPacket sends a copy of the frame to each node in targets, along the same path as unicast frames
+func (device *Device) SendMcastPacket(targets []mtypes.Vertex, usage path.Usage, ttl uint8, packet []byte, offset int) {
+	header, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
+	for _, id := range targets {
+		next_id := device.NextHopByFlow(id, packet[usage.FrameOffset():])
+		device.peers.RLock()
+		peer := device.nextHopPeer(next_id)
+		device.peers.RUnlock()
+		if peer == nil {
+			atomic.AddUint64(&device.counters.noRoute, 1)
+			continue
+		}
+		header.SetDst(id)
+		device.SendPacket(peer, usage, ttl, packet, offset) // it copies the packet
+	}
+}
+
+// McastGroups returns a copy of the group table, group MAC and VLAN to the nodes with subscribers
+func (device *Device) McastGroups() map[L2FIBKey][]mtypes.Vertex {
+	ret := make(map[L2FIBKey][]mtypes.Vertex)
+	device.mcastfib.Range(func(k, v interface{}) bool {
+		group := v.(*McastGroup)
+		group.Lock()
+		nodes := make([]mtypes.Vertex, 0, len(group.members))
+		for id := range group.members {
+			nodes = append(nodes, id)
+		}
+		group.Unlock()
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+		ret[k.(L2FIBKey)] = nodes
+		return true
+	})
+	return ret
+}
+
+// RoutineClearMcastFIB removes the reporters that didn't report again within GroupTimeout,
+// so the groups whose querier is gone fall back to FloodUnknown.
+func (device *Device) RoutineClearMcastFIB() {
+	for {
+		timeout := device.mcastGroupTimeout()
+		now := time.Now()
+		device.mcastfib.Range(func(k interface{}, v interface{}) bool {
+			key := k.(L2FIBKey)
+			group := v.(*McastGroup)
+			group.Lock()
+			for id, reporters := range group.members {
+				for reporter, t := range reporters {
+					if now.After(t.Add(timeout)) {
+						delete(reporters, reporter)
+					}
+				}
+				if len(reporters) == 0 {
+					delete(group.members, id)
+					elog.Info(elog.Internal, "Multicast group timed out", "group", key.String(), "node", id)
+				}
+			}
+			if len(group.members) == 0 {
+				group.deleted = true
+				device.mcastfib.Delete(k)
+			}
+			group.Unlock()
+			return true
+		})
+		time.Sleep(timeout / 4)
+	}
+}
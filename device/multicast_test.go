@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func igmpFrame(src byte, igmptype byte, group net.IP) []byte {
+	frame := []byte{0x01, 0x00, 0x5e, 0, 0, 0x16, 0x02, 0, 0, 0, 0, src, 0x08, 0x00}
+	ip := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 1, 2, 0, 0, 10, 0, 0, src, 224, 0, 0, 22}
+	igmp := append([]byte{igmptype, 0, 0, 0}, group.To4()...)
+	return append(append(frame, ip...), igmp...)
+}
+
+func mldv2Frame(src byte, rtype byte, group net.IP) []byte {
+	frame := []byte{0x33, 0x33, 0, 0, 0, 0x16, 0x02, 0, 0, 0, 0, src, 0x86, 0xdd}
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	ip[6] = 0 // hop-by-hop options
+	copy(ip[24:], net.ParseIP("ff02::16"))
+	hbh := []byte{58, 0, 5, 2, 0, 0, 1, 0} // router alert
+	mld := []byte{143, 0, 0, 0, 0, 0, 0, 1, rtype, 0, 0, 0}
+	mld = append(mld, group.To16()...)
+	return append(append(append(frame, ip...), hbh...), mld...)
+}
+
+func udpFrame(group net.IP) []byte {
+	dst := group.To4()
+	frame := []byte{0x01, 0x00, 0x5e, dst[1] & 0x7f, dst[2], dst[3], 0x02, 0, 0, 0, 0, 9, 0x08, 0x00}
+	ip := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 1, 17, 0, 0, 10, 0, 0, 9}
+	ip = append(ip, dst...)
+	return append(append(frame, ip...), 0x13, 0x88, 0x13, 0x88, 0, 8, 0, 0)
+}
+
+func udp6Frame(group net.IP) []byte {
+	dst := group.To16()
+	frame := []byte{0x33, 0x33, dst[12], dst[13], dst[14], dst[15], 0x02, 0, 0, 0, 0, 9, 0x86, 0xdd}
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	ip[6] = 17
+	copy(ip[24:], dst)
+	return append(append(frame, ip...), 0x14, 0xe9, 0x14, 0xe9, 0, 8, 0, 0)
+}
+
+func TestMcastSnooping(t *testing.T) {
+	device := &Device{
+		ID: 1,
+	}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{Multicast: mtypes.MulticastInfo{Mode: McastMode_Snooping}})
+	vn := NewVNet(0, nil, nil)
+	group := net.ParseIP("239.1.2.3")
+	check := func(name string, frame []byte, expect []mtypes.Vertex, expectFlood bool) {
+		t.Helper()
+		targets, flood := device.McastTargets(vn, frame)
+		if flood != expectFlood || !reflect.DeepEqual(targets, expect) {
+			t.Errorf("%v: McastTargets() = %v %v, expect %v %v", name, targets, flood, expect, expectFlood)
+		}
+	}
+
+	check("unknown group", udpFrame(group), nil, false)
+	device.UpdateEdgeConfig(func(econfig *mtypes.EdgeConfig) { econfig.Multicast.FloodUnknown = true })
+	check("unknown group, FloodUnknown", udpFrame(group), nil, true)
+	check("IGMP report", igmpFrame(2, 0x16, group), nil, true)
+
+	device.SnoopMcast(vn, 3, igmpFrame(3, 0x16, group))
+	device.SnoopMcast(vn, 2, igmpFrame(2, 0x16, group))
+	device.SnoopMcast(vn, 2, igmpFrame(4, 0x16, group)) // another host behind node 2
+	device.SnoopMcast(vn, 1, igmpFrame(5, 0x16, group)) // ourselves
+	check("joined", udpFrame(group), []mtypes.Vertex{2, 3}, false)
+	check("other group", udpFrame(net.ParseIP("239.1.2.4")), nil, true)
+	check("all hosts", udpFrame(net.ParseIP("224.0.0.1")), nil, true)
+	mdns := net.ParseIP("224.0.0.251")
+	device.SnoopMcast(vn, 3, igmpFrame(3, 0x16, mdns))
+	check("link local", udpFrame(mdns), nil, true)
+	check("same MAC as link local", udpFrame(net.ParseIP("239.128.0.251")), nil, true)
+
+	device.SnoopMcast(vn, 3, igmpFrame(3, 0x17, group))
+	device.SnoopMcast(vn, 2, igmpFrame(2, 0x17, group))
+	check("left", udpFrame(group), []mtypes.Vertex{2}, false)
+
+	group6 := net.ParseIP("ff05::1:3")
+	device.SnoopMcast(vn, 4, mldv2Frame(4, 4, group6)) // CHANGE_TO_EXCLUDE {}
+	check("MLDv2 joined", udp6Frame(group6), []mtypes.Vertex{4}, false)
+	device.SnoopMcast(vn, 4, mldv2Frame(4, 3, group6)) // CHANGE_TO_INCLUDE {}
+	check("MLDv2 left", udp6Frame(group6), nil, false)
+
+	device.UpdateEdgeConfig(func(econfig *mtypes.EdgeConfig) { econfig.Multicast.Mode = McastMode_Flood })
+	check("flood mode", udpFrame(group), nil, true)
+}
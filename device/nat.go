@@ -0,0 +1,272 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+const (
+	NATDetectInterval_Default = 300                  // seconds
+	NATDetectDelay            = time.Second * 5      // the endpoints of the supernode are resolved by then
+	NATProbeSize              = MessageKeepaliveSize // the reply is as large, nothing to amplify
+	NATProbeTimeout           = time.Second * 2
+	NATProbeTries             = 3
+
+	PunchDelayMax     = 10 // seconds, longer ones are not from a sane supernode
+	PunchTries        = 10
+	PunchPingInterval = 0.2 // seconds
+)
+
+// natProbeNonce matches a NATProbeReply to its NATProbe
+type natProbeNonce [8]byte
+
+// makeNATProbe makes a NATProbe, which is type, 3 zero bytes, nonce, padding
+func makeNATProbe(nonce natProbeNonce) []byte {
+	probe := make([]byte, NATProbeSize)
+	probe[0] = byte(path.NATProbe)
+	copy(probe[4:12], nonce[:])
+	return probe
+}
+
+// MakeNATProbeReply answers a NATProbe received from addr. It returns nil if probe is not a NATProbe.
+// The reply is type, 3 zero bytes, nonce, port, IP in 16 bytes.
+func MakeNATProbeReply(probe []byte, addr *net.UDPAddr) []byte {
+	if len(probe) != NATProbeSize || path.Usage(probe[0]) != path.NATProbe || addr == nil || addr.IP.To16() == nil {
+		return nil
+	}
+	reply := make([]byte, NATProbeSize)
+	reply[0] = byte(path.NATProbeReply)
+	copy(reply[4:12], probe[4:12])
+	binary.BigEndian.PutUint16(reply[12:14], uint16(addr.Port))
+	copy(reply[14:30], addr.IP.To16())
+	return reply
+}
+
+func parseNATProbeReply(reply []byte) (nonce natProbeNonce, addr *net.UDPAddr, ok bool) {
+	if len(reply) != NATProbeSize || path.Usage(reply[0]) != path.NATProbeReply {
+		return nonce, nil, false
+	}
+	copy(nonce[:], reply[4:12])
+	addr = &net.UDPAddr{
+		IP:   net.IP(append([]byte{}, reply[14:30]...)),
+		Port: int(binary.BigEndian.Uint16(reply[12:14])),
+	}
+	return nonce, addr, true
+}
+
+// process_nat_probe answers a NATProbe on the supernode, and hands a NATProbeReply to the probe waiting for it on an edge
+func (device *Device) process_nat_probe(packet []byte, endpoint conn.Endpoint) {
+	if device.IsSuperNode {
+		addr, err := net.ResolveUDPAddr("udp", endpoint.DstToString())
+		if err != nil {
+			return
+		}
+		if reply := MakeNATProbeReply(packet, addr); reply != nil {
+			device.net.RLock()
+			device.net.bind.Send(reply, endpoint)
+			device.net.RUnlock()
+		}
+		return
+	}
+	nonce, addr, ok := parseNATProbeReply(packet)
+	if !ok {
+		return
+	}
+	device.nat.Lock()
+	waiting := device.nat.probes[nonce]
+	device.nat.Unlock()
+	if waiting != nil {
+		select {
+		case waiting <- addr:
+		default:
+		}
+	}
+}
+
+// sendNATProbe sends NATProbes to the address from our port, and returns the address the receiver saw. nil if it didn't answer.
+func (device *Device) sendNATProbe(addr string) *net.UDPAddr {
+	device.net.RLock()
+	endpoint, err := device.net.bind.ParseEndpoint(addr)
+	device.net.RUnlock()
+	if err != nil {
+		return nil
+	}
+	var nonce natProbeNonce
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil
+	}
+	waiting := make(chan *net.UDPAddr, 1)
+	device.nat.Lock()
+	device.nat.probes[nonce] = waiting
+	device.nat.Unlock()
+	defer func() {
+		device.nat.Lock()
+		delete(device.nat.probes, nonce)
+		device.nat.Unlock()
+	}()
+	probe := makeNATProbe(nonce)
+	for i := 0; i < NATProbeTries; i++ {
+		device.net.RLock()
+		err = device.net.bind.Send(probe, endpoint)
+		device.net.RUnlock()
+		if err != nil {
+			return nil
+		}
+		select {
+		case mapped := <-waiting:
+			return mapped
+		case <-time.After(NATProbeTimeout):
+		case <-device.done:
+			return nil
+		}
+	}
+	return nil
+}
+
+// NATType returns the result of the last detection
+func (device *Device) NATType() mtypes.NATType {
+	return mtypes.NATType(atomic.LoadUint32(&device.nat.natType))
+}
+
+// DetectNAT classifies the NAT in front of us the way STUN does, by the addresses that the supernode sees.
+// The probes go to each address family of the supernode, then to its DetectPort if it has one:
+// a mapped address of our own is Open, the same mapping for both ports is a Cone, and another one is Symmetric.
+// The first supernode that tells the type of a family decides it. IPv4 decides, IPv6 only if IPv4 is unknown.
+func (device *Device) DetectNAT() mtypes.NATType {
+	device.peers.RLock()
+	endpoints := make([]string, 0, len(device.peers.SuperPeer))
+	for _, peer := range device.peers.SuperPeer {
+		if endpoint := peer.GetEndpointDstStr(); endpoint != "" && !conn.IsStreamURL(endpoint) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	device.peers.RUnlock()
+	device.net.RLock()
+	port := int(device.net.port)
+	device.net.RUnlock()
+	detectPort := device.SuperConfig.NATTraversal.DetectPort
+
+	natType := map[bool]mtypes.NATType{}
+	for _, endpoint := range endpoints {
+		host, _, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			continue
+		}
+		isV4 := net.ParseIP(host).To4() != nil
+		if natType[isV4] != mtypes.NATType_Unknown {
+			continue
+		}
+		natType[isV4] = classifyNAT(device.sendNATProbe(endpoint), func() *net.UDPAddr {
+			if detectPort == 0 {
+				return nil
+			}
+			return device.sendNATProbe(net.JoinHostPort(host, strconv.Itoa(detectPort)))
+		}, port)
+	}
+	if natType[true] != mtypes.NATType_Unknown {
+		return natType[true]
+	}
+	return natType[false]
+}
+
+// classifyNAT tells the NAT type by the address mapped for the first port of the supernode and, if needed, the second one
+func classifyNAT(mapped *net.UDPAddr, second func() *net.UDPAddr, port int) mtypes.NATType {
+	if mapped == nil {
+		return mtypes.NATType_Unknown
+	}
+	if mapped.Port == port && isLocalIP(mapped.IP) {
+		return mtypes.NATType_Open
+	}
+	mapped2 := second()
+	if mapped2 == nil {
+		return mtypes.NATType_Unknown
+	}
+	if mapped2.IP.Equal(mapped.IP) && mapped2.Port == mapped.Port {
+		return mtypes.NATType_Cone
+	}
+	return mtypes.NATType_Symmetric
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (device *Device) RoutineDetectNAT() {
+	interval := device.EdgeConfig().DynamicRoute.SuperNode.NATDetectInterval
+	if !device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode || interval <= 0 {
+		return
+	}
+	wait := NATDetectDelay
+	for {
+		select {
+		case <-device.done:
+			return
+		case <-time.After(wait):
+		}
+		natType := device.DetectNAT()
+		if old := mtypes.NATType(atomic.SwapUint32(&device.nat.natType, uint32(natType))); old != natType {
+			elog.Info(elog.Control, "NAT type changed", "old", old.ToString(), "new", natType.ToString())
+		}
+		wait = mtypes.S2TD(interval)
+	}
+}
+
+// process_PunchHoleMsg sends pings to the peer at the time the supernode told us, the peer does the same to us
+func (device *Device) process_PunchHoleMsg(Params string) error {
+	var params mtypes.PunchHoleParams
+	if err := json.Unmarshal([]byte(Params), &params); err != nil {
+		return err
+	}
+	if params.Delay < 0 || params.Delay > PunchDelayMax {
+		return fmt.Errorf("PunchHole: Delay out of range: %v", params.Delay)
+	}
+	device.peers.RLock()
+	peer := device.peers.IDMap[params.NodeID]
+	device.peers.RUnlock()
+	if peer == nil || peer.StaticConn {
+		return nil
+	}
+	if peer.punching.Swap(true) { // we get it from both address families of the supernode
+		return nil
+	}
+	go func() {
+		defer peer.punching.Set(false)
+		time.Sleep(mtypes.S2TD(params.Delay))
+		if peer.IsPeerAlive() {
+			return
+		}
+		if err := peer.SetEndpointFromConnURL(params.Endpoint, device.enabledAf, device.EdgeConfig().AfPrefer, false); err != nil {
+			elog.Error(elog.Control, "PunchHole: bind failed", "peer", peer.ID, "endpoint", params.Endpoint, "err", err)
+			return
+		}
+		atomic.AddUint64(&device.counters.holePunches, 1)
+		elog.Info(elog.Control, "Punching hole", "peer", peer.ID, "endpoint", params.Endpoint)
+		device.SendPing(peer, PunchTries, 1, PunchPingInterval)
+	}()
+	return nil
+}
@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestNATProbe(t *testing.T) {
+	nonce := natProbeNonce{1, 2, 3, 4, 5, 6, 7, 8}
+	probe := makeNATProbe(nonce)
+	from := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	reply := MakeNATProbeReply(probe, from)
+	if len(reply) != len(probe) {
+		t.Fatalf("reply of %v bytes to a probe of %v", len(reply), len(probe))
+	}
+	got, mapped, ok := parseNATProbeReply(reply)
+	if !ok || got != nonce || !mapped.IP.Equal(from.IP) || mapped.Port != from.Port {
+		t.Errorf("parsed %v %v %v", ok, got, mapped)
+	}
+	if MakeNATProbeReply(reply, from) != nil || MakeNATProbeReply(append(probe, 0), from) != nil {
+		t.Error("answered something else than a probe")
+	}
+
+	second := func(addr *net.UDPAddr) func() *net.UDPAddr {
+		return func() *net.UDPAddr { return addr }
+	}
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3001}
+	for _, c := range []struct {
+		mapped, mapped2 *net.UDPAddr
+		want            mtypes.NATType
+	}{
+		{nil, nil, mtypes.NATType_Unknown},
+		{local, nil, mtypes.NATType_Open},
+		{&net.UDPAddr{IP: local.IP, Port: 40000}, nil, mtypes.NATType_Unknown}, // no DetectPort
+		{from, &net.UDPAddr{IP: from.IP, Port: from.Port}, mtypes.NATType_Cone},
+		{from, &net.UDPAddr{IP: from.IP, Port: from.Port + 1}, mtypes.NATType_Symmetric},
+	} {
+		if got := classifyNAT(c.mapped, second(c.mapped2), local.Port); got != c.want {
+			t.Errorf("%v %v: %v, want %v", c.mapped, c.mapped2, got.ToString(), c.want.ToString())
+		}
+	}
+}
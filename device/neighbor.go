@@ -0,0 +1,133 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const NeighborTimeout_Default = 300
+
+// NeighborEntry is an IP/MAC binding of a host behind another node, learned from its ARP/ND messages
+type NeighborEntry struct {
+	MAC         tap.MacAddress
+	Time        time.Time
+	IsRouter    bool
+	RouterKnown bool // only a NA tells the router flag
+}
+
+// neighborKey is the key of the neighbor cache, each virtual network and VLAN has its own
+type neighborKey struct {
+	vni  uint16
+	vlan uint16
+	ip   [16]byte
+}
+
+func getNeighborKey(vni uint16, vlan uint16, ip net.IP) (key neighborKey) {
+	key.vni = vni
+	key.vlan = vlan
+	copy(key.ip[:], ip.To16())
+	return
+}
+
+func (device *Device) neighborTimeout() time.Duration {
+	if device.EdgeConfig().NeighborProxy.Timeout > 0 {
+		return mtypes.S2TD(device.EdgeConfig().NeighborProxy.Timeout)
+	}
+	return mtypes.S2TD(NeighborTimeout_Default)
+}
+
+// LearnNeighbor learns the IP/MAC binding from an ARP or ND frame received from another node
+func (device *Device) LearnNeighbor(vn *VNet, frame []byte) {
+	if !device.EdgeConfig().NeighborProxy.Enabled {
+		return
+	}
+	msg, ok := tap.ParseNeighborMsg(frame)
+	if !ok || !msg.HasBinding() {
+		return
+	}
+	key := getNeighborKey(vn.VNI, tap.GetVlanID(frame), msg.SenderIP)
+	entry := &NeighborEntry{
+		MAC:  msg.SenderMAC,
+		Time: time.Now(),
+	}
+	val, ok := device.neighbors.Load(key)
+	if ok && val.(*NeighborEntry).MAC == entry.MAC {
+		entry.IsRouter = val.(*NeighborEntry).IsRouter
+		entry.RouterKnown = val.(*NeighborEntry).RouterKnown
+	} else {
+		elog.Info(elog.Internal, "Neighbor learned", "ip", msg.SenderIP.String(), "mac", msg.SenderMAC.String())
+	}
+	if msg.Op == tap.NeighborReply && msg.SenderIP.To4() == nil {
+		entry.IsRouter = msg.IsRouter
+		entry.RouterKnown = true
+	}
+	device.neighbors.Store(key, entry)
+}
+
+// ProxyNeighbor answers an ARP request or NS from the tap device with the cache, so it doesn't go
+// to every node. It returns false if the frame must be forwarded as usual.
+func (device *Device) ProxyNeighbor(vn *VNet, frame []byte) bool {
+	if !device.EdgeConfig().NeighborProxy.Enabled {
+		return false
+	}
+	msg, ok := tap.ParseNeighborMsg(frame)
+	if !ok || !msg.CanProxy() {
+		return false
+	}
+	vlan := tap.GetVlanID(frame)
+	val, ok := device.neighbors.Load(getNeighborKey(vn.VNI, vlan, msg.TargetIP))
+	if !ok {
+		return false
+	}
+	entry := val.(*NeighborEntry)
+	if time.Since(entry.Time) > device.neighborTimeout() {
+		return false
+	}
+	if msg.TargetIP.To4() == nil && !entry.RouterKnown {
+		return false // a NA with a wrong router flag would break the default route of the host
+	}
+	if _, ok := device.l2fib.Load(L2FIBKey{vn.VNI, vlan, entry.MAC}); !ok {
+		return false // we don't know where the host is now
+	}
+	reply := tap.MakeNeighborReply(&msg, entry.MAC, entry.IsRouter)
+	if device.EdgeConfig().VLAN.AccessVLAN != 0 {
+		reply = tap.PopVlanTag(reply) // the request was tagged by VlanFromTap
+	}
+	offset := MessageTransportOffsetContent + path.EgHeaderLen
+	buf := make([]byte, offset+len(reply))
+	copy(buf[offset:], reply)
+	if _, err := vn.tap.Write(buf, offset); err != nil {
+		device.log.Errorf("Failed to write packet to TUN device: %v", err)
+		return false
+	}
+	if err := vn.tap.Flush(); err != nil {
+		device.log.Errorf("Unable to flush packets: %v", err)
+	}
+	atomic.AddUint64(&device.counters.neighborProxied, 1)
+	elog.Debug(elog.Normal, "Neighbor proxy replied", "ip", msg.TargetIP.String(), "mac", entry.MAC.String())
+	return true
+}
+
+func (device *Device) RoutineClearNeighborCache() {
+	for {
+		timeout := device.neighborTimeout()
+		device.neighbors.Range(func(k interface{}, v interface{}) bool {
+			if time.Since(v.(*NeighborEntry).Time) > timeout {
+				device.neighbors.Delete(k)
+			}
+			return true
+		})
+		time.Sleep(timeout)
+	}
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+type captureTap struct {
+	tap.Device
+	frames [][]byte
+}
+
+func (c *captureTap) Write(buf []byte, offset int) (int, error) {
+	c.frames = append(c.frames, append([]byte{}, buf[offset:]...))
+	return len(buf) - offset, nil
+}
+
+func (c *captureTap) Flush() error { return nil }
+
+func arpFrame(op byte, smac tap.MacAddress, sip net.IP, tip net.IP) []byte {
+	frame := append(tap.BroadcastMac[:], smac[:]...)
+	frame = append(frame, 0x08, 0x06, 0, 1, 0x08, 0, 6, 4, 0, op)
+	frame = append(frame, smac[:]...)
+	frame = append(frame, sip.To4()...)
+	frame = append(frame, make([]byte, 6)...)
+	return append(frame, tip.To4()...)
+}
+
+func ndFrame(icmptype byte, flags byte, smac tap.MacAddress, sip net.IP, target net.IP) []byte {
+	frame := append([]byte{0x33, 0x33, 0xff, target[13], target[14], target[15]}, smac[:]...)
+	frame = append(frame, 0x86, 0xdd)
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	ip[5] = 32
+	ip[6] = 58
+	ip[7] = 255
+	copy(ip[8:24], sip.To16())
+	copy(ip[24:40], net.ParseIP("ff02::1:ff00:0").To16())
+	icmp := make([]byte, 32)
+	icmp[0] = icmptype
+	icmp[4] = flags
+	copy(icmp[8:24], target.To16())
+	icmp[24] = 1 // source link-layer address
+	if icmptype == 136 {
+		icmp[24] = 2 // target link-layer address
+	}
+	icmp[25] = 1
+	copy(icmp[26:32], smac[:])
+	return append(append(frame, ip...), icmp...)
+}
+
+func TestNeighborProxy(t *testing.T) {
+	capture := &captureTap{}
+	device := &Device{
+		ID: 1,
+	}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{NeighborProxy: mtypes.NeighborProxyInfo{Enabled: true}})
+	vn := NewVNet(0, capture, nil)
+	remote := tap.MacAddress{0x02, 0, 0, 0, 0, 2}
+	local := tap.MacAddress{0x02, 0, 0, 0, 0, 1}
+	remoteIP, localIP := net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")
+
+	request := arpFrame(1, local, localIP, remoteIP)
+	if device.ProxyNeighbor(vn, request) {
+		t.Fatal("answered before learning")
+	}
+	device.LearnNeighbor(vn, arpFrame(2, remote, remoteIP, localIP))
+	if device.ProxyNeighbor(vn, request) {
+		t.Fatal("answered for a MAC that is not in the L2FIB")
+	}
+	device.l2fib.Store(L2FIBKey{0, 0, remote}, &IdAndTime{ID: 2})
+	if !device.ProxyNeighbor(vn, request) || len(capture.frames) != 1 {
+		t.Fatal("ARP request not answered")
+	}
+	reply, ok := tap.ParseNeighborMsg(capture.frames[0])
+	if !ok || reply.Op != tap.NeighborReply || !reply.SenderIP.Equal(remoteIP) || reply.SenderMAC != remote || !bytes.Equal(capture.frames[0][0:6], local[:]) {
+		t.Errorf("wrong ARP reply %x", capture.frames[0])
+	}
+	if device.ProxyNeighbor(vn, arpFrame(1, remote, remoteIP, remoteIP)) {
+		t.Error("answered a gratuitous ARP")
+	}
+
+	remote6, local6 := net.ParseIP("fd00::2"), net.ParseIP("fd00::1")
+	solicit := ndFrame(135, 0, local, local6, remote6)
+	device.LearnNeighbor(vn, ndFrame(135, 0, remote, remote6, local6))
+	if device.ProxyNeighbor(vn, solicit) {
+		t.Error("answered without knowing the router flag")
+	}
+	device.LearnNeighbor(vn, ndFrame(136, 0x80|0x20, remote, remote6, remote6))
+	if !device.ProxyNeighbor(vn, solicit) || len(capture.frames) != 2 {
+		t.Fatal("NS not answered")
+	}
+	reply, ok = tap.ParseNeighborMsg(capture.frames[1])
+	if !ok || reply.Op != tap.NeighborReply || !reply.SenderIP.Equal(remote6) || reply.SenderMAC != remote || !reply.IsRouter {
+		t.Errorf("wrong NA %x", capture.frames[1])
+	}
+}
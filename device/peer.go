@@ -11,6 +11,8 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"math/bits"
 	"net"
 	"sort"
 	"sync"
@@ -18,6 +20,7 @@ import (
 	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"gopkg.in/yaml.v2"
 )
@@ -54,9 +57,7 @@ func (et *endpoint_trylist) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool
 	defer et.Unlock()
 	newmap_super := make(map[string]*endpoint_tryitem)
 	if urls.IsEmpty() {
-		if et.peer.device.LogLevel.LogInternal {
-			fmt.Printf("Internal: Peer %v : Reset trylist(super) %v\n", et.peer.ID.ToString(), "nil")
-		}
+		elog.Info(elog.Internal, "Reset trylist(super)", "peer", et.peer.ID)
 	}
 	for url, it := range urls.GetList(UseLocalIP) {
 		if url == "" {
@@ -74,20 +75,14 @@ func (et *endpoint_trylist) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool
 			}
 		}
 		if err != nil {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : Update trylist(super) %v error: %v\n", et.peer.ID.ToString(), url, err)
-			}
+			elog.Info(elog.Internal, "Update trylist(super) failed", "peer", et.peer.ID, "url", url, "err", err)
 			continue
 		}
 		if val, ok := et.trymap_super[url]; ok {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : Update trylist(super) %v\n", et.peer.ID.ToString(), url)
-			}
+			elog.Info(elog.Internal, "Update trylist(super)", "peer", et.peer.ID, "url", url)
 			newmap_super[url] = val
 		} else {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : New trylist(super) %v\n", et.peer.ID.ToString(), url)
-			}
+			elog.Info(elog.Internal, "New trylist(super)", "peer", et.peer.ID, "url", url)
 			newmap_super[url] = &endpoint_tryitem{
 				URL:      url,
 				lastTry:  time.Time{}.Add(mtypes.S2TD(AfPerferVal)).Add(mtypes.S2TD(it)),
@@ -106,9 +101,7 @@ func (et *endpoint_trylist) UpdateP2P(url string) {
 	et.Lock()
 	defer et.Unlock()
 	if _, ok := et.trymap_p2p[url]; !ok {
-		if et.peer.device.LogLevel.LogInternal {
-			fmt.Printf("Internal: Peer %v : Add trylist(p2p) %v\n", et.peer.ID.ToString(), url)
-		}
+		elog.Info(elog.Internal, "Add trylist(p2p)", "peer", et.peer.ID, "url", url)
 		et.trymap_p2p[url] = &endpoint_tryitem{
 			URL:      url,
 			lastTry:  time.Now(),
@@ -136,9 +129,7 @@ func (et *endpoint_trylist) GetNextTry() (bool, string) {
 	}
 	for url, v := range et.trymap_p2p {
 		if v.firstTry.After(time.Time{}) && v.firstTry.Add(et.timeout).Before(time.Now()) {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : Delete trylist(p2p) %v\n", et.peer.ID.ToString(), url)
-			}
+			elog.Info(elog.Internal, "Delete trylist(p2p)", "peer", et.peer.ID, "url", url)
 			delete(et.trymap_p2p, url)
 		}
 		if smallest == nil || smallest.lastTry.After(v.lastTry) {
@@ -237,6 +228,85 @@ func (f *filterwindow) GetVal() float64 {
 	return f.value
 }
 
+const pinglossWindow = 64
+
+// pingloss counts the missed RequestIDs of the last pinglossWindow pings from a peer
+type pingloss struct {
+	sync.RWMutex
+	highest uint32
+	window  uint64 // bit i is set if ping highest-i was received
+	count   uint32 // pings in the window
+}
+
+func (l *pingloss) Push(seq uint32) {
+	if seq == 0 { // not counted, like the pings of SendPing()
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	d := int32(seq - l.highest) // works across the wrap around
+	switch {
+	case l.count > 0 && d > 0 && d < pinglossWindow:
+		l.window = l.window<<uint(d) | 1
+		l.highest = seq
+		l.count += uint32(d)
+		if l.count > pinglossWindow {
+			l.count = pinglossWindow
+		}
+	case l.count > 0 && d <= 0 && uint32(-d) < l.count:
+		l.window |= 1 << uint(-d)
+	default: // first ping, the peer restarted or the link was down for a long time
+		l.highest = seq
+		l.window = 1
+		l.count = 1
+	}
+}
+
+func (l *pingloss) GetVal() float64 {
+	l.RLock()
+	defer l.RUnlock()
+	if l.count == 0 {
+		return 0
+	}
+	mask := ^uint64(0)
+	if l.count < pinglossWindow {
+		mask = 1<<l.count - 1
+	}
+	return 1 - float64(bits.OnesCount64(l.window&mask))/float64(l.count)
+}
+
+// ThroughputMinSample is the least bytes between two pings that tell the throughput of a link.
+// Less is an idle link, which says nothing about how fast it is.
+const ThroughputMinSample = 1 << 20
+
+// rxrate estimates the throughput of a link with the peak receive rate. The peak decays on every busy sample,
+// so it follows the link if it becomes slower.
+type rxrate struct {
+	sync.RWMutex
+	lastBytes uint64
+	lastTime  time.Time
+	peak      float64 // Mbit/s
+}
+
+func (r *rxrate) Sample(rxBytes uint64) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	if !r.lastTime.IsZero() && rxBytes >= r.lastBytes+ThroughputMinSample {
+		if dt := now.Sub(r.lastTime).Seconds(); dt > 0 {
+			r.peak = math.Max(float64(rxBytes-r.lastBytes)*8/1e6/dt, r.peak*0.95)
+		}
+	}
+	r.lastBytes = rxBytes
+	r.lastTime = now
+}
+
+func (r *rxrate) GetVal() float64 {
+	r.RLock()
+	defer r.RUnlock()
+	return r.peak
+}
+
 type Peer struct {
 	isRunning        AtomicBool
 	sync.RWMutex     // Mostly protects endpoint, but is generally taken whenever we modify peer
@@ -249,6 +319,8 @@ type Peer struct {
 	LastPacketReceivedAdd1Sec atomic.Value // *time.Time
 
 	SingleWayLatency filterwindow
+	PingLoss         pingloss
+	Throughput       rxrate
 
 	stopping sync.WaitGroup // routines pending stop
 
@@ -257,6 +329,7 @@ type Peer struct {
 	StaticConn       bool //if true, this peer will not write to config file when roaming, and the endpoint will be reset periodically
 	ConnURL          string
 	ConnAF           conn.EnabledAf
+	EdgeAPIUrl       string // supernode peers only, the EdgeAPI served by that supernode
 
 	// These fields are accessed with atomic operations, which must be
 	// 64-bit aligned even on 32-bit platforms. Go guarantees that an
@@ -268,6 +341,7 @@ type Peer struct {
 		rxBytes           uint64 // bytes received from peer
 		lastHandshakeNano int64  // nano seconds since epoch
 	}
+	wire_codecs uint32 // mtypes.WireCodecSet, advertised in RegisterMsg or PingMsg
 
 	disableRoaming bool
 
@@ -286,10 +360,20 @@ type Peer struct {
 		sync.Mutex // protects against concurrent Start/Stop
 	}
 
+	pmtu struct {
+		state      atomic.Value // *pmtuState
+		probing    AtomicBool
+		ack        chan int // ProbeSize of the pongs answering the probes
+		fragmentID uint32   // accessed atomically
+	}
+	fragments map[uint32]*reassembly // only touched by RoutineSequentialReceiver
+	punching  AtomicBool             // a PunchHole from the supernode is pending
+
 	queue struct {
-		staged   chan *QueueOutboundElement // staged packets before a handshake is available
-		outbound *autodrainingOutboundQueue // sequential ordering of udp transmission
-		inbound  *autodrainingInboundQueue  // sequential ordering of tun writing
+		staged        chan *QueueOutboundElement // staged packets before a handshake is available
+		stagedControl chan *QueueOutboundElement // control messages and keepalives, sent before the staged packets
+		outbound      *autodrainingOutboundQueue // sequential ordering of udp transmission
+		inbound       *autodrainingInboundQueue  // sequential ordering of tun writing
 	}
 
 	cookieGenerator             CookieGenerator
@@ -299,7 +383,7 @@ type Peer struct {
 
 func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool, PersistentKeepalive uint32) (*Peer, error) {
 	if !isSuper {
-		if id < mtypes.NodeID_Special {
+		if !id.IsSpecial() {
 			//pass check
 		} else {
 			return nil, errors.New(fmt.Sprint("ID ", uint32(id), " is a special NodeID"))
@@ -328,9 +412,7 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 	}
 
 	// create peer
-	if device.LogLevel.LogInternal {
-		fmt.Println("Internal: Create peer with ID : " + id.ToString() + " and PubKey:" + pk.ToString())
-	}
+	elog.Info(elog.Internal, "Create peer", "peer", id, "pubkey", pk.ToString())
 	peer := new(Peer)
 	peer.ConnAF = conn.EnabledAf46
 	atomic.SwapUint32(&peer.persistentKeepaliveInterval, PersistentKeepalive)
@@ -340,12 +422,15 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
-	peer.endpoint_trylist = NewEndpoint_trylist(peer, mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout), device.enabledAf)
+	peer.endpoint_trylist = NewEndpoint_trylist(peer, mtypes.S2TD(device.EdgeConfig().DynamicRoute.PeerAliveTimeout), device.enabledAf)
 	peer.SingleWayLatency.device = device
 	peer.SingleWayLatency.Push(mtypes.Infinity)
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
 	peer.queue.inbound = newAutodrainingInboundQueue(device)
 	peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
+	peer.queue.stagedControl = make(chan *QueueOutboundElement, QueueStagedSize)
+	peer.pmtu.ack = make(chan int, 8)
+	peer.fragments = make(map[uint32]*reassembly)
 	// map public key
 	oldpeer, ok := device.peers.keyMap[pk]
 	if ok {
@@ -388,7 +473,7 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 }
 
 func (peer *Peer) IsPeerAlive() bool {
-	PeerAliveTimeout := mtypes.S2TD(peer.device.EdgeConfig.DynamicRoute.PeerAliveTimeout)
+	PeerAliveTimeout := mtypes.S2TD(peer.device.EdgeConfig().DynamicRoute.PeerAliveTimeout)
 	if peer.endpoint == nil {
 		return false
 	}
@@ -550,7 +635,7 @@ func (peer *Peer) Stop() {
 }
 
 func (peer *Peer) SetPSK(psk NoisePresharedKey) {
-	if !peer.device.IsSuperNode && peer.ID < mtypes.NodeID_Special && peer.device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if !peer.device.IsSuperNode && !peer.ID.IsSpecial() && peer.device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		peer.device.log.Verbosef("Preshared keys disabled in P2P mode.")
 		return
 	}
@@ -559,10 +644,16 @@ func (peer *Peer) SetPSK(psk NoisePresharedKey) {
 	peer.handshake.mutex.Unlock()
 }
 
-func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_perfer int, static bool) error {
-	if peer.device.LogLevel.LogInternal {
-		fmt.Printf("Internal: Set endpoint to %v for NodeID: %v static:%v\n", connurl, peer.ID.ToString(), static)
+func (peer *Peer) SetPersistentKeepalive(secs uint32) {
+	old := atomic.SwapUint32(&peer.persistentKeepaliveInterval, secs)
+	// Send immediate keepalive if we're turning it on and before it wasn't on.
+	if old == 0 && secs != 0 && peer.device.isUp() {
+		peer.SendKeepalive()
 	}
+}
+
+func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_perfer int, static bool) error {
+	elog.Info(elog.Internal, "Set endpoint", "peer", peer.ID, "endpoint", connurl, "static", static)
 	var err error
 	_, connIP, err := conn.LookupIP(connurl, af, af_perfer)
 	if err != nil {
@@ -591,12 +682,10 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	}
 	peer.Lock()
 	defer peer.Unlock()
-	if peer.ID == mtypes.NodeID_SuperNode {
+	if _, stream := endpoint.(*conn.StreamEndpoint); peer.ID == mtypes.NodeID_SuperNode && !stream {
 		conn, err := net.Dial("udp", endpoint.DstToString())
 		if err != nil {
-			if peer.device.LogLevel.LogControl {
-				fmt.Printf("Control: Set endpoint to peer %v failed: %v", peer.ID, err)
-			}
+			elog.Error(elog.Control, "Set endpoint failed", "peer", peer.ID, "endpoint", endpoint.DstToString(), "err", err)
 			return
 		}
 		defer conn.Close()
@@ -639,7 +728,7 @@ func (device *Device) SaveToConfig(peer *Peer, endpoint conn.Endpoint) {
 	if peer.StaticConn { //static conn do not write new endpoint to config
 		return
 	}
-	if !device.EdgeConfig.DynamicRoute.P2P.UseP2P { //Must in p2p mode
+	if !device.EdgeConfig().DynamicRoute.P2P.UseP2P { //Must in p2p mode
 		return
 	}
 	if peer.endpoint != nil && peer.endpoint.DstIP().Equal(endpoint.DstIP()) { //endpoint changed
@@ -653,7 +742,7 @@ func (device *Device) SaveToConfig(peer *Peer, endpoint conn.Endpoint) {
 	if bytes.Equal(peer.handshake.presharedKey[:], make([]byte, 32)) {
 		pskstr = ""
 	}
-	for _, peerfile := range device.EdgeConfig.Peers {
+	for _, peerfile := range device.EdgeConfig().Peers {
 		if peerfile.NodeID == peer.ID && peerfile.PubKey == pubkeystr {
 			foundInFile = true
 			if !peerfile.Static {
@@ -664,20 +753,24 @@ func (device *Device) SaveToConfig(peer *Peer, endpoint conn.Endpoint) {
 		}
 	}
 	if !foundInFile {
-		device.EdgeConfig.Peers = append(device.EdgeConfig.Peers, mtypes.PeerInfo{
-			NodeID:   peer.ID,
-			PubKey:   pubkeystr,
-			PSKey:    pskstr,
-			EndPoint: url,
-			Static:   false,
+		device.UpdateEdgeConfig(func(econfig *mtypes.EdgeConfig) {
+			peers := make([]mtypes.PeerInfo, len(econfig.Peers), len(econfig.Peers)+1)
+			copy(peers, econfig.Peers)
+			econfig.Peers = append(peers, mtypes.PeerInfo{
+				NodeID:   peer.ID,
+				PubKey:   pubkeystr,
+				PSKey:    pskstr,
+				EndPoint: url,
+				Static:   false,
+			})
 		})
 	}
 	go device.SaveConfig()
 }
 
 func (device *Device) SaveConfig() {
-	if device.EdgeConfig.DynamicRoute.SaveNewPeers {
-		configbytes, _ := yaml.Marshal(device.EdgeConfig)
+	if device.EdgeConfig().DynamicRoute.SaveNewPeers {
+		configbytes, _ := yaml.Marshal(device.EdgeConfig())
 		ioutil.WriteFile(device.EdgeConfigPath, configbytes, 0644)
 	}
 }
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"gopkg.in/yaml.v2"
+)
+
+func TestPingLoss(t *testing.T) {
+	var l pingloss
+	check := func(expect float64) {
+		t.Helper()
+		if v := l.GetVal(); math.Abs(v-expect) > 1e-9 {
+			t.Errorf("loss = %v, expect %v", v, expect)
+		}
+	}
+	check(0)
+	// 100..109, 103 and 107 are lost, 105 arrives late
+	for _, seq := range []uint32{100, 101, 102, 104, 106, 105, 108, 109} {
+		l.Push(seq)
+	}
+	check(0.2)
+	l.Push(0) // not counted
+	check(0.2)
+	for seq := uint32(110); seq < 110+pinglossWindow; seq++ {
+		l.Push(seq)
+	}
+	check(0)
+	// The peer restarted with another RequestID
+	l.Push(7)
+	l.Push(9)
+	check(1.0 / 3)
+	// Wrap around, 0 is never sent
+	l.Push(math.MaxUint32 - 1)
+	l.Push(math.MaxUint32)
+	l.Push(1)
+	check(0.25)
+}
+
+func TestSaveConfig(t *testing.T) {
+	device := &Device{EdgeConfigPath: filepath.Join(t.TempDir(), "edge.yaml")}
+	econfig := &mtypes.EdgeConfig{NodeName: "edge1"}
+	econfig.DynamicRoute.SaveNewPeers = true
+	device.SetEdgeConfig(econfig)
+	device.UpdateEdgeConfig(func(econfig *mtypes.EdgeConfig) {
+		econfig.Peers = []mtypes.PeerInfo{{NodeID: 2, PubKey: "pubkey", EndPoint: "127.0.0.1:3002"}}
+	})
+	device.SaveConfig()
+	configbytes, err := ioutil.ReadFile(device.EdgeConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved mtypes.EdgeConfig
+	if err := yaml.Unmarshal(configbytes, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.NodeName != "edge1" || len(saved.Peers) != 1 || saved.Peers[0].EndPoint != "127.0.0.1:3002" {
+		t.Errorf("saved %+v", saved)
+	}
+}
@@ -0,0 +1,378 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const (
+	PMTUProbeInterval_Default = 600 // seconds
+	PMTUMinSize_Default       = 576
+	PMTUCheckInterval         = time.Second * 5  // how often the endpoints are checked for a change
+	PMTURetryInterval         = time.Second * 60 // after a peer didn't answer any probe
+	PMTUProbeTimeout          = time.Second
+	PMTUProbeTries            = 2
+
+	FragmentHeaderLen = 10 // after the EgHeader: ID, index, count, usage, TTL, length
+	FragmentTimeout   = time.Second * 5
+	FragmentsMax      = 64 // packets being put back together per peer
+)
+
+// pmtuState is the result of a probe, the PMTU is the size of the EgHeader and the content
+type pmtuState struct {
+	size     int // 0 if the peer didn't answer
+	endpoint string
+	next     time.Time // when to probe again
+}
+
+// reassembly is a packet whose fragments are being received
+type reassembly struct {
+	parts   [][]byte
+	missing int
+	usage   path.Usage
+	ttl     uint8
+	expire  time.Time
+}
+
+// CheckPMTU validates EdgeConfig.PMTU
+func CheckPMTU(info mtypes.PMTUInfo) error {
+	if info.ProbeInterval < 0 {
+		return fmt.Errorf("PMTU.ProbeInterval must >= 0: %v", info.ProbeInterval)
+	}
+	if info.MinSize != 0 && info.MinSize < 128 {
+		return fmt.Errorf("PMTU.MinSize must >= 128: %v", info.MinSize)
+	}
+	return nil
+}
+
+// PMTU returns the largest packet that gets through to the peer, the EgHeader included. 0 if unknown.
+func (peer *Peer) PMTU() int {
+	if state, _ := peer.pmtu.state.Load().(*pmtuState); state != nil {
+		return state.size
+	}
+	return 0
+}
+
+// PMTUInfo returns the largest IP packet of the main network the peer receives unfragmented, and the endpoint it was probed on
+func (peer *Peer) PMTUInfo() (mtu int, endpoint string) {
+	state, _ := peer.pmtu.state.Load().(*pmtuState)
+	if state == nil || state.size == 0 {
+		return 0, ""
+	}
+	return state.size - path.EgHeaderLen - 14, state.endpoint
+}
+
+// pmtuMaxSize is the size of the largest packet read from a tap device, rounded up like the padding of the transport
+func (device *Device) pmtuMaxSize() int {
+	size := path.EgHeaderLen + path.EgVNILen + 14 + tap.VlanTagLen + int(device.EdgeConfig().Interface.MTU)
+	return (size + PaddingMultiple - 1) &^ (PaddingMultiple - 1)
+}
+
+func (device *Device) RoutinePMTUProbe() {
+	for {
+		select {
+		case <-device.done:
+			return
+		case <-time.After(PMTUCheckInterval):
+		}
+		// Read it every time, it may be changed by a config reload
+		conf := device.EdgeConfig().PMTU
+		now := time.Now()
+		device.peers.RLock()
+		for _, peer := range device.peers.IDMap {
+			if !conf.Enabled {
+				peer.pmtu.state.Store((*pmtuState)(nil))
+				continue
+			}
+			endpoint := peer.GetEndpointDstStr()
+			if peer.pmtu.probing.Get() || endpoint == "" || peer.keypairs.Current() == nil { // the probes would wait for the handshake
+				continue
+			}
+			state, _ := peer.pmtu.state.Load().(*pmtuState)
+			if state != nil && state.endpoint == endpoint && now.Before(state.next) {
+				continue
+			}
+			if state != nil && state.endpoint != endpoint { // it is another path now
+				peer.pmtu.state.Store((*pmtuState)(nil))
+			}
+			peer.pmtu.probing.Set(true)
+			go device.probePMTU(peer, endpoint)
+		}
+		device.peers.RUnlock()
+	}
+}
+
+// probePMTU finds the PMTU of the peer by a binary search with padded pings
+func (device *Device) probePMTU(peer *Peer, endpoint string) {
+	defer peer.pmtu.probing.Set(false)
+	hi := device.pmtuMaxSize()
+	lo := device.EdgeConfig().PMTU.MinSize
+	if lo == 0 {
+		lo = PMTUMinSize_Default
+	}
+	lo = (lo + PaddingMultiple - 1) &^ (PaddingMultiple - 1)
+	if lo > hi {
+		lo = hi
+	}
+	state := &pmtuState{endpoint: endpoint}
+	switch {
+	case device.sendPMTUProbe(peer, hi):
+		state.size = hi
+	case device.sendPMTUProbe(peer, lo):
+		for hi-lo > PaddingMultiple {
+			mid := (lo + hi) / 2 &^ (PaddingMultiple - 1)
+			if device.sendPMTUProbe(peer, mid) {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		state.size = lo
+	}
+	if state.size == 0 { // down, or too old to answer the probes
+		state.next = time.Now().Add(PMTURetryInterval)
+		elog.Debug(elog.Control, "PMTU probe not answered", "peer", peer.ID, "endpoint", endpoint)
+	} else {
+		interval := device.EdgeConfig().PMTU.ProbeInterval
+		if interval == 0 {
+			interval = PMTUProbeInterval_Default
+		}
+		state.next = time.Now().Add(mtypes.S2TD(interval))
+		elog.Info(elog.Control, "PMTU probed", "peer", peer.ID, "endpoint", endpoint, "size", state.size, "mtu", state.size-path.EgHeaderLen-14)
+	}
+	peer.pmtu.state.Store(state)
+}
+
+// sendPMTUProbe sends a ping padded to size and reports whether the peer answered it.
+// The ping is larger by the overhead of the bind, so it gets through only if a packet of size does with the most padding.
+func (device *Device) sendPMTUProbe(peer *Peer, size int) bool {
+	size += device.net.overhead
+	packet, err := device.GeneratePMTUProbe(peer.ID, size)
+	if err != nil {
+		device.log.Errorf("%v", err)
+		return false
+	}
+	for i := 0; i < PMTUProbeTries; i++ {
+		for len(peer.pmtu.ack) > 0 {
+			<-peer.pmtu.ack
+		}
+		device.SendPacket(peer, path.PingPacket, 0, packet, MessageTransportOffsetContent)
+		timeout := time.After(PMTUProbeTimeout)
+	wait:
+		for {
+			select {
+			case got := <-peer.pmtu.ack:
+				if got == size {
+					return true
+				}
+			case <-timeout:
+				break wait
+			case <-device.done:
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// GeneratePMTUProbe makes a ping to dst padded to size with zeros
+func (device *Device) GeneratePMTUProbe(dst mtypes.Vertex, size int) ([]byte, error) {
+	body, err := device.EncodeMsg(&mtypes.PingMsg{
+		Src_nodeID: device.ID,
+		Time:       device.graph.GetCurrentTime(),
+		WireCodecs: mtypes.WireCodecsSupported,
+		ProbeSize:  size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if path.EgHeaderLen+len(body) > size {
+		return nil, fmt.Errorf("PMTU probe of %v bytes too small for the PingMsg", size)
+	}
+	buf := make([]byte, size)
+	header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
+	header.SetDst(dst)
+	header.SetSrc(device.ID)
+	copy(buf[path.EgHeaderLen:], body)
+	return buf, nil
+}
+
+// process_pmtu_probe answers a probe to the peer it came from only, the pong is not a latency report
+func (device *Device) process_pmtu_probe(peer *Peer, content mtypes.PingMsg) error {
+	body, err := device.EncodeMsg(&mtypes.PongMsg{
+		RequestID:  content.RequestID,
+		Src_nodeID: content.Src_nodeID,
+		Dst_nodeID: device.ID,
+		ProbeSize:  content.ProbeSize,
+	})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
+	header.SetSrc(device.ID)
+	header.SetDst(content.Src_nodeID)
+	copy(buf[path.EgHeaderLen:], body)
+	device.SendPacket(peer, path.PongPacket, 0, buf, MessageTransportOffsetContent)
+	return nil
+}
+
+func (peer *Peer) pmtuAck(content mtypes.PongMsg) {
+	if content.Src_nodeID != peer.device.ID {
+		return
+	}
+	select {
+	case peer.pmtu.ack <- content.ProbeSize:
+	default:
+	}
+}
+
+// pmtuTooBig answers a frame larger than the PMTU of the peer with ICMP/ICMPv6 too big if PMTU.TooBig is on.
+// It returns false if the packet should be sent, and fragmented if it is too big.
+func (device *Device) pmtuTooBig(vn *VNet, peer *Peer, packet []byte, frame []byte) bool {
+	if !device.EdgeConfig().PMTU.TooBig {
+		return false
+	}
+	size := peer.PMTU()
+	if size == 0 || len(packet) <= size {
+		return false
+	}
+	reply := tap.MakeICMPTooBig(frame, size-(len(packet)-len(frame)))
+	if reply == nil {
+		return false
+	}
+	if device.EdgeConfig().VLAN.AccessVLAN != 0 {
+		reply = tap.PopVlanTag(reply) // the frame was tagged by VlanFromTap
+	}
+	offset := MessageTransportOffsetContent + path.EgHeaderLen
+	buf := make([]byte, offset+len(reply))
+	copy(buf[offset:], reply)
+	if _, err := vn.tap.Write(buf, offset); err != nil {
+		device.log.Errorf("Failed to write packet to TUN device: %v", err)
+		return false
+	}
+	if err := vn.tap.Flush(); err != nil {
+		device.log.Errorf("Unable to flush packets: %v", err)
+	}
+	atomic.AddUint64(&device.counters.icmpTooBig, 1)
+	elog.Debug(elog.Normal, "Packet too big, ICMP sent", "len", len(packet), "pmtu", size, "peer", peer.ID)
+	return true
+}
+
+// stageFragments splits a packet larger than size into Fragment packets. Each fragment carries a copy of the EgHeader.
+func (device *Device) stageFragments(peer *Peer, elem *QueueOutboundElement, size int) {
+	defer func() {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+	}()
+	body := elem.packet[path.EgHeaderLen:]
+	chunk := size - path.EgHeaderLen - FragmentHeaderLen
+	if chunk <= 0 {
+		return
+	}
+	count := (len(body) + chunk - 1) / chunk
+	if count > 255 {
+		elog.Debug(elog.Normal, "Too many fragments, dropped", "len", len(elem.packet), "pmtu", size, "peer", peer.ID)
+		return
+	}
+	id := atomic.AddUint32(&peer.pmtu.fragmentID, 1)
+	offset := MessageTransportOffsetContent
+	for i := 0; i < count; i++ {
+		part := body[i*chunk:]
+		if len(part) > chunk {
+			part = part[:chunk]
+		}
+		f := device.NewOutboundElement()
+		f.Type = path.Fragment
+		f.TTL = elem.TTL
+		f.packet = f.buffer[offset : offset+path.EgHeaderLen+FragmentHeaderLen+len(part)]
+		copy(f.packet, elem.packet[:path.EgHeaderLen])
+		h := f.packet[path.EgHeaderLen:]
+		binary.BigEndian.PutUint32(h[0:4], id)
+		h[4] = uint8(i)
+		h[5] = uint8(count)
+		h[6] = uint8(elem.Type)
+		h[7] = elem.TTL
+		binary.BigEndian.PutUint16(h[8:10], uint16(len(part)))
+		copy(h[FragmentHeaderLen:], part)
+		peer.StagePacket(f)
+	}
+	atomic.AddUint64(&device.counters.fragmented, 1)
+}
+
+// reassemble collects a Fragment. When it is the last one, elem is replaced by the whole packet and it returns true.
+// No lock, it is only called by RoutineSequentialReceiver of the peer.
+func (peer *Peer) reassemble(elem *QueueInboundElement) (bool, error) {
+	if len(elem.packet) < path.EgHeaderLen+FragmentHeaderLen {
+		return false, errors.New("invalid Fragment: too small")
+	}
+	h := elem.packet[path.EgHeaderLen:]
+	id := binary.BigEndian.Uint32(h[0:4])
+	index, count := int(h[4]), int(h[5])
+	usage, ttl := path.Usage(h[6]), h[7]
+	length := int(binary.BigEndian.Uint16(h[8:10]))
+	if index >= count || length > len(h)-FragmentHeaderLen || !usage.IsValid_EgType() || usage == path.Fragment {
+		return false, errors.New("invalid Fragment header")
+	}
+	now := time.Now()
+	if peer.fragments == nil {
+		peer.fragments = make(map[uint32]*reassembly)
+	}
+	r := peer.fragments[id]
+	if r == nil || len(r.parts) != count {
+		for k, v := range peer.fragments {
+			if now.After(v.expire) || len(peer.fragments) >= FragmentsMax {
+				delete(peer.fragments, k)
+			}
+		}
+		r = &reassembly{
+			parts:   make([][]byte, count),
+			missing: count,
+			usage:   usage,
+			ttl:     ttl,
+			expire:  now.Add(FragmentTimeout),
+		}
+		peer.fragments[id] = r
+	}
+	if r.parts[index] == nil {
+		r.parts[index] = append([]byte{}, h[FragmentHeaderLen:FragmentHeaderLen+length]...)
+		r.missing--
+	}
+	if r.missing > 0 {
+		return false, nil
+	}
+	delete(peer.fragments, id)
+
+	device := peer.device
+	buffer := device.GetMessageBuffer()
+	offset := MessageTransportOffsetContent
+	size := path.EgHeaderLen
+	copy(buffer[offset:], elem.packet[:path.EgHeaderLen])
+	for _, part := range r.parts {
+		if offset+size+len(part) > MaxMessageSize {
+			device.PutMessageBuffer(buffer)
+			return false, errors.New("invalid Fragment: reassembled packet too large")
+		}
+		size += copy(buffer[offset+size:], part)
+	}
+	device.PutMessageBuffer(elem.buffer)
+	elem.buffer = buffer
+	elem.packet = buffer[offset : offset+size]
+	elem.Type = r.usage
+	elem.TTL = r.ttl
+	atomic.AddUint64(&device.counters.reassembled, 1)
+	return true, nil
+}
@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+func TestFragment(t *testing.T) {
+	device := &Device{log: NewLogger(LogLevelSilent, "")}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{})
+	device.PopulatePools()
+	sender := &Peer{ID: 2, device: device}
+	sender.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
+	receiver := &Peer{ID: 1, device: device}
+
+	elem := device.NewOutboundElement()
+	elem.Type = path.NormalPacket
+	elem.TTL = 200
+	elem.packet = elem.buffer[MessageTransportOffsetContent : MessageTransportOffsetContent+path.EgHeaderLen+1000]
+	for i := range elem.packet {
+		elem.packet[i] = byte(i)
+	}
+	want := append([]byte{}, elem.packet...)
+	device.stageFragments(sender, elem, 256)
+	if len(sender.queue.staged) != 5 || device.GetMetrics().Fragmented != 1 {
+		t.Fatalf("%v fragments staged", len(sender.queue.staged))
+	}
+
+	var fragments []*QueueInboundElement
+	for len(sender.queue.staged) > 0 {
+		f := <-sender.queue.staged
+		if len(f.packet) > 256 || f.Type != path.Fragment || !bytes.Equal(f.packet[:path.EgHeaderLen], want[:path.EgHeaderLen]) {
+			t.Errorf("invalid fragment of %v bytes: %v", len(f.packet), f.Type.ToString())
+		}
+		in := device.GetInboundElement()
+		in.buffer = device.GetMessageBuffer()
+		in.packet = append(in.buffer[:0], f.packet...)
+		in.packet = append(in.packet, 0, 0, 0) // the padding of the transport
+		in.Type = f.Type
+		fragments = append(fragments, in)
+	}
+	// Out of order, with a duplicate
+	for _, i := range []int{4, 1, 1, 0, 3} {
+		if ok, err := receiver.reassemble(fragments[i]); ok || err != nil {
+			t.Fatalf("fragment %v: %v, %v", i, ok, err)
+		}
+	}
+	last := fragments[2]
+	if ok, err := receiver.reassemble(last); !ok || err != nil {
+		t.Fatalf("not reassembled: %v", err)
+	}
+	if !bytes.Equal(last.packet, want) || last.Type != path.NormalPacket || last.TTL != 200 {
+		t.Errorf("reassembled %v bytes, %v, TTL %v", len(last.packet), last.Type.ToString(), last.TTL)
+	}
+	if len(receiver.fragments) != 0 || device.GetMetrics().Reassembled != 1 {
+		t.Error("reassembly not finished")
+	}
+
+	bad := device.GetInboundElement()
+	bad.packet = make([]byte, path.EgHeaderLen+FragmentHeaderLen+10)
+	bad.packet[path.EgHeaderLen+4] = 3 // index 3 of 2
+	bad.packet[path.EgHeaderLen+5] = 2
+	bad.packet[path.EgHeaderLen+6] = uint8(path.NormalPacket)
+	if _, err := receiver.reassemble(bad); err == nil {
+		t.Error("accepted an index out of the count")
+	}
+}
+
+func TestICMPTooBig(t *testing.T) {
+	frame := tcpFrame(10, []byte{10, 0, 0, 5}, 80)
+	frame = append(frame, make([]byte, 1400)...)
+	ip := frame[18:]
+	if tap.MakeICMPTooBig(frame, 1000) != nil {
+		t.Error("answered a packet without DF")
+	}
+	ip[6] |= 0x40
+	reply := tap.MakeICMPTooBig(frame, 1000)
+	if len(reply) < 18+20+8+28 {
+		t.Fatalf("no reply to a packet with DF")
+	}
+	if !bytes.Equal(reply[0:6], frame[6:12]) || tap.GetVlanID(reply) != 10 {
+		t.Error("not sent back to the sender in its VLAN")
+	}
+	rip := reply[18:]
+	if !bytes.Equal(rip[16:20], ip[12:16]) || rip[20] != 3 || rip[21] != 4 {
+		t.Errorf("not a fragmentation needed to the sender: % x", rip[:24])
+	}
+	if mtu := binary.BigEndian.Uint16(rip[26:28]); mtu != 1000-18 {
+		t.Errorf("MTU %v", mtu)
+	}
+	if !bytes.Equal(rip[28:], ip[:28]) {
+		t.Error("the header of the packet is not quoted")
+	}
+}
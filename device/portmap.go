@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/portmap"
+)
+
+const (
+	PortMappingLifetime_Default = 3600 // seconds
+	PortMappingRetry            = time.Second * 60
+	PortMappingRenewMin         = time.Second * 30 // some routers grant less than we asked
+	PortMappingPriority         = 3                // in the endpoint_trylist, before the ExternalV4 the supernode sees
+)
+
+// CheckPortMapping validates EdgeConfig.DynamicRoute.SuperNode.PortMapping
+func CheckPortMapping(info mtypes.PortMappingInfo) error {
+	if !info.Enabled {
+		return nil
+	}
+	if err := portmap.CheckProtocols(info.Protocols); err != nil {
+		return err
+	}
+	if info.Gateway != "" && net.ParseIP(info.Gateway).To4() == nil {
+		return fmt.Errorf("PortMapping.Gateway must be an IPv4 address: %v", info.Gateway)
+	}
+	if info.Lifetime < 0 {
+		return fmt.Errorf("PortMapping.Lifetime must >= 0: %v", info.Lifetime)
+	}
+	return nil
+}
+
+// MappedAddress returns the external address that the router forwards to our port, nil if none
+func (device *Device) MappedAddress() *net.UDPAddr {
+	m, _ := device.portmapping.mapping.Load().(*portmap.Mapping)
+	if m == nil {
+		return nil
+	}
+	return m.External
+}
+
+// RoutinePortMapping keeps a mapping of our port on the router, renewed at half of its lifetime. Close deletes it.
+func (device *Device) RoutinePortMapping() {
+	info := device.EdgeConfig().DynamicRoute.SuperNode.PortMapping
+	if !device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode || !info.Enabled {
+		return
+	}
+	lifetime := mtypes.S2TD(info.Lifetime)
+	if info.Lifetime == 0 {
+		lifetime = mtypes.S2TD(PortMappingLifetime_Default)
+	}
+	device.portmapping.Lock()
+	device.portmapping.mapper = &portmap.Mapper{
+		Gateway:   net.ParseIP(info.Gateway),
+		Protocols: info.Protocols,
+	}
+	device.portmapping.Unlock()
+	var wait time.Duration
+	for {
+		select {
+		case <-device.done:
+			return
+		case <-time.After(wait):
+		}
+		wait = device.renewPortMapping(lifetime)
+	}
+}
+
+// renewPortMapping maps our port on the router or renews the mapping, and returns when to do it again
+func (device *Device) renewPortMapping(lifetime time.Duration) time.Duration {
+	device.portmapping.Lock()
+	defer device.portmapping.Unlock()
+	if device.portmapping.closed {
+		return PortMappingRetry
+	}
+	device.net.RLock()
+	port := int(device.net.port)
+	device.net.RUnlock()
+	mp := device.portmapping.mapper
+	old, _ := device.portmapping.mapping.Load().(*portmap.Mapping)
+	var m *portmap.Mapping
+	var err error
+	if old != nil && old.InternalPort == port {
+		m, err = mp.Renew(old, lifetime)
+	} else {
+		if old != nil {
+			mp.Delete(old) // the port changed with the bind
+		}
+		m, err = mp.Map(port, lifetime)
+	}
+	device.portmapping.mapping.Store(m)
+	if err != nil {
+		device.log.Errorf("PortMapping: %v", err)
+		return PortMappingRetry
+	}
+	if old == nil || old.External.String() != m.External.String() {
+		elog.Info(elog.Control, "Port mapped", "protocol", m.Protocol, "external", m.External.String(), "port", port, "lifetime", m.Lifetime.String())
+	}
+	if m.Lifetime/2 < PortMappingRenewMin {
+		return PortMappingRenewMin
+	}
+	return m.Lifetime / 2
+}
+
+// deletePortMapping removes our mapping from the router when the device closes
+func (device *Device) deletePortMapping() {
+	device.portmapping.Lock()
+	defer device.portmapping.Unlock()
+	device.portmapping.closed = true
+	m, _ := device.portmapping.mapping.Load().(*portmap.Mapping)
+	if m == nil {
+		return
+	}
+	if err := device.portmapping.mapper.Delete(m); err != nil {
+		device.log.Errorf("PortMapping: failed to delete %v: %v", m, err)
+	}
+	device.portmapping.mapping.Store((*portmap.Mapping)(nil))
+}
@@ -10,9 +10,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"net"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,6 +18,7 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
@@ -129,6 +128,10 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 		packet := buffer[:size]
 		msgType := path.Usage(packet[0])
 		msgTTL := uint8(packet[1])
+		if msgType == path.NATProbe || msgType == path.NATProbeReply {
+			device.process_nat_probe(packet, endpoint)
+			continue
+		}
 		msgType_wg := msgType
 		if msgType >= path.MessageTransportType {
 			msgType_wg = path.MessageTransportType
@@ -242,6 +245,11 @@ func (device *Device) RoutineDecryption(id int) {
 		)
 		if err != nil {
 			elem.packet = nil
+		} else if elem.Type&path.EgHeaderV2Flag != 0 {
+			elem.Type &^= path.EgHeaderV2Flag
+		} else if len(elem.packet) >= path.EgHeaderLenV1 {
+			// widen it in the space of the transport header, which is not needed anymore
+			elem.packet = path.FromV1(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent)
 		}
 		elem.Unlock()
 	}
@@ -467,17 +475,47 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			device.log.Errorf("Invalid EgHeader from peer %v", peer)
 			goto skip
 		}
-		EgHeader, _ = path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU) // EG header
+		if elem.Type == path.Fragment {
+			if ok, err := peer.reassemble(elem); !ok {
+				if err != nil {
+					device.log.Errorf("%v from peer %v", err, peer)
+				}
+				goto skip
+			}
+		}
+		EgHeader, _ = path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU) // EG header
 		src_nodeID = EgHeader.GetSrc()
 		dst_nodeID = EgHeader.GetDst()
 		packet_type = elem.Type
 		if !packet_type.IsValid_EgType() {
-			if device.LogLevel.LogTransit {
-				fmt.Printf("Transit: Invalid packet usage:%v ttl:%v, content %v PL:%v S:%v D:%v From:%v IP:%v\n", elem.Type.ToString(), elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet), src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString(), peer.endpoint.DstToString())
+			if elog.Enabled(elog.Transit, elog.LevelInfo) {
+				elog.Info(elog.Transit, "Invalid packet", "usage", elem.Type.ToString(), "ttl", elem.TTL, "content", base64.StdEncoding.EncodeToString([]byte(elem.packet)), "len", len(elem.packet), "src", src_nodeID, "dst", dst_nodeID, "peer", peer.ID, "endpoint", peer.GetEndpointDstStr())
 			}
 			goto skip
 		}
-		if device.IsSuperNode {
+		if device.IsSuperNode && packet_type.IsNormal() && device.RelayEnabled() {
+			// The edges only send it to us if their NhTable goes through the relay
+			switch {
+			case dst_nodeID == mtypes.NodeID_Broadcast:
+				should_transfer = true
+			case dst_nodeID.IsSpecial():
+				device.log.Errorf("received invalid dst_nodeID: %v S:%v From:%v IP:%v", dst_nodeID, src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
+				goto skip
+			case device.graph.Next(device.ID, dst_nodeID) != mtypes.NodeID_Invalid:
+				should_transfer = true
+				if len(elem.packet) > packet_type.FrameOffset() && !device.aclAllowed(src_nodeID, dst_nodeID, elem.packet[packet_type.FrameOffset():]) {
+					elog.Debug(elog.Transit, "Denied by the ACL, dropped", "src", src_nodeID, "dst", dst_nodeID, "peer", peer.ID)
+					should_transfer = false
+				}
+			default:
+				atomic.AddUint64(&device.counters.noRoute, 1)
+				device.log.Verbosef("No route to peer ID %v", dst_nodeID)
+			}
+			if should_transfer && !device.relayAllowed(len(elem.packet)) {
+				elog.Debug(elog.Transit, "Relay over its Bandwidth, dropped", "src", src_nodeID, "dst", dst_nodeID, "peer", peer.ID)
+				should_transfer = false
+			}
+		} else if device.IsSuperNode {
 			if packet_type.IsControl_Edge2Super() {
 				should_process = true
 			} else {
@@ -537,9 +575,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				if device.CheckNoDup(packet) {
 					should_transfer = true
 				} else {
-					if device.LogLevel.LogTransit {
-						fmt.Printf("Transit: Duplicate packet dropped. S:%v D:%v From:%v \n", src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID)
-					}
+					atomic.AddUint64(&device.counters.dupHits, 1)
+					elog.Info(elog.Transit, "Duplicate packet dropped", "src", src_nodeID, "dst", dst_nodeID, "peer", peer.ID)
 					goto skip
 				}
 			case device.ID:
@@ -551,7 +588,12 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			default:
 				if device.graph.Next(device.ID, dst_nodeID) != mtypes.NodeID_Invalid {
 					should_transfer = true
+					if packet_type.IsNormal() && len(elem.packet) > packet_type.FrameOffset() && !device.aclAllowed(src_nodeID, dst_nodeID, elem.packet[packet_type.FrameOffset():]) {
+						elog.Debug(elog.Transit, "Denied by the ACL, dropped", "src", src_nodeID, "dst", dst_nodeID, "peer", peer.ID)
+						should_transfer = false
+					}
 				} else {
+					atomic.AddUint64(&device.counters.noRoute, 1)
 					device.log.Verbosef("No route to peer ID %v", dst_nodeID)
 				}
 			}
@@ -559,6 +601,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		if should_transfer {
 			l2ttl := elem.TTL
 			if l2ttl == 0 {
+				atomic.AddUint64(&device.counters.ttlExpired, 1)
 				device.log.Verbosef("TTL is 0 %v", dst_nodeID)
 			} else {
 				l2ttl = l2ttl - 1
@@ -572,17 +615,19 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 				} else {
 					next_id := device.graph.Next(device.ID, dst_nodeID)
-					if next_id != mtypes.NodeID_Invalid {
-						device.peers.RLock()
-						peer_out = device.peers.IDMap[next_id]
-						device.peers.RUnlock()
-						if device.LogLevel.LogTransit {
-							fmt.Printf("Transit: Transfer From:%v Me:%v To:%v S:%v D:%v TTL:%v\n", peer.ID, device.ID, peer_out.ID, src_nodeID.ToString(), dst_nodeID.ToString(), l2ttl)
-						}
+					if packet_type.IsNormal() {
+						next_id = device.NextHopByFlow(dst_nodeID, elem.packet[packet_type.FrameOffset():])
+					}
+					device.peers.RLock()
+					peer_out = device.nextHopPeer(next_id)
+					device.peers.RUnlock()
+					if peer_out != nil {
+						elog.Info(elog.Transit, "Transfer", "peer", peer.ID, "me", device.ID, "to", peer_out.ID, "src", src_nodeID, "dst", dst_nodeID, "ttl", l2ttl)
 						go device.SendPacket(peer_out, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
 					} else {
-						if device.LogLevel.LogTransit {
-							fmt.Printf("Transit: No route to %v,usage:%v ttl:%v, content %v PL:%v S:%v D:%v From:%v IP:%v\n", dst_nodeID.ToString(), elem.Type.ToString(), elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet), src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString(), peer.endpoint.DstToString())
+						atomic.AddUint64(&device.counters.noRoute, 1)
+						if elog.Enabled(elog.Transit, elog.LevelInfo) {
+							elog.Info(elog.Transit, "No route", "usage", elem.Type.ToString(), "ttl", elem.TTL, "content", base64.StdEncoding.EncodeToString([]byte(elem.packet)), "len", len(elem.packet), "src", src_nodeID, "dst", dst_nodeID, "peer", peer.ID, "endpoint", peer.GetEndpointDstStr())
 						}
 					}
 				}
@@ -590,10 +635,10 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		}
 
 		if should_process {
-			if packet_type != path.NormalPacket {
-				if device.LogLevel.LogControl {
+			if !packet_type.IsNormal() {
+				if elog.Enabled(elog.Control, elog.LevelInfo) {
 					if peer.GetEndpointDstStr() != "" {
-						fmt.Printf("Control: Recv %v S:%v D:%v TTL:%v From:%v IP:%v\n", device.sprint_received(packet_type, elem.packet[path.EgHeaderLen:]), src_nodeID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
+						elog.Info(elog.Control, "Recv", "usage", packet_type.ToString(), "content", device.sprint_received(packet_type, elem.packet[path.EgHeaderLen:]), "src", src_nodeID, "dst", dst_nodeID, "ttl", elem.TTL, "peer", peer.ID, "endpoint", peer.GetEndpointDstStr())
 					}
 				}
 				err = device.process_received(packet_type, peer, elem.packet[path.EgHeaderLen:])
@@ -604,47 +649,62 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		}
 
 		if should_receive { // Write message to tap device
-			if packet_type == path.NormalPacket {
-				if len(elem.packet) <= path.EgHeaderLen+12 {
+			if packet_type.IsNormal() {
+				frame_offset := packet_type.FrameOffset()
+				if len(elem.packet) <= frame_offset+12 {
 					device.log.Errorf("Invalid Normal packet: Ethernet packet too small from peer %v", peer.ID.ToString())
 					goto skip
 				}
-				if device.LogLevel.LogNormal {
-					packet_len := len(elem.packet) - path.EgHeaderLen
-					fmt.Printf("Normal: Recv Len:%v S:%v D:%v TTL:%v From:%v IP:%v:\n", strconv.Itoa(packet_len), src_nodeID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
-					if device.LogLevel.DumpNormal {
-						packet := gopacket.NewPacket(elem.packet[path.EgHeaderLen:], layers.LayerTypeEthernet, gopacket.Default)
-						fmt.Println(packet.Dump())
+				vni := path.GetVNI(packet_type, elem.packet)
+				if elog.Enabled(elog.Normal, elog.LevelInfo) {
+					packet_len := len(elem.packet) - frame_offset
+					elog.Info(elog.Normal, "Recv", "len", packet_len, "src", src_nodeID, "dst", dst_nodeID, "vni", vni, "ttl", elem.TTL, "peer", peer.ID, "endpoint", peer.GetEndpointDstStr())
+					if elog.Enabled(elog.Normal, elog.LevelDebug) {
+						packet := gopacket.NewPacket(elem.packet[frame_offset:], layers.LayerTypeEthernet, gopacket.Default)
+						elog.Debug(elog.Normal, "Recv dump", "dump", packet.Dump())
 					}
 				}
-				src_macaddr := tap.GetSrcMacAddr(elem.packet[path.EgHeaderLen:])
-				if !tap.IsNotUnicast(src_macaddr) {
-					val, ok := device.l2fib.Load(src_macaddr)
-					if ok {
-						idtime := val.(*IdAndTime)
-						if idtime.ID != src_nodeID {
-							idtime.ID = src_nodeID
-							if device.LogLevel.LogInternal {
-								fmt.Printf("Internal: L2FIB [%v -> %v] updated.\n", src_macaddr.String(), src_nodeID)
-							}
-						}
-						idtime.Time = time.Now()
-					} else {
-						device.l2fib.Store(src_macaddr, &IdAndTime{
-							ID:   src_nodeID,
-							Time: time.Now(),
-						}) // Write to l2fib table
-						if device.LogLevel.LogInternal {
-							fmt.Printf("Internal: L2FIB [%v -> %v] added.\n", src_macaddr.String(), src_nodeID)
-						}
+				vn := device.GetVNet(vni)
+				if vn == nil || !vn.Allowed(src_nodeID) {
+					elog.Debug(elog.Normal, "VNI not served or node not allowed, dropped", "vni", vni, "src", src_nodeID, "peer", peer.ID)
+					goto skip
+				}
+				frame := elem.packet[frame_offset:]
+				if !device.aclAllowed(src_nodeID, device.ID, frame) {
+					elog.Debug(elog.Normal, "Denied by the ACL, dropped", "src", src_nodeID, "dst", device.ID, "peer", peer.ID)
+					goto skip
+				}
+				if !device.firewallAllowed(false, frame) {
+					elog.Debug(elog.Normal, "Dropped by the firewall", "vni", vni, "src", src_nodeID, "peer", peer.ID)
+					goto skip
+				}
+				pop, ok := device.VlanToTap(frame)
+				if !ok {
+					elog.Debug(elog.Normal, "VLAN not allowed, dropped", "vlan", tap.GetVlanID(frame), "src", src_nodeID, "peer", peer.ID)
+					goto skip
+				}
+				dst_key, src_key := GetL2FIBKey(vni, frame)
+				if tap.IsNotUnicast(dst_key.MAC) {
+					device.SnoopMcast(vn, src_nodeID, frame)
+				}
+				device.LearnNeighbor(vn, frame)
+				if !tap.IsNotUnicast(src_key.MAC) {
+					device.learnL2FIB(src_key, src_nodeID)
+				}
+				buf, offset := elem.packet, frame_offset
+				if pop {
+					if should_transfer { // the packet is being forwarded at the same time
+						buf = append([]byte{}, buf...)
 					}
+					tap.PopVlanTag(buf[offset:])
+					offset += tap.VlanTagLen
 				}
-				_, err = device.tap.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent+path.EgHeaderLen)
+				_, err = vn.tap.Write(buf, offset)
 				if err != nil && !device.isClosed() {
 					device.log.Errorf("Failed to write packet to TUN device: %v", err)
 				}
-				if len(peer.queue.inbound.c) == 0 {
-					err = device.tap.device.Flush()
+				if vn.VNI != 0 || len(peer.queue.inbound.c) == 0 { // the batch is flushed on the main tap only
+					err = vn.tap.Flush()
 					if err != nil {
 						peer.device.log.Errorf("Unable to flush packets: %v", err)
 					}
@@ -17,13 +17,14 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
-	"github.com/KusakabeSi/EtherGuard-VPN/tap"
 	"github.com/golang-jwt/jwt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -40,32 +41,30 @@ func (device *Device) SendPacket(peer *Peer, usage path.Usage, ttl uint8, packet
 	} else if peer.endpoint == nil {
 		return
 	}
-	if usage == path.NormalPacket && len(packet)-path.EgHeaderLen <= 12 {
-		if device.LogLevel.LogNormal {
-			fmt.Printf("Normal: Send Len:%v Invalid packet: Ethernet packet too small\n", len(packet)-path.EgHeaderLen)
-		}
+	if usage.IsNormal() && len(packet)-usage.FrameOffset() <= 12 {
+		elog.Info(elog.Normal, "Send invalid packet: Ethernet packet too small", "len", len(packet)-usage.FrameOffset())
 		return
 	}
 
-	if device.LogLevel.LogNormal {
-		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
-		if usage == path.NormalPacket && EgHeader.GetSrc() == device.ID {
+	if elog.Enabled(elog.Normal, elog.LevelInfo) {
+		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
+		if usage.IsNormal() && EgHeader.GetSrc() == device.ID {
 			dst_nodeID := EgHeader.GetDst()
-			packet_len := len(packet) - path.EgHeaderLen
-			fmt.Printf("Normal: Send Len:%v S:%v D:%v TTL:%v To:%v IP:%v:\n", packet_len, device.ID.ToString(), dst_nodeID.ToString(), ttl, peer.ID.ToString(), peer.GetEndpointDstStr())
-			if device.LogLevel.DumpNormal {
-				packet_dump := gopacket.NewPacket(packet[path.EgHeaderLen:], layers.LayerTypeEthernet, gopacket.Default)
-				fmt.Println(packet_dump.Dump())
+			packet_len := len(packet) - usage.FrameOffset()
+			elog.Info(elog.Normal, "Send", "len", packet_len, "src", device.ID, "dst", dst_nodeID, "vni", path.GetVNI(usage, packet), "ttl", ttl, "peer", peer.ID, "endpoint", peer.GetEndpointDstStr())
+			if elog.Enabled(elog.Normal, elog.LevelDebug) {
+				packet_dump := gopacket.NewPacket(packet[usage.FrameOffset():], layers.LayerTypeEthernet, gopacket.Default)
+				elog.Debug(elog.Normal, "Send dump", "dump", packet_dump.Dump())
 			}
 		}
 	}
-	if device.LogLevel.LogControl {
-		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
-		if usage != path.NormalPacket {
+	if elog.Enabled(elog.Control, elog.LevelInfo) {
+		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
+		if !usage.IsNormal() {
 			if peer.GetEndpointDstStr() != "" {
 				src_nodeID := EgHeader.GetSrc()
 				dst_nodeID := EgHeader.GetDst()
-				fmt.Printf("Control: Send %v S:%v D:%v TTL:%v To:%v IP:%v\n", device.sprint_received(usage, packet[path.EgHeaderLen:]), src_nodeID.ToString(), dst_nodeID.ToString(), ttl, peer.ID.ToString(), peer.GetEndpointDstStr())
+				elog.Info(elog.Control, "Send", "usage", usage.ToString(), "content", device.sprint_received(usage, packet[path.EgHeaderLen:]), "src", src_nodeID, "dst", dst_nodeID, "ttl", ttl, "peer", peer.ID, "endpoint", peer.GetEndpointDstStr())
 			}
 		}
 	}
@@ -75,28 +74,34 @@ func (device *Device) SendPacket(peer *Peer, usage path.Usage, ttl uint8, packet
 	elem.Type = usage
 	elem.TTL = ttl
 	elem.packet = elem.buffer[offset : offset+len(packet)]
-	device.chan_send_packet <- &packet_send_params{
+	params := &packet_send_params{
 		peer: peer,
 		elem: elem,
 	}
+	if usage.IsNormal() {
+		device.chan_send_packet <- params
+	} else {
+		device.chan_send_control <- params
+	}
 }
 
+// RoutineSendPacket stages the packets to the peers. The control messages go first,
+// and the NormalPacket go through the shapers if there are any.
 func (device *Device) RoutineSendPacket() {
-	var elem *QueueOutboundElement
 	for {
-		if elem != nil {
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
+		var params *packet_send_params
+		select {
+		case params = <-device.chan_send_control:
+		default:
+			select {
+			case params = <-device.chan_send_control:
+			case params = <-device.chan_send_packet:
+			}
 		}
-		elem = device.NewOutboundElement()
-		params := <-device.chan_send_packet
-		elem := params.elem
-		peer := params.peer
-		if peer.isRunning.Get() {
-			peer.StagePacket(elem)
-			elem = nil
-			peer.SendStagedPackets()
+		if params.elem.Type.IsNormal() && params.peer.isRunning.Get() && device.shapePacket(params, false) {
+			continue
 		}
+		device.stagePacket(params)
 	}
 }
 
@@ -108,7 +113,7 @@ func (device *Device) BoardcastPacket(skip_list map[mtypes.Vertex]bool, usage pa
 	device.peers.RLock()
 	for node_id, should_send := range send_list {
 		if should_send {
-			peer_out := device.peers.IDMap[node_id]
+			peer_out := device.nextHopPeer(node_id)
 			go device.SendPacket(peer_out, usage, ttl, packet, offset)
 		}
 	}
@@ -119,8 +124,8 @@ func (device *Device) SpreadPacket(skip_list map[mtypes.Vertex]bool, usage path.
 	device.peers.RLock()
 	for peer_id, peer_out := range device.peers.IDMap {
 		if _, ok := skip_list[peer_id]; ok {
-			if device.LogLevel.LogTransit && peer_out.endpoint != nil {
-				fmt.Printf("Transit: Skipped Spread Packet packet Me:%v To:%d  TTL:%v\n", device.ID, peer_out.ID, ttl)
+			if peer_out.endpoint != nil {
+				elog.Info(elog.Transit, "Skipped spread packet", "me", device.ID, "to", peer_out.ID, "ttl", ttl)
 			}
 			continue
 		}
@@ -131,17 +136,16 @@ func (device *Device) SpreadPacket(skip_list map[mtypes.Vertex]bool, usage path.
 
 func (device *Device) TransitBoardcastPacket(src_nodeID mtypes.Vertex, in_id mtypes.Vertex, usage path.Usage, ttl uint8, packet []byte, offset int) {
 	node_boardcast_list, errs := device.graph.GetBoardcastThroughList(device.ID, in_id, src_nodeID)
-	if device.LogLevel.LogControl {
-		for _, err := range errs {
-			fmt.Printf("Internal: Can't boardcast: %v", err)
-		}
+	for _, err := range errs {
+		elog.Info(elog.Internal, "Can't boardcast", "err", err)
 	}
 	device.peers.RLock()
 	for peer_id := range node_boardcast_list {
-		peer_out := device.peers.IDMap[peer_id]
-		if device.LogLevel.LogTransit {
-			fmt.Printf("Transit: Transfer From:%v Me:%v To:%v S:%v D:%v TTL:%v\n", in_id, device.ID, peer_out.ID, src_nodeID.ToString(), peer_out.ID.ToString(), ttl)
+		peer_out := device.nextHopPeer(peer_id)
+		if peer_out == nil {
+			continue
 		}
+		elog.Info(elog.Transit, "Transfer", "peer", in_id, "me", device.ID, "to", peer_out.ID, "src", src_nodeID, "dst", peer_out.ID, "ttl", ttl)
 		go device.SendPacket(peer_out, usage, ttl, packet, offset)
 	}
 	device.peers.RUnlock()
@@ -149,7 +153,7 @@ func (device *Device) TransitBoardcastPacket(src_nodeID mtypes.Vertex, in_id mty
 
 func (device *Device) Send2Super(usage path.Usage, ttl uint8, packet []byte, offset int) {
 	device.peers.RLock()
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
 		for _, peer_out := range device.peers.SuperPeer {
 			/*if device.LogTransit {
 				fmt.Printf("Send to supernode %s\n", peer_out.endpoint.DstToString())
@@ -263,17 +267,20 @@ func (device *Device) sprint_received(msg_type path.Usage, body []byte) string {
 	}
 }
 
-func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, request_reply int) ([]byte, path.Usage, uint8, error) {
-	body, err := mtypes.GetByte(&mtypes.PingMsg{
+// GeneratePingPacket makes a ping. request_id 0 means it is not counted by the packet loss of the receiver.
+func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, request_id uint32, request_reply int) ([]byte, path.Usage, uint8, error) {
+	body, err := device.EncodeMsg(&mtypes.PingMsg{
+		RequestID:    request_id,
 		Src_nodeID:   src_nodeID,
 		Time:         device.graph.GetCurrentTime(),
 		RequestReply: request_reply,
+		WireCodecs:   mtypes.WireCodecsSupported,
 	})
 	if err != nil {
 		return nil, path.PingPacket, 0, err
 	}
 	buf := make([]byte, path.EgHeaderLen+len(body))
-	header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 	if err != nil {
 		return nil, path.PingPacket, 0, err
 	}
@@ -285,7 +292,7 @@ func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, request_reply
 
 func (device *Device) SendPing(peer *Peer, times int, replies int, interval float64) {
 	for i := 0; i < times; i++ {
-		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, replies)
+		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, 0, replies)
 		device.SendPacket(peer, usage, ttl, packet, MessageTransportOffsetContent)
 		time.Sleep(mtypes.S2TD(interval))
 	}
@@ -301,6 +308,18 @@ func compareVersion(v1 string, v2 string) bool {
 	return v1 == v2
 }
 
+// hasWideNodeID reports whether any peer has a node ID that needs a version 2 EgHeader
+func (device *Device) hasWideNodeID() bool {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for id := range device.peers.IDMap {
+		if id > mtypes.NodeID_MaxNarrow {
+			return true
+		}
+	}
+	return false
+}
+
 func (device *Device) server_process_RegisterMsg(peer *Peer, content mtypes.RegisterMsg) error {
 	ServerUpdateMsg := mtypes.ServerUpdateMsg{
 		Node_id: peer.ID,
@@ -316,21 +335,38 @@ func (device *Device) server_process_RegisterMsg(peer *Peer, content mtypes.Regi
 			Params:  fmt.Sprintf("Your nodeID: %v is not match with registered nodeID: %v", content.Node_id, peer.ID),
 		}
 	}
-	if !compareVersion(content.Version, device.Version) {
+	peer.SetWireCodecs(content.WireCodecs)
+	// Edges with a protocol version can run a different release, the older ones must run ours.
+	if content.ProtocolVersion == 0 && !compareVersion(content.Version, device.Version) {
 		ServerUpdateMsg = mtypes.ServerUpdateMsg{
 			Node_id: peer.ID,
 			Action:  mtypes.ThrowError,
 			Code:    int(syscall.ENOSYS),
 			Params:  fmt.Sprintf("Your version: \"%v\" is not compatible with our version: \"%v\"", content.Version, device.Version),
 		}
+	} else if content.ProtocolVersion != 0 && !mtypes.ProtocolCompatible(content.ProtocolVersion) {
+		ServerUpdateMsg = mtypes.ServerUpdateMsg{
+			Node_id: peer.ID,
+			Action:  mtypes.ThrowError,
+			Code:    int(syscall.ENOSYS),
+			Params:  fmt.Sprintf("Your protocol version: %v is not compatible with our protocol versions: %v to %v", content.ProtocolVersion, mtypes.ProtocolVersionMin, mtypes.ProtocolVersion),
+		}
+	}
+	if content.EgHeaderVersion < 2 && device.hasWideNodeID() {
+		ServerUpdateMsg = mtypes.ServerUpdateMsg{
+			Node_id: peer.ID,
+			Action:  mtypes.ThrowError,
+			Code:    int(syscall.ENOSYS),
+			Params:  fmt.Sprintf("This network has node IDs above %v, your version: \"%v\" only supports 16 bit node IDs", mtypes.NodeID_MaxNarrow, content.Version),
+		}
 	}
 	if ServerUpdateMsg.Action != mtypes.NoAction {
-		body, err := mtypes.GetByte(&ServerUpdateMsg)
+		body, err := device.EncodeMsgFor(peer, &ServerUpdateMsg)
 		if err != nil {
 			return err
 		}
 		buf := make([]byte, path.EgHeaderLen+len(body))
-		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 		header.SetSrc(device.ID)
 		copy(buf[path.EgHeaderLen:], body)
 		header.SetDst(mtypes.NodeID_SuperNode)
@@ -347,58 +383,76 @@ func (device *Device) server_process_Pong(peer *Peer, content mtypes.PongMsg) er
 }
 
 func (device *Device) process_ping(peer *Peer, content mtypes.PingMsg) error {
+	if content.ProbeSize > 0 {
+		return device.process_pmtu_probe(peer, content)
+	}
+	peer.SetWireCodecs(content.WireCodecs)
 	Timediff := device.graph.GetCurrentTime().Sub(content.Time).Seconds()
 	NewTimediff := peer.SingleWayLatency.Push(Timediff)
+	peer.PingLoss.Push(content.RequestID)
+	if device.EdgeConfig().DynamicRoute.MeasureThroughput && content.RequestID != 0 {
+		peer.Throughput.Sample(atomic.LoadUint64(&peer.stats.rxBytes))
+	}
 
 	PongMSG := mtypes.PongMsg{
+		RequestID:      content.RequestID,
 		Src_nodeID:     content.Src_nodeID,
 		Dst_nodeID:     device.ID,
 		Timediff:       NewTimediff,
-		TimeToAlive:    device.EdgeConfig.DynamicRoute.PeerAliveTimeout,
-		AdditionalCost: device.EdgeConfig.DynamicRoute.AdditionalCost,
+		TimeToAlive:    device.EdgeConfig().DynamicRoute.PeerAliveTimeout,
+		AdditionalCost: device.EdgeConfig().DynamicRoute.AdditionalCost,
+		Loss:           peer.PingLoss.GetVal(),
 	}
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P && time.Now().After(device.graph.NhTableExpire) {
+	if device.EdgeConfig().DynamicRoute.MeasureThroughput {
+		PongMSG.Throughput = peer.Throughput.GetVal()
+	}
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P && time.Now().After(device.graph.NhTableExpire) {
 		device.graph.UpdateLatencyMulti([]mtypes.PongMsg{PongMSG}, true, false)
 	}
-	body, err := mtypes.GetByte(&PongMSG)
+	body, err := device.EncodeMsg(&PongMSG)
 	if err != nil {
 		return err
 	}
 	buf := make([]byte, path.EgHeaderLen+len(body))
-	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 	header.SetSrc(device.ID)
 	copy(buf[path.EgHeaderLen:], body)
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
 		header.SetDst(mtypes.NodeID_SuperNode)
 		device.Send2Super(path.PongPacket, 0, buf, MessageTransportOffsetContent)
 	}
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		header.SetDst(mtypes.NodeID_Spread)
-		device.SpreadPacket(make(map[mtypes.Vertex]bool), path.PongPacket, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+		device.SpreadPacket(make(map[mtypes.Vertex]bool), path.PongPacket, device.EdgeConfig().DefaultTTL, buf, MessageTransportOffsetContent)
 	}
 	go device.SendPing(peer, content.RequestReply, 0, 3)
 	return nil
 }
 
 func (device *Device) process_pong(peer *Peer, content mtypes.PongMsg) error {
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if content.ProbeSize > 0 {
+		peer.pmtuAck(content)
+		return nil
+	}
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		if time.Now().After(device.graph.NhTableExpire) {
-			device.graph.UpdateLatency(content.Src_nodeID, content.Dst_nodeID, content.Timediff, device.EdgeConfig.DynamicRoute.PeerAliveTimeout, content.AdditionalCost, true, false)
+			content.TimeToAlive = device.EdgeConfig().DynamicRoute.PeerAliveTimeout
+			device.graph.UpdateLatencyMulti([]mtypes.PongMsg{content}, true, false)
 		}
 		if !peer.AskedForNeighbor {
 			QueryPeerMsg := mtypes.QueryPeerMsg{
 				Request_ID: uint32(device.ID),
 			}
-			body, err := mtypes.GetByte(&QueryPeerMsg)
+			body, err := device.EncodeMsg(&QueryPeerMsg)
 			if err != nil {
 				return err
 			}
 			buf := make([]byte, path.EgHeaderLen+len(body))
-			header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+			header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 			header.SetSrc(device.ID)
 			header.SetDst(mtypes.NodeID_Spread)
 			copy(buf[path.EgHeaderLen:], body)
-			device.SendPacket(peer, path.QueryPeer, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+			device.SendPacket(peer, path.QueryPeer, device.EdgeConfig().DefaultTTL, buf, MessageTransportOffsetContent)
 		}
 	}
 	return nil
@@ -406,11 +460,9 @@ func (device *Device) process_pong(peer *Peer, content mtypes.PongMsg) error {
 
 func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error {
 	var send_signal bool
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.Peer.Load().(string) == State_hash {
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Same Hash, skip download PeerInfo")
-			}
+			elog.Info(elog.Control, "Same hash, skip download PeerInfo")
 			return nil
 		}
 		var peer_infos mtypes.API_Peers
@@ -418,7 +470,7 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 		client := http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/peerinfo" ////////////////////////////////////////////////////////////////////////////////////////////////
+		downloadurl := device.SuperEdgeAPIUrl() + "/edge/peerinfo" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -429,9 +481,7 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
 		q.Add("State", State_hash)
 		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download PeerInfo from :" + req.URL.RequestURI())
-		}
+		elog.Info(elog.Control, "Download PeerInfo", "url", req.URL.RequestURI())
 		resp, err := client.Do(req)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -447,9 +497,7 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 			device.log.Errorf("Control: Download peerinfo failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download peerinfo result :" + string(allbytes))
-		}
+		elog.Debug(elog.Control, "Download PeerInfo result", "body", string(allbytes))
 		if err := json.Unmarshal(allbytes, &peer_infos); err != nil {
 			device.log.Errorf("JSON decode error:", err.Error())
 			return err
@@ -486,14 +534,12 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 				if len(peerinfo.Connurl.ExternalV4)+len(peerinfo.Connurl.ExternalV6)+len(peerinfo.Connurl.LocalV4)+len(peerinfo.Connurl.LocalV6) == 0 {
 					continue
 				}
-				if device.LogLevel.LogControl {
-					fmt.Println("Control: Add new peer to local ID:" + peerinfo.NodeID.ToString() + " PubKey:" + PubKey)
-				}
+				elog.Info(elog.Control, "Add new peer", "peer", peerinfo.NodeID, "pubkey", PubKey)
 				if device.graph.Weight(device.ID, peerinfo.NodeID, false) == mtypes.Infinity { // add node to graph
-					device.graph.UpdateLatency(device.ID, peerinfo.NodeID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
+					device.graph.UpdateLatency(device.ID, peerinfo.NodeID, mtypes.Infinity, 0, device.EdgeConfig().DynamicRoute.AdditionalCost, true, false)
 				}
 				if device.graph.Weight(peerinfo.NodeID, device.ID, false) == mtypes.Infinity { // add node to graph
-					device.graph.UpdateLatency(peerinfo.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
+					device.graph.UpdateLatency(peerinfo.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig().DynamicRoute.AdditionalCost, true, false)
 				}
 				thepeer, err = device.NewPeer(sk, peerinfo.NodeID, false, 0)
 				if err != nil {
@@ -510,7 +556,7 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 				thepeer.SetPSK(pk)
 			}
 
-			thepeer.endpoint_trylist.UpdateSuper(*peerinfo.Connurl, !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP, device.EdgeConfig.AfPrefer)
+			thepeer.endpoint_trylist.UpdateSuper(*peerinfo.Connurl, !device.EdgeConfig().DynamicRoute.SuperNode.SkipLocalIP, device.EdgeConfig().AfPrefer)
 			if !thepeer.IsPeerAlive() {
 				//Peer died, try to switch to this new endpoint
 				send_signal = true
@@ -525,20 +571,18 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 }
 
 func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) error {
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.NhTable.Load().(string) == State_hash {
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Same Hash, skip download nhTable")
-			}
+			elog.Info(elog.Control, "Same hash, skip download NhTable")
 			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
 			return nil
 		}
-		var NhTable mtypes.NextHopTable
+		var NhTable mtypes.API_NhTable
 		// Download from supernode
 		client := &http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/nhtable" ////////////////////////////////////////////////////////////////////////////////////////////////
+		downloadurl := device.SuperEdgeAPIUrl() + "/edge/nhtable" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -548,10 +592,9 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 		q.Add("NodeID", device.ID.ToString())
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
 		q.Add("State", State_hash)
+		q.Add("ECMP", "true")
 		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download NhTable from :" + req.URL.RequestURI())
-		}
+		elog.Info(elog.Control, "Download NhTable", "url", req.URL.RequestURI())
 		resp, err := client.Do(req)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -567,25 +610,32 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 			device.log.Errorf("Control: Download NhTable failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download NhTable result :" + string(allbytes))
+		elog.Debug(elog.Control, "Download NhTable result", "body", string(allbytes))
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(allbytes, &fields); err != nil {
+			device.log.Errorf("JSON decode error:", err.Error())
+			return err
+		}
+		if _, has := fields["NhTable"]; has {
+			err = json.Unmarshal(allbytes, &NhTable)
+		} else { // the supernode doesn't support ECMP, it's a plain NextHopTable
+			err = json.Unmarshal(allbytes, &NhTable.NhTable)
 		}
-		if err := json.Unmarshal(allbytes, &NhTable); err != nil {
+		if err != nil {
 			device.log.Errorf("JSON decode error:", err.Error())
 			return err
 		}
-		device.graph.SetNHTable(NhTable)
+		device.graph.SetNHTable(NhTable.NhTable)
+		device.graph.SetNHSets(NhTable.NhSets)
 		device.state_hashes.NhTable.Store(State_hash)
 	}
 	return nil
 }
 
 func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string) error {
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.SuperParam.Load().(string) == State_hash {
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Same Hash, skip download SuperParams")
-			}
+			elog.Info(elog.Control, "Same hash, skip download SuperParams")
 			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
 			return nil
 		}
@@ -593,7 +643,7 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 		client := &http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/superparams" ////////////////////////////////////////////////////////////////////////////////////////////////
+		downloadurl := device.SuperEdgeAPIUrl() + "/edge/superparams" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -604,9 +654,7 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
 		q.Add("State", State_hash)
 		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download SuperParams from :" + req.URL.RequestURI())
-		}
+		elog.Info(elog.Control, "Download SuperParams", "url", req.URL.RequestURI())
 		resp, err := client.Do(req)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -622,9 +670,7 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 			device.log.Errorf("Control: Download SuperParams failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download SuperParams result :" + string(allbytes))
-		}
+		elog.Debug(elog.Control, "Download SuperParams result", "body", string(allbytes))
 		if err := json.Unmarshal(allbytes, &SuperParams); err != nil {
 			device.log.Errorf("JSON decode error:", err.Error())
 			return err
@@ -641,29 +687,47 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 			device.log.Errorf("SuperParams.HttpPostInterval < 0: %v, please check the config of the supernode", SuperParams.HttpPostInterval)
 			return fmt.Errorf("SuperParams.HttpPostInterval < 0: %v, please check the config of the supernode", SuperParams.HttpPostInterval)
 		}
+		if err := CheckACL(SuperParams.ACL); err != nil {
+			device.log.Errorf("SuperParams.ACL: %v, please check the config of the supernode", err)
+			return err
+		}
 
-		device.EdgeConfig.DynamicRoute.PeerAliveTimeout = SuperParams.PeerAliveTimeout
-		device.EdgeConfig.DynamicRoute.SendPingInterval = SuperParams.SendPingInterval
+		device.UpdateEdgeConfig(func(econfig *mtypes.EdgeConfig) {
+			econfig.DynamicRoute.PeerAliveTimeout = SuperParams.PeerAliveTimeout
+			econfig.DynamicRoute.SendPingInterval = SuperParams.SendPingInterval
+			if SuperParams.AdditionalCost >= 0 {
+				econfig.DynamicRoute.AdditionalCost = SuperParams.AdditionalCost
+			}
+		})
 		device.SuperConfig.HttpPostInterval = SuperParams.HttpPostInterval
 		device.SuperConfig.DampingFilterRadius = SuperParams.DampingFilterRadius
+		device.SuperConfig.NATTraversal.DetectPort = SuperParams.NATDetectPort
+		device.SetACL(SuperParams.ACL)
 		device.Chan_SendPingStart <- struct{}{}
 		device.Chan_HttpPostStart <- struct{}{}
-		if SuperParams.AdditionalCost >= 0 {
-			device.EdgeConfig.DynamicRoute.AdditionalCost = SuperParams.AdditionalCost
-		}
 
 		device.state_hashes.SuperParam.Store(State_hash)
 	}
 	return nil
 }
 
+func (device *Device) SuperEdgeAPIUrl() string {
+	return device.super_edgeapi.Load().(string)
+}
+
 func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerUpdateMsg) error {
 	if peer.ID != mtypes.NodeID_SuperNode {
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Ignored UpdateErrorMsg. Not from supernode.")
-		}
+		elog.Info(elog.Control, "Ignored UpdateErrorMsg. Not from supernode", "peer", peer.ID)
 		return nil
 	}
+	if mtypes.WireCodecsSupported.Has(content.WireCodec) {
+		atomic.StoreUint32(&device.wire_codec, uint32(content.WireCodec))
+	}
+	// Only the leader of a supernode cluster pushes updates, follow it.
+	if peer.EdgeAPIUrl != "" && peer.EdgeAPIUrl != device.SuperEdgeAPIUrl() {
+		elog.Info(elog.Control, "Switch EdgeAPI", "url", peer.EdgeAPIUrl)
+		device.super_edgeapi.Store(peer.EdgeAPIUrl)
+	}
 
 	switch content.Action {
 	case mtypes.Shutdown:
@@ -681,6 +745,8 @@ func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerU
 		return device.process_UpdatePeerMsg(peer, content.Params)
 	case mtypes.UpdateSuperParams:
 		return device.process_UpdateSuperParamsMsg(peer, content.Params)
+	case mtypes.PunchHole:
+		return device.process_PunchHoleMsg(content.Params)
 	default:
 		device.log.Errorf("Unknown Action: %v", content.ToString())
 	}
@@ -688,10 +754,10 @@ func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerU
 }
 
 func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error { //Send all my peers to all my peers
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		device.peers.RLock()
 		for pubkey, peer := range device.peers.keyMap {
-			if peer.ID >= mtypes.NodeID_Special {
+			if peer.ID.IsSpecial() {
 				continue
 			}
 			if peer.endpoint == nil {
@@ -711,17 +777,17 @@ func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error
 				ConnURL:    peer.endpoint.DstToString(),
 			}
 			peer.handshake.mutex.RUnlock()
-			body, err := mtypes.GetByte(response)
+			body, err := device.EncodeMsg(&response)
 			if err != nil {
 				device.log.Errorf("Error at receivesendproc.go line221: ", err)
 				continue
 			}
 			buf := make([]byte, path.EgHeaderLen+len(body))
-			header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+			header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 			header.SetDst(mtypes.NodeID_Spread)
 			header.SetSrc(device.ID)
 			copy(buf[path.EgHeaderLen:], body)
-			device.SpreadPacket(make(map[mtypes.Vertex]bool), path.BroadcastPeer, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+			device.SpreadPacket(make(map[mtypes.Vertex]bool), path.BroadcastPeer, device.EdgeConfig().DefaultTTL, buf, MessageTransportOffsetContent)
 		}
 		device.peers.RUnlock()
 	}
@@ -729,7 +795,7 @@ func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error
 }
 
 func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.BoardcastPeerMsg) (err error) {
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		var pk NoisePublicKey
 		if content.Request_ID == uint32(device.ID) {
 			peer.AskedForNeighbor = true
@@ -740,14 +806,12 @@ func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.Boardc
 		copy(pk[:], content.PubKey[:])
 		thepeer := device.LookupPeer(pk)
 		if thepeer == nil { //not exist in local
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Add new peer to local ID:" + content.NodeID.ToString() + " PubKey:" + pk.ToString())
-			}
+			elog.Info(elog.Control, "Add new peer", "peer", content.NodeID, "pubkey", pk.ToString())
 			if device.graph.Weight(device.ID, content.NodeID, false) == mtypes.Infinity { // add node to graph
-				device.graph.UpdateLatency(device.ID, content.NodeID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
+				device.graph.UpdateLatency(device.ID, content.NodeID, mtypes.Infinity, 0, device.EdgeConfig().DynamicRoute.AdditionalCost, true, false)
 			}
 			if device.graph.Weight(content.NodeID, device.ID, false) == mtypes.Infinity { // add node to graph
-				device.graph.UpdateLatency(content.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
+				device.graph.UpdateLatency(content.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig().DynamicRoute.AdditionalCost, true, false)
 			}
 			thepeer, err = device.NewPeer(pk, content.NodeID, false, 0)
 			if err != nil {
@@ -765,15 +829,15 @@ func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.Boardc
 }
 
 func (device *Device) RoutineTryReceivedEndpoint() {
-	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	if !(device.EdgeConfig().DynamicRoute.P2P.UseP2P || device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
-	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.ConnNextTry)
+	timeout := mtypes.S2TD(device.EdgeConfig().DynamicRoute.ConnNextTry)
 	for {
 		NextRun := false
 		<-device.event_tryendpoint
 		for _, thepeer := range device.peers.IDMap {
-			if thepeer.LastPacketReceivedAdd1Sec.Load().(*time.Time).Add(mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout)).After(time.Now()) {
+			if thepeer.LastPacketReceivedAdd1Sec.Load().(*time.Time).Add(mtypes.S2TD(device.EdgeConfig().DynamicRoute.PeerAliveTimeout)).After(time.Now()) {
 				//Peer alives
 				continue
 			} else {
@@ -784,7 +848,7 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 				if thepeer.StaticConn {
 					continue
 				}
-				err := thepeer.SetEndpointFromConnURL(connurl, device.enabledAf, device.EdgeConfig.AfPrefer, thepeer.StaticConn) //trying to bind first url in the list and wait ConnNextTry seconds
+				err := thepeer.SetEndpointFromConnURL(connurl, device.enabledAf, device.EdgeConfig().AfPrefer, thepeer.StaticConn) //trying to bind first url in the list and wait ConnNextTry seconds
 				if err != nil {
 					device.log.Errorf("Bind " + connurl + " failed!")
 					thepeer.endpoint_trylist.Delete(connurl)
@@ -792,10 +856,8 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 				}
 				if FastTry {
 					NextRun = true
-					if device.LogLevel.LogControl {
-						fmt.Printf("Control: First try for peer %v at endpoint %v, sending hole-punching ping\n", thepeer.ID.ToString(), connurl)
-					}
-					go device.SendPing(thepeer, int(device.EdgeConfig.DynamicRoute.ConnNextTry+1), 1, 1)
+					elog.Info(elog.Control, "First try for peer, sending hole-punching ping", "peer", thepeer.ID, "endpoint", connurl)
+					go device.SendPing(thepeer, int(device.EdgeConfig().DynamicRoute.ConnNextTry+1), 1, 1)
 				}
 
 			}
@@ -809,9 +871,7 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 			}
 		}
 		time.Sleep(timeout)
-		if device.LogLevel.LogInternal {
-			fmt.Printf("Internal: RoutineSetEndpoint: NextRun:%v\n", NextRun)
-		}
+		elog.Debug(elog.Internal, "RoutineSetEndpoint", "next_run", NextRun)
 		if NextRun {
 			device.event_tryendpoint <- struct{}{}
 		}
@@ -819,63 +879,63 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 }
 
 func (device *Device) RoutineDetectOfflineAndTryNextEndpoint() {
-	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	if !(device.EdgeConfig().DynamicRoute.P2P.UseP2P || device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
-	if device.EdgeConfig.DynamicRoute.TimeoutCheckInterval == 0 {
+	if device.EdgeConfig().DynamicRoute.TimeoutCheckInterval == 0 {
 		return
 	}
-	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.TimeoutCheckInterval)
 	for {
 		device.event_tryendpoint <- struct{}{}
-		time.Sleep(timeout)
+		// Read it every time, it may be changed by a config reload
+		time.Sleep(mtypes.S2TD(device.EdgeConfig().DynamicRoute.TimeoutCheckInterval))
 	}
 }
 
 func (device *Device) RoutineSendPing(startchan chan struct{}) {
-	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	if !(device.EdgeConfig().DynamicRoute.P2P.UseP2P || device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
 	var waitchan <-chan time.Time
 	startchan <- struct{}{}
 	for {
-		if device.EdgeConfig.DynamicRoute.SendPingInterval > 0 {
-			waitchan = time.After(mtypes.S2TD(device.EdgeConfig.DynamicRoute.SendPingInterval))
+		if device.EdgeConfig().DynamicRoute.SendPingInterval > 0 {
+			waitchan = time.After(mtypes.S2TD(device.EdgeConfig().DynamicRoute.SendPingInterval))
 		} else {
 			waitchan = make(<-chan time.Time)
 		}
 		select {
 		case <-startchan:
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Start RoutineSendPing()")
-			}
+			elog.Info(elog.Control, "Start RoutineSendPing()")
 			for len(startchan) > 0 {
 				<-startchan
 			}
 		case <-waitchan:
 		}
-		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, 0)
+		seq := atomic.AddUint32(&device.ping_seq, 1)
+		if seq == 0 {
+			seq = atomic.AddUint32(&device.ping_seq, 1)
+		}
+		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, seq, 0)
 		device.SpreadPacket(make(map[mtypes.Vertex]bool), usage, ttl, packet, MessageTransportOffsetContent)
 	}
 }
 
 func (device *Device) RoutineRegister(startchan chan struct{}) {
-	if !(device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	if !(device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
 	var waitchan <-chan time.Time
 	startchan <- struct{}{}
 	for {
-		if device.EdgeConfig.DynamicRoute.SendPingInterval > 0 {
-			waitchan = time.After(mtypes.S2TD(device.EdgeConfig.DynamicRoute.SendPingInterval))
+		if device.EdgeConfig().DynamicRoute.SendPingInterval > 0 {
+			waitchan = time.After(mtypes.S2TD(device.EdgeConfig().DynamicRoute.SendPingInterval))
 		} else {
 			waitchan = time.After(8 * time.Second)
 		}
 		select {
 		case <-startchan:
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Start RoutineRegister()")
-			}
+			elog.Info(elog.Control, "Start RoutineRegister()")
 			for len(startchan) > 0 {
 				<-startchan
 			}
@@ -884,7 +944,7 @@ func (device *Device) RoutineRegister(startchan chan struct{}) {
 		local_PeerStateHash := device.state_hashes.Peer.Load().(string)
 		local_NhTableHash := device.state_hashes.NhTable.Load().(string)
 		local_SuperParamState := device.state_hashes.SuperParam.Load().(string)
-		body, _ := mtypes.GetByte(mtypes.RegisterMsg{
+		body, err := device.EncodeMsg(&mtypes.RegisterMsg{
 			Node_id:             device.ID,
 			PeerStateHash:       local_PeerStateHash,
 			NhStateHash:         local_NhTableHash,
@@ -892,9 +952,16 @@ func (device *Device) RoutineRegister(startchan chan struct{}) {
 			Version:             device.Version,
 			JWTSecret:           device.JWTSecret,
 			HttpPostCount:       device.HttpPostCount,
+			WireCodecs:          mtypes.WireCodecsSupported,
+			EgHeaderVersion:     path.EgHeaderVersion,
+			ProtocolVersion:     mtypes.ProtocolVersion,
 		})
+		if err != nil {
+			device.log.Errorf("RoutineRegister: %v", err)
+			continue
+		}
 		buf := make([]byte, path.EgHeaderLen+len(body))
-		header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+		header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 		header.SetDst(mtypes.NodeID_SuperNode)
 		header.SetSrc(device.ID)
 		copy(buf[path.EgHeaderLen:], body)
@@ -903,7 +970,7 @@ func (device *Device) RoutineRegister(startchan chan struct{}) {
 }
 
 func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
-	if !(device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	if !(device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
 	var waitchan <-chan time.Time
@@ -916,9 +983,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		select {
 		case <-waitchan:
 		case <-startchan:
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Start RoutinePostPeerInfo()")
-			}
+			elog.Info(elog.Control, "Start RoutinePostPeerInfo()")
 			for len(startchan) > 0 {
 				<-startchan
 			}
@@ -934,12 +999,14 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 					Src_nodeID:  id,
 					Dst_nodeID:  device.ID,
 					Timediff:    peer.SingleWayLatency.GetVal(),
-					TimeToAlive: -time.Since(*peer.LastPacketReceivedAdd1Sec.Load().(*time.Time)).Seconds() + device.EdgeConfig.DynamicRoute.PeerAliveTimeout,
+					TimeToAlive: -time.Since(*peer.LastPacketReceivedAdd1Sec.Load().(*time.Time)).Seconds() + device.EdgeConfig().DynamicRoute.PeerAliveTimeout,
+					Loss:        peer.PingLoss.GetVal(),
 				}
-				pongs = append(pongs, pong)
-				if device.LogLevel.LogControl {
-					fmt.Printf("Control: Pack %v S:%v D:%v To:Post body\n", pong.ToString(), pong.Src_nodeID.ToString(), pong.Dst_nodeID.ToString())
+				if device.EdgeConfig().DynamicRoute.MeasureThroughput {
+					pong.Throughput = peer.Throughput.GetVal()
 				}
+				pongs = append(pongs, pong)
+				elog.Info(elog.Control, "Pack into post body", "content", pong.ToString(), "src", pong.Src_nodeID, "dst", pong.Dst_nodeID)
 			}
 			device.peers.RLock()
 		}
@@ -947,7 +1014,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		// Prepare post paramater and post body
 		LocalV4s := make(map[string]float64)
 		LocalV6s := make(map[string]float64)
-		if !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP {
+		if !device.EdgeConfig().DynamicRoute.SuperNode.SkipLocalIP {
 			if !device.peers.LocalV4.Equal(net.IP{}) {
 				LocalV4 := net.UDPAddr{
 					IP:   device.peers.LocalV4,
@@ -964,7 +1031,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 				LocalV6s[LocalV6.String()] = 100
 			}
 		}
-		for _, AIP := range device.EdgeConfig.DynamicRoute.SuperNode.AdditionalLocalIP {
+		for _, AIP := range device.EdgeConfig().DynamicRoute.SuperNode.AdditionalLocalIP {
 			success := false
 			_, ipstr, err := conn.LookupIP(AIP, conn.EnabledAf4, 0)
 			if err == nil {
@@ -981,11 +1048,22 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 			}
 		}
 
-		body, _ := mtypes.GetByte(mtypes.API_report_peerinfo{
-			Pongs:    pongs,
-			LocalV4s: LocalV4s,
-			LocalV6s: LocalV6s,
+		MappedV4s := make(map[string]float64)
+		if mapped := device.MappedAddress(); mapped != nil {
+			MappedV4s[mapped.String()] = PortMappingPriority
+		}
+
+		body, err := device.EncodeMsg(&mtypes.API_report_peerinfo{
+			Pongs:     pongs,
+			LocalV4s:  LocalV4s,
+			LocalV6s:  LocalV6s,
+			NATType:   device.NATType(),
+			MappedV4s: MappedV4s,
 		})
+		if err != nil {
+			device.log.Errorf("RoutinePostPeerInfo: %v", err)
+			continue
+		}
 		body = mtypes.Gzip(body)
 		bodyhash := base64.StdEncoding.EncodeToString(body)
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, mtypes.API_report_peerinfo_jwt_claims{
@@ -997,7 +1075,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		client := &http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/post/nodeinfo"
+		downloadurl := device.SuperEdgeAPIUrl() + "/edge/post/nodeinfo"
 		req, err := http.NewRequest("POST", downloadurl, bytes.NewReader(body))
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -1011,19 +1089,17 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		req.Header.Set("Content-Type", "application/octet-stream")
 		req.Header.Set("Content-Encoding", "gzip")
 		device.HttpPostCount += 1
-		if device.LogLevel.LogControl {
-			fmt.Printf("Control: Post to %v\n", downloadurl)
-		}
+		elog.Info(elog.Control, "Post", "url", downloadurl)
 		resp, err := client.Do(req)
 		if err != nil {
 			device.log.Errorf("RoutinePostPeerInfo: " + err.Error())
 		} else {
-			if device.LogLevel.LogControl {
+			if elog.Enabled(elog.Control, elog.LevelInfo) {
 				res, err := ioutil.ReadAll(resp.Body)
 				if err == nil {
-					fmt.Printf("Control: Post result %v\n", string(res))
+					elog.Info(elog.Control, "Post result", "body", string(res))
 				} else {
-					fmt.Printf("Control: Post error %v %v\n", err, string(res))
+					elog.Error(elog.Control, "Post result", "err", err, "body", string(res))
 				}
 			}
 			resp.Body.Close()
@@ -1036,7 +1112,7 @@ func (device *Device) RoutineRecalculateNhTable() {
 		return
 	}
 
-	if !device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if !device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		return
 	}
 	for {
@@ -1049,15 +1125,14 @@ func (device *Device) RoutineRecalculateNhTable() {
 }
 
 func (device *Device) RoutineSpreadAllMyNeighbor() {
-	if !device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if !device.EdgeConfig().DynamicRoute.P2P.UseP2P {
 		return
 	}
-	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.P2P.SendPeerInterval)
 	for {
 		device.process_RequestPeerMsg(mtypes.QueryPeerMsg{
 			Request_ID: uint32(mtypes.NodeID_Broadcast),
 		})
-		time.Sleep(timeout)
+		time.Sleep(mtypes.S2TD(device.EdgeConfig().DynamicRoute.P2P.SendPeerInterval))
 	}
 }
 
@@ -1066,12 +1141,11 @@ func (device *Device) RoutineResetEndpoint() {
 	if device.IsSuperNode {
 		ResetEndPointInterval = device.SuperConfig.ResetEndPointInterval
 	} else {
-		ResetEndPointInterval = device.EdgeConfig.ResetEndPointInterval
+		ResetEndPointInterval = device.EdgeConfig().ResetEndPointInterval
 	}
 	if ResetEndPointInterval <= 0.01 {
 		return
 	}
-	timeout := mtypes.S2TD(ResetEndPointInterval)
 	for {
 		for _, peer := range device.peers.keyMap {
 			if !peer.StaticConn { //Do not reset connecton for dynamic peer
@@ -1083,30 +1157,36 @@ func (device *Device) RoutineResetEndpoint() {
 			if peer.IsPeerAlive() {
 				continue
 			}
-			err := peer.SetEndpointFromConnURL(peer.ConnURL, peer.ConnAF, device.EdgeConfig.AfPrefer, peer.StaticConn)
+			err := peer.SetEndpointFromConnURL(peer.ConnURL, peer.ConnAF, device.EdgeConfig().AfPrefer, peer.StaticConn)
 			if err != nil {
 				device.log.Errorf("Failed to bind "+peer.ConnURL, err)
 				continue
 			}
 		}
-		time.Sleep(timeout)
+		// Read it every time, it may be changed by a config reload
+		NewInterval := device.SuperConfig.ResetEndPointInterval
+		if !device.IsSuperNode {
+			NewInterval = device.EdgeConfig().ResetEndPointInterval
+		}
+		if NewInterval > 0.01 {
+			ResetEndPointInterval = NewInterval
+		}
+		time.Sleep(mtypes.S2TD(ResetEndPointInterval))
 	}
 }
 
 func (device *Device) RoutineClearL2FIB() {
-	if device.EdgeConfig.L2FIBTimeout <= 0.01 {
+	if device.EdgeConfig().L2FIBTimeout <= 0.01 {
 		return
 	}
-	timeout := mtypes.S2TD(device.EdgeConfig.L2FIBTimeout)
 	for {
+		timeout := mtypes.S2TD(device.EdgeConfig().L2FIBTimeout)
 		device.l2fib.Range(func(k interface{}, v interface{}) bool {
 			val := v.(*IdAndTime)
-			if time.Now().After(val.Time.Add(timeout)) {
-				mac := k.(tap.MacAddress)
+			if val.Kind == L2FIB_Learned && time.Now().After(val.Time.Add(timeout)) { // static and pinned entries never age out
+				mac := k.(L2FIBKey)
 				device.l2fib.Delete(k)
-				if device.LogLevel.LogInternal {
-					fmt.Printf("Internal: L2FIB [%v -> %v] deleted.\n", mac.String(), val.ID)
-				}
+				elog.Info(elog.Internal, "L2FIB deleted", "mac", mac.String(), "node", val.ID)
 			}
 			return true
 		})
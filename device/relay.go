@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Relay
+//
+// The supernode can relay NormalPacket between edges that have no path to each other, like two behind symmetric NATs.
+// It adds a link between itself and each alive edge to the graph, which costs the AdditionalCost of the relay,
+// so the NhTable only goes through NodeID_SuperNode if there is no cheaper path.
+// The edges send to NodeID_SuperNode like to any other next hop, it is one of their SuperPeer.
+
+const RelayBurst_Default = 0.1 // seconds of Bandwidth, the relay drops the packets over it instead of queueing them
+
+// Relay is the compiled mtypes.SuperRelayInfo. The supernode shares one between its devices.
+type Relay struct {
+	sync.Mutex         // protects shaper
+	shaper     *Shaper // nil is unlimited
+}
+
+// CheckRelay validates SuperConfig.Relay and compiles it, nil if it is disabled
+func CheckRelay(info mtypes.SuperRelayInfo) (*Relay, error) {
+	if info.AdditionalCost < 0 {
+		return nil, fmt.Errorf("Relay.AdditionalCost must >= 0: %v", info.AdditionalCost)
+	}
+	if info.Bandwidth < 0 {
+		return nil, fmt.Errorf("Relay.Bandwidth must >= 0: %v", info.Bandwidth)
+	}
+	if !info.Enabled {
+		return nil, nil
+	}
+	r := &Relay{}
+	if info.Bandwidth > 0 {
+		rate := info.Bandwidth * 1000 * 1000 / 8
+		r.shaper = &Shaper{
+			NodeID: mtypes.NodeID_SuperNode,
+			rate:   rate,
+			burst:  rate * RelayBurst_Default,
+		}
+		r.shaper.tokens = r.shaper.burst
+	}
+	return r, nil
+}
+
+// allow takes the tokens of a packet, false if the relay is over its Bandwidth
+func (r *Relay) allow(size int) bool {
+	if r.shaper == nil {
+		return true
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.shaper.reserve(size, time.Now()) > 0 {
+		r.shaper.tokens += float64(size) // dropped, give them back
+		return false
+	}
+	return true
+}
+
+// SetRelay replaces the relay, nil stops relaying
+func (device *Device) SetRelay(r *Relay) {
+	device.relay.Store(r)
+}
+
+// RelayEnabled tells if the supernode relays NormalPacket
+func (device *Device) RelayEnabled() bool {
+	r, _ := device.relay.Load().(*Relay)
+	return r != nil
+}
+
+// relayAllowed counts a NormalPacket relayed by the supernode, false if it has to be dropped
+func (device *Device) relayAllowed(size int) bool {
+	r, _ := device.relay.Load().(*Relay)
+	if r == nil {
+		return false
+	}
+	if !r.allow(size) {
+		atomic.AddUint64(&device.counters.relayDropped, 1)
+		return false
+	}
+	atomic.AddUint64(&device.counters.relayed, 1)
+	return true
+}
+
+// nextHopPeer returns the peer of a next hop from the NhTable. On an edge NodeID_SuperNode is the supernode relaying for us,
+// an alive one first, then the one on IPv4, where the supernode sees most edges.
+// No lock, lock before call me
+func (device *Device) nextHopPeer(id mtypes.Vertex) *Peer {
+	if id != mtypes.NodeID_SuperNode || device.IsSuperNode {
+		return device.peers.IDMap[id]
+	}
+	var ret *Peer
+	var retScore int
+	for _, peer := range device.peers.SuperPeer {
+		endpoint := peer.GetEndpointDstStr()
+		if endpoint == "" {
+			continue
+		}
+		score := 1
+		if peer.IsPeerAlive() {
+			score += 2
+		}
+		if host, _, err := net.SplitHostPort(endpoint); err == nil && net.ParseIP(host).To4() != nil {
+			score += 1
+		}
+		if score > retScore {
+			ret, retScore = peer, score
+		}
+	}
+	return ret
+}
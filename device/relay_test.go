@@ -0,0 +1,56 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestRelay(t *testing.T) {
+	if _, err := CheckRelay(mtypes.SuperRelayInfo{Enabled: true, Bandwidth: -1}); err == nil {
+		t.Error("accepted a negative Bandwidth")
+	}
+	if _, err := CheckRelay(mtypes.SuperRelayInfo{AdditionalCost: -1}); err == nil {
+		t.Error("accepted a negative AdditionalCost while disabled")
+	}
+	if r, err := CheckRelay(mtypes.SuperRelayInfo{Bandwidth: 8}); r != nil || err != nil {
+		t.Errorf("disabled relay compiled to %v %v", r, err)
+	}
+
+	device := &Device{SuperConfig: &mtypes.SuperConfig{}, IsSuperNode: true}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{})
+	if device.RelayEnabled() || device.relayAllowed(100) {
+		t.Error("relayed before SetRelay")
+	}
+	// 8 Mbit/s is 1000000 bytes per second, the burst is 100000 bytes
+	r, err := CheckRelay(mtypes.SuperRelayInfo{Enabled: true, AdditionalCost: 200, Bandwidth: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.SetRelay(r)
+	if !device.relayAllowed(100000) {
+		t.Error("dropped within the burst")
+	}
+	if device.relayAllowed(50000) {
+		t.Error("relayed over the Bandwidth")
+	}
+	if m := device.GetMetrics(); m.Relayed != 1 || m.RelayDropped != 1 {
+		t.Errorf("counted %v relayed and %v dropped", m.Relayed, m.RelayDropped)
+	}
+	device.SetRelay(nil)
+	if device.RelayEnabled() {
+		t.Error("still relaying after SetRelay(nil)")
+	}
+
+	unlimited, _ := CheckRelay(mtypes.SuperRelayInfo{Enabled: true})
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow(1 << 20) {
+			t.Fatal("an unlimited relay dropped")
+		}
+	}
+}
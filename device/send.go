@@ -9,13 +9,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"os"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
@@ -80,10 +79,10 @@ func (elem *QueueOutboundElement) clearPointers() {
 /* Queues a keepalive if no packets are queued for peer
  */
 func (peer *Peer) SendKeepalive() {
-	if len(peer.queue.staged) == 0 && peer.isRunning.Get() {
+	if len(peer.queue.staged) == 0 && len(peer.queue.stagedControl) == 0 && peer.isRunning.Get() {
 		elem := peer.device.NewOutboundElement()
 		select {
-		case peer.queue.staged <- elem:
+		case peer.queue.stagedControl <- elem:
 			peer.device.log.Verbosef("%v - Sending keepalive packet", peer)
 		default:
 			peer.device.PutMessageBuffer(elem.buffer)
@@ -216,14 +215,21 @@ func (device *Device) RoutineReadFromTUN() {
 	}()
 
 	device.log.Verbosef("Routine: TUN reader - started")
+	device.readFromTap(device.GetVNet(0))
+}
 
+// readFromTap reads the frames from the tap device of a virtual network and sends them, until the tap device is closed
+func (device *Device) readFromTap(vn *VNet) {
 	var elem *QueueOutboundElement
+	usage := path.NormalUsage(vn.VNI)
+	frame_offset := usage.FrameOffset()
+	maxContentSize := device.maxContentSize()
 
 	for {
 		elem = device.NewOutboundElement()
 		// read packet
 		offset := MessageTransportHeaderSize
-		size, err := device.tap.device.Read(elem.buffer[:], offset+path.EgHeaderLen)
+		size, err := vn.tap.Read(elem.buffer[:], offset+frame_offset)
 
 		if err != nil {
 			if !device.isClosed() {
@@ -237,67 +243,118 @@ func (device *Device) RoutineReadFromTUN() {
 			return
 		}
 
-		if size == 0 || (size+path.EgHeaderLen) > MaxContentSize {
+		if size == 0 || (size+frame_offset) > maxContentSize {
 			continue
 		}
 
 		//add custom header dst_node, src_node, ttl
-		size += path.EgHeaderLen
+		size += frame_offset
 		elem.packet = elem.buffer[offset : offset+size]
-		EgBody, _ := path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+		frame, ok := device.VlanFromTap(elem.buffer[offset+frame_offset : offset+size : offset+maxContentSize])
+		if !ok {
+			elog.Debug(elog.Normal, "VLAN not allowed, dropped", "vlan", tap.GetVlanID(elem.packet[frame_offset:]))
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			continue
+		}
+		elem.packet = elem.buffer[offset : offset+frame_offset+len(frame)]
+		if !device.firewallAllowed(true, frame) {
+			elog.Debug(elog.Normal, "Dropped by the firewall", "vni", vn.VNI)
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			continue
+		}
+		if vn.VNI != 0 {
+			path.SetVNI(elem.packet, vn.VNI)
+		}
+		EgBody, _ := path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
 		dst_nodeID := EgBody.GetDst()
-		dstMacAddr := tap.GetDstMacAddr(elem.packet[path.EgHeaderLen:])
+		dstMacAddr, _ := GetL2FIBKey(vn.VNI, frame)
 		// lookup peer
-		if tap.IsNotUnicast(dstMacAddr) {
+		if tap.IsNotUnicast(dstMacAddr.MAC) {
 			dst_nodeID = mtypes.NodeID_Broadcast
 		} else if val, ok := device.l2fib.Load(dstMacAddr); !ok { //Lookup failed
 			dst_nodeID = mtypes.NodeID_Broadcast
 		} else {
 			dst_nodeID = val.(*IdAndTime).ID
 		}
-		packet_len := len(elem.packet) - path.EgHeaderLen
+		packet_len := len(frame)
 		EgBody.SetSrc(device.ID)
 		EgBody.SetDst(dst_nodeID)
-		elem.Type = path.NormalPacket
-		elem.TTL = device.EdgeConfig.DefaultTTL
+		elem.Type = usage
+		elem.TTL = device.EdgeConfig().DefaultTTL
 		if packet_len <= 12 {
-			if device.LogLevel.LogNormal {
-				fmt.Println("Normal: Invalid packet: Ethernet packet too small." + " Len:" + strconv.Itoa(packet_len))
-			}
+			elog.Info(elog.Normal, "Invalid packet: Ethernet packet too small", "len", packet_len)
 			continue
 		}
 
 		if dst_nodeID != mtypes.NodeID_Broadcast {
 			var peer *Peer
-			next_id := device.graph.Next(device.ID, dst_nodeID)
+			if !vn.Allowed(dst_nodeID) {
+				elog.Debug(elog.Normal, "Node not allowed in the VNI, dropped", "vni", vn.VNI, "dst", dst_nodeID)
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+				continue
+			}
+			next_id := device.NextHopByFlow(dst_nodeID, frame)
 			if next_id != mtypes.NodeID_Invalid {
 				device.peers.RLock()
-				peer = device.peers.IDMap[next_id]
+				peer = device.nextHopPeer(next_id)
 				device.peers.RUnlock()
 				if peer == nil {
+					atomic.AddUint64(&device.counters.noRoute, 1)
+					continue
+				}
+				if device.pmtuTooBig(vn, peer, elem.packet, frame) {
+					device.PutMessageBuffer(elem.buffer)
+					device.PutOutboundElement(elem)
 					continue
 				}
 				device.chan_send_packet <- &packet_send_params{
 					peer: peer,
 					elem: elem,
 				}
+			} else {
+				atomic.AddUint64(&device.counters.noRoute, 1)
 			}
-		} else {
+		} else if device.ProxyNeighbor(vn, frame) {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+		} else if targets, flood := device.McastTargets(vn, frame); flood {
 			device.BoardcastPacket(make(map[mtypes.Vertex]bool, 0), elem.Type, elem.TTL, elem.packet, offset)
+		} else {
+			device.SendMcastPacket(targets, elem.Type, elem.TTL, elem.packet, offset)
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
 		}
 
 	}
 }
 
+// NextHopByFlow picks the next hop to dst. If there are equal cost paths, the flows
+// of the ethernet frame are spread over them, a flow always takes the same path.
+func (device *Device) NextHopByFlow(dst mtypes.Vertex, frame []byte) mtypes.Vertex {
+	if set := device.graph.NextHopSet(device.ID, dst); len(set) > 1 {
+		return set[tap.FlowHash(frame)%uint32(len(set))]
+	}
+	return device.graph.Next(device.ID, dst)
+}
+
+// StagePacket queues a packet until it can be sent. Control messages have their own queue,
+// so a bulk transfer can't push them out.
 func (peer *Peer) StagePacket(elem *QueueOutboundElement) {
+	staged := peer.queue.staged
+	if !elem.Type.IsNormal() && elem.Type != path.Fragment {
+		staged = peer.queue.stagedControl
+	}
 	for {
 		select {
-		case peer.queue.staged <- elem:
+		case staged <- elem:
 			return
 		default:
 		}
 		select {
-		case tooOld := <-peer.queue.staged:
+		case tooOld := <-staged:
 			peer.device.PutMessageBuffer(tooOld.buffer)
 			peer.device.PutOutboundElement(tooOld)
 		default:
@@ -307,7 +364,7 @@ func (peer *Peer) StagePacket(elem *QueueOutboundElement) {
 
 func (peer *Peer) SendStagedPackets() {
 top:
-	if len(peer.queue.staged) == 0 || !peer.device.isUp() {
+	if (len(peer.queue.staged) == 0 && len(peer.queue.stagedControl) == 0) || !peer.device.isUp() {
 		return
 	}
 
@@ -318,29 +375,34 @@ top:
 	}
 
 	for {
-		select {
-		case elem := <-peer.queue.staged:
-			elem.peer = peer
-			elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
-			if elem.nonce >= RejectAfterMessages {
-				atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
-				peer.StagePacket(elem) // XXX: Out of order, but we can't front-load go chans
-				goto top
+		var elem *QueueOutboundElement
+		select { // strict priority for the control messages
+		case elem = <-peer.queue.stagedControl:
+		default:
+			select {
+			case elem = <-peer.queue.staged:
+			default:
+				return
 			}
+		}
+		elem.peer = peer
+		elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
+		if elem.nonce >= RejectAfterMessages {
+			atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
+			peer.StagePacket(elem) // XXX: Out of order, but we can't front-load go chans
+			goto top
+		}
 
-			elem.keypair = keypair
-			elem.Lock()
+		elem.keypair = keypair
+		elem.Lock()
 
-			// add to parallel and sequential queue
-			if peer.isRunning.Get() {
-				peer.queue.outbound.c <- elem
-				peer.device.queue.encryption.c <- elem
-			} else {
-				peer.device.PutMessageBuffer(elem.buffer)
-				peer.device.PutOutboundElement(elem)
-			}
-		default:
-			return
+		// add to parallel and sequential queue
+		if peer.isRunning.Get() {
+			peer.queue.outbound.c <- elem
+			peer.device.queue.encryption.c <- elem
+		} else {
+			peer.device.PutMessageBuffer(elem.buffer)
+			peer.device.PutOutboundElement(elem)
 		}
 	}
 }
@@ -351,6 +413,9 @@ func (peer *Peer) FlushStagedPackets() {
 		case elem := <-peer.queue.staged:
 			peer.device.PutMessageBuffer(elem.buffer)
 			peer.device.PutOutboundElement(elem)
+		case elem := <-peer.queue.stagedControl:
+			peer.device.PutMessageBuffer(elem.buffer)
+			peer.device.PutOutboundElement(elem)
 		default:
 			return
 		}
@@ -386,13 +451,25 @@ func (device *Device) RoutineEncryption(id int) {
 	device.log.Verbosef("Routine: encryption worker %d - started", id)
 
 	for elem := range device.queue.encryption.c {
+		// shorten the EgHeader if the IDs fit, the transport header moves with it
+		headerOffset := 0
+		usage := uint8(elem.Type)
+		if len(elem.packet) > 0 { // not a keepalive
+			if EgHeader, _ := path.NewEgHeader(elem.packet[:path.EgHeaderLen], 0); EgHeader.FitsV1() {
+				elem.packet = path.ToV1(elem.packet)
+				headerOffset = path.EgHeaderLen - path.EgHeaderLenV1
+			} else {
+				usage |= path.EgHeaderV2Flag
+			}
+		}
+
 		// populate header fields
-		header := elem.buffer[:MessageTransportHeaderSize]
+		header := elem.buffer[headerOffset : headerOffset+MessageTransportHeaderSize]
 
 		fieldReceiver := header[MessageTransportOffsetReceiver:MessageTransportOffsetCounter]
 		fieldNonce := header[MessageTransportOffsetCounter:MessageTransportHeaderSize]
 
-		header[0] = uint8(elem.Type)
+		header[0] = usage
 		header[1] = uint8(elem.TTL)
 		binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
 		binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
@@ -0,0 +1,213 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+const (
+	ShapingQueueLen_Default = 1024
+	ShapingBurst_Default    = 0.01 // seconds of Rate
+)
+
+// Shaper is a token bucket with the queue of the packets waiting for it
+type Shaper struct {
+	NodeID mtypes.Vertex
+	isDst  bool
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64 // only touched by RoutineShaper
+	last   time.Time
+	queue  chan *packet_send_params
+}
+
+// Shaping is the compiled mtypes.ShapingInfo. A nil *Shaping shapes nothing.
+type Shaping struct {
+	peers map[mtypes.Vertex]*Shaper
+	dsts  map[mtypes.Vertex]*Shaper
+	stop  chan struct{} // closed when it is replaced
+}
+
+// CheckShaping validates EdgeConfig.Shaping and compiles it, nil if it has no rules
+func CheckShaping(info mtypes.ShapingInfo) (*Shaping, error) {
+	if len(info.Peers) == 0 && len(info.Destinations) == 0 {
+		return nil, nil
+	}
+	s := &Shaping{
+		peers: make(map[mtypes.Vertex]*Shaper, len(info.Peers)),
+		dsts:  make(map[mtypes.Vertex]*Shaper, len(info.Destinations)),
+		stop:  make(chan struct{}),
+	}
+	for _, rule := range info.Peers {
+		if err := s.add(s.peers, rule, false); err != nil {
+			return nil, fmt.Errorf("Shaping.Peers: %v", err)
+		}
+	}
+	for _, rule := range info.Destinations {
+		if err := s.add(s.dsts, rule, true); err != nil {
+			return nil, fmt.Errorf("Shaping.Destinations: %v", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *Shaping) add(m map[mtypes.Vertex]*Shaper, rule mtypes.ShapingRule, isDst bool) error {
+	if rule.NodeID.IsSpecial() {
+		return fmt.Errorf("ID %v is a special NodeID", rule.NodeID)
+	}
+	if _, has := m[rule.NodeID]; has {
+		return fmt.Errorf("duplicate NodeID: %v", rule.NodeID)
+	}
+	if rule.Rate <= 0 {
+		return fmt.Errorf("NodeID %v: Rate must > 0: %v", rule.NodeID, rule.Rate)
+	}
+	if rule.Burst < 0 || rule.QueueLen < 0 {
+		return fmt.Errorf("NodeID %v: Burst and QueueLen must >= 0: %v %v", rule.NodeID, rule.Burst, rule.QueueLen)
+	}
+	shaper := &Shaper{
+		NodeID: rule.NodeID,
+		isDst:  isDst,
+		rate:   rule.Rate * 1000 * 1000 / 8,
+		burst:  float64(rule.Burst),
+	}
+	if rule.Burst == 0 {
+		shaper.burst = shaper.rate * ShapingBurst_Default
+	}
+	shaper.tokens = shaper.burst
+	queuelen := rule.QueueLen
+	if queuelen == 0 {
+		queuelen = ShapingQueueLen_Default
+	}
+	shaper.queue = make(chan *packet_send_params, queuelen)
+	m[rule.NodeID] = shaper
+	return nil
+}
+
+// reserve takes the tokens of a packet and returns how long it has to wait for them
+func (shaper *Shaper) reserve(size int, now time.Time) time.Duration {
+	if !shaper.last.IsZero() {
+		shaper.tokens += now.Sub(shaper.last).Seconds() * shaper.rate
+		if shaper.tokens > shaper.burst {
+			shaper.tokens = shaper.burst
+		}
+	}
+	shaper.last = now
+	shaper.tokens -= float64(size)
+	if shaper.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-shaper.tokens / shaper.rate * float64(time.Second))
+}
+
+// SetShaping replaces the shapers. The packets waiting in the old ones are dropped.
+func (device *Device) SetShaping(s *Shaping) {
+	old, _ := device.shaping.Swap(s).(*Shaping)
+	if s != nil {
+		for _, shaper := range s.peers {
+			go device.RoutineShaper(s, shaper)
+		}
+		for _, shaper := range s.dsts {
+			go device.RoutineShaper(s, shaper)
+		}
+	}
+	if old != nil {
+		close(old.stop)
+	}
+}
+
+// shapePacket queues a NormalPacket to the shaper of its destination, or the shaper of the peer if skipDst.
+// It returns false if no shaper applies, the caller sends the packet then.
+func (device *Device) shapePacket(params *packet_send_params, skipDst bool) bool {
+	s, _ := device.shaping.Load().(*Shaping)
+	if s == nil {
+		return false
+	}
+	var shaper *Shaper
+	if !skipDst && len(params.elem.packet) >= path.EgHeaderLen {
+		EgHeader, _ := path.NewEgHeader(params.elem.packet[:path.EgHeaderLen], device.EdgeConfig().Interface.MTU)
+		shaper = s.dsts[EgHeader.GetDst()]
+	}
+	if shaper == nil {
+		shaper = s.peers[params.peer.ID]
+	}
+	if shaper == nil {
+		return false
+	}
+	select {
+	case shaper.queue <- params:
+	default:
+		atomic.AddUint64(&device.counters.shapingDropped, 1)
+		device.PutMessageBuffer(params.elem.buffer)
+		device.PutOutboundElement(params.elem)
+	}
+	return true
+}
+
+// stagePacket hands the packet to the peer, the end of the send path before the encryption.
+// Packets larger than the PMTU are fragmented, except the pings, the PMTU probes are pings.
+func (device *Device) stagePacket(params *packet_send_params) {
+	if !params.peer.isRunning.Get() {
+		device.PutMessageBuffer(params.elem.buffer)
+		device.PutOutboundElement(params.elem)
+		return
+	}
+	if size := params.peer.PMTU(); size > 0 && len(params.elem.packet) > size && params.elem.Type != path.PingPacket {
+		device.stageFragments(params.peer, params.elem, size)
+	} else {
+		params.peer.StagePacket(params.elem)
+	}
+	params.peer.SendStagedPackets()
+}
+
+func (device *Device) RoutineShaper(s *Shaping, shaper *Shaper) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer func() {
+		timer.Stop()
+		for {
+			select {
+			case params := <-shaper.queue:
+				device.PutMessageBuffer(params.elem.buffer)
+				device.PutOutboundElement(params.elem)
+			default:
+				return
+			}
+		}
+	}()
+	for {
+		var params *packet_send_params
+		select {
+		case params = <-shaper.queue:
+		case <-s.stop:
+			return
+		case <-device.done:
+			return
+		}
+		if wait := shaper.reserve(len(params.elem.packet), time.Now()); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-s.stop:
+				device.PutMessageBuffer(params.elem.buffer)
+				device.PutOutboundElement(params.elem)
+				return
+			case <-device.done:
+				device.PutMessageBuffer(params.elem.buffer)
+				device.PutOutboundElement(params.elem)
+				return
+			}
+		}
+		if !shaper.isDst || !device.shapePacket(params, true) {
+			device.stagePacket(params)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestShaping(t *testing.T) {
+	device := &Device{}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{})
+	device.PopulatePools()
+	s, err := CheckShaping(mtypes.ShapingInfo{
+		Peers:        []mtypes.ShapingRule{{NodeID: 2, Rate: 8, Burst: 1500, QueueLen: 1}},
+		Destinations: []mtypes.ShapingRule{{NodeID: 5, Rate: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 8 Mbit/s is 1000 bytes per ms
+	shaper := s.peers[2]
+	now := time.Now()
+	if wait := shaper.reserve(1500, now); wait != 0 {
+		t.Errorf("waited %v within the burst", wait)
+	}
+	if wait := shaper.reserve(1000, now); wait != time.Millisecond {
+		t.Errorf("waited %v for 1000 bytes", wait)
+	}
+	if wait := shaper.reserve(1000, now.Add(10*time.Millisecond)); wait != 0 {
+		t.Errorf("waited %v after the bucket refilled", wait)
+	}
+
+	device.shaping.Store(s)
+	peer := &Peer{ID: 2}
+	packet := func(dst mtypes.Vertex, usage path.Usage) *packet_send_params {
+		elem := device.NewOutboundElement()
+		elem.Type = usage
+		elem.packet = elem.buffer[:path.EgHeaderLen+14]
+		EgHeader, _ := path.NewEgHeader(elem.packet[:path.EgHeaderLen], 0)
+		EgHeader.SetDst(dst)
+		return &packet_send_params{peer: peer, elem: elem}
+	}
+	if !device.shapePacket(packet(5, path.NormalPacket), false) || len(s.dsts[5].queue) != 1 {
+		t.Error("not queued to the shaper of the destination")
+	}
+	if !device.shapePacket(packet(5, path.NormalPacket), true) || len(shaper.queue) != 1 {
+		t.Error("not queued to the shaper of the peer after the destination")
+	}
+	if !device.shapePacket(packet(3, path.NormalPacket), false) || device.GetMetrics().ShapingDropped != 1 {
+		t.Error("a full queue didn't drop")
+	}
+	if device.shapePacket(&packet_send_params{peer: &Peer{ID: 3}, elem: packet(3, path.NormalPacket).elem}, false) {
+		t.Error("queued a packet without a shaper")
+	}
+
+	// Control messages have their own staged queue
+	peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
+	peer.queue.stagedControl = make(chan *QueueOutboundElement, QueueStagedSize)
+	peer.device = device
+	for i := 0; i < QueueStagedSize+10; i++ {
+		peer.StagePacket(packet(2, path.NormalPacket).elem)
+	}
+	peer.StagePacket(packet(2, path.PingPacket).elem)
+	if len(peer.queue.stagedControl) != 1 || len(peer.queue.staged) != QueueStagedSize {
+		t.Errorf("staged %v control and %v normal packets", len(peer.queue.stagedControl), len(peer.queue.staged))
+	}
+
+	if _, err := CheckShaping(mtypes.ShapingInfo{Peers: []mtypes.ShapingRule{{NodeID: 2, Rate: 0}}}); err == nil {
+		t.Error("accepted Rate 0")
+	}
+	if _, err := CheckShaping(mtypes.ShapingInfo{Destinations: []mtypes.ShapingRule{{NodeID: 2, Rate: 1}, {NodeID: 2, Rate: 2}}}); err == nil {
+		t.Error("accepted a duplicate NodeID")
+	}
+}
@@ -25,6 +25,12 @@ import (
 )
 
 func (device *Device) startRouteListener(bind conn.Bind) (*rwcancel.RWCancel, error) {
+	if obfs, ok := bind.(*conn.ObfsBind); ok {
+		bind = obfs.Inner()
+	}
+	if multi, ok := bind.(*conn.MultiBind); ok {
+		bind = multi.UDP()
+	}
 	if _, ok := bind.(*conn.LinuxSocketBind); !ok {
 		return nil, nil
 	}
@@ -112,11 +118,12 @@ func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netl
 									pePtr.peer.Unlock()
 									break
 								}
-								if uint32(pePtr.peer.endpoint.(*conn.LinuxSocketEndpoint).Src4().Ifindex) == ifidx {
+								nativeEP, _ := pePtr.peer.endpoint.(*conn.LinuxSocketEndpoint)
+								if nativeEP == nil || uint32(nativeEP.Src4().Ifindex) == ifidx {
 									pePtr.peer.Unlock()
 									break
 								}
-								pePtr.peer.endpoint.(*conn.LinuxSocketEndpoint).ClearSrc()
+								nativeEP.ClearSrc()
 								pePtr.peer.Unlock()
 							}
 							attr = attr[attrhdr.Len:]
@@ -29,9 +29,9 @@ func (device *Device) RoutineTUNEventReader() {
 				continue
 			}
 			var tooLarge string
-			if mtu > MaxContentSize {
-				tooLarge = fmt.Sprintf(" (too large, capped at %v)", MaxContentSize)
-				mtu = MaxContentSize
+			if max := device.maxContentSize(); mtu > max {
+				tooLarge = fmt.Sprintf(" (too large, capped at %v)", max)
+				mtu = max
 			}
 			old := atomic.SwapInt32(&device.tap.mtu, int32(mtu))
 			if int(old) != mtu {
@@ -18,7 +18,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 )
 
 type IPCError struct {
@@ -98,6 +100,22 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("fwmark=%d", device.net.fwmark)
 		}
 
+		for _, sub := range elog.Subsystems() {
+			sendf("log_level=%v:%v", sub.ToString(), elog.GetLevel(sub).ToString())
+		}
+
+		for _, e := range device.GetL2FIB() {
+			var lastseen int64
+			if !e.LastSeen.IsZero() {
+				lastseen = e.LastSeen.Unix()
+			}
+			sendf("l2fib=%v,%v,%v,%d,%v,%v", e.MacAddress, e.NodeID, e.Kind, lastseen, e.VLAN, e.VNI)
+		}
+
+		for i, s := range device.GetFirewallStats() {
+			sendf("firewall_rule=%d,%v,%d,%d,%v", i, s.Action, s.Hits, s.Drops, s.Name)
+		}
+
 		// serialize each peer state
 
 		for _, peer := range device.peers.keyMap {
@@ -119,6 +137,9 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("last_handshake_time_nsec=%d", nano)
 			sendf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes))
 			sendf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes))
+			if mtu, endpoint := peer.PMTUInfo(); mtu > 0 {
+				sendf("pmtu=%d,%v", mtu, endpoint)
+			}
 			sendf("persistent_keepalive_interval=%d", atomic.LoadUint32(&peer.persistentKeepaliveInterval))
 			sendf("allowed_ip=%s/%d", net.IPv4zero.String(), 0)
 			sendf("allowed_ip=%s/%d", net.IPv6zero.String(), 0)
@@ -232,6 +253,95 @@ func (device *Device) handleDeviceLine(key, value string) error {
 			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to update fwmark: %w", err)
 		}
 
+	case "log_level":
+		// subsystem:level, or level for all subsystems
+		if err := elog.SetLevelStr(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_level: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating log level %v", value)
+
+	case "log_format":
+		format, err := elog.ParseFormat(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_format: %w", err)
+		}
+		elog.SetFormat(format)
+
+	case "reload":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to reload, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Reloading config")
+		select {
+		case device.Chan_Reload <- struct{}{}:
+		default: // a reload is pending already
+		}
+
+	case "l2fib_pin":
+		// mac,node_id, mac,node_id,vlan or mac,node_id,vlan,vni
+		parts := strings.Split(value, ",")
+		if len(parts) < 2 || len(parts) > 4 {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_pin, invalid value: %v", value)
+		}
+		id, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_pin: %w", err)
+		}
+		mac, err := ParseL2FIBEntry(parts[0], mtypes.Vertex(id))
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_pin: %w", err)
+		}
+		key := L2FIBKey{MAC: mac}
+		if len(parts) >= 3 {
+			vlan, err := ParseVLANID(parts[2])
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_pin: %w", err)
+			}
+			key.VLAN = vlan
+		}
+		if len(parts) == 4 {
+			vni, err := strconv.ParseUint(parts[3], 10, 16)
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_pin: %w", err)
+			}
+			key.VNI = uint16(vni)
+		}
+		if err := device.PinL2FIB(key, mtypes.Vertex(id)); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_pin: %w", err)
+		}
+
+	case "l2fib_flush":
+		// mac in all VNIs and VLANs, mac,vlan in all VNIs, mac,vlan,vni, or all
+		if value == "all" {
+			device.log.Verbosef("UAPI: Flushing L2FIB")
+			device.FlushL2FIB(nil, -1, -1)
+			break
+		}
+		parts := strings.Split(value, ",")
+		if len(parts) > 3 {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_flush, invalid value: %v", value)
+		}
+		mac, err := ParseL2FIBEntry(parts[0], 0)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_flush: %w", err)
+		}
+		vni, vlan := -1, -1
+		if len(parts) >= 2 {
+			vid, err := ParseVLANID(parts[1])
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_flush: %w", err)
+			}
+			vlan = int(vid)
+		}
+		if len(parts) == 3 {
+			v, err := strconv.ParseUint(parts[2], 10, 16)
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set l2fib_flush: %w", err)
+			}
+			vni = int(v)
+		}
+		device.FlushL2FIB(&mac, vni, vlan)
+
 	case "replace_peers":
 		if value != "true" {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set replace_peers, invalid value: %v", value)
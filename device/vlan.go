@@ -0,0 +1,107 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const VLANID_Max = 4094
+
+// L2FIBKey is the key of the L2FIB and the multicast groups, each virtual network and VLAN has its own.
+// VLAN is 0 for untagged frames.
+type L2FIBKey struct {
+	VNI  uint16
+	VLAN uint16
+	MAC  tap.MacAddress
+}
+
+func (k L2FIBKey) String() string {
+	ret := k.MAC.String()
+	if k.VLAN != 0 {
+		ret = fmt.Sprintf("%v@%v", ret, k.VLAN)
+	}
+	if k.VNI != 0 {
+		ret = fmt.Sprintf("vni%v/%v", k.VNI, ret)
+	}
+	return ret
+}
+
+// GetL2FIBKey returns the key of the destination and the source MAC address of a frame in a virtual network
+func GetL2FIBKey(vni uint16, frame []byte) (dst L2FIBKey, src L2FIBKey) {
+	vid := tap.GetVlanID(frame)
+	return L2FIBKey{vni, vid, tap.GetDstMacAddr(frame)}, L2FIBKey{vni, vid, tap.GetSrcMacAddr(frame)}
+}
+
+func CheckVLANInfo(info mtypes.VLANInfo) error {
+	if info.AccessVLAN > VLANID_Max {
+		return fmt.Errorf("VLAN.AccessVLAN must <= %v: %v", VLANID_Max, info.AccessVLAN)
+	}
+	if info.AccessVLAN != 0 && len(info.AllowedVLANs) > 0 {
+		return fmt.Errorf("VLAN.AllowedVLANs can't be used with VLAN.AccessVLAN, an access port carries one VLAN only")
+	}
+	for _, vid := range info.AllowedVLANs {
+		if vid > VLANID_Max {
+			return fmt.Errorf("VLAN.AllowedVLANs must <= %v: %v", VLANID_Max, vid)
+		}
+	}
+	return nil
+}
+
+// ParseVLANID parses a VLAN ID, 0 for untagged
+func ParseVLANID(s string) (uint16, error) {
+	vid, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	if vid > VLANID_Max {
+		return 0, fmt.Errorf("VLAN must <= %v: %v", VLANID_Max, vid)
+	}
+	return uint16(vid), nil
+}
+
+// vlanAllowed reports whether this node carries the VLAN. vid is the VLAN in the overlay, 0 for untagged.
+func (device *Device) vlanAllowed(vid uint16) bool {
+	vlan := device.EdgeConfig().VLAN
+	if vlan.AccessVLAN != 0 {
+		return vid == vlan.AccessVLAN
+	}
+	if len(vlan.AllowedVLANs) == 0 {
+		return true
+	}
+	for _, allowed := range vlan.AllowedVLANs {
+		if allowed == vid {
+			return true
+		}
+	}
+	return false
+}
+
+// VlanFromTap turns a frame read from the tap device into the frame sent to the overlay.
+// The access VLAN tag is pushed in place, the frame must have tap.VlanTagLen bytes of spare capacity.
+// It returns false if the frame must be dropped.
+func (device *Device) VlanFromTap(frame []byte) ([]byte, bool) {
+	if access := device.EdgeConfig().VLAN.AccessVLAN; access != 0 {
+		if tap.IsVlanTagged(frame) || cap(frame)-len(frame) < tap.VlanTagLen {
+			return nil, false
+		}
+		frame = tap.PushVlanTag(frame, access)
+	}
+	return frame, device.vlanAllowed(tap.GetVlanID(frame))
+}
+
+// VlanToTap decides if a frame from the overlay goes to the tap device, and if the access VLAN tag
+// must be popped before that. The caller pops it with tap.PopVlanTag.
+func (device *Device) VlanToTap(frame []byte) (pop bool, ok bool) {
+	if !device.vlanAllowed(tap.GetVlanID(frame)) {
+		return false, false
+	}
+	return device.EdgeConfig().VLAN.AccessVLAN != 0 && tap.IsVlanTagged(frame), true
+}
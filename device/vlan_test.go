@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+func vlanFrame(vid uint16) []byte {
+	frame := []byte{0x02, 0, 0, 0, 0, 2, 0x02, 0, 0, 0, 0, 1}
+	if vid != 0 {
+		frame = append(frame, 0x81, 0x00, byte(vid>>8), byte(vid))
+	}
+	return append(frame, 0x08, 0x00, 0x45, 0, 0, 20)
+}
+
+func TestVLAN(t *testing.T) {
+	device := &Device{
+		ID: 1,
+	}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{VLAN: mtypes.VLANInfo{AccessVLAN: 10}})
+	untagged := vlanFrame(0)
+	buf := make([]byte, len(untagged), len(untagged)+tap.VlanTagLen)
+	copy(buf, untagged)
+	frame, ok := device.VlanFromTap(buf)
+	if !ok || !bytes.Equal(frame, vlanFrame(10)) {
+		t.Fatalf("access VLAN not pushed: %v %x", ok, frame)
+	}
+	if _, ok := device.VlanFromTap(vlanFrame(20)); ok {
+		t.Fatal("tagged frame accepted from an access port")
+	}
+	if pop, ok := device.VlanToTap(frame); !ok || !pop {
+		t.Fatalf("access VLAN not popped: %v %v", pop, ok)
+	}
+	if popped := tap.PopVlanTag(frame); !bytes.Equal(popped, untagged) {
+		t.Fatalf("wrong frame after pop: %x", popped)
+	}
+	if _, ok := device.VlanToTap(vlanFrame(20)); ok {
+		t.Fatal("other VLAN sent to an access port")
+	}
+
+	device.SetEdgeConfig(&mtypes.EdgeConfig{VLAN: mtypes.VLANInfo{AllowedVLANs: []uint16{0, 20}}})
+	for vid, allowed := range map[uint16]bool{0: true, 20: true, 30: false} {
+		if pop, ok := device.VlanToTap(vlanFrame(vid)); ok != allowed || pop {
+			t.Errorf("VLAN %v to tap: %v %v", vid, pop, ok)
+		}
+		if _, ok := device.VlanFromTap(vlanFrame(vid)); ok != allowed {
+			t.Errorf("VLAN %v from tap: %v", vid, ok)
+		}
+	}
+	if err := CheckVLANInfo(mtypes.VLANInfo{AllowedVLANs: []uint16{4095}}); err == nil {
+		t.Error("accepted VLAN 4095")
+	}
+
+	// The same MAC address in two VLANs doesn't flap
+	_, src20 := GetL2FIBKey(0, vlanFrame(20))
+	_, src0 := GetL2FIBKey(0, vlanFrame(0))
+	device.learnL2FIB(src20, 2)
+	device.learnL2FIB(src0, 3)
+	device.learnL2FIB(src20, 2)
+	entries := device.GetL2FIB()
+	if len(entries) != 2 || entries[0].VLAN != 0 || entries[0].NodeID != 3 || entries[1].VLAN != 20 || entries[1].NodeID != 2 {
+		t.Fatalf("wrong L2FIB: %+v", entries)
+	}
+	mac := src20.MAC
+	if n := device.FlushL2FIB(&mac, -1, 20); n != 1 {
+		t.Fatalf("flushed %v entries in VLAN 20", n)
+	}
+}
@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// VNet is a virtual network, a tap device with its own L2FIB and broadcast domain.
+// All of them share the peers, the Noise sessions and the graph.
+// VNI 0 is the main network on EdgeConfig.Interface, its frames are sent as NormalPacket.
+type VNet struct {
+	VNI          uint16
+	tap          tap.Device
+	allowedNodes map[mtypes.Vertex]bool // nil for all nodes
+}
+
+func NewVNet(vni uint16, tapDevice tap.Device, allowedNodes []mtypes.Vertex) *VNet {
+	vn := &VNet{
+		VNI: vni,
+		tap: tapDevice,
+	}
+	if len(allowedNodes) > 0 {
+		vn.allowedNodes = make(map[mtypes.Vertex]bool, len(allowedNodes))
+		for _, id := range allowedNodes {
+			vn.allowedNodes[id] = true
+		}
+	}
+	return vn
+}
+
+// Allowed reports whether the frames of this network can be exchanged with the node
+func (vn *VNet) Allowed(id mtypes.Vertex) bool {
+	return vn.allowedNodes == nil || vn.allowedNodes[id]
+}
+
+func CheckVirtualNetworks(nets []mtypes.VirtualNetworkInfo) error {
+	vnis := make(map[uint16]bool, len(nets))
+	for _, n := range nets {
+		if n.VNI == 0 {
+			return fmt.Errorf("VirtualNetworks: VNI 0 is the main network")
+		}
+		if vnis[n.VNI] {
+			return fmt.Errorf("VirtualNetworks: duplicate VNI: %v", n.VNI)
+		}
+		vnis[n.VNI] = true
+		for _, id := range n.AllowedNodes {
+			if id.IsSpecial() {
+				return fmt.Errorf("VirtualNetworks: VNI %v: ID %v is a special NodeID", n.VNI, id)
+			}
+		}
+	}
+	return nil
+}
+
+// AddVNet serves another virtual network and starts reading its tap device.
+// The device owns the tap device after that, it is closed with the device.
+func (device *Device) AddVNet(vn *VNet) error {
+	device.vnets.Lock()
+	defer device.vnets.Unlock()
+	if _, has := device.vnets.m[vn.VNI]; has {
+		return fmt.Errorf("VNI %v is served already", vn.VNI)
+	}
+	device.vnets.m[vn.VNI] = vn
+	go device.RoutineReadFromVNet(vn)
+	return nil
+}
+
+// GetVNet returns the virtual network, nil if this node doesn't serve it
+func (device *Device) GetVNet(vni uint16) *VNet {
+	device.vnets.RLock()
+	defer device.vnets.RUnlock()
+	return device.vnets.m[vni]
+}
+
+func (device *Device) RoutineReadFromVNet(vn *VNet) {
+	device.log.Verbosef("Routine: TUN reader of VNI %v - started", vn.VNI)
+	device.readFromTap(vn)
+	device.log.Verbosef("Routine: TUN reader of VNI %v - stopped", vn.VNI)
+}
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestVNet(t *testing.T) {
+	device := &Device{
+		ID: 1,
+	}
+	device.SetEdgeConfig(&mtypes.EdgeConfig{Multicast: mtypes.MulticastInfo{Mode: McastMode_Snooping}})
+	main := NewVNet(0, nil, nil)
+	vn := NewVNet(5, nil, []mtypes.Vertex{1, 2})
+	if !main.Allowed(3) || !vn.Allowed(2) || vn.Allowed(3) {
+		t.Fatal("wrong AllowedNodes")
+	}
+
+	packet := make([]byte, path.NormalPacketVNI.FrameOffset()+14)
+	path.SetVNI(packet, 5)
+	if vni := path.GetVNI(path.NormalUsage(5), packet); vni != 5 {
+		t.Fatalf("GetVNI() = %v", vni)
+	}
+	if vni := path.GetVNI(path.NormalPacket, packet); vni != 0 {
+		t.Fatalf("GetVNI() of a NormalPacket = %v", vni)
+	}
+
+	// The same MAC address in two networks doesn't flap
+	_, src0 := GetL2FIBKey(0, vlanFrame(0))
+	_, src5 := GetL2FIBKey(5, vlanFrame(0))
+	device.learnL2FIB(src0, 3)
+	device.learnL2FIB(src5, 2)
+	device.learnL2FIB(src0, 3)
+	entries := device.GetL2FIB()
+	if len(entries) != 2 || entries[0].VNI != 0 || entries[0].NodeID != 3 || entries[1].VNI != 5 || entries[1].NodeID != 2 {
+		t.Fatalf("wrong L2FIB: %+v", entries)
+	}
+	mac := src5.MAC
+	if n := device.FlushL2FIB(&mac, 5, -1); n != 1 {
+		t.Fatalf("flushed %v entries in VNI 5", n)
+	}
+
+	// Multicast groups are per network, and nodes that aren't allowed are never a target
+	group := net.ParseIP("239.1.2.3")
+	device.SnoopMcast(vn, 2, igmpFrame(2, 0x16, group))
+	device.SnoopMcast(vn, 3, igmpFrame(3, 0x16, group))
+	if targets, flood := device.McastTargets(vn, udpFrame(group)); flood || !reflect.DeepEqual(targets, []mtypes.Vertex{2}) {
+		t.Errorf("McastTargets() in VNI 5 = %v %v", targets, flood)
+	}
+	if targets, flood := device.McastTargets(main, udpFrame(group)); flood || targets != nil {
+		t.Errorf("McastTargets() in the main network = %v %v", targets, flood)
+	}
+
+	if err := CheckVirtualNetworks([]mtypes.VirtualNetworkInfo{{VNI: 5}, {VNI: 5}}); err == nil {
+		t.Error("accepted a duplicate VNI")
+	}
+	if err := CheckVirtualNetworks([]mtypes.VirtualNetworkInfo{{VNI: 0}}); err == nil {
+		t.Error("accepted VNI 0")
+	}
+}
@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// WireCodec returns the codec this node uses for outgoing control messages.
+//
+// In super mode the supernode picks one codec for the whole network and sends it in every
+// ServerUpdateMsg, because pings and pongs are spread to peers we never negotiated with.
+// In p2p mode we use the best codec every known peer advertised in its PingMsg.
+func (device *Device) WireCodec() mtypes.WireCodec {
+	if device.EdgeConfig().DynamicRoute.SuperNode.UseSuperNode {
+		return mtypes.WireCodec(atomic.LoadUint32(&device.wire_codec))
+	}
+	codecs := mtypes.WireCodecsSupported
+	device.peers.RLock()
+	for _, peer := range device.peers.IDMap {
+		codecs = codecs.Intersect(peer.WireCodecs())
+	}
+	device.peers.RUnlock()
+	return codecs.Best()
+}
+
+// EncodeMsg serializes a control message with the codec returned by WireCodec.
+func (device *Device) EncodeMsg(msg mtypes.WireMessage) ([]byte, error) {
+	return mtypes.EncodeMsg(device.WireCodec(), msg)
+}
+
+// EncodeMsgFor serializes a control message with the best codec the given peer is able to decode.
+// Used by the supernode, which talks to every edge individually.
+func (device *Device) EncodeMsgFor(peer *Peer, msg mtypes.WireMessage) ([]byte, error) {
+	if peer == nil {
+		return mtypes.EncodeMsg(mtypes.WireCodec_Gob, msg)
+	}
+	return mtypes.EncodeMsg(peer.WireCodecs().Intersect(mtypes.WireCodecsSupported).Best(), msg)
+}
+
+func (peer *Peer) WireCodecs() mtypes.WireCodecSet {
+	return mtypes.WireCodecSet(atomic.LoadUint32(&peer.wire_codecs))
+}
+
+func (peer *Peer) SetWireCodecs(codecs mtypes.WireCodecSet) {
+	atomic.StoreUint32(&peer.wire_codecs, uint32(codecs))
+}
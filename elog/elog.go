@@ -0,0 +1,387 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+// Package elog is the structured logger of etherguard.
+//
+// Every record belongs to a subsystem (normal, transit, control, internal, ntp, device)
+// and carries a level. Each subsystem has its own level, which can be changed at runtime.
+// Records are written as plain text, logfmt or JSON:
+//
+//	Control: Recv Ping S:1 D:2 ...                                     (text)
+//	time=2021-10-20T12:00:00Z level=info subsystem=control msg="Recv"  (logfmt)
+//	{"time":"2021-10-20T12:00:00Z","level":"info",...}                 (json)
+//
+// Extra fields are passed as key, value pairs.
+package elog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+type Subsystem int
+
+const (
+	Normal Subsystem = iota
+	Transit
+	Control
+	Internal
+	NTP
+	Device // the wireguard device.Logger
+	numSubsystem
+)
+
+var subsystemNames = [numSubsystem]string{"normal", "transit", "control", "internal", "ntp", "device"}
+
+// textPrefix is the prefix used by the text format, same as the old fmt.Printf logs
+var textPrefix = [numSubsystem]string{"Normal", "Transit", "Control", "Internal", "NTP", "Device"}
+
+func (s Subsystem) ToString() string {
+	if s < 0 || s >= numSubsystem {
+		return "unknown(" + strconv.Itoa(int(s)) + ")"
+	}
+	return subsystemNames[s]
+}
+
+func ParseSubsystem(s string) (Subsystem, error) {
+	for i, name := range subsystemNames {
+		if strings.EqualFold(s, name) {
+			return Subsystem(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log subsystem: %v", s)
+}
+
+type Level int32
+
+const (
+	LevelOff Level = iota
+	LevelError
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"off", "error", "info", "debug"}
+
+func (l Level) ToString() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "unknown(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "silent":
+		return LevelOff, nil
+	case "verbose":
+		return LevelDebug, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %v", s)
+}
+
+type Format int32
+
+const (
+	FormatText Format = iota
+	FormatLogfmt
+	FormatJSON
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "", "text":
+		return FormatText, nil
+	case "logfmt":
+		return FormatLogfmt, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format: %v", s)
+}
+
+var (
+	levels [numSubsystem]int32
+	format int32
+	outMu  sync.Mutex
+	out    io.Writer = os.Stdout
+)
+
+func init() {
+	for s := range levels {
+		levels[s] = int32(LevelError)
+	}
+}
+
+// Setup sets the format and the initial levels from the config.
+//
+// LogLevel sets the device subsystem. LogNormal, LogTransit, LogControl,
+// LogInternal and LogNTP set their subsystem to info, or error if false.
+// DumpNormal raises normal to debug, which includes the packet dumps.
+// Subsystems overrides any of them by name.
+func Setup(info mtypes.LoggerInfo) error {
+	f, err := ParseFormat(info.LogFormat)
+	if err != nil {
+		return err
+	}
+	devlevel := LevelError
+	if info.LogLevel != "" {
+		if devlevel, err = ParseLevel(info.LogLevel); err != nil {
+			return err
+		}
+	}
+	bool2level := func(b bool) Level {
+		if b {
+			return LevelInfo
+		}
+		return LevelError
+	}
+	newlevels := [numSubsystem]Level{
+		Normal:   bool2level(info.LogNormal),
+		Transit:  bool2level(info.LogTransit),
+		Control:  bool2level(info.LogControl),
+		Internal: bool2level(info.LogInternal),
+		NTP:      bool2level(info.LogNTP),
+		Device:   devlevel,
+	}
+	if info.DumpNormal {
+		newlevels[Normal] = LevelDebug
+	}
+	for name, lvstr := range info.Subsystems {
+		s, err := ParseSubsystem(name)
+		if err != nil {
+			return err
+		}
+		if newlevels[s], err = ParseLevel(lvstr); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&format, int32(f))
+	for s, l := range newlevels {
+		SetLevel(Subsystem(s), l)
+	}
+	return nil
+}
+
+func SetOutput(w io.Writer) {
+	outMu.Lock()
+	defer outMu.Unlock()
+	out = w
+}
+
+func SetFormat(f Format) {
+	atomic.StoreInt32(&format, int32(f))
+}
+
+func SetLevel(s Subsystem, l Level) {
+	atomic.StoreInt32(&levels[s], int32(l))
+}
+
+func GetLevel(s Subsystem) Level {
+	return Level(atomic.LoadInt32(&levels[s]))
+}
+
+// Subsystems returns all subsystems in order
+func Subsystems() []Subsystem {
+	ret := make([]Subsystem, numSubsystem)
+	for s := range ret {
+		ret[s] = Subsystem(s)
+	}
+	return ret
+}
+
+// SetLevelStr parses "subsystem:level", or just "level" for all subsystems
+func SetLevelStr(s string) error {
+	var sub, lv string
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		sub, lv = s[:i], s[i+1:]
+	} else {
+		lv = s
+	}
+	level, err := ParseLevel(lv)
+	if err != nil {
+		return err
+	}
+	if sub == "" || sub == "all" {
+		for s := Subsystem(0); s < numSubsystem; s++ {
+			SetLevel(s, level)
+		}
+		return nil
+	}
+	subsystem, err := ParseSubsystem(sub)
+	if err != nil {
+		return err
+	}
+	SetLevel(subsystem, level)
+	return nil
+}
+
+// Enabled reports whether a record of this level would be written.
+// Use it to skip building expensive fields.
+func Enabled(s Subsystem, l Level) bool {
+	return l != LevelOff && l <= GetLevel(s)
+}
+
+func Error(s Subsystem, msg string, kv ...interface{}) {
+	Log(s, LevelError, msg, kv...)
+}
+
+func Info(s Subsystem, msg string, kv ...interface{}) {
+	Log(s, LevelInfo, msg, kv...)
+}
+
+func Debug(s Subsystem, msg string, kv ...interface{}) {
+	Log(s, LevelDebug, msg, kv...)
+}
+
+// Printf returns a printf style function that logs with fixed fields, for device.Logger
+func Printf(s Subsystem, l Level, kv ...interface{}) func(format string, args ...interface{}) {
+	return func(format string, args ...interface{}) {
+		if !Enabled(s, l) {
+			return
+		}
+		Log(s, l, fmt.Sprintf(format, args...), kv...)
+	}
+}
+
+func Log(s Subsystem, l Level, msg string, kv ...interface{}) {
+	if !Enabled(s, l) {
+		return
+	}
+	var buf bytes.Buffer
+	switch Format(atomic.LoadInt32(&format)) {
+	case FormatJSON:
+		writeJSON(&buf, s, l, msg, kv)
+	case FormatLogfmt:
+		writeLogfmt(&buf, s, l, msg, kv)
+	default:
+		writeText(&buf, s, l, msg, kv)
+	}
+	outMu.Lock()
+	out.Write(buf.Bytes())
+	outMu.Unlock()
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case mtypes.Vertex:
+		return v.ToString()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func fieldString(v interface{}) string {
+	switch v := fieldValue(v).(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// pairs calls fn for each key, value. A trailing key without value gets "!MISSING".
+// Keys that clash with the fixed fields are prefixed with "field_".
+func pairs(kv []interface{}, fn func(k string, v interface{})) {
+	for i := 0; i < len(kv); i += 2 {
+		k := fmt.Sprint(kv[i])
+		switch k {
+		case "time", "level", "subsystem", "msg":
+			k = "field_" + k
+		}
+		if i+1 < len(kv) {
+			fn(k, kv[i+1])
+		} else {
+			fn(k, "!MISSING")
+		}
+	}
+}
+
+func writeText(buf *bytes.Buffer, s Subsystem, l Level, msg string, kv []interface{}) {
+	buf.WriteString(textPrefix[s])
+	if l == LevelError {
+		buf.WriteString(" error")
+	}
+	buf.WriteString(": ")
+	buf.WriteString(msg)
+	pairs(kv, func(k string, v interface{}) {
+		buf.WriteByte(' ')
+		buf.WriteString(k)
+		buf.WriteByte(':')
+		buf.WriteString(fieldString(v))
+	})
+	buf.WriteByte('\n')
+}
+
+func logfmtQuote(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || r > '~' {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func writeLogfmt(buf *bytes.Buffer, s Subsystem, l Level, msg string, kv []interface{}) {
+	fmt.Fprintf(buf, "time=%v level=%v subsystem=%v msg=%v", time.Now().Format(time.RFC3339Nano), l.ToString(), s.ToString(), logfmtQuote(msg))
+	pairs(kv, func(k string, v interface{}) {
+		buf.WriteByte(' ')
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtQuote(fieldString(v)))
+	})
+	buf.WriteByte('\n')
+}
+
+func writeJSONField(buf *bytes.Buffer, k string, v interface{}) {
+	kb, _ := json.Marshal(k)
+	buf.Write(kb)
+	buf.WriteByte(':')
+	vb, err := json.Marshal(v)
+	if err != nil {
+		vb, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(vb)
+}
+
+func writeJSON(buf *bytes.Buffer, s Subsystem, l Level, msg string, kv []interface{}) {
+	buf.WriteByte('{')
+	writeJSONField(buf, "time", time.Now().Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeJSONField(buf, "level", l.ToString())
+	buf.WriteByte(',')
+	writeJSONField(buf, "subsystem", s.ToString())
+	buf.WriteByte(',')
+	writeJSONField(buf, "msg", msg)
+	pairs(kv, func(k string, v interface{}) {
+		buf.WriteByte(',')
+		writeJSONField(buf, k, fieldValue(v))
+	})
+	buf.WriteString("}\n")
+}
@@ -0,0 +1,75 @@
+package elog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestFormats(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stdout)
+	SetLevel(Control, LevelInfo)
+	defer SetLevel(Control, LevelError)
+
+	SetFormat(FormatText)
+	Info(Control, "Recv", "src", mtypes.Vertex(1), "endpoint", "1.2.3.4:3000")
+	if got := buf.String(); got != "Control: Recv src:1 endpoint:1.2.3.4:3000\n" {
+		t.Errorf("text: got %q", got)
+	}
+
+	buf.Reset()
+	SetFormat(FormatLogfmt)
+	Error(Control, "Post failed", "err", errors.New("connection refused"), "msg", "x")
+	got := buf.String()
+	if !strings.Contains(got, ` level=error subsystem=control msg="Post failed" err="connection refused" field_msg=x`) {
+		t.Errorf("logfmt: got %q", got)
+	}
+
+	buf.Reset()
+	SetFormat(FormatJSON)
+	defer SetFormat(FormatText)
+	Info(Control, "Recv", "src", mtypes.NodeID_SuperNode, "ttl", uint8(200), "msg", "dup")
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("json: %v %q", err, buf.String())
+	}
+	if record["subsystem"] != "control" || record["msg"] != "Recv" || record["src"] != "Super" || record["ttl"] != float64(200) || record["field_msg"] != "dup" {
+		t.Errorf("json: got %v", record)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stdout)
+	defer Setup(mtypes.LoggerInfo{})
+
+	if err := Setup(mtypes.LoggerInfo{LogLevel: "verbose", LogTransit: true, Subsystems: map[string]string{"ntp": "off"}}); err != nil {
+		t.Fatal(err)
+	}
+	if GetLevel(Device) != LevelDebug || GetLevel(Transit) != LevelInfo || GetLevel(Control) != LevelError || GetLevel(NTP) != LevelOff {
+		t.Errorf("unexpected levels after Setup")
+	}
+	Info(Control, "hidden")
+	Error(NTP, "hidden")
+	if buf.Len() != 0 {
+		t.Errorf("expect nothing written, got %q", buf.String())
+	}
+
+	if err := SetLevelStr("control:debug"); err != nil || GetLevel(Control) != LevelDebug {
+		t.Errorf("set control:debug: %v", err)
+	}
+	if err := SetLevelStr("info"); err != nil || GetLevel(NTP) != LevelInfo || GetLevel(Device) != LevelInfo {
+		t.Errorf("set all to info: %v", err)
+	}
+	if SetLevelStr("nosuch:info") == nil || SetLevelStr("control:loud") == nil {
+		t.Error("expect error for unknown subsystem or level")
+	}
+}
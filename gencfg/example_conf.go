@@ -43,8 +43,46 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 		PostScript:   "",
 		DefaultTTL:   200,
 		L2FIBTimeout: 3600,
-		PrivKey:      "6GyDagZKhbm5WNqMiRHhkf43RlbMJ34IieTlIuvfJ1M=",
-		ListenPort:   0,
+		Multicast: mtypes.MulticastInfo{
+			Mode:         "flood",
+			FloodUnknown: true,
+			GroupTimeout: 260,
+		},
+		NeighborProxy: mtypes.NeighborProxyInfo{
+			Enabled: false,
+			Timeout: 300,
+		},
+		StaticL2FIB: []mtypes.StaticL2FIBEntry{},
+		VLAN: mtypes.VLANInfo{
+			AllowedVLANs: []uint16{},
+			AccessVLAN:   0,
+		},
+		VirtualNetworks: []mtypes.VirtualNetworkInfo{},
+		Firewall: mtypes.FirewallInfo{
+			DefaultAction: "accept",
+			Rules:         []mtypes.FirewallRule{},
+		},
+		Shaping: mtypes.ShapingInfo{
+			Peers:        []mtypes.ShapingRule{},
+			Destinations: []mtypes.ShapingRule{},
+		},
+		PMTU: mtypes.PMTUInfo{
+			Enabled:       false,
+			ProbeInterval: 600,
+			MinSize:       576,
+			TooBig:        false,
+		},
+		PrivKey:        "6GyDagZKhbm5WNqMiRHhkf43RlbMJ34IieTlIuvfJ1M=",
+		ListenPort:     0,
+		ListenPort_TCP: "",
+		Obfuscation: mtypes.ObfuscationInfo{
+			Enabled:    false,
+			Secret:     "",
+			MaxPadding: 64,
+		},
+		ListenPort_Metrics:   "",
+		ListenPort_ManageAPI: "",
+		Password_ManageAPI:   "",
 		DisableAf: conn.EnabledAf{
 			IPv4: false,
 			IPv6: false,
@@ -52,11 +90,13 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 		AfPrefer: 4,
 		LogLevel: mtypes.LoggerInfo{
 			LogLevel:    "error",
+			LogFormat:   "text",
 			LogTransit:  false,
 			LogControl:  true,
 			LogNormal:   false,
 			LogInternal: true,
 			LogNTP:      true,
+			Subsystems:  map[string]string{},
 		},
 		DynamicRoute: mtypes.DynamicRouteInfo{
 			SendPingInterval:     16,
@@ -66,6 +106,7 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 			ConnNextTry:          5,
 			AdditionalCost:       10,
 			DampingFilterRadius:  4,
+			MeasureThroughput:    false,
 			SaveNewPeers:         true,
 			SuperNode: mtypes.SuperInfo{
 				UseSuperNode:         true,
@@ -76,8 +117,24 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 				PubKeyV6:             "HCfL6YJtpJEGHTlJ2LgVXIWKB/K95P57LHTJ42ZG8VI=",
 				EndpointEdgeAPIUrl:   "http://127.0.0.1:3000/eg_api",
 				SuperNodeInfoTimeout: 50,
-				SkipLocalIP:          false,
-				AdditionalLocalIP:    []string{"11.11.11.11:11111"},
+				NATDetectInterval:    300,
+				PortMapping: mtypes.PortMappingInfo{
+					Enabled:   false,
+					Protocols: []string{},
+					Gateway:   "",
+					Lifetime:  3600,
+				},
+				SkipLocalIP:       false,
+				AdditionalLocalIP: []string{"11.11.11.11:11111"},
+				Backups: []mtypes.SuperBackupInfo{
+					{
+						EndpointV4:         "127.0.0.2:3000",
+						PubKeyV4:           "0Xbbr6Vm7FIUL+/N5oylgXrZpFaGoyj2ibT9Vm+4IUk=",
+						EndpointV6:         "",
+						PubKeyV6:           "",
+						EndpointEdgeAPIUrl: "http://127.0.0.2:3000/eg_api",
+					},
+				},
 			},
 			P2P: mtypes.P2PInfo{
 				UseP2P:           false,
@@ -88,6 +145,11 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 					JitterToleranceMultiplier: 1.1,
 					TimeoutCheckInterval:      5,
 					RecalculateCoolDown:       5,
+					RouteSolver:               "floyd",
+					ECMPTolerance:             0,
+					LinkMetric:                "latency",
+					LossPenalty:               10,
+					ReferenceBandwidth:        0,
 					ManualLatency: mtypes.DistTable{
 						mtypes.Vertex(1): {
 							mtypes.Vertex(2): 1.14,
@@ -184,6 +246,7 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 		econfig.DynamicRoute.SuperNode.EndpointV4 = ""
 		econfig.DynamicRoute.SuperNode.EndpointV6 = ""
 		econfig.DynamicRoute.SuperNode.AdditionalLocalIP = make([]string, 0)
+		econfig.DynamicRoute.SuperNode.Backups = make([]mtypes.SuperBackupInfo, 0)
 	}
 	return econfig, &fs.PathError{Path: "", Err: fmt.Errorf("no path provided")}
 }
@@ -204,21 +267,31 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 	random_passwd := mtypes.RandomStr(8, "passwd")
 
 	sconfig = mtypes.SuperConfig{
-		NodeName:             "NodeSuper",
-		PostScript:           "",
-		PrivKeyV4:            "mL5IW0GuqbjgDeOJuPHBU2iJzBPNKhaNEXbIGwwYWWk=",
-		PrivKeyV6:            "+EdOKIoBp/EvIusHDsvXhV1RJYbyN3Qr8nxlz35wl3I=",
-		ListenPort:           3000,
-		ListenPort_EdgeAPI:   "3000",
+		NodeName:           "NodeSuper",
+		PostScript:         "",
+		PrivKeyV4:          "mL5IW0GuqbjgDeOJuPHBU2iJzBPNKhaNEXbIGwwYWWk=",
+		PrivKeyV6:          "+EdOKIoBp/EvIusHDsvXhV1RJYbyN3Qr8nxlz35wl3I=",
+		ListenPort:         3000,
+		ListenPort_TCP:     "",
+		ListenPort_EdgeAPI: "3000",
+		WebSocket:          false,
+		Obfuscation: mtypes.ObfuscationInfo{
+			Enabled:    false,
+			Secret:     "",
+			MaxPadding: 64,
+		},
 		ListenPort_ManageAPI: "3000",
+		ListenPort_Metrics:   "",
 		API_Prefix:           "/eg_api",
 		LogLevel: mtypes.LoggerInfo{
 			LogLevel:    "error",
+			LogFormat:   "text",
 			LogTransit:  false,
 			LogControl:  true,
 			LogNormal:   false,
 			LogInternal: true,
 			LogNTP:      true,
+			Subsystems:  map[string]string{},
 		},
 		RePushConfigInterval:  30,
 		PeerAliveTimeout:      70,
@@ -226,6 +299,32 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 		HttpPostInterval:      50,
 		SendPingInterval:      15,
 		ResetEndPointInterval: 600,
+		Cluster: mtypes.SuperClusterInfo{
+			Members:       []string{"http://127.0.0.2:3000/eg_api"},
+			Secret:        random_passwd + "_cluster",
+			Priority:      0,
+			SyncInterval:  1,
+			LeaderTimeout: 5,
+		},
+		StateStore: mtypes.SuperStateStoreInfo{
+			Path:         "",
+			SaveInterval: 60,
+			MaxAge:       600,
+		},
+		NATTraversal: mtypes.SuperNATTraversalInfo{
+			DetectPort:    3001,
+			PunchInterval: 30,
+			PunchDelay:    1,
+		},
+		Relay: mtypes.SuperRelayInfo{
+			Enabled:        false,
+			AdditionalCost: 200,
+			Bandwidth:      100,
+		},
+		ACL: mtypes.ACLInfo{
+			Enabled: false,
+			Rules:   []mtypes.ACLRule{},
+		},
 		Passwords: mtypes.Passwords{
 			ShowState:   random_passwd + "_showstate",
 			AddPeer:     random_passwd + "_addpeer",
@@ -253,6 +352,11 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 			JitterToleranceMultiplier: 1.01,
 			TimeoutCheckInterval:      5,
 			RecalculateCoolDown:       5,
+			RouteSolver:               "floyd",
+			ECMPTolerance:             0,
+			LinkMetric:                "latency",
+			LossPenalty:               10,
+			ReferenceBandwidth:        0,
 		},
 		NextHopTable: mtypes.NextHopTable{
 			mtypes.Vertex(1): {
@@ -283,6 +387,7 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 	}
 	if !getDemo {
 		sconfig.Peers = []mtypes.SuperPeerInfo{}
+		sconfig.Cluster.Members = []string{}
 		sconfig.NextHopTable = make(mtypes.NextHopTable)
 		sconfig.GraphRecalculateSetting.ManualLatency = make(mtypes.DistTable)
 	}
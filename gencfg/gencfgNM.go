@@ -110,6 +110,9 @@ func GenNMCfg(NMCinfigPath string, enableP2P bool, printExample bool) (err error
 		if !all_verts[NodeID] {
 			return fmt.Errorf("duplicate definition: NodeID %v ", NodeID)
 		}
+		if NodeID.IsSpecial() {
+			return fmt.Errorf("NodeID %v is a special NodeID", NodeID)
+		}
 		if endpoint != "" {
 			_, _, err = conn.LookupIP(endpoint, conn.EnabledAf46, 0)
 			if err != nil {
@@ -148,10 +151,7 @@ func GenNMCfg(NMCinfigPath string, enableP2P bool, printExample bool) (err error
 			return err
 		}
 	} else {
-		pbyte := mtypes.RandomBytes(4, []byte{0xaa, 0xbb, 0xcc, 0xdd})
-		pbyte[0] &^= 0b00000001
-		pbyte[0] |= 0b00000010
-		NMCfg.EdgeNode.MacPrefix = fmt.Sprintf("%02X:%02X:%02X:%02X", pbyte[0], pbyte[1], pbyte[2], pbyte[3])
+		NMCfg.EdgeNode.MacPrefix = RandomMacPrefix(MaxNodeID)
 	}
 
 	dist, dist_noAC, next, err := g.FloydWarshall(false)
@@ -204,12 +204,7 @@ func GenNMCfg(NMCinfigPath string, enableP2P bool, printExample bool) (err error
 	if enableP2P {
 		econfig.NextHopTable = make(mtypes.NextHopTable)
 	}
-	ModeIDmax := 0
-	for id, _ := range NMCfg.NetworkName {
-		if ModeIDmax < id {
-			ModeIDmax = id
-		}
-	}
+	ModeIDmax := MaxNodeID
 	IPv4Block := NMCfg.EdgeNode.IPv4Range
 	if IPv4Block != "" {
 		_, _, err = tap.GetIP(4, IPv4Block, uint32(ModeIDmax))
@@ -45,8 +45,8 @@ func readFLn(promptF string, checkFn func(string) error, defaultAns func() strin
 	return text
 }
 
-func ParseIDs(s string) ([]int, int, int, error) {
-	ret := make([]int, 0)
+func ParseIDs(s string) ([]mtypes.Vertex, mtypes.Vertex, mtypes.Vertex, error) {
+	ret := make([]mtypes.Vertex, 0)
 	if len(s) <= 3 {
 		return ret, 0, 0, fmt.Errorf("Parse Error: %v", s)
 	}
@@ -58,57 +58,72 @@ func ParseIDs(s string) ([]int, int, int, error) {
 	}
 	s = s[1 : len(s)-1]
 	as := strings.Split(s, ",")
-	min := math.MaxUint16
-	max := 0
+	min := mtypes.Vertex(math.MaxUint32)
+	max := mtypes.Vertex(0)
 	for i, es := range as {
 		if strings.Contains(es, "~") {
 			esl := strings.SplitN(es, "~", 2)
-			si, err := strconv.ParseInt(esl[0], 10, 16)
+			si, err := mtypes.String2NodeID(esl[0])
 			if err != nil {
 				return ret, min, max, err
 			}
-			ei, err := strconv.ParseInt(esl[1], 10, 16)
+			ei, err := mtypes.String2NodeID(esl[1])
 			if err != nil {
 				return ret, min, max, err
 			}
 			if si >= ei {
 				return ret, min, max, fmt.Errorf("end %v must > start %v", ei, si)
 			}
-			if int(si) < 0 {
-				return ret, min, max, fmt.Errorf("node ID < 0 at element %v", i)
+			if si <= mtypes.NodeID_Broadcast && ei >= mtypes.NodeID_Special {
+				return ret, min, max, fmt.Errorf("special node ID in the %vth element: %v", i, es)
 			}
-			if min > int(si) {
-				min = int(si)
+			if min > si {
+				min = si
 			}
-			if int(si) < max {
+			if si < max {
 				return ret, min, max, fmt.Errorf("list out of order at the %vth element: %v", i, es)
-			} else if int(si) == max {
+			} else if si == max {
 				return ret, min, max, fmt.Errorf("duplicate id in the %vth element: %v", i, es)
 			}
-			max = int(ei)
-			for ; si <= ei; si++ {
-				ret = append(ret, int(si))
+			max = ei
+			for ; si < ei; si++ {
+				ret = append(ret, si)
 			}
+			ret = append(ret, ei)
 		} else {
-			si, err := strconv.ParseInt(es, 10, 16)
+			si, err := mtypes.String2NodeID(es)
 			if err != nil {
 				return ret, min, max, err
 			}
-			if int(si) < max {
+			if si.IsSpecial() {
+				return ret, min, max, fmt.Errorf("special node ID in the %vth element: %v", i, es)
+			}
+			if si < max {
 				return ret, min, max, fmt.Errorf("List out of order at the %vth element!", i)
-			} else if int(si) == max {
+			} else if si == max {
 				return ret, min, max, fmt.Errorf("duplicate id in the %vth element", i)
 			}
-			if min > int(si) {
-				min = int(si)
+			if min > si {
+				min = si
 			}
-			max = int(si)
-			ret = append(ret, int(si))
+			max = si
+			ret = append(ret, si)
 		}
 	}
 	return ret, min, max, nil
 }
 
+// RandomMacPrefix makes a locally administered MacAddrPrefix with room for maxID after it
+func RandomMacPrefix(maxID mtypes.Vertex) string {
+	pbyte := mtypes.RandomBytes(4, []byte{0xaa, 0xbb, 0xcc, 0xdd})
+	pbyte[0] &^= 0b00000001
+	pbyte[0] |= 0b00000010
+	if maxID > mtypes.NodeID_MaxNarrow {
+		return fmt.Sprintf("%02X:%02X", pbyte[0], pbyte[1])
+	}
+	return fmt.Sprintf("%02X:%02X:%02X:%02X", pbyte[0], pbyte[1], pbyte[2], pbyte[3])
+}
+
 func printExampleSMCfg() {
 	tconfig := SMCfg{}
 	toprint, _ := yaml.Marshal(tconfig)
@@ -198,6 +213,9 @@ func GenSuperCfg(SMCinfigPath string, printExample bool) (err error) {
 	sconfig.ListenPort, _ = strconv.Atoi(ListenPort)
 	sconfig.ListenPort_EdgeAPI = ListenPort
 	sconfig.ListenPort_ManageAPI = ListenPort
+	if sconfig.ListenPort < 65535 {
+		sconfig.NATTraversal.DetectPort = sconfig.ListenPort + 1
+	}
 	sconfig.EdgeTemplate = SMCfg.EdgeConfigTemplate
 
 	NodeIDs, _, ModeIDmax, err := ParseIDs(SMCfg.EdgeNode.NodeIDs)
@@ -212,10 +230,7 @@ func GenSuperCfg(SMCinfigPath string, printExample bool) (err error) {
 			return err
 		}
 	} else {
-		pbyte := mtypes.RandomBytes(4, []byte{0xaa, 0xbb, 0xcc, 0xdd})
-		pbyte[0] &^= 0b00000001
-		pbyte[0] |= 0b00000010
-		MacPrefix = fmt.Sprintf("%02X:%02X:%02X:%02X", pbyte[0], pbyte[1], pbyte[2], pbyte[3])
+		MacPrefix = RandomMacPrefix(ModeIDmax)
 	}
 
 	IPv4Block := SMCfg.EdgeNode.IPv4Range
@@ -242,18 +257,17 @@ func GenSuperCfg(SMCinfigPath string, printExample bool) (err error) {
 		}
 	}
 
-	SuperPeerInfo := make([]mtypes.SuperPeerInfo, 0, ModeIDmax)
+	SuperPeerInfo := make([]mtypes.SuperPeerInfo, 0, len(NodeIDs))
 	PrivKeyS4, PubKeyS4 := device.RandomKeyPair()
 	PrivKeyS6, PubKeyS6 := device.RandomKeyPair()
 	sconfig.PrivKeyV4 = PrivKeyS4.ToString()
 	sconfig.PrivKeyV6 = PrivKeyS6.ToString()
 	allec := make(map[mtypes.Vertex]mtypes.EdgeConfig)
 	peerceconf, _ := GetExampleEdgeConf(sconfig.EdgeTemplate, false)
-	for _, ii := range NodeIDs {
-		i := mtypes.Vertex(ii)
+	for _, i := range NodeIDs {
 		PSKeyE := device.RandomPSK()
 		PrivKeyE, PubKeyE := device.RandomKeyPair()
-		idstr := fmt.Sprintf("%0"+strconv.Itoa(len(strconv.Itoa(ModeIDmax)))+"d", i)
+		idstr := fmt.Sprintf("%0"+strconv.Itoa(len(ModeIDmax.ToString()))+"d", i)
 
 		allec[i] = peerceconf
 		if EndpointV4 != "" {
@@ -263,6 +277,7 @@ func GenSuperCfg(SMCinfigPath string, printExample bool) (err error) {
 			peerceconf.DynamicRoute.SuperNode.EndpointV6 = EndpointV6 + ":" + ListenPort
 		}
 		peerceconf.DynamicRoute.SuperNode.EndpointEdgeAPIUrl = EndpointEdgeAPIUrl
+		peerceconf.Obfuscation = sconfig.Obfuscation
 		peerceconf.NodeName = SMCfg.NetworkName
 		peerceconf.Interface.Name = SMCfg.NetworkName
 		if SMCfg.NetworkIFNameID {
@@ -20,6 +20,7 @@ import (
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
@@ -52,21 +53,13 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	if len(NodeName) > 32 {
 		return errors.New("Node name can't longer than 32 :" + NodeName)
 	}
-	var logLevel int
-	switch econfig.LogLevel.LogLevel {
-	case "verbose", "debug":
-		logLevel = device.LogLevelVerbose
-	case "error":
-		logLevel = device.LogLevelError
-	case "silent":
-		logLevel = device.LogLevelSilent
-	default:
-		logLevel = device.LogLevelError
-	}
-	logger := device.NewLogger(
-		logLevel,
-		fmt.Sprintf("(%s) ", NodeName),
-	)
+	if err = elog.Setup(econfig.LogLevel); err != nil {
+		return err
+	}
+	logger := &device.Logger{
+		Verbosef: elog.Printf(elog.Device, elog.LevelDebug, "node", NodeName),
+		Errorf:   elog.Printf(elog.Device, elog.LevelError, "node", NodeName),
+	}
 
 	if err != nil {
 		logger.Errorf("UAPI listen error: %v", err)
@@ -74,32 +67,8 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		return
 	}
 
-	var thetap tap.Device
 	// open TUN device (or use supplied fd)
-	switch econfig.Interface.IType {
-	case "dummy":
-		thetap, err = tap.CreateDummyTAP()
-	case "stdio":
-		thetap, err = tap.CreateStdIOTAP(econfig.Interface, econfig.NodeID)
-	case "udpsock":
-		thetap, err = tap.CreateUDPSockTAP(econfig.Interface, econfig.NodeID)
-	case "tcpsock":
-		thetap, err = tap.CreateSockTAP(econfig.Interface, "tcp", econfig.NodeID, econfig.LogLevel)
-	case "unixsock":
-		thetap, err = tap.CreateSockTAP(econfig.Interface, "unix", econfig.NodeID, econfig.LogLevel)
-	case "unixgramsock":
-		thetap, err = tap.CreateSockTAP(econfig.Interface, "unixgram", econfig.NodeID, econfig.LogLevel)
-	case "unixpacketsock":
-		thetap, err = tap.CreateSockTAP(econfig.Interface, "unixpacket", econfig.NodeID, econfig.LogLevel)
-	case "fd":
-		thetap, err = tap.CreateFdTAP(econfig.Interface, econfig.NodeID)
-	case "vpp":
-		thetap, err = tap.CreateVppTAP(econfig.Interface, econfig.NodeID, econfig.LogLevel.LogLevel)
-	case "tap":
-		thetap, err = tap.CreateTAP(econfig.Interface, econfig.NodeID)
-	default:
-		return errors.New("Unknown interface type:" + econfig.Interface.IType)
-	}
+	thetap, err := edge_create_tap(econfig.Interface, &econfig)
 	if err != nil {
 		logger.Errorf("Failed to create TAP device: %v", err)
 		os.Exit(ExitSetupFailed)
@@ -108,11 +77,51 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	if econfig.DefaultTTL <= 0 {
 		return errors.New("DefaultTTL must > 0")
 	}
+	if err := device.CheckMulticastInfo(econfig.Multicast); err != nil {
+		return err
+	}
+	staticL2FIB, err := device.CheckStaticL2FIB(econfig.StaticL2FIB)
+	if err != nil {
+		return err
+	}
+	if err := device.CheckVLANInfo(econfig.VLAN); err != nil {
+		return err
+	}
+	if err := device.CheckVirtualNetworks(econfig.VirtualNetworks); err != nil {
+		return err
+	}
+	firewall, err := device.CheckFirewall(econfig.Firewall)
+	if err != nil {
+		return err
+	}
+	shaping, err := device.CheckShaping(econfig.Shaping)
+	if err != nil {
+		return err
+	}
+	if err := device.CheckPMTU(econfig.PMTU); err != nil {
+		return err
+	}
+	if err := device.CheckPortMapping(econfig.DynamicRoute.SuperNode.PortMapping); err != nil {
+		return err
+	}
+	if err := CheckEdgeManageAPI(econfig.ListenPort_ManageAPI, econfig.Password_ManageAPI); err != nil {
+		return err
+	}
+	vnets := make([]*device.VNet, 0, len(econfig.VirtualNetworks))
+	for _, vnconf := range econfig.VirtualNetworks {
+		vntap, err := edge_create_tap(vnconf.Interface, &econfig)
+		if err != nil {
+			logger.Errorf("Failed to create TAP device of VNI %v: %v", vnconf.VNI, err)
+			os.Exit(ExitSetupFailed)
+		}
+		vnets = append(vnets, device.NewVNet(vnconf.VNI, vntap, vnconf.AllowedNodes))
+	}
 
 	////////////////////////////////////////////////////
 	// Config
 	if !econfig.DynamicRoute.P2P.UseP2P && !econfig.DynamicRoute.SuperNode.UseSuperNode {
 		econfig.LogLevel.LogNTP = false // NTP in static mode is useless
+		elog.SetLevel(elog.NTP, elog.LevelOff)
 	}
 	graph, err := path.NewGraph(3, false, econfig.DynamicRoute.P2P.GraphRecalculateSetting, econfig.DynamicRoute.NTPConfig, econfig.LogLevel)
 	if err != nil {
@@ -122,7 +131,13 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 
 	EnabledAf := econfig.DisableAf.Disalbed2Enabled()
 
-	the_device := device.NewDevice(thetap, econfig.NodeID, conn.NewDefaultBind(EnabledAf, bindmode, econfig.FwMark), logger, graph, false, configPath, &econfig, nil, nil, Version)
+	var bind conn.Bind = conn.NewMultiBind(conn.NewDefaultBind(EnabledAf, bindmode, econfig.FwMark), conn.NewTCPBind(EnabledAf, econfig.ListenPort_TCP), conn.NewWSBind())
+	if econfig.Obfuscation.Enabled {
+		if bind, err = conn.NewObfsBind(bind, econfig.Obfuscation.Secret, econfig.Obfuscation.MaxPadding); err != nil {
+			return err
+		}
+	}
+	the_device := device.NewDevice(thetap, econfig.NodeID, bind, logger, graph, false, configPath, &econfig, nil, nil, Version)
 	defer the_device.Close()
 	pk, err := device.Str2PriKey(econfig.PrivKey)
 	if err != nil {
@@ -130,6 +145,14 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		return err
 	}
 	the_device.SetPrivateKey(pk)
+	the_device.SetStaticL2FIB(staticL2FIB)
+	the_device.SetFirewall(firewall)
+	the_device.SetShaping(shaping)
+	for _, vn := range vnets {
+		if err := the_device.AddVNet(vn); err != nil {
+			return err
+		}
+	}
 	the_device.IpcSet("fwmark=" + fmt.Sprint(econfig.FwMark) + "\n")
 	the_device.IpcSet("listen_port=" + strconv.Itoa(econfig.ListenPort) + "\n")
 	the_device.IpcSet("replace_peers=true\n")
@@ -151,71 +174,39 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	}
 
 	if econfig.DynamicRoute.SuperNode.UseSuperNode {
-		S4 := true
-		S6 := true
-		if econfig.DynamicRoute.SuperNode.EndpointV4 != "" && EnabledAf.IPv4 {
-			pk, err := device.Str2PubKey(econfig.DynamicRoute.SuperNode.PubKeyV4)
-			if err != nil {
-				fmt.Println("Error decode base64 ", err)
-				return err
-			}
-			psk, err := device.Str2PSKey(econfig.DynamicRoute.SuperNode.PSKey)
-			if err != nil {
-				fmt.Println("Error decode base64 ", err)
-				return err
-			}
-			peer, err := the_device.NewPeer(pk, mtypes.NodeID_SuperNode, true, 0)
-			if err != nil {
-				return err
-			}
-			peer.SetPSK(psk)
-			StaticSuper := true
-			sc := econfig.DynamicRoute.SuperNode.EndpointV4
-			if strings.Contains(sc, ":") {
-				i := strings.LastIndex(sc, ":")
-				sch := sc[:i]
-				if sch == "127.0.0.1" {
-					StaticSuper = false
+		SuperInfo := econfig.DynamicRoute.SuperNode
+		supers := append([]mtypes.SuperBackupInfo{{
+			EndpointV4:         SuperInfo.EndpointV4,
+			PubKeyV4:           SuperInfo.PubKeyV4,
+			EndpointV6:         SuperInfo.EndpointV6,
+			PubKeyV6:           SuperInfo.PubKeyV6,
+			EndpointEdgeAPIUrl: SuperInfo.EndpointEdgeAPIUrl,
+		}}, SuperInfo.Backups...)
+		connected := false
+		for _, super := range supers {
+			if super.EndpointV4 != "" && EnabledAf.IPv4 {
+				err = edge_add_supernode(the_device, super.PubKeyV4, SuperInfo.PSKey, super.EndpointV4, "127.0.0.1", super.EndpointEdgeAPIUrl, EnabledAf.GetOnly4())
+				if err == nil {
+					connected = true
+				} else if errors.Is(err, errSuperEndpoint) {
+					logger.Errorf("Failed to set endpoint for supernode v4 %v: %v", super.EndpointV4, err)
+				} else {
+					return err
 				}
 			}
-			err = peer.SetEndpointFromConnURL(econfig.DynamicRoute.SuperNode.EndpointV4, EnabledAf.GetOnly4(), 0, StaticSuper)
-			if err != nil {
-				logger.Errorf("Failed to set endpoint for supernode v4 %v: %v", econfig.DynamicRoute.SuperNode.EndpointV4, err)
-				S4 = false
-			}
-		}
-		if econfig.DynamicRoute.SuperNode.EndpointV6 != "" && EnabledAf.IPv6 {
-			pk, err := device.Str2PubKey(econfig.DynamicRoute.SuperNode.PubKeyV6)
-			if err != nil {
-				fmt.Println("Error decode base64 ", err)
-			}
-			psk, err := device.Str2PSKey(econfig.DynamicRoute.SuperNode.PSKey)
-			if err != nil {
-				fmt.Println("Error decode base64 ", err)
-				return err
-			}
-			peer, err := the_device.NewPeer(pk, mtypes.NodeID_SuperNode, true, 0)
-			if err != nil {
-				return err
-			}
-			peer.SetPSK(psk)
-			StaticSuper := true
-			sc := econfig.DynamicRoute.SuperNode.EndpointV6
-			if strings.Contains(sc, ":") {
-				i := strings.LastIndex(sc, ":")
-				sch := sc[:i]
-				if sch == "[::1]" {
-					StaticSuper = false
+			if super.EndpointV6 != "" && EnabledAf.IPv6 {
+				err = edge_add_supernode(the_device, super.PubKeyV6, SuperInfo.PSKey, super.EndpointV6, "[::1]", super.EndpointEdgeAPIUrl, EnabledAf.GetOnly6())
+				if err == nil {
+					connected = true
+				} else if errors.Is(err, errSuperEndpoint) {
+					logger.Errorf("Failed to set endpoint for supernode v6 %v: %v", super.EndpointV6, err)
+				} else {
+					return err
 				}
 			}
-			err = peer.SetEndpointFromConnURL(econfig.DynamicRoute.SuperNode.EndpointV6, EnabledAf.GetOnly6(), 0, StaticSuper)
-			if err != nil {
-				logger.Errorf("Failed to set endpoint for supernode v6 %v: %v", econfig.DynamicRoute.SuperNode.EndpointV6, err)
-				S6 = false
-			}
-			if !(S4 || S6) {
-				return errors.New("failed to connect to supernode")
-			}
+		}
+		if !connected {
+			return errors.New("failed to connect to supernode")
 		}
 	}
 
@@ -227,22 +218,28 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	if useUAPI {
 		startUAPI(NodeName, logger, the_device, errs)
 	}
+	MetricsServer(econfig.ListenPort_Metrics, []metrics_device{{econfig.NodeName, the_device}}, graph, errs)
+	EdgeManageServer(econfig.ListenPort_ManageAPI, econfig.Password_ManageAPI, the_device, errs)
 
 	if econfig.PostScript != "" {
 		envs := make(map[string]string)
 		nid := econfig.NodeID
-		nid_bytearr := []byte{0, 0}
+		nid_bytearr := []byte{0, 0, 0, 0}
 		MacAddr, _ := tap.GetMacAddr(econfig.Interface.MacAddrPrefix, uint32(nid))
-		binary.LittleEndian.PutUint16(nid_bytearr, uint16(nid))
+		binary.LittleEndian.PutUint32(nid_bytearr, uint32(nid))
 
 		envs["EG_MODE"] = "edge"
 		envs["EG_NODE_NAME"] = econfig.NodeName
 		envs["EG_NODE_ID_INT_DEC"] = fmt.Sprintf("%d", nid)
 		envs["EG_NODE_ID_BYTE0_DEC"] = fmt.Sprintf("%d", nid_bytearr[0])
 		envs["EG_NODE_ID_BYTE1_DEC"] = fmt.Sprintf("%d", nid_bytearr[1])
+		envs["EG_NODE_ID_BYTE2_DEC"] = fmt.Sprintf("%d", nid_bytearr[2])
+		envs["EG_NODE_ID_BYTE3_DEC"] = fmt.Sprintf("%d", nid_bytearr[3])
 		envs["EG_NODE_ID_INT_HEX"] = fmt.Sprintf("%x", nid)
 		envs["EG_NODE_ID_BYTE0_HEX"] = fmt.Sprintf("%X", nid_bytearr[0])
 		envs["EG_NODE_ID_BYTE1_HEX"] = fmt.Sprintf("%X", nid_bytearr[1])
+		envs["EG_NODE_ID_BYTE2_HEX"] = fmt.Sprintf("%X", nid_bytearr[2])
+		envs["EG_NODE_ID_BYTE3_HEX"] = fmt.Sprintf("%X", nid_bytearr[3])
 		envs["EG_INTERFACE_NAME"] = econfig.Interface.Name
 		envs["EG_INTERFACE_TYPE"] = econfig.Interface.IType
 		envs["EG_INTERFACE_MAC_PREFIX"] = econfig.Interface.MacAddrPrefix
@@ -252,9 +249,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		if err != nil {
 			return fmt.Errorf("error parse PostScript %v", err)
 		}
-		if econfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript: exec.Command(%v)\n", cmdarg)
-		}
+		elog.Info(elog.Internal, "PostScript: exec.Command", "cmd", cmdarg)
 		cmd := exec.Command(cmdarg[0], cmdarg[1:]...)
 		cmd.Env = os.Environ()
 		for k, v := range envs {
@@ -264,30 +259,102 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		if err != nil {
 			return fmt.Errorf("exec.Command(%v) failed with %v", cmdarg, err)
 		}
-		if econfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript output: %s\n", string(out))
-		}
+		elog.Info(elog.Internal, "PostScript output", "output", string(out))
 	}
 
 	// wait for program to terminate
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, os.Interrupt)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	the_device.Chan_Device_Initialized <- struct{}{}
 	mtypes.SdNotify(false, mtypes.SdNotifyReady)
 	SdNotify, err := mtypes.SdNotify(false, mtypes.SdNotifyReady)
-	if econfig.LogLevel.LogInternal {
-		fmt.Printf("Internal: SdNotify:%v err:%v\n", SdNotify, err)
-	}
+	elog.Info(elog.Internal, "SdNotify", "result", SdNotify, "err", err)
 
-	select {
-	case <-term:
-	case <-errs:
-	case errcode := <-the_device.Wait():
-		if errcode != 0 {
-			return syscall.Errno(errcode)
+	reload := func() {
+		if err := edge_reload(the_device, graph, configPath); err != nil {
+			elog.Error(elog.Internal, "Reload failed, keep running with the old config", "path", configPath, "err", err)
+		}
+	}
+wait:
+	for {
+		select {
+		case <-hup:
+			reload()
+		case <-the_device.Chan_Reload:
+			reload()
+		case <-term:
+			break wait
+		case <-errs:
+			break wait
+		case errcode := <-the_device.Wait():
+			if errcode != 0 {
+				return syscall.Errno(errcode)
+			}
+			break wait
 		}
 	}
 	logger.Verbosef("Shutting down")
 	return
 }
+
+var errSuperEndpoint = errors.New("failed to set supernode endpoint")
+
+func edge_add_supernode(the_device *device.Device, PubKey string, PSKey string, EndPoint string, loopback string, EdgeAPIUrl string, af conn.EnabledAf) error {
+	pk, err := device.Str2PubKey(PubKey)
+	if err != nil {
+		fmt.Println("Error decode base64 ", err)
+		return err
+	}
+	psk, err := device.Str2PSKey(PSKey)
+	if err != nil {
+		fmt.Println("Error decode base64 ", err)
+		return err
+	}
+	peer, err := the_device.NewPeer(pk, mtypes.NodeID_SuperNode, true, 0)
+	if err != nil {
+		return err
+	}
+	peer.SetPSK(psk)
+	peer.EdgeAPIUrl = EdgeAPIUrl
+	StaticSuper := true
+	if strings.Contains(EndPoint, ":") {
+		i := strings.LastIndex(EndPoint, ":")
+		if EndPoint[:i] == loopback {
+			StaticSuper = false
+		}
+	}
+	err = peer.SetEndpointFromConnURL(EndPoint, af, 0, StaticSuper)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSuperEndpoint, err)
+	}
+	return nil
+}
+
+func edge_create_tap(iconfig mtypes.InterfaceConf, econfig *mtypes.EdgeConfig) (tap.Device, error) {
+	switch iconfig.IType {
+	case "dummy":
+		return tap.CreateDummyTAP()
+	case "stdio":
+		return tap.CreateStdIOTAP(iconfig, econfig.NodeID)
+	case "udpsock":
+		return tap.CreateUDPSockTAP(iconfig, econfig.NodeID)
+	case "tcpsock":
+		return tap.CreateSockTAP(iconfig, "tcp", econfig.NodeID, econfig.LogLevel)
+	case "unixsock":
+		return tap.CreateSockTAP(iconfig, "unix", econfig.NodeID, econfig.LogLevel)
+	case "unixgramsock":
+		return tap.CreateSockTAP(iconfig, "unixgram", econfig.NodeID, econfig.LogLevel)
+	case "unixpacketsock":
+		return tap.CreateSockTAP(iconfig, "unixpacket", econfig.NodeID, econfig.LogLevel)
+	case "fd":
+		return tap.CreateFdTAP(iconfig, econfig.NodeID)
+	case "vpp":
+		return tap.CreateVppTAP(iconfig, econfig.NodeID, econfig.LogLevel.LogLevel)
+	case "tap":
+		return tap.CreateTAP(iconfig, econfig.NodeID)
+	}
+	return nil, errors.New("Unknown interface type:" + iconfig.IType)
+}
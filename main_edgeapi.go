@@ -0,0 +1,190 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// EdgeManageServer serves the local manage API of an edge node. It listens on localhost if only a port is given.
+// Every request needs the Password paramater, requests from web pages are refused.
+//
+//	GET  /l2fib                                          the L2FIB in json
+//	POST /l2fib/pin?MacAddress=&NodeID=[&VLAN=][&VNI=]   pin a MAC address to a node
+//	POST /l2fib/flush[?MacAddress=[&VLAN=][&VNI=]]       flush a learned or pinned entry, or all of them
+func EdgeManageServer(listen string, password string, the_device *device.Device, errchan chan error) {
+	if listen == "" {
+		return
+	}
+	listen = edgemanage_listen_addr(listen)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/l2fib", func(w http.ResponseWriter, r *http.Request) {
+		if !edgemanage_check_auth(w, r, password) {
+			return
+		}
+		ret, _ := json.Marshal(the_device.GetL2FIB())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(ret)
+	})
+	mux.HandleFunc("/l2fib/pin", func(w http.ResponseWriter, r *http.Request) {
+		if !edgemanage_check_auth(w, r, password) || !edgemanage_check_post(w, r) {
+			return
+		}
+		params := r.URL.Query()
+		macstr, err := extractParamsStr(params, "MacAddress", w)
+		if err != nil {
+			return
+		}
+		NodeID, err := extractParamsVertex(params, "NodeID", w)
+		if err != nil {
+			return
+		}
+		mac, err := device.ParseL2FIBEntry(macstr, NodeID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Paramater MacAddress: %v", err)))
+			return
+		}
+		key := device.L2FIBKey{MAC: mac}
+		if vlan, ok := edgemanage_extract_vlan(params, w); !ok {
+			return
+		} else if vlan >= 0 {
+			key.VLAN = uint16(vlan)
+		}
+		if vni, ok := edgemanage_extract_vni(params, w); !ok {
+			return
+		} else if vni >= 0 {
+			key.VNI = uint16(vni)
+		}
+		if err := the_device.PinL2FIB(key, NodeID); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("%v pinned to %v", key.String(), NodeID)))
+	})
+	mux.HandleFunc("/l2fib/flush", func(w http.ResponseWriter, r *http.Request) {
+		if !edgemanage_check_auth(w, r, password) || !edgemanage_check_post(w, r) {
+			return
+		}
+		params := r.URL.Query()
+		var mac *tap.MacAddress
+		vlan, ok := edgemanage_extract_vlan(params, w)
+		if !ok {
+			return
+		}
+		vni, ok := edgemanage_extract_vni(params, w)
+		if !ok {
+			return
+		}
+		if macstr, err := extractParamsStr(params, "MacAddress", nil); err == nil {
+			m, err := device.ParseL2FIBEntry(macstr, 0)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Paramater MacAddress: %v", err)))
+				return
+			}
+			mac = &m
+		}
+		flushed := the_device.FlushL2FIB(mac, vni, vlan)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("%v entries flushed", flushed)))
+	})
+	go func() {
+		err := http.ListenAndServe(listen, mux)
+		if err != nil {
+			errchan <- err
+		}
+	}()
+}
+
+// edgemanage_listen_addr puts 127.0.0.1 in front of a bare port
+func edgemanage_listen_addr(listen string) string {
+	if !strings.Contains(listen, ":") {
+		return "127.0.0.1:" + listen
+	}
+	return listen
+}
+
+// CheckEdgeManageAPI refuses to serve the manage API without a password, even on localhost
+func CheckEdgeManageAPI(listen string, password string) error {
+	if listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(edgemanage_listen_addr(listen)); err != nil {
+		return fmt.Errorf("ListenPort_ManageAPI: %v", err)
+	}
+	if password == "" {
+		return errors.New("ListenPort_ManageAPI is set, it needs Password_ManageAPI")
+	}
+	return nil
+}
+
+// edgemanage_check_auth checks the password, and refuses the requests sent by web pages, which have an Origin
+func edgemanage_check_auth(w http.ResponseWriter, r *http.Request, password string) bool {
+	if r.Header.Get("Origin") != "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Requests from web pages are not allowed"))
+		return false
+	}
+	if !checkPassword(r.URL.Query().Get("Password"), password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater Password: Wrong password"))
+		return false
+	}
+	return true
+}
+
+// edgemanage_extract_vlan returns the optional VLAN paramater, -1 if not given
+func edgemanage_extract_vlan(params url.Values, w http.ResponseWriter) (int, bool) {
+	vlanstr, err := extractParamsStr(params, "VLAN", nil)
+	if err != nil {
+		return -1, true
+	}
+	vlan, err := device.ParseVLANID(vlanstr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Paramater VLAN: %v", err)))
+		return -1, false
+	}
+	return int(vlan), true
+}
+
+// edgemanage_extract_vni returns the optional VNI paramater, -1 if not given
+func edgemanage_extract_vni(params url.Values, w http.ResponseWriter) (int, bool) {
+	vnistr, err := extractParamsStr(params, "VNI", nil)
+	if err != nil {
+		return -1, true
+	}
+	vni, err := strconv.ParseUint(vnistr, 10, 16)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Paramater VNI: %v", err)))
+		return -1, false
+	}
+	return int(vni), true
+}
+
+func edgemanage_check_post(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("POST only"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,231 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// edge_reload reads the config file again and applies the new one to the running device.
+//
+// Peers, NextHopTable, DynamicRoute timers, L2FIBTimeout, StaticL2FIB, VLAN, Multicast, NeighborProxy and LogLevel are applied
+// by replacing the running config of the device as a whole.
+// Everything bound to the tap device, the sockets or the supernode connection needs a restart,
+// a change there is reported and ignored.
+func edge_reload(the_device *device.Device, graph *path.IG, configPath string) error {
+	var newconf mtypes.EdgeConfig
+	err := mtypes.ReadYaml(configPath, &newconf)
+	if err != nil {
+		return err
+	}
+	econfig := the_device.EdgeConfig() // read only, the new config replaces it at the end
+
+	// Validate everything before touching the running device
+	if newconf.DefaultTTL <= 0 {
+		return errors.New("DefaultTTL must > 0")
+	}
+	if err := path.CheckGraphSetting(newconf.DynamicRoute.P2P.GraphRecalculateSetting); err != nil {
+		return err
+	}
+	if err := device.CheckMulticastInfo(newconf.Multicast); err != nil {
+		return err
+	}
+	staticL2FIB, err := device.CheckStaticL2FIB(newconf.StaticL2FIB)
+	if err != nil {
+		return err
+	}
+	if err := device.CheckVLANInfo(newconf.VLAN); err != nil {
+		return err
+	}
+	firewall, err := device.CheckFirewall(newconf.Firewall)
+	if err != nil {
+		return err
+	}
+	shaping, err := device.CheckShaping(newconf.Shaping)
+	if err != nil {
+		return err
+	}
+	if err := device.CheckPMTU(newconf.PMTU); err != nil {
+		return err
+	}
+	newpeers := make(map[device.NoisePublicKey]mtypes.PeerInfo, len(newconf.Peers))
+	newids := make(map[mtypes.Vertex]bool, len(newconf.Peers))
+	for _, peerconf := range newconf.Peers {
+		pk, err := device.Str2PubKey(peerconf.PubKey)
+		if err != nil {
+			return fmt.Errorf("error decode base64 %v: %v", peerconf.PubKey, err)
+		}
+		if peerconf.NodeID.IsSpecial() {
+			return fmt.Errorf("peer %v: ID %v is a special NodeID", peerconf.PubKey, peerconf.NodeID)
+		}
+		if _, has := newpeers[pk]; has || newids[peerconf.NodeID] {
+			return fmt.Errorf("duplicate peer: %v %v", peerconf.NodeID, peerconf.PubKey)
+		}
+		newpeers[pk] = peerconf
+		newids[peerconf.NodeID] = true
+	}
+	if err := elog.Setup(newconf.LogLevel); err != nil {
+		return err
+	}
+	if !econfig.DynamicRoute.P2P.UseP2P && !econfig.DynamicRoute.SuperNode.UseSuperNode {
+		newconf.LogLevel.LogNTP = false // NTP in static mode is useless
+		elog.SetLevel(elog.NTP, elog.LevelOff)
+	}
+
+	edge_reload_keep_static(econfig, &newconf)
+
+	// Peers. Only peers from the config file are managed here, peers learned from the supernode or p2p are left alone.
+	oldpeers := make(map[device.NoisePublicKey]mtypes.PeerInfo, len(econfig.Peers))
+	for _, peerconf := range econfig.Peers {
+		pk, err := device.Str2PubKey(peerconf.PubKey)
+		if err != nil {
+			continue
+		}
+		oldpeers[pk] = peerconf
+	}
+	for pk, oldconf := range oldpeers {
+		if newconf, has := newpeers[pk]; !has || newconf.NodeID != oldconf.NodeID {
+			elog.Info(elog.Internal, "Reload: remove peer", "peer", oldconf.NodeID, "pubkey", oldconf.PubKey)
+			the_device.RemovePeer(pk)
+		}
+	}
+	EnabledAf := econfig.DisableAf.Disalbed2Enabled()
+	for pk, peerconf := range newpeers {
+		oldconf, has := oldpeers[pk]
+		peer := the_device.LookupPeer(pk)
+		if peer == nil || !has || oldconf.NodeID != peerconf.NodeID {
+			elog.Info(elog.Internal, "Reload: add peer", "peer", peerconf.NodeID, "pubkey", peerconf.PubKey)
+			the_device.RemovePeerByID(peerconf.NodeID) // the ID may belong to another key now
+			peer, err = the_device.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive)
+			if err != nil {
+				elog.Error(elog.Internal, "Reload: add peer failed", "peer", peerconf.NodeID, "err", err)
+				continue
+			}
+			oldconf = mtypes.PeerInfo{}
+		}
+		if peerconf.PersistentKeepalive != oldconf.PersistentKeepalive {
+			peer.SetPersistentKeepalive(peerconf.PersistentKeepalive)
+		}
+		if peerconf.EndPoint != "" && (peerconf.EndPoint != oldconf.EndPoint || peerconf.Static != oldconf.Static) {
+			err = peer.SetEndpointFromConnURL(peerconf.EndPoint, EnabledAf, newconf.AfPrefer, peerconf.Static)
+			if err != nil {
+				elog.Error(elog.Internal, "Reload: set endpoint failed", "peer", peerconf.NodeID, "endpoint", peerconf.EndPoint, "err", err)
+			}
+		}
+	}
+	// NextHopTable is only used in static mode, it comes from the supernode or p2p otherwise
+	if !econfig.DynamicRoute.SuperNode.UseSuperNode && !econfig.DynamicRoute.P2P.UseP2P {
+		if !reflect.DeepEqual(econfig.NextHopTable, newconf.NextHopTable) {
+			elog.Info(elog.Internal, "Reload: update NextHopTable")
+			graph.SetNHTable(newconf.NextHopTable)
+		}
+	}
+	if !reflect.DeepEqual(econfig.StaticL2FIB, newconf.StaticL2FIB) {
+		elog.Info(elog.Internal, "Reload: update StaticL2FIB")
+		the_device.SetStaticL2FIB(staticL2FIB)
+	}
+	if !reflect.DeepEqual(econfig.Firewall, newconf.Firewall) {
+		elog.Info(elog.Internal, "Reload: update Firewall")
+		the_device.SetFirewall(firewall)
+	}
+	if !reflect.DeepEqual(econfig.Shaping, newconf.Shaping) {
+		elog.Info(elog.Internal, "Reload: update Shaping")
+		the_device.SetShaping(shaping)
+	}
+	if !econfig.DynamicRoute.SuperNode.UseSuperNode {
+		the_device.SuperConfig.DampingFilterRadius = newconf.DynamicRoute.DampingFilterRadius
+	}
+	if !reflect.DeepEqual(econfig.DynamicRoute.P2P.GraphRecalculateSetting, newconf.DynamicRoute.P2P.GraphRecalculateSetting) {
+		graph.UpdateSetting(newconf.DynamicRoute.P2P.GraphRecalculateSetting)
+	}
+
+	// The routines read the running config on every round or packet, they see the new one as a whole
+	the_device.UpdateEdgeConfig(func(running *mtypes.EdgeConfig) {
+		running.Peers = newconf.Peers
+		running.NextHopTable = newconf.NextHopTable
+		running.DefaultTTL = newconf.DefaultTTL
+		running.AfPrefer = newconf.AfPrefer
+		running.LogLevel = newconf.LogLevel
+		running.L2FIBTimeout = newconf.L2FIBTimeout
+		running.Multicast = newconf.Multicast
+		running.NeighborProxy = newconf.NeighborProxy
+		running.StaticL2FIB = newconf.StaticL2FIB
+		running.VLAN = newconf.VLAN
+		running.Firewall = newconf.Firewall
+		running.Shaping = newconf.Shaping
+		running.PMTU = newconf.PMTU
+		running.ResetEndPointInterval = newconf.ResetEndPointInterval
+		dr := &running.DynamicRoute
+		if !dr.SuperNode.UseSuperNode {
+			// Overwritten by SuperParams from the supernode otherwise
+			dr.SendPingInterval = newconf.DynamicRoute.SendPingInterval
+			dr.PeerAliveTimeout = newconf.DynamicRoute.PeerAliveTimeout
+			dr.AdditionalCost = newconf.DynamicRoute.AdditionalCost
+			dr.DampingFilterRadius = newconf.DynamicRoute.DampingFilterRadius
+		}
+		dr.TimeoutCheckInterval = newconf.DynamicRoute.TimeoutCheckInterval
+		dr.ConnNextTry = newconf.DynamicRoute.ConnNextTry
+		dr.SaveNewPeers = newconf.DynamicRoute.SaveNewPeers
+		dr.MeasureThroughput = newconf.DynamicRoute.MeasureThroughput
+		dr.P2P.SendPeerInterval = newconf.DynamicRoute.P2P.SendPeerInterval
+		dr.P2P.GraphRecalculateSetting = newconf.DynamicRoute.P2P.GraphRecalculateSetting
+	})
+	select {
+	case the_device.Chan_SendPingStart <- struct{}{}: // apply the new SendPingInterval now
+	default:
+	}
+	elog.Info(elog.Internal, "Reload: done", "path", configPath)
+	return nil
+}
+
+// edge_reload_keep_static reverts the settings that can't be changed at runtime, and tells the user about it
+func edge_reload_keep_static(econfig *mtypes.EdgeConfig, newconf *mtypes.EdgeConfig) {
+	keep := func(name string, running interface{}, loaded interface{}) {
+		if !reflect.DeepEqual(running, loaded) {
+			elog.Error(elog.Internal, "Reload: changing "+name+" requires restart, ignored")
+			reflect.ValueOf(loaded).Elem().Set(reflect.ValueOf(running).Elem())
+		}
+	}
+	keep("Interface", &econfig.Interface, &newconf.Interface)
+	keep("VirtualNetworks", &econfig.VirtualNetworks, &newconf.VirtualNetworks)
+	keep("NodeID", &econfig.NodeID, &newconf.NodeID)
+	keep("NodeName", &econfig.NodeName, &newconf.NodeName)
+	keep("PostScript", &econfig.PostScript, &newconf.PostScript)
+	keep("PrivKey", &econfig.PrivKey, &newconf.PrivKey)
+	keep("ListenPort", &econfig.ListenPort, &newconf.ListenPort)
+	keep("ListenPort_TCP", &econfig.ListenPort_TCP, &newconf.ListenPort_TCP)
+	keep("Obfuscation", &econfig.Obfuscation, &newconf.Obfuscation)
+	keep("ListenPort_Metrics", &econfig.ListenPort_Metrics, &newconf.ListenPort_Metrics)
+	keep("ListenPort_ManageAPI", &econfig.ListenPort_ManageAPI, &newconf.ListenPort_ManageAPI)
+	keep("Password_ManageAPI", &econfig.Password_ManageAPI, &newconf.Password_ManageAPI)
+	keep("FwMark", &econfig.FwMark, &newconf.FwMark)
+	keep("DisabledAf", &econfig.DisableAf, &newconf.DisableAf)
+	keep("DynamicRoute.SuperNode", &econfig.DynamicRoute.SuperNode, &newconf.DynamicRoute.SuperNode)
+	keep("DynamicRoute.P2P.UseP2P", &econfig.DynamicRoute.P2P.UseP2P, &newconf.DynamicRoute.P2P.UseP2P)
+	keep("DynamicRoute.NTPConfig", &econfig.DynamicRoute.NTPConfig, &newconf.DynamicRoute.NTPConfig)
+	keep("DynamicRoute.DupCheckTimeout", &econfig.DynamicRoute.DupCheckTimeout, &newconf.DynamicRoute.DupCheckTimeout)
+
+	// The routines of these timers have quit if they were disabled at start, and must not spin if disabled now
+	enabled := func(name string, running *float64, loaded *float64, min float64) {
+		if (*running > min) != (*loaded > min) {
+			elog.Error(elog.Internal, "Reload: enabling or disabling "+name+" requires restart, ignored")
+			*loaded = *running
+		}
+	}
+	enabled("L2FIBTimeout", &econfig.L2FIBTimeout, &newconf.L2FIBTimeout, 0.01)
+	enabled("ResetEndPointInterval", &econfig.ResetEndPointInterval, &newconf.ResetEndPointInterval, 0.01)
+	enabled("DynamicRoute.TimeoutCheckInterval", &econfig.DynamicRoute.TimeoutCheckInterval, &newconf.DynamicRoute.TimeoutCheckInterval, 0)
+	if econfig.DynamicRoute.P2P.UseP2P {
+		enabled("DynamicRoute.P2P.SendPeerInterval", &econfig.DynamicRoute.P2P.SendPeerInterval, &newconf.DynamicRoute.P2P.SendPeerInterval, 0)
+	}
+}
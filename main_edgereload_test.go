@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"gopkg.in/yaml.v2"
+)
+
+func TestEdgeReload(t *testing.T) {
+	econfig, _ := gencfg.GetExampleEdgeConf("", true)
+	econfig.LogLevel.LogLevel = "error"
+	econfig.LogLevel.LogInternal = false
+	econfig.DynamicRoute.SuperNode.UseSuperNode = false
+	econfig.DynamicRoute.P2P.UseP2P = false
+	econfig.DynamicRoute.NTPConfig.UseNTP = false
+	configPath := filepath.Join(t.TempDir(), "edge.yaml")
+	graph, err := path.NewGraph(3, false, econfig.DynamicRoute.P2P.GraphRecalculateSetting, econfig.DynamicRoute.NTPConfig, econfig.LogLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thetap, _ := tap.CreateDummyTAP()
+	bind := conn.NewStdNetBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0)
+	the_device := device.NewDevice(thetap, econfig.NodeID, bind, device.NewLogger(device.LogLevelSilent, ""), graph, false, configPath, &econfig, nil, nil, "test")
+	defer the_device.Close()
+	for _, peerconf := range econfig.Peers {
+		pk, _ := device.Str2PubKey(peerconf.PubKey)
+		if _, err := the_device.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func(newconf mtypes.EdgeConfig) error {
+		t.Helper()
+		configbytes, err := yaml.Marshal(newconf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(configPath, configbytes, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return edge_reload(the_device, graph, configPath)
+	}
+	old := the_device.EdgeConfig()
+
+	newconf := econfig
+	newconf.DefaultTTL = 0
+	if err := reload(newconf); err == nil || the_device.EdgeConfig() != old {
+		t.Fatalf("invalid config applied: %v", err)
+	}
+
+	newPubKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))
+	newconf.DefaultTTL = econfig.DefaultTTL + 10
+	newconf.L2FIBTimeout = econfig.L2FIBTimeout * 2
+	newconf.ListenPort = econfig.ListenPort + 1
+	newconf.Peers = append(append([]mtypes.PeerInfo{}, econfig.Peers...), mtypes.PeerInfo{NodeID: 3, PubKey: newPubKey, EndPoint: "127.0.0.1:3003"})
+	if err := reload(newconf); err != nil {
+		t.Fatal(err)
+	}
+	running := the_device.EdgeConfig()
+	if running.DefaultTTL != newconf.DefaultTTL || running.L2FIBTimeout != newconf.L2FIBTimeout || len(running.Peers) != 2 {
+		t.Errorf("reload not applied: DefaultTTL %v, L2FIBTimeout %v, %v peers", running.DefaultTTL, running.L2FIBTimeout, len(running.Peers))
+	}
+	if running.ListenPort != econfig.ListenPort {
+		t.Errorf("ListenPort changed to %v, it requires restart", running.ListenPort)
+	}
+	if pk, _ := device.Str2PubKey(newPubKey); the_device.LookupPeer(pk) == nil {
+		t.Errorf("peer 3 not added")
+	}
+	// The snapshot taken before is never changed, a routine sees either config as a whole
+	if old.DefaultTTL != econfig.DefaultTTL || old.L2FIBTimeout != econfig.L2FIBTimeout || len(old.Peers) != 1 {
+		t.Errorf("the old snapshot was changed: DefaultTTL %v, L2FIBTimeout %v, %v peers", old.DefaultTTL, old.L2FIBTimeout, len(old.Peers))
+	}
+}
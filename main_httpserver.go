@@ -26,22 +26,27 @@ import (
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type http_shared_objects struct {
-	http_graph         *path.IG
-	http_device4       *device.Device
-	http_device6       *device.Device
-	http_HashSalt      []byte
-	http_NhTable_Hash  string
-	http_PeerInfo_hash string
-	http_NhTableStr    []byte
-	http_PeerInfo      mtypes.API_Peers
-	http_super_chains  *mtypes.SUPER_Events
-	http_pskdb         device.PSKDB
+	http_graph           *path.IG
+	http_device4         *device.Device
+	http_device6         *device.Device
+	http_ws4             *conn.WSBind // WebSocket of http_device4, served on the EdgeAPI if WebSocket is on
+	http_ws6             *conn.WSBind
+	http_HashSalt        []byte
+	http_NhTable_Hash    string
+	http_PeerInfo_hash   string
+	http_NhTableStr      []byte
+	http_NhTableStr_ECMP []byte       // mtypes.API_NhTable, for the edges that ask for ECMP
+	http_WireCodec       atomic.Value // mtypes.WireCodec, codec every registered edge can decode. Pushes read it without lock
+	http_PeerInfo        mtypes.API_Peers
+	http_super_chains    *mtypes.SUPER_Events
+	http_pskdb           device.PSKDB
 
 	http_passwords       mtypes.Passwords
 	http_StateExpire     time.Time
@@ -64,8 +69,9 @@ var (
 )
 
 type HttpPeerLocalIP struct {
-	LocalIPv4 map[string]float64
-	LocalIPv6 map[string]float64
+	LocalIPv4  map[string]float64
+	LocalIPv6  map[string]float64
+	MappedIPv4 map[string]float64 // mapped on the router of the edge with PortMapping
 }
 
 type HttpState struct {
@@ -81,6 +87,7 @@ type HttpState struct {
 type HttpPeerInfo struct {
 	Name     string
 	LastSeen string
+	NATType  string
 }
 
 type PeerState struct {
@@ -91,6 +98,8 @@ type PeerState struct {
 	JETSecret             atomic.Value // mtypes.JWTSecret
 	httpPostCount         atomic.Value // uint64
 	LastSeen              atomic.Value // time.Time
+	WireCodecs            atomic.Value // mtypes.WireCodecSet
+	NATType               atomic.Value // mtypes.NATType
 }
 
 func extractParamsStr(params url.Values, key string, w http.ResponseWriter) (string, error) {
@@ -141,7 +150,7 @@ func extractParamsUint(params url.Values, key string, bitSize int, w http.Respon
 }
 
 func extractParamsVertex(params url.Values, key string, w http.ResponseWriter) (mtypes.Vertex, error) {
-	val, err := extractParamsUint(params, key, 16, w)
+	val, err := extractParamsUint(params, key, 32, w)
 	if err != nil {
 		return mtypes.NodeID_Invalid, err
 	}
@@ -154,6 +163,14 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 	for _, peerinfo := range httpobj.http_sconfig.Peers {
 		connV4 := httpobj.http_device4.GetConnurl(peerinfo.NodeID)
 		connV6 := httpobj.http_device6.GetConnurl(peerinfo.NodeID)
+		connected := len(connV4)+len(connV6) > 0
+		// An edge that comes over TCP or WebSocket can't be reached there by other edges, only its UDP endpoints are told
+		if conn.IsStreamURL(connV4) {
+			connV4 = ""
+		}
+		if conn.IsStreamURL(connV6) {
+			connV6 = ""
+		}
 
 		if peerinfo.ExternalIP != "" {
 			ExternalIP := peerinfo.ExternalIP
@@ -178,9 +195,12 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 			}
 		}
 
-		if len(connV4)+len(connV6) == 0 {
+		if !connected {
 			continue
 		}
+		if _, has := httpobj.http_PeerState[peerinfo.PubKey]; !has {
+			continue // the old peer with this NodeID is still being removed
+		}
 		api_peerinfo[peerinfo.PubKey] = mtypes.API_Peerinfo{
 			NodeID:  peerinfo.NodeID,
 			PSKey:   peerinfo.PSKey,
@@ -190,6 +210,14 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 			if connV4 != "" {
 				api_peerinfo[peerinfo.PubKey].Connurl.ExternalV4 = map[string]float64{connV4: 4}
 			}
+			for mapped, priority := range httpobj.http_PeerIPs[peerinfo.PubKey].MappedIPv4 {
+				if api_peerinfo[peerinfo.PubKey].Connurl.ExternalV4 == nil {
+					api_peerinfo[peerinfo.PubKey].Connurl.ExternalV4 = make(map[string]float64)
+				}
+				if _, has := api_peerinfo[peerinfo.PubKey].Connurl.ExternalV4[mapped]; !has {
+					api_peerinfo[peerinfo.PubKey].Connurl.ExternalV4[mapped] = priority
+				}
+			}
 			if connV6 != "" {
 				api_peerinfo[peerinfo.PubKey].Connurl.ExternalV6 = map[string]float64{connV6: 6}
 			}
@@ -224,7 +252,7 @@ func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	if NodeID >= mtypes.NodeID_Special {
+	if NodeID.IsSpecial() {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Paramater NodeID: Can't use special nodeID."))
 		return
@@ -255,14 +283,7 @@ func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Do something
-	SuperParams := mtypes.API_SuperParams{
-		SendPingInterval:    httpobj.http_sconfig.SendPingInterval,
-		HttpPostInterval:    httpobj.http_sconfig.HttpPostInterval,
-		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
-		AdditionalCost:      httpobj.http_PeerID2Info[NodeID].AdditionalCost,
-		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
-	}
-	SuperParamStr, _ := json.Marshal(SuperParams)
+	SuperParamStr, _ := json.Marshal(super_SuperParams(httpobj.http_PeerID2Info[NodeID]))
 	httpobj.http_PeerState[PubKey].SuperParamStateClient.Store(State)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -284,7 +305,7 @@ func edge_get_peerinfo(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	if NodeID >= mtypes.NodeID_Special {
+	if NodeID.IsSpecial() {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Paramater NodeID: Can't use special nodeID."))
 		return
@@ -355,7 +376,7 @@ func edge_get_nhtable(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	if NodeID >= mtypes.NodeID_Special {
+	if NodeID.IsSpecial() {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Paramater NodeID: Can't use special nodeID."))
 		return
@@ -387,6 +408,10 @@ func edge_get_nhtable(w http.ResponseWriter, r *http.Request) {
 	httpobj.http_PeerState[PubKey].NhTableState.Store(State)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if params.Get("ECMP") == "true" && len(httpobj.http_NhTableStr_ECMP) > 0 {
+		w.Write(httpobj.http_NhTableStr_ECMP)
+		return
+	}
 	w.Write([]byte(httpobj.http_NhTableStr))
 }
 
@@ -401,7 +426,7 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	if NodeID >= mtypes.NodeID_Special {
+	if NodeID.IsSpecial() {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Paramater NodeID: Can't use special nodeID."))
 		return
@@ -487,15 +512,15 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 
 	httpobj.http_PeerIPs[PubKey].LocalIPv4 = client_report.LocalV4s
 	httpobj.http_PeerIPs[PubKey].LocalIPv6 = client_report.LocalV6s
+	httpobj.http_PeerIPs[PubKey].MappedIPv4 = client_report.MappedV4s
+	httpobj.http_PeerState[PubKey].NATType.Store(client_report.NATType)
 	httpobj.http_PeerState[PubKey].httpPostCount.Store(client_PostCount + 1)
 	httpobj.http_PeerState[PubKey].LastSeen.Store(time.Now())
 
 	applied_pones := make([]mtypes.PongMsg, 0, len(client_report.Pongs))
 	for _, pong_msg := range client_report.Pongs {
 		if pong_msg.Dst_nodeID != NodeID {
-			if httpobj.http_sconfig.LogLevel.LogControl {
-				fmt.Printf("Control: Dropped because not correct dst: Recv %v S:%v D:%v From: %v IP:%v(HTTP)\n", pong_msg.ToString(), pong_msg.Src_nodeID.ToString(), pong_msg.Dst_nodeID.ToString(), NodeID.ToString(), r.RemoteAddr)
-			}
+			elog.Info(elog.Control, "Dropped because not correct dst", "content", pong_msg.ToString(), "src", pong_msg.Src_nodeID, "dst", pong_msg.Dst_nodeID, "peer", NodeID, "endpoint", r.RemoteAddr, "via", "http")
 			continue
 		}
 
@@ -506,19 +531,12 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 				pong_msg.AdditionalCost = AdditionalCost_use
 			}
 			applied_pones = append(applied_pones, pong_msg)
-			if httpobj.http_sconfig.LogLevel.LogControl {
-				fmt.Printf("Control: Recv %v S:%v D:%v From: %v IP:%v(HTTP)\n", pong_msg.ToString(), pong_msg.Src_nodeID.ToString(), pong_msg.Dst_nodeID.ToString(), NodeID.ToString(), r.RemoteAddr)
-			}
+			elog.Info(elog.Control, "Recv", "content", pong_msg.ToString(), "src", pong_msg.Src_nodeID, "dst", pong_msg.Dst_nodeID, "peer", NodeID, "endpoint", r.RemoteAddr, "via", "http")
 		}
 	}
 	changed := httpobj.http_graph.UpdateLatencyMulti(applied_pones, true, true)
-	if changed {
-		NhTable := httpobj.http_graph.GetNHTable(true)
-		NhTablestr, _ := json.Marshal(NhTable)
-		md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
-		new_hash_str := hex.EncodeToString(md5_hash_raw[:])
-		httpobj.http_NhTable_Hash = new_hash_str
-		httpobj.http_NhTableStr = NhTablestr
+	if changed && super_is_leader() {
+		super_update_NhTableStr()
 		PushNhTable(false)
 	}
 	w.WriteHeader(http.StatusOK)
@@ -578,6 +596,7 @@ func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
 			hs.PeerInfo[peerinfo.NodeID] = HttpPeerInfo{
 				Name:     peerinfo.Name,
 				LastSeen: LastSeenStr,
+				NATType:  httpobj.http_PeerState[peerinfo.PubKey].NATType.Load().(mtypes.NATType).ToString(),
 			}
 		}
 		httpobj.http_StateExpire = time.Now().Add(5 * time.Second)
@@ -598,6 +617,9 @@ func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Paramater Password: Wrong password"))
 		return
 	}
+	if !cluster_check_leader(w) {
+		return
+	}
 
 	r.ParseForm()
 	NodeID, err := extractParamsVertex(r.Form, "NodeID", w)
@@ -729,6 +751,9 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Paramater Password: Wrong password"))
 		return
 	}
+	if !cluster_check_leader(w) {
+		return
+	}
 	NodeID, err = extractParamsVertex(params, "NodeID", w)
 	if err != nil {
 		return
@@ -764,18 +789,7 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	httpobj.http_PeerID2Info[toUpdate] = new_superpeerinfo
-	SuperParams := mtypes.API_SuperParams{
-		SendPingInterval:    httpobj.http_sconfig.SendPingInterval,
-		HttpPostInterval:    httpobj.http_sconfig.HttpPostInterval,
-		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
-		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
-		AdditionalCost:      new_superpeerinfo.AdditionalCost,
-	}
-
-	SuperParamStr, _ := json.Marshal(SuperParams)
-	md5_hash_raw := md5.Sum(append(SuperParamStr, httpobj.http_HashSalt...))
-	new_hash_str := hex.EncodeToString(md5_hash_raw[:])
-	httpobj.http_PeerState[PubKey].SuperParamState.Store(new_hash_str)
+	httpobj.http_PeerState[PubKey].SuperParamState.Store(super_SuperParamState(new_superpeerinfo))
 
 	var peers_new []mtypes.SuperPeerInfo
 	for _, peerinfo := range httpobj.http_sconfig.Peers {
@@ -809,6 +823,9 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Paramater Password: Wrong password"))
 		return
 	}
+	if !cluster_check_leader(w) {
+		return
+	}
 
 	r.ParseForm()
 	Updated_params := make(map[string]string)
@@ -868,22 +885,10 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 	httpobj.http_sconfig.HttpPostInterval = sconfig_temp.HttpPostInterval
 	httpobj.http_sconfig.DampingFilterRadius = sconfig_temp.DampingFilterRadius
 
-	SuperParams := mtypes.API_SuperParams{
-		SendPingInterval:    httpobj.http_sconfig.SendPingInterval,
-		HttpPostInterval:    httpobj.http_sconfig.HttpPostInterval,
-		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
-		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
-		AdditionalCost:      10,
-	}
 	httpobj.Lock()
 	defer httpobj.Unlock()
 	for _, peerinfo := range httpobj.http_PeerID2Info {
-		SuperParams.AdditionalCost = peerinfo.AdditionalCost
-		PubKey := peerinfo.PubKey
-		SuperParamStr, _ := json.Marshal(SuperParams)
-		md5_hash_raw := md5.Sum(append(SuperParamStr, httpobj.http_HashSalt...))
-		new_hash_str := hex.EncodeToString(md5_hash_raw[:])
-		httpobj.http_PeerState[PubKey].SuperParamState.Store(new_hash_str)
+		httpobj.http_PeerState[peerinfo.PubKey].SuperParamState.Store(super_SuperParamState(peerinfo))
 	}
 
 	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
@@ -947,6 +952,9 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if !cluster_check_leader(w) { // only tell the leader to the ones who may delete
+		return
+	}
 
 	var peers_new []mtypes.SuperPeerInfo
 	for _, peerinfo := range httpobj.http_sconfig.Peers {
@@ -985,6 +993,11 @@ func HttpServer(edgeListen string, manageListen string, apiprefix string, errcha
 		mux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
 		mux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
 		mux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
+		mux.HandleFunc(apiprefix+"/cluster/sync", cluster_post_sync)
+		if httpobj.http_sconfig.WebSocket {
+			mux.Handle(apiprefix+"/edge/ws4", httpobj.http_ws4)
+			mux.Handle(apiprefix+"/edge/ws6", httpobj.http_ws6)
+		}
 
 		go func() {
 			err := http.ListenAndServe(edgeListen, mux)
@@ -1000,11 +1013,16 @@ func HttpServer(edgeListen string, manageListen string, apiprefix string, errcha
 		edgemux.HandleFunc(apiprefix+"/edge/peerinfo", edge_get_peerinfo)
 		edgemux.HandleFunc(apiprefix+"/edge/nhtable", edge_get_nhtable)
 		edgemux.HandleFunc(apiprefix+"/edge/post/nodeinfo", edge_post_nodeinfo)
+		if httpobj.http_sconfig.WebSocket {
+			edgemux.Handle(apiprefix+"/edge/ws4", httpobj.http_ws4)
+			edgemux.Handle(apiprefix+"/edge/ws6", httpobj.http_ws6)
+		}
 		managemux.HandleFunc(apiprefix+"/manage/peer/add", manage_peeradd)
 		managemux.HandleFunc(apiprefix+"/manage/peer/del", manage_peerdel)
 		managemux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
 		managemux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
 		managemux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
+		managemux.HandleFunc(apiprefix+"/cluster/sync", cluster_post_sync)
 
 		go func() {
 			err := http.ListenAndServe(edgeListen, edgemux)
@@ -0,0 +1,215 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// metrics_device is one device exposed by the metrics endpoint.
+// The edge has one, the supernode has one for each address family.
+type metrics_device struct {
+	Name   string
+	Device *device.Device
+}
+
+// metrics_label_escaper escapes a label value as the text exposition format does, other characters are kept as they are
+var metrics_label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metrics_writer struct {
+	bytes.Buffer
+}
+
+func (w *metrics_writer) header(name string, mtype string, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, mtype)
+}
+
+func (w *metrics_writer) sample(name string, val float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i])
+			w.WriteString("=\"")
+			w.WriteString(metrics_label_escaper.Replace(labels[i+1]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	switch {
+	case math.IsInf(val, 1):
+		w.WriteString("+Inf")
+	case math.IsInf(val, -1):
+		w.WriteString("-Inf")
+	case math.IsNaN(val):
+		w.WriteString("NaN")
+	default:
+		w.WriteString(strconv.FormatFloat(val, 'g', -1, 64))
+	}
+	w.WriteByte('\n')
+}
+
+func metrics_bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func metrics_render(devices []metrics_device, graph *path.IG) []byte {
+	w := &metrics_writer{}
+	now := time.Now()
+	stats := make([]device.DeviceMetrics, len(devices))
+	for i, d := range devices {
+		stats[i] = d.Device.GetMetrics()
+		sort.Slice(stats[i].Peers, func(a, b int) bool { return stats[i].Peers[a].ID < stats[i].Peers[b].ID })
+	}
+	peer_metric := func(name string, mtype string, help string, val func(p device.PeerMetrics) (float64, bool)) {
+		w.header(name, mtype, help)
+		for i, d := range devices {
+			for _, p := range stats[i].Peers {
+				if v, ok := val(p); ok {
+					w.sample(name, v, "device", d.Name, "peer_id", p.ID.ToString(), "public_key", p.PubKey)
+				}
+			}
+		}
+	}
+	device_metric := func(name string, mtype string, help string, val func(s device.DeviceMetrics) float64) {
+		w.header(name, mtype, help)
+		for i, d := range devices {
+			w.sample(name, val(stats[i]), "device", d.Name)
+		}
+	}
+
+	peer_metric("eg_peer_rx_bytes_total", "counter", "Bytes received from the peer.", func(p device.PeerMetrics) (float64, bool) {
+		return float64(p.RxBytes), true
+	})
+	peer_metric("eg_peer_tx_bytes_total", "counter", "Bytes sent to the peer.", func(p device.PeerMetrics) (float64, bool) {
+		return float64(p.TxBytes), true
+	})
+	peer_metric("eg_peer_handshake_age_seconds", "gauge", "Seconds since the last handshake with the peer. Absent if never.", func(p device.PeerMetrics) (float64, bool) {
+		if p.LastHandshake.IsZero() {
+			return 0, false
+		}
+		return now.Sub(p.LastHandshake).Seconds(), true
+	})
+	peer_metric("eg_peer_single_way_latency_seconds", "gauge", "Filtered single way latency to the peer. Absent if unknown.", func(p device.PeerMetrics) (float64, bool) {
+		return p.SingleWayLatency, p.SingleWayLatency < mtypes.Infinity
+	})
+	peer_metric("eg_peer_ping_loss_ratio", "gauge", "Ratio of the recent pings from the peer that were missed.", func(p device.PeerMetrics) (float64, bool) {
+		return p.PingLoss, true
+	})
+	peer_metric("eg_peer_throughput_mbps", "gauge", "Peak receive rate from the peer in Mbit/s. Absent if MeasureThroughput is off.", func(p device.PeerMetrics) (float64, bool) {
+		return p.Throughput, p.Throughput > 0
+	})
+	peer_metric("eg_peer_alive", "gauge", "Whether a packet from the peer was received within PeerAliveTimeout.", func(p device.PeerMetrics) (float64, bool) {
+		return metrics_bool(p.IsAlive), true
+	})
+	w.header("eg_peer_pmtu_bytes", "gauge", "Largest IP packet sent to the peer unfragmented, probed on the endpoint label. Absent if not probed.")
+	for i, d := range devices {
+		for _, p := range stats[i].Peers {
+			if p.PMTU > 0 {
+				w.sample("eg_peer_pmtu_bytes", float64(p.PMTU), "device", d.Name, "peer_id", p.ID.ToString(), "public_key", p.PubKey, "endpoint", p.PMTUEndpoint)
+			}
+		}
+	}
+	device_metric("eg_l2fib_entries", "gauge", "Number of MAC addresses in the L2FIB.", func(s device.DeviceMetrics) float64 {
+		return float64(s.L2FIBSize)
+	})
+	device_metric("eg_mcast_groups", "gauge", "Number of multicast groups learned by IGMP/MLD snooping.", func(s device.DeviceMetrics) float64 {
+		return float64(s.McastGroups)
+	})
+	device_metric("eg_dup_cache_hits_total", "counter", "Spread packets dropped by the duplicate check.", func(s device.DeviceMetrics) float64 {
+		return float64(s.DupHits)
+	})
+	device_metric("eg_ttl_expired_drops_total", "counter", "Packets dropped in transit because the TTL reached 0.", func(s device.DeviceMetrics) float64 {
+		return float64(s.TTLExpired)
+	})
+	device_metric("eg_no_route_drops_total", "counter", "Packets dropped because the NhTable has no next hop.", func(s device.DeviceMetrics) float64 {
+		return float64(s.NoRoute)
+	})
+	device_metric("eg_neighbor_proxy_replies_total", "counter", "ARP requests and neighbor solicitations answered by the neighbor proxy.", func(s device.DeviceMetrics) float64 {
+		return float64(s.NeighborProxied)
+	})
+	device_metric("eg_acl_drops_total", "counter", "Frames dropped by the ACL, received or in transit.", func(s device.DeviceMetrics) float64 {
+		return float64(s.ACLDropped)
+	})
+	device_metric("eg_shaping_drops_total", "counter", "Packets dropped because the queue of a shaper was full.", func(s device.DeviceMetrics) float64 {
+		return float64(s.ShapingDropped)
+	})
+	device_metric("eg_fragmented_packets_total", "counter", "Packets larger than the PMTU of the peer sent in fragments.", func(s device.DeviceMetrics) float64 {
+		return float64(s.Fragmented)
+	})
+	device_metric("eg_reassembled_packets_total", "counter", "Packets put back together from fragments.", func(s device.DeviceMetrics) float64 {
+		return float64(s.Reassembled)
+	})
+	device_metric("eg_icmp_too_big_total", "counter", "Frames larger than the PMTU of the peer answered with ICMP/ICMPv6 too big.", func(s device.DeviceMetrics) float64 {
+		return float64(s.ICMPTooBig)
+	})
+	device_metric("eg_hole_punches_total", "counter", "PunchHole commands from the supernode carried out.", func(s device.DeviceMetrics) float64 {
+		return float64(s.HolePunches)
+	})
+	device_metric("eg_relayed_packets_total", "counter", "Packets relayed between edges by the supernode.", func(s device.DeviceMetrics) float64 {
+		return float64(s.Relayed)
+	})
+	device_metric("eg_relay_drops_total", "counter", "Packets dropped because the relay of the supernode was over its Bandwidth.", func(s device.DeviceMetrics) float64 {
+		return float64(s.RelayDropped)
+	})
+	w.header("eg_nat_type", "gauge", "The NAT type detected with the supernode, 1 for the type label.")
+	for i, d := range devices {
+		if !d.Device.IsSuperNode {
+			w.sample("eg_nat_type", 1, "device", d.Name, "type", stats[i].NATType.ToString())
+		}
+	}
+
+	if graph != nil {
+		count, total, last := graph.RecalculateStats()
+		w.header("eg_nhtable_recalculations_total", "counter", "Number of NhTable recalculations.")
+		w.sample("eg_nhtable_recalculations_total", float64(count))
+		w.header("eg_nhtable_recalculation_seconds_total", "counter", "Total time spent recalculating the NhTable.")
+		w.sample("eg_nhtable_recalculation_seconds_total", total.Seconds())
+		w.header("eg_nhtable_last_recalculation_seconds", "gauge", "Duration of the last NhTable recalculation.")
+		w.sample("eg_nhtable_last_recalculation_seconds", last.Seconds())
+	}
+	return w.Bytes()
+}
+
+// MetricsServer serves the Prometheus text exposition format at /metrics
+func MetricsServer(listen string, devices []metrics_device, graph *path.IG, errchan chan error) {
+	if listen == "" {
+		return
+	}
+	if !strings.Contains(listen, ":") {
+		listen = ":" + listen
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(metrics_render(devices, graph))
+	})
+	go func() {
+		err := http.ListenAndServe(listen, mux)
+		if err != nil {
+			errchan <- err
+		}
+	}()
+}
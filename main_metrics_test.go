@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+func TestMetricsLabelEscape(t *testing.T) {
+	for _, c := range []struct {
+		val  string
+		want string
+	}{
+		{"edge", `x{device="edge"} 1`},
+		{"節點", `x{device="節點"} 1`},
+		{`a"b`, `x{device="a\"b"} 1`},
+		{`a\b`, `x{device="a\\b"} 1`},
+		{"a\nb", `x{device="a\nb"} 1`},
+		{"a\tb", "x{device=\"a\tb\"} 1"},
+	} {
+		w := &metrics_writer{}
+		w.sample("x", 1, "device", c.val)
+		if got := strings.TrimSuffix(w.String(), "\n"); got != c.want {
+			t.Errorf("label %q: got %s, expect %s", c.val, got, c.want)
+		}
+	}
+}
+
+func TestMetricsRender(t *testing.T) {
+	econfig, _ := gencfg.GetExampleEdgeConf("", true)
+	econfig.LogLevel.LogLevel = "error"
+	econfig.LogLevel.LogInternal = false
+	econfig.DynamicRoute.NTPConfig.UseNTP = false
+	graph, err := path.NewGraph(3, false, econfig.DynamicRoute.P2P.GraphRecalculateSetting, econfig.DynamicRoute.NTPConfig, econfig.LogLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thetap, _ := tap.CreateDummyTAP()
+	bind := conn.NewStdNetBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0)
+	the_device := device.NewDevice(thetap, econfig.NodeID, bind, device.NewLogger(device.LogLevelSilent, ""), graph, false, "", &econfig, nil, nil, "test")
+	defer the_device.Close()
+	peerconf := econfig.Peers[0]
+	pk, _ := device.Str2PubKey(peerconf.PubKey)
+	if _, err := the_device.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive); err != nil {
+		t.Fatal(err)
+	}
+
+	out := string(metrics_render([]metrics_device{{Name: "邊緣\"1\"", Device: the_device}}, graph))
+	for _, want := range []string{
+		"# HELP eg_peer_rx_bytes_total Bytes received from the peer.\n# TYPE eg_peer_rx_bytes_total counter\n",
+		`eg_peer_rx_bytes_total{device="邊緣\"1\"",peer_id="` + peerconf.NodeID.ToString() + `",public_key="` + peerconf.PubKey + `"} 0` + "\n",
+		`eg_l2fib_entries{device="邊緣\"1\""} 0` + "\n",
+		`eg_nat_type{device="邊緣\"1\"",type="`,
+		"# TYPE eg_nhtable_recalculations_total counter\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	// Every line is a comment or a sample, which a scraper can parse
+	line := regexp.MustCompile(`^(# (HELP|TYPE) [a-z0-9_]+ .+|[a-z0-9_]+(\{[a-z0-9_]+="([^"\\\n]|\\.)*"(,[a-z0-9_]+="([^"\\\n]|\\.)*")*\})? ([-+]?[0-9.e+-]+|[+-]Inf|NaN))$`)
+	for _, l := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if !line.MatchString(l) {
+			t.Errorf("malformed line %q", l)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
 	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
@@ -61,6 +62,59 @@ func checkNhTable(NhTable mtypes.NextHopTable, peers []mtypes.SuperPeerInfo) err
 	return nil
 }
 
+// super_check_config checks the values the supernode can't run with
+func super_check_config(sconfig *mtypes.SuperConfig) error {
+	if sconfig.PeerAliveTimeout <= 0 {
+		return fmt.Errorf("PeerAliveTimeout must > 0 : %v", sconfig.PeerAliveTimeout)
+	}
+	if sconfig.HttpPostInterval < 0 {
+		return fmt.Errorf("HttpPostInterval must >= 0 : %v", sconfig.HttpPostInterval)
+	} else if sconfig.HttpPostInterval > sconfig.PeerAliveTimeout {
+		return fmt.Errorf("HttpPostInterval must <= PeerAliveTimeout : %v", sconfig.HttpPostInterval)
+	}
+	if sconfig.SendPingInterval <= 0 {
+		return fmt.Errorf("SendPingInterval must > 0 : %v", sconfig.SendPingInterval)
+	}
+	if sconfig.RePushConfigInterval <= 0 {
+		return fmt.Errorf("RePushConfigInterval must > 0 : %v", sconfig.RePushConfigInterval)
+	}
+	if sconfig.StateStore.Path != "" && sconfig.StateStore.SaveInterval <= 0 {
+		return fmt.Errorf("StateStore.SaveInterval must > 0 : %v", sconfig.StateStore.SaveInterval)
+	}
+	if sconfig.Cluster.Enabled() {
+		if sconfig.Cluster.Secret == "" {
+			return fmt.Errorf("Cluster.Secret must not be empty")
+		}
+		if sconfig.Cluster.SyncInterval <= 0 {
+			return fmt.Errorf("Cluster.SyncInterval must > 0 : %v", sconfig.Cluster.SyncInterval)
+		}
+		if sconfig.Cluster.LeaderTimeout <= sconfig.Cluster.SyncInterval {
+			return fmt.Errorf("Cluster.LeaderTimeout must > Cluster.SyncInterval : %v", sconfig.Cluster.LeaderTimeout)
+		}
+		if sconfig.ListenPort_ManageAPI == "" && sconfig.ListenPort_EdgeAPI != sconfig.ListenPort_ManageAPI {
+			return fmt.Errorf("Cluster needs ListenPort_ManageAPI")
+		}
+	}
+	if err := path.CheckGraphSetting(sconfig.GraphRecalculateSetting); err != nil {
+		return err
+	}
+	if sconfig.GraphRecalculateSetting.StaticMode {
+		if err := checkNhTable(sconfig.NextHopTable, sconfig.Peers); err != nil {
+			return err
+		}
+	}
+	if err := super_check_nat_traversal(sconfig.NATTraversal, sconfig.ListenPort); err != nil {
+		return err
+	}
+	if err := device.CheckACL(sconfig.ACL); err != nil {
+		return err
+	}
+	if _, err := device.CheckRelay(sconfig.Relay); err != nil {
+		return err
+	}
+	return nil
+}
+
 func printExampleSuperConf() {
 	sconfig, _ := gencfg.GetExampleSuperConf("", true)
 	scprint, _ := yaml.Marshal(sconfig)
@@ -86,40 +140,21 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	if len(NodeName) > 32 {
 		return errors.New("Node name can't longer than 32 :" + NodeName)
 	}
-	if sconfig.PeerAliveTimeout <= 0 {
-		return fmt.Errorf("PeerAliveTimeout must > 0 : %v", sconfig.PeerAliveTimeout)
+	if err = super_check_config(&sconfig); err != nil {
+		return err
 	}
-	if sconfig.HttpPostInterval < 0 {
-		return fmt.Errorf("HttpPostInterval must >= 0 : %v", sconfig.HttpPostInterval)
-	} else if sconfig.HttpPostInterval > sconfig.PeerAliveTimeout {
-		return fmt.Errorf("HttpPostInterval must <= PeerAliveTimeout : %v", sconfig.HttpPostInterval)
+	if err = elog.Setup(sconfig.LogLevel); err != nil {
+		return err
 	}
-	if sconfig.SendPingInterval <= 0 {
-		return fmt.Errorf("SendPingInterval must > 0 : %v", sconfig.SendPingInterval)
+
+	logger4 := &device.Logger{
+		Verbosef: elog.Printf(elog.Device, elog.LevelDebug, "node", NodeName+"_v4"),
+		Errorf:   elog.Printf(elog.Device, elog.LevelError, "node", NodeName+"_v4"),
 	}
-	if sconfig.RePushConfigInterval <= 0 {
-		return fmt.Errorf("RePushConfigInterval must > 0 : %v", sconfig.RePushConfigInterval)
+	logger6 := &device.Logger{
+		Verbosef: elog.Printf(elog.Device, elog.LevelDebug, "node", NodeName+"_v6"),
+		Errorf:   elog.Printf(elog.Device, elog.LevelError, "node", NodeName+"_v6"),
 	}
-	var logLevel int
-	switch sconfig.LogLevel.LogLevel {
-	case "verbose", "debug":
-		logLevel = device.LogLevelVerbose
-	case "error":
-		logLevel = device.LogLevelError
-	case "silent":
-		logLevel = device.LogLevelSilent
-	default:
-		logLevel = device.LogLevelError
-	}
-
-	logger4 := device.NewLogger(
-		logLevel,
-		fmt.Sprintf("(%s) ", NodeName+"_v4"),
-	)
-	logger6 := device.NewLogger(
-		logLevel,
-		fmt.Sprintf("(%s) ", NodeName+"_v6"),
-	)
 
 	EnabledAf := sconfig.DisableAf.Disalbed2Enabled()
 	if !EnabledAf.IPv4 {
@@ -134,6 +169,13 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	httpobj.http_PeerIPs = make(map[string]*HttpPeerLocalIP)
 	httpobj.http_PeerID2Info = make(map[mtypes.Vertex]mtypes.SuperPeerInfo)
 	httpobj.http_HashSalt = []byte(mtypes.RandomStr(32, fmt.Sprintf("%v", time.Now())))
+	if sconfig.Cluster.Enabled() {
+		// Every member must produce the same state hashes and inter-edge PSKs
+		salt := md5.Sum([]byte("HashSalt" + sconfig.Cluster.Secret))
+		httpobj.http_HashSalt = []byte(hex.EncodeToString(salt[:]))
+		httpobj.http_pskdb.SetSeed([]byte(sconfig.Cluster.Secret))
+		cluster_init()
+	}
 	httpobj.http_passwords = sconfig.Passwords
 
 	httpobj.http_super_chains = &mtypes.SUPER_Events{
@@ -145,17 +187,23 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 		return err
 	}
 	httpobj.http_graph.SetNHTable(httpobj.http_sconfig.NextHopTable)
-	if sconfig.GraphRecalculateSetting.StaticMode {
-		err = checkNhTable(httpobj.http_sconfig.NextHopTable, sconfig.Peers)
-		if err != nil {
+	httpobj.http_ws4 = conn.NewWSBind()
+	httpobj.http_ws6 = conn.NewWSBind()
+	var bind4 conn.Bind = conn.NewMultiBind(conn.NewDefaultBind(EnabledAf.GetOnly4(), bindmode, sconfig.FwMark), conn.NewTCPBind(EnabledAf.GetOnly4(), sconfig.ListenPort_TCP), httpobj.http_ws4)
+	var bind6 conn.Bind = conn.NewMultiBind(conn.NewDefaultBind(EnabledAf.GetOnly6(), bindmode, sconfig.FwMark), conn.NewTCPBind(EnabledAf.GetOnly6(), sconfig.ListenPort_TCP), httpobj.http_ws6)
+	if sconfig.Obfuscation.Enabled {
+		if bind4, err = conn.NewObfsBind(bind4, sconfig.Obfuscation.Secret, sconfig.Obfuscation.MaxPadding); err != nil {
+			return err
+		}
+		if bind6, err = conn.NewObfsBind(bind6, sconfig.Obfuscation.Secret, sconfig.Obfuscation.MaxPadding); err != nil {
 			return err
 		}
 	}
 	thetap4, _ := tap.CreateDummyTAP()
-	httpobj.http_device4 = device.NewDevice(thetap4, mtypes.NodeID_SuperNode, conn.NewDefaultBind(EnabledAf.GetOnly4(), bindmode, sconfig.FwMark), logger4, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
+	httpobj.http_device4 = device.NewDevice(thetap4, mtypes.NodeID_SuperNode, bind4, logger4, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
 	defer httpobj.http_device4.Close()
 	thetap6, _ := tap.CreateDummyTAP()
-	httpobj.http_device6 = device.NewDevice(thetap6, mtypes.NodeID_SuperNode, conn.NewDefaultBind(EnabledAf.GetOnly6(), bindmode, sconfig.FwMark), logger6, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
+	httpobj.http_device6 = device.NewDevice(thetap6, mtypes.NodeID_SuperNode, bind6, logger6, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
 	defer httpobj.http_device6.Close()
 	if sconfig.PrivKeyV4 != "" {
 		pk4, err := device.Str2PriKey(sconfig.PrivKeyV4)
@@ -187,6 +235,20 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 			return err
 		}
 	}
+	if sconfig.StateStore.Path != "" {
+		err = super_load_state()
+		if err != nil {
+			// A broken state file only costs us the warm start
+			elog.Error(elog.Internal, "Load state failed", "err", err)
+		}
+	}
+	super_apply_relay()
+	if sconfig.NATTraversal.DetectPort != 0 {
+		obfs, _ := bind4.(*conn.ObfsBind)
+		if err = super_listen_nat_detect(sconfig.NATTraversal.DetectPort, EnabledAf, obfs); err != nil {
+			return err
+		}
+	}
 	logger4.Verbosef("Device4 started")
 	logger6.Verbosef("Device6 started")
 
@@ -206,9 +268,20 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	}
 
 	go Event_server_event_hendler(httpobj.http_graph, httpobj.http_super_chains)
-	go RoutinePushSettings(mtypes.S2TD(sconfig.RePushConfigInterval))
+	go RoutinePushSettings()
 	go RoutineTimeoutCheck()
+	go RoutinePunchHole()
+	if sconfig.Cluster.Enabled() {
+		go RoutineClusterSync()
+	}
+	if sconfig.StateStore.Path != "" {
+		go RoutineSaveState(mtypes.S2TD(sconfig.StateStore.SaveInterval))
+	}
 	HttpServer(sconfig.ListenPort_EdgeAPI, sconfig.ListenPort_ManageAPI, sconfig.API_Prefix, errs)
+	MetricsServer(sconfig.ListenPort_Metrics, []metrics_device{
+		{sconfig.NodeName + "_v4", httpobj.http_device4},
+		{sconfig.NodeName + "_v6", httpobj.http_device6},
+	}, httpobj.http_graph, errs)
 
 	if sconfig.PostScript != "" {
 		envs := make(map[string]string)
@@ -218,34 +291,53 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 		if err != nil {
 			return fmt.Errorf("error parse PostScript %v", err)
 		}
-		if sconfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript: exec.Command(%v)\n", cmdarg)
-		}
+		elog.Info(elog.Internal, "PostScript: exec.Command", "cmd", cmdarg)
 		cmd := exec.Command(cmdarg[0], cmdarg[1:]...)
 		out, err := cmd.CombinedOutput()
 		if err != nil {
 			return fmt.Errorf("exec.Command(%v) failed with %v", cmdarg, err)
 		}
-		if sconfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript output: %s\n", string(out))
-		}
+		elog.Info(elog.Internal, "PostScript output", "output", string(out))
 	}
 
 	httpobj.http_device4.Chan_Device_Initialized <- struct{}{}
 	httpobj.http_device6.Chan_Device_Initialized <- struct{}{}
 
 	SdNotify, err := mtypes.SdNotify(false, mtypes.SdNotifyReady)
-	if sconfig.LogLevel.LogInternal {
-		fmt.Printf("Internal: SdNotify:%v err:%v\n", SdNotify, err)
-	}
+	elog.Info(elog.Internal, "SdNotify", "result", SdNotify, "err", err)
 
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, os.Interrupt)
-	select {
-	case <-term:
-	case <-errs:
-	case <-httpobj.http_device4.Wait():
-	case <-httpobj.http_device6.Wait():
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reload := func() {
+		if err := super_reload(configPath); err != nil {
+			elog.Error(elog.Internal, "Reload failed, keep running with the old config", "path", configPath, "err", err)
+		}
+	}
+wait:
+	for {
+		select {
+		case <-hup:
+			reload()
+		case <-httpobj.http_device4.Chan_Reload:
+			reload()
+		case <-httpobj.http_device6.Chan_Reload:
+			reload()
+		case <-term:
+			break wait
+		case <-errs:
+			break wait
+		case <-httpobj.http_device4.Wait():
+			break wait
+		case <-httpobj.http_device6.Wait():
+			break wait
+		}
+	}
+	if sconfig.StateStore.Path != "" {
+		if err := super_save_state(); err != nil {
+			elog.Error(elog.Internal, "Save state failed", "err", err)
+		}
 	}
 	logger4.Verbosef("Shutting down")
 	return
@@ -276,9 +368,7 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 		if peerconf.EndPoint != "" {
 			err = peer4.SetEndpointFromConnURL(peerconf.EndPoint, conn.EnabledAf4, 0, true)
 			if err != nil {
-				if httpobj.http_sconfig.LogLevel.LogInternal {
-					fmt.Printf("Internal: Set endpoint failed:%v\n", err)
-				}
+				elog.Info(elog.Internal, "Set endpoint failed", "peer", peerconf.NodeID, "err", err)
 			}
 		}
 	}
@@ -301,33 +391,22 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 		if peerconf.EndPoint != "" {
 			err = peer6.SetEndpointFromConnURL(peerconf.EndPoint, conn.EnabledAf6, 0, true)
 			if err != nil {
-				if httpobj.http_sconfig.LogLevel.LogInternal {
-					fmt.Printf("Internal: Set endpoint failed:%v\n", err)
-				}
+				elog.Info(elog.Internal, "Set endpoint failed", "peer", peerconf.NodeID, "err", err)
 			}
 		}
 	}
 	httpobj.http_PeerID2Info[peerconf.NodeID] = peerconf
 
-	SuperParams := mtypes.API_SuperParams{
-		SendPingInterval: httpobj.http_sconfig.SendPingInterval,
-		HttpPostInterval: httpobj.http_sconfig.HttpPostInterval,
-		PeerAliveTimeout: httpobj.http_sconfig.PeerAliveTimeout,
-		AdditionalCost:   peerconf.AdditionalCost,
-	}
-
-	SuperParamStr, _ := json.Marshal(SuperParams)
-	md5_hash_raw := md5.Sum(append(SuperParamStr, httpobj.http_HashSalt...))
-	new_hash_str := hex.EncodeToString(md5_hash_raw[:])
-
 	PS := PeerState{}
-	PS.NhTableState.Store("")              // string
-	PS.PeerInfoState.Store("")             // string
-	PS.SuperParamState.Store(new_hash_str) // string
-	PS.SuperParamStateClient.Store("")     // string
-	PS.JETSecret.Store(mtypes.JWTSecret{}) // mtypes.JWTSecret
-	PS.httpPostCount.Store(uint64(0))      // uint64
-	PS.LastSeen.Store(time.Time{})         // time.Time
+	PS.NhTableState.Store("")                                 // string
+	PS.PeerInfoState.Store("")                                // string
+	PS.SuperParamState.Store(super_SuperParamState(peerconf)) // string
+	PS.SuperParamStateClient.Store("")                        // string
+	PS.JETSecret.Store(mtypes.JWTSecret{})                    // mtypes.JWTSecret
+	PS.httpPostCount.Store(uint64(0))                         // uint64
+	PS.LastSeen.Store(time.Time{})                            // time.Time
+	PS.WireCodecs.Store(mtypes.WireCodecsSupported)           // mtypes.WireCodecSet, assume the best until it registers
+	PS.NATType.Store(mtypes.NATType_Unknown)                  // mtypes.NATType
 	httpobj.http_PeerState[peerconf.PubKey] = &PS
 
 	httpobj.http_PeerIPs[peerconf.PubKey] = &HttpPeerLocalIP{}
@@ -344,6 +423,7 @@ func super_peerdel(toDelete mtypes.Vertex) {
 	delete(httpobj.http_PeerState, PubKey)
 	delete(httpobj.http_PeerIPs, PubKey)
 	delete(httpobj.http_PeerID2Info, toDelete)
+	super_update_WireCodec()
 	go super_peerdel_notify(toDelete, PubKey)
 }
 
@@ -355,18 +435,7 @@ func super_peerdel_notify(toDelete mtypes.Vertex, PubKey string) {
 		Params:  "You've been removed from supernode.",
 	}
 	for i := 0; i < 10; i++ {
-		body, _ := mtypes.GetByte(&ServerUpdateMsg)
-		buf := make([]byte, path.EgHeaderLen+len(body))
-		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
-		header.SetSrc(mtypes.NodeID_SuperNode)
-		copy(buf[path.EgHeaderLen:], body)
-		header.SetDst(toDelete)
-
-		peer4 := httpobj.http_device4.LookupPeerByStr(PubKey)
-		httpobj.http_device4.SendPacket(peer4, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
-
-		peer6 := httpobj.http_device6.LookupPeerByStr(PubKey)
-		httpobj.http_device6.SendPacket(peer6, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+		super_send_ServerUpdate(PubKey, toDelete, ServerUpdateMsg)
 		time.Sleep(mtypes.S2TD(0.1))
 	}
 	httpobj.http_device4.RemovePeerByID(toDelete)
@@ -382,10 +451,19 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 			var should_push_nh bool
 			var should_push_superparams bool
 			NodeID := reg_msg.Node_id
-			httpobj.RLock()
+			httpobj.Lock() // the NhTable and the peer list are updated below
 			PubKey := httpobj.http_PeerID2Info[NodeID].PubKey
-			if reg_msg.Node_id < mtypes.NodeID_Special {
+			if !reg_msg.Node_id.IsSpecial() {
+				httpobj.http_PeerState[PubKey].WireCodecs.Store(reg_msg.WireCodecs)
+				if super_update_WireCodec() {
+					// Edges learn the new codec from any ServerUpdateMsg
+					should_push_nh = true
+				}
 				httpobj.http_PeerState[PubKey].LastSeen.Store(time.Now())
+				if super_relay_link(NodeID) && super_is_leader() {
+					super_update_NhTableStr()
+					should_push_nh = true
+				}
 				httpobj.http_PeerState[PubKey].JETSecret.Store(reg_msg.JWTSecret)
 				httpobj.http_PeerState[PubKey].httpPostCount.Store(reg_msg.HttpPostCount)
 				if httpobj.http_PeerState[PubKey].NhTableState.Load().(string) != reg_msg.NhStateHash {
@@ -402,8 +480,9 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 				}
 			}
 			var peer_state_changed bool
-
-			httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, peer_state_changed = get_api_peers(httpobj.http_PeerInfo_hash)
+			if super_is_leader() { // followers serve the peer list of the leader
+				httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, peer_state_changed = get_api_peers(httpobj.http_PeerInfo_hash)
+			}
 			if should_push_peer || peer_state_changed {
 				PushPeerinfo(false)
 			}
@@ -413,11 +492,11 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 			if should_push_superparams {
 				PushServerParams(false)
 			}
-			httpobj.RUnlock()
+			httpobj.Unlock()
 		case pong_msg := <-events.Event_server_pong:
 			var changed bool
-			httpobj.RLock()
-			if pong_msg.Src_nodeID < mtypes.NodeID_Special && pong_msg.Dst_nodeID < mtypes.NodeID_Special {
+			httpobj.Lock()
+			if !pong_msg.Src_nodeID.IsSpecial() && !pong_msg.Dst_nodeID.IsSpecial() {
 				AdditionalCost_use := httpobj.http_PeerID2Info[pong_msg.Dst_nodeID].AdditionalCost
 				if AdditionalCost_use < 0 {
 					pong_msg.AdditionalCost = AdditionalCost_use
@@ -427,24 +506,21 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 				changed = httpobj.http_graph.RecalculateNhTable(true)
 
 			}
-			if changed {
-				NhTable := graph.GetNHTable(true)
-				NhTablestr, _ := json.Marshal(NhTable)
-				md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
-				new_hash_str := hex.EncodeToString(md5_hash_raw[:])
-				httpobj.http_NhTable_Hash = new_hash_str
-				httpobj.http_NhTableStr = NhTablestr
+			if changed && super_is_leader() {
+				super_update_NhTableStr()
 				PushNhTable(false)
 			}
-			httpobj.RUnlock()
+			httpobj.Unlock()
 		}
 	}
 }
 
-func RoutinePushSettings(interval time.Duration) {
+func RoutinePushSettings() {
 	force := false
 	var lastforce time.Time
 	for {
+		// Read it every time, it may be changed by a config reload
+		interval := mtypes.S2TD(httpobj.http_sconfig.RePushConfigInterval)
 		if time.Now().After(lastforce.Add(interval)) {
 			lastforce = time.Now()
 			force = true
@@ -475,66 +551,38 @@ func RoutineTimeoutCheck() {
 
 func PushNhTable(force bool) {
 	// No lock
-	body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+	msg := mtypes.ServerUpdateMsg{
 		Node_id: mtypes.NodeID_SuperNode,
 		Action:  mtypes.UpdateNhTable,
 		Code:    0,
 		Params:  string(httpobj.http_NhTable_Hash[:]),
-	})
-	if err != nil {
-		fmt.Println("Error get byte")
-		return
 	}
-	buf := make([]byte, path.EgHeaderLen+len(body))
-	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
-	header.SetDst(mtypes.NodeID_SuperNode)
-	header.SetSrc(mtypes.NodeID_SuperNode)
-	copy(buf[path.EgHeaderLen:], body)
 	for pkstr, peerstate := range httpobj.http_PeerState {
 		isAlive := peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now())
 		if !isAlive && !force {
 			continue
 		}
 		if force || peerstate.NhTableState.Load().(string) != httpobj.http_NhTable_Hash {
-			if peer := httpobj.http_device4.LookupPeerByStr(pkstr); peer != nil && peer.GetEndpointDstStr() != "" {
-				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
-			}
-			if peer := httpobj.http_device6.LookupPeerByStr(pkstr); peer != nil && peer.GetEndpointDstStr() != "" {
-				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
-			}
+			super_send_ServerUpdate(pkstr, mtypes.NodeID_SuperNode, msg)
 		}
 	}
 }
 
 func PushPeerinfo(force bool) {
 	//No lock
-	body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+	msg := mtypes.ServerUpdateMsg{
 		Node_id: mtypes.NodeID_SuperNode,
 		Action:  mtypes.UpdatePeer,
 		Code:    0,
 		Params:  string(httpobj.http_PeerInfo_hash[:]),
-	})
-	if err != nil {
-		fmt.Println("Error get byte")
-		return
 	}
-	buf := make([]byte, path.EgHeaderLen+len(body))
-	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
-	header.SetDst(mtypes.NodeID_SuperNode)
-	header.SetSrc(mtypes.NodeID_SuperNode)
-	copy(buf[path.EgHeaderLen:], body)
 	for pkstr, peerstate := range httpobj.http_PeerState {
 		isAlive := peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now())
 		if !isAlive && !force {
 			continue
 		}
 		if force || peerstate.PeerInfoState.Load().(string) != httpobj.http_PeerInfo_hash {
-			if peer := httpobj.http_device4.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
-			}
-			if peer := httpobj.http_device6.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
-			}
+			super_send_ServerUpdate(pkstr, mtypes.NodeID_SuperNode, msg)
 		}
 	}
 }
@@ -547,33 +595,104 @@ func PushServerParams(force bool) {
 			continue
 		}
 		if force || peerstate.SuperParamState.Load().(string) != peerstate.SuperParamStateClient.Load().(string) {
-
-			body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+			super_send_ServerUpdate(pkstr, mtypes.NodeID_SuperNode, mtypes.ServerUpdateMsg{
 				Node_id: mtypes.NodeID_SuperNode,
 				Action:  mtypes.UpdateSuperParams,
 				Code:    0,
 				Params:  peerstate.SuperParamState.Load().(string),
 			})
-			if err != nil {
-				fmt.Println("Error get byte")
-				return
-			}
-			buf := make([]byte, path.EgHeaderLen+len(body))
-			header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
-			header.SetDst(mtypes.NodeID_SuperNode)
-			header.SetSrc(mtypes.NodeID_SuperNode)
-			copy(buf[path.EgHeaderLen:], body)
-
-			if peer := httpobj.http_device4.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
-			}
-			if peer := httpobj.http_device6.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
-			}
 		}
 	}
 }
 
+// super_SuperParams returns the SuperParams served to this peer
+func super_SuperParams(peerinfo mtypes.SuperPeerInfo) mtypes.API_SuperParams {
+	// No lock
+	return mtypes.API_SuperParams{
+		SendPingInterval:    httpobj.http_sconfig.SendPingInterval,
+		HttpPostInterval:    httpobj.http_sconfig.HttpPostInterval,
+		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
+		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
+		AdditionalCost:      peerinfo.AdditionalCost,
+		ACL:                 httpobj.http_sconfig.ACL,
+		NATDetectPort:       httpobj.http_sconfig.NATTraversal.DetectPort,
+	}
+}
+
+// super_SuperParamState returns the state hash of the SuperParams for this peer.
+// The edge fetches the new SuperParams when it changes.
+func super_SuperParamState(peerinfo mtypes.SuperPeerInfo) string {
+	// No lock
+	SuperParamStr, _ := json.Marshal(super_SuperParams(peerinfo))
+	md5_hash_raw := md5.Sum(append(SuperParamStr, httpobj.http_HashSalt...))
+	return hex.EncodeToString(md5_hash_raw[:])
+}
+
+// super_update_NhTableStr serializes the NhTable of the graph for the EdgeAPI and updates its hash.
+// The hash covers the NhSets too, so the edges download it again if only the equal cost paths changed.
+func super_update_NhTableStr() {
+	// No lock
+	NhTable := httpobj.http_graph.GetNHTable(true)
+	NhTablestr, _ := json.Marshal(NhTable)
+	NhTablestr_ECMP, _ := json.Marshal(mtypes.API_NhTable{
+		NhTable: NhTable,
+		NhSets:  httpobj.http_graph.GetNHSets(),
+	})
+	md5_hash_raw := md5.Sum(append(NhTablestr_ECMP, httpobj.http_HashSalt...))
+	new_hash_str := hex.EncodeToString(md5_hash_raw[:])
+	httpobj.http_NhTable_Hash = new_hash_str
+	httpobj.http_NhTableStr = NhTablestr
+	httpobj.http_NhTableStr_ECMP = NhTablestr_ECMP
+}
+
+// super_update_WireCodec picks the best codec that every registered edge can decode.
+// Returns true if it changed.
+func super_update_WireCodec() bool {
+	// No lock
+	codecs := mtypes.WireCodecsSupported
+	for _, peerstate := range httpobj.http_PeerState {
+		codecs = codecs.Intersect(peerstate.WireCodecs.Load().(mtypes.WireCodecSet))
+	}
+	if codecs.Best() == super_wire_codec() {
+		return false
+	}
+	httpobj.http_WireCodec.Store(codecs.Best())
+	return true
+}
+
+// super_wire_codec returns the codec picked by super_update_WireCodec
+func super_wire_codec() mtypes.WireCodec {
+	codec, _ := httpobj.http_WireCodec.Load().(mtypes.WireCodec)
+	return codec
+}
+
+// super_send_ServerUpdate sends msg to the edge over both address families.
+// Each copy is encoded with the codec that edge announced in its RegisterMsg.
+func super_send_ServerUpdate(pkstr string, dst mtypes.Vertex, msg mtypes.ServerUpdateMsg) {
+	if !super_is_leader() {
+		// Edges follow whoever pushes to them, keep quiet unless we are in charge.
+		return
+	}
+	msg.WireCodec = super_wire_codec()
+	for _, the_device := range []*device.Device{httpobj.http_device4, httpobj.http_device6} {
+		peer := the_device.LookupPeerByStr(pkstr)
+		if peer == nil || peer.GetEndpointDstStr() == "" {
+			continue
+		}
+		body, err := the_device.EncodeMsgFor(peer, &msg)
+		if err != nil {
+			elog.Error(elog.Control, "Encode ServerUpdateMsg failed", "peer", peer.ID, "err", err)
+			continue
+		}
+		buf := make([]byte, path.EgHeaderLen+len(body))
+		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
+		header.SetDst(dst)
+		header.SetSrc(mtypes.NodeID_SuperNode)
+		copy(buf[path.EgHeaderLen:], body)
+		the_device.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+	}
+}
+
 func startUAPI(interfaceName string, logger *device.Logger, the_device *device.Device, errs chan error) (net.Listener, error) {
 	fileUAPI, err := func() (*os.File, error) {
 		uapiFdStr := os.Getenv(ENV_EG_UAPI_FD)
@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"gopkg.in/yaml.v2"
+)
+
+// super_test_config is the demo config of gencfg with peer 1 and 2, as a supernode out of any cluster
+func super_test_config(t *testing.T) mtypes.SuperConfig {
+	t.Helper()
+	sconfig, _ := gencfg.GetExampleSuperConf("", true)
+	sconfig.LogLevel.LogLevel = "error"
+	sconfig.LogLevel.LogInternal = false
+	sconfig.LogLevel.LogNTP = false
+	sconfig.Cluster = mtypes.SuperClusterInfo{}
+	return sconfig
+}
+
+// super_test_init sets up httpobj like Super does, without opening any socket.
+// The config is written to http_sconfig_path.
+func super_test_init(t *testing.T, sconfig mtypes.SuperConfig) {
+	t.Helper()
+	httpobj = http_shared_objects{}
+	clusterobj = cluster_state{}
+	httpobj.http_sconfig = &sconfig
+	httpobj.http_sconfig_path = filepath.Join(t.TempDir(), "super.yaml")
+	httpobj.http_PeerState = make(map[string]*PeerState)
+	httpobj.http_PeerIPs = make(map[string]*HttpPeerLocalIP)
+	httpobj.http_PeerID2Info = make(map[mtypes.Vertex]mtypes.SuperPeerInfo)
+	httpobj.http_HashSalt = []byte("HashSalt")
+	httpobj.http_passwords = sconfig.Passwords
+	httpobj.http_super_chains = &mtypes.SUPER_Events{
+		Event_server_pong:     make(chan mtypes.PongMsg, 1<<5),
+		Event_server_register: make(chan mtypes.RegisterMsg, 1<<5),
+	}
+	econfig_tmp, _ := gencfg.GetExampleEdgeConf("", true)
+	httpobj.http_econfig_tmp = &econfig_tmp
+	if sconfig.Cluster.Enabled() {
+		cluster_init()
+	}
+	var err error
+	httpobj.http_graph, err = path.NewGraph(3, true, sconfig.GraphRecalculateSetting, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []struct {
+		dev  **device.Device
+		priv string
+	}{{&httpobj.http_device4, sconfig.PrivKeyV4}, {&httpobj.http_device6, sconfig.PrivKeyV6}} {
+		thetap, _ := tap.CreateDummyTAP()
+		bind := conn.NewStdNetBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0)
+		*d.dev = device.NewDevice(thetap, mtypes.NodeID_SuperNode, bind, device.NewLogger(device.LogLevelSilent, ""), httpobj.http_graph, true, httpobj.http_sconfig_path, nil, &sconfig, httpobj.http_super_chains, "test")
+		t.Cleanup((*d.dev).Close)
+		if d.priv != "" {
+			pk, err := device.Str2PriKey(d.priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			(*d.dev).SetPrivateKey(pk)
+		}
+	}
+	for _, peerconf := range sconfig.Peers {
+		if err := super_peeradd(peerconf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	super_test_write_config(t, sconfig)
+}
+
+// super_test_write_config writes sconfig to http_sconfig_path
+func super_test_write_config(t *testing.T, sconfig mtypes.SuperConfig) {
+	t.Helper()
+	configbytes, err := yaml.Marshal(sconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(httpobj.http_sconfig_path, configbytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
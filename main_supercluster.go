@@ -0,0 +1,429 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Supernode cluster
+//
+// Every member pushes a SuperStateSnapshot to the others each SyncInterval.
+// The member with the lowest Priority (then the lowest NodeName) that has been
+// heard within LeaderTimeout is the leader. Only the leader calculates the
+// NhTable and sends ServerUpdateMsg to the edges, the followers serve the
+// leader's NhTable and peer list on their EdgeAPI so that an edge can download
+// from any of them. Latencies, JWT secrets and post counts are merged from every
+// member, because edges register and post to whichever supernode they reach.
+
+type SuperStateSnapshot struct {
+	Node            string
+	Priority        int
+	Leader          bool
+	Peers           []mtypes.SuperPeerInfo
+	PeerState       map[string]PeerStateSnapshot
+	PeerIPs         map[string]HttpPeerLocalIP
+	Edges           []path.EdgeState
+	NhTable_Hash    string
+	NhTableStr      []byte
+	NhTableStr_ECMP []byte
+	PeerInfo        mtypes.API_Peers
+	PeerInfo_hash   string
+	SuperParams     mtypes.API_SuperParams
+}
+
+type PeerStateSnapshot struct {
+	SuperParamState string
+	JWTSecret       mtypes.JWTSecret
+	HttpPostCount   uint64
+	LastSeen        time.Time
+	WireCodecs      mtypes.WireCodecSet
+}
+
+type cluster_member struct {
+	Name     string
+	Url      string
+	Priority int
+	LastSeen time.Time
+}
+
+type cluster_state struct {
+	members   map[string]*cluster_member // map[NodeName]
+	leader    string
+	leaderUrl string
+	started   time.Time
+	sync.RWMutex
+}
+
+var (
+	clusterobj cluster_state
+)
+
+func super_is_leader() bool {
+	if !httpobj.http_sconfig.Cluster.Enabled() {
+		return true
+	}
+	clusterobj.RLock()
+	defer clusterobj.RUnlock()
+	return clusterobj.leader == httpobj.http_sconfig.NodeName
+}
+
+// cluster_check_leader rejects write requests on followers, the peer list is owned by the leader.
+func cluster_check_leader(w http.ResponseWriter) bool {
+	if super_is_leader() {
+		return true
+	}
+	clusterobj.RLock()
+	defer clusterobj.RUnlock()
+	w.WriteHeader(http.StatusConflict)
+	w.Write([]byte(fmt.Sprintf("This supernode is not the cluster leader, please send this request to the leader: %v(%v)", clusterobj.leader, clusterobj.leaderUrl)))
+	return false
+}
+
+func super_get_snapshot() SuperStateSnapshot {
+	// No lock, lock before call me
+	snap := SuperStateSnapshot{
+		Node:     httpobj.http_sconfig.NodeName,
+		Priority: httpobj.http_sconfig.Cluster.Priority,
+		Leader:   super_is_leader(),
+		Peers:    httpobj.http_sconfig.Peers,
+		Edges:    httpobj.http_graph.ExportEdges(),
+		SuperParams: mtypes.API_SuperParams{
+			SendPingInterval:    httpobj.http_sconfig.SendPingInterval,
+			HttpPostInterval:    httpobj.http_sconfig.HttpPostInterval,
+			PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
+			DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
+			ACL:                 httpobj.http_sconfig.ACL,
+		},
+	}
+	if snap.Leader {
+		snap.NhTable_Hash = httpobj.http_NhTable_Hash
+		snap.NhTableStr = httpobj.http_NhTableStr
+		snap.NhTableStr_ECMP = httpobj.http_NhTableStr_ECMP
+		snap.PeerInfo = httpobj.http_PeerInfo
+		snap.PeerInfo_hash = httpobj.http_PeerInfo_hash
+	}
+	snap.PeerState, snap.PeerIPs = super_get_peerstates()
+	return snap
+}
+
+func super_get_peerstates() (states map[string]PeerStateSnapshot, peerips map[string]HttpPeerLocalIP) {
+	// No lock, lock before call me
+	states = make(map[string]PeerStateSnapshot, len(httpobj.http_PeerState))
+	peerips = make(map[string]HttpPeerLocalIP, len(httpobj.http_PeerIPs))
+	for PubKey, peerstate := range httpobj.http_PeerState {
+		states[PubKey] = PeerStateSnapshot{
+			SuperParamState: peerstate.SuperParamState.Load().(string),
+			JWTSecret:       peerstate.JETSecret.Load().(mtypes.JWTSecret),
+			HttpPostCount:   peerstate.httpPostCount.Load().(uint64),
+			LastSeen:        peerstate.LastSeen.Load().(time.Time),
+			WireCodecs:      peerstate.WireCodecs.Load().(mtypes.WireCodecSet),
+		}
+	}
+	for PubKey, ips := range httpobj.http_PeerIPs {
+		peerips[PubKey] = *ips
+	}
+	return
+}
+
+// super_apply_peers replaces the running peer list with peers.
+// Peers whose key changed are deleted first and added back in a later call,
+// after the device has released the old one.
+func super_apply_peers(peers []mtypes.SuperPeerInfo) (changed bool, err error) {
+	// No lock, lock before call me
+	newpeers := make(map[mtypes.Vertex]mtypes.SuperPeerInfo, len(peers))
+	for _, peerinfo := range peers {
+		newpeers[peerinfo.NodeID] = peerinfo
+	}
+	for NodeID, oldinfo := range httpobj.http_PeerID2Info {
+		newinfo, has := newpeers[NodeID]
+		if !has || newinfo.PubKey != oldinfo.PubKey || newinfo.PSKey != oldinfo.PSKey {
+			super_peerdel(NodeID)
+			changed = true
+		}
+	}
+	for _, newinfo := range peers {
+		oldinfo, has := httpobj.http_PeerID2Info[newinfo.NodeID]
+		if !has {
+			if err2 := super_peeradd(newinfo); err2 != nil {
+				err = fmt.Errorf("peer %v: %v", newinfo.NodeID.ToString(), err2)
+				continue
+			}
+			changed = true
+		} else if oldinfo != newinfo {
+			httpobj.http_PeerID2Info[newinfo.NodeID] = newinfo
+			changed = true
+		}
+	}
+	httpobj.http_sconfig.Peers = peers
+	return
+}
+
+func cluster_apply_snapshot(snap SuperStateSnapshot) {
+	// No lock, lock before call me
+	from_leader := snap.Leader && !super_is_leader()
+	if from_leader {
+		peers_changed, err := super_apply_peers(snap.Peers)
+		if err != nil {
+			elog.Error(elog.Internal, "Cluster: apply peer list failed", "member", snap.Node, "err", err)
+		}
+		if snap.SuperParams.PeerAliveTimeout > 0 {
+			peers_changed = peers_changed || httpobj.http_sconfig.SendPingInterval != snap.SuperParams.SendPingInterval ||
+				httpobj.http_sconfig.HttpPostInterval != snap.SuperParams.HttpPostInterval ||
+				httpobj.http_sconfig.PeerAliveTimeout != snap.SuperParams.PeerAliveTimeout ||
+				httpobj.http_sconfig.DampingFilterRadius != snap.SuperParams.DampingFilterRadius ||
+				!reflect.DeepEqual(httpobj.http_sconfig.ACL, snap.SuperParams.ACL)
+			httpobj.http_sconfig.SendPingInterval = snap.SuperParams.SendPingInterval
+			httpobj.http_sconfig.HttpPostInterval = snap.SuperParams.HttpPostInterval
+			httpobj.http_sconfig.PeerAliveTimeout = snap.SuperParams.PeerAliveTimeout
+			httpobj.http_sconfig.DampingFilterRadius = snap.SuperParams.DampingFilterRadius
+			httpobj.http_sconfig.ACL = snap.SuperParams.ACL
+			super_apply_relay()
+		}
+		// The peer list stays in memory, the config file of a follower belongs to its operator
+		if peers_changed {
+			elog.Info(elog.Internal, "Cluster: peer list taken from the leader", "member", snap.Node)
+		}
+		httpobj.http_NhTable_Hash = snap.NhTable_Hash
+		httpobj.http_NhTableStr = snap.NhTableStr
+		httpobj.http_NhTableStr_ECMP = snap.NhTableStr_ECMP
+		httpobj.http_PeerInfo = snap.PeerInfo
+		httpobj.http_PeerInfo_hash = snap.PeerInfo_hash
+	}
+	for PubKey, remote := range snap.PeerState {
+		peerstate, has := httpobj.http_PeerState[PubKey]
+		if !has {
+			continue
+		}
+		if from_leader {
+			peerstate.SuperParamState.Store(remote.SuperParamState)
+		}
+		if remote.HttpPostCount > peerstate.httpPostCount.Load().(uint64) {
+			peerstate.httpPostCount.Store(remote.HttpPostCount)
+		}
+		if remote.LastSeen.After(peerstate.LastSeen.Load().(time.Time)) {
+			peerstate.LastSeen.Store(remote.LastSeen)
+			peerstate.JETSecret.Store(remote.JWTSecret)
+			peerstate.WireCodecs.Store(remote.WireCodecs)
+			if peerips, has := snap.PeerIPs[PubKey]; has {
+				httpobj.http_PeerIPs[PubKey] = &peerips
+			}
+		}
+	}
+	super_update_WireCodec()
+	httpobj.http_graph.ImportEdges(snap.Edges)
+}
+
+// cluster_update_leader elects the leader from the members heard within LeaderTimeout.
+// Returns true if the leader changed.
+func cluster_update_leader() (changed bool) {
+	clusterobj.Lock()
+	defer clusterobj.Unlock()
+	cconfig := httpobj.http_sconfig.Cluster
+	timeout := mtypes.S2TD(cconfig.LeaderTimeout)
+	if time.Since(clusterobj.started) < timeout {
+		// Listen to the cluster before claiming anything, we may just have restarted with an empty state.
+		return false
+	}
+	candidates := []cluster_member{{Name: httpobj.http_sconfig.NodeName, Priority: cconfig.Priority}}
+	for _, member := range clusterobj.members {
+		if time.Since(member.LastSeen) < timeout {
+			candidates = append(candidates, *member)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority < candidates[j].Priority
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	changed = clusterobj.leader != candidates[0].Name
+	clusterobj.leader = candidates[0].Name
+	clusterobj.leaderUrl = candidates[0].Url
+	return
+}
+
+func cluster_member_seen(Name string, Url string, Priority int) {
+	clusterobj.Lock()
+	defer clusterobj.Unlock()
+	member, has := clusterobj.members[Name]
+	if !has {
+		member = &cluster_member{Name: Name}
+		clusterobj.members[Name] = member
+	}
+	if Url != "" {
+		member.Url = Url
+	}
+	member.Priority = Priority
+	member.LastSeen = time.Now()
+}
+
+func cluster_init() {
+	clusterobj.members = make(map[string]*cluster_member)
+	clusterobj.started = time.Now()
+}
+
+func RoutineClusterSync() {
+	cconfig := httpobj.http_sconfig.Cluster
+	client := &http.Client{
+		Timeout: mtypes.S2TD(cconfig.LeaderTimeout),
+	}
+	for {
+		httpobj.RLock()
+		snap := super_get_snapshot()
+		body, err := json.Marshal(snap)
+		httpobj.RUnlock()
+		if err == nil {
+			body = mtypes.Gzip(body)
+			for _, url := range cconfig.Members {
+				go cluster_post_snapshot(client, url, body)
+			}
+		} else {
+			elog.Error(elog.Internal, "Cluster: encode snapshot failed", "err", err)
+		}
+
+		if cluster_update_leader() {
+			clusterobj.RLock()
+			leader := clusterobj.leader
+			clusterobj.RUnlock()
+			elog.Info(elog.Internal, "Cluster: leader changed", "leader", leader)
+			if leader == httpobj.http_sconfig.NodeName {
+				httpobj.Lock()
+				super_update_NhTableStr()
+				httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, _ = get_api_peers("")
+				// Tell every edge, so that they switch to our EdgeAPI
+				PushNhTable(true)
+				PushPeerinfo(true)
+				PushServerParams(true)
+				httpobj.Unlock()
+			}
+		}
+		time.Sleep(mtypes.S2TD(cconfig.SyncInterval))
+	}
+}
+
+func cluster_post_snapshot(client *http.Client, url string, body []byte) {
+	cconfig := httpobj.http_sconfig.Cluster
+	bodyhash := sha3.Sum512(body)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, mtypes.API_cluster_sync_jwt_claims{
+		Node:     httpobj.http_sconfig.NodeName,
+		BodyHash: base64.StdEncoding.EncodeToString(bodyhash[:]),
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(mtypes.S2TD(cconfig.LeaderTimeout)).Unix(),
+		},
+	})
+	tokenString, _ := token.SignedString([]byte(cconfig.Secret))
+	req, err := http.NewRequest("POST", url+"/cluster/sync", bytes.NewReader(body))
+	if err != nil {
+		elog.Error(elog.Internal, "Cluster: sync failed", "url", url, "err", err)
+		return
+	}
+	q := req.URL.Query()
+	q.Add("JWTSig", tokenString)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		elog.Info(elog.Internal, "Cluster: sync failed", "url", url, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		elog.Info(elog.Internal, "Cluster: sync failed", "url", url, "status", resp.StatusCode, "body", string(res))
+		return
+	}
+	var ack cluster_member
+	if err := json.Unmarshal(res, &ack); err != nil || ack.Name == "" {
+		return
+	}
+	cluster_member_seen(ack.Name, url, ack.Priority)
+}
+
+func cluster_post_sync(w http.ResponseWriter, r *http.Request) {
+	cconfig := httpobj.http_sconfig.Cluster
+	if !cconfig.Enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Cluster is not enabled on this supernode"))
+		return
+	}
+	params := r.URL.Query()
+	JWTSig, err := extractParamsStr(params, "JWTSig", w)
+	if err != nil {
+		return
+	}
+	token_claims := mtypes.API_cluster_sync_jwt_claims{}
+	token, err := jwt.ParseWithClaims(JWTSig, &token_claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(cconfig.Secret), nil
+	})
+	if err != nil || !token.Valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(fmt.Sprintf("Paramater JWTSig: Signature verification failed: %v", err)))
+		return
+	}
+	client_body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Request body: Error reading request body: %v", err)))
+		return
+	}
+	bodyhash := sha3.Sum512(client_body)
+	if base64.StdEncoding.EncodeToString(bodyhash[:]) != token_claims.BodyHash {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Request body: hash not match"))
+		return
+	}
+	client_body, err = mtypes.GUzip(client_body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Request body: gzip unzip failed"))
+		return
+	}
+	var snap SuperStateSnapshot
+	if err := json.Unmarshal(client_body, &snap); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Request body: Error parsing request body: %v", err)))
+		return
+	}
+	if snap.Node != token_claims.Node || snap.Node == httpobj.http_sconfig.NodeName {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Request body: Bad node name: %v", snap.Node)))
+		return
+	}
+	cluster_member_seen(snap.Node, "", snap.Priority)
+
+	httpobj.Lock()
+	cluster_apply_snapshot(snap)
+	httpobj.Unlock()
+
+	ack, _ := json.Marshal(cluster_member{
+		Name:     httpobj.http_sconfig.NodeName,
+		Priority: cconfig.Priority,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ack)
+}
@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const cluster_test_secret = "cluster secret"
+
+// cluster_test_config is the demo config as member name of a cluster of two
+func cluster_test_config(t *testing.T, name string, priority int) mtypes.SuperConfig {
+	sconfig := super_test_config(t)
+	sconfig.NodeName = name
+	sconfig.Cluster = mtypes.SuperClusterInfo{
+		Members:       []string{"http://127.0.0.1:1"},
+		Secret:        cluster_test_secret,
+		Priority:      priority,
+		SyncInterval:  1,
+		LeaderTimeout: 5,
+	}
+	return sconfig
+}
+
+// cluster_test_sync posts body to cluster_post_sync signed like cluster_post_snapshot does
+func cluster_test_sync(secret string, node string, body []byte, signed []byte) *httptest.ResponseRecorder {
+	bodyhash := sha3.Sum512(signed)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, mtypes.API_cluster_sync_jwt_claims{
+		Node:     node,
+		BodyHash: base64.StdEncoding.EncodeToString(bodyhash[:]),
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+	})
+	tokenString, _ := token.SignedString([]byte(secret))
+	req := httptest.NewRequest("POST", "/cluster/sync?JWTSig="+tokenString, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	cluster_post_sync(w, req)
+	return w
+}
+
+// cluster_test_leader_snapshot sets up super1 as the leader with some state, and returns its snapshot
+func cluster_test_leader_snapshot(t *testing.T) (SuperStateSnapshot, []byte) {
+	super_test_init(t, cluster_test_config(t, "super1", 0))
+	clusterobj.leader = "super1"
+	httpobj.http_graph.UpdateLatencyMulti([]mtypes.PongMsg{
+		{Src_nodeID: 1, Dst_nodeID: 2, Timediff: 0.010, TimeToAlive: 60},
+		{Src_nodeID: 2, Dst_nodeID: 1, Timediff: 0.012, TimeToAlive: 60},
+	}, true, false)
+	peerstate := httpobj.http_PeerState[httpobj.http_PeerID2Info[1].PubKey]
+	peerstate.httpPostCount.Store(uint64(7))
+	peerstate.LastSeen.Store(time.Now())
+	peerstate.JETSecret.Store(mtypes.JWTSecret{1, 2, 3})
+	super_update_NhTableStr()
+	httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, _ = get_api_peers("")
+	snap := super_get_snapshot()
+	body, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snap, mtypes.Gzip(body)
+}
+
+func TestClusterLeader(t *testing.T) {
+	super_test_init(t, cluster_test_config(t, "super2", 1))
+	cluster_member_seen("super1", "http://127.0.0.1:1", 0)
+	if cluster_update_leader() || clusterobj.leader != "" {
+		t.Fatalf("claimed %q before listening for LeaderTimeout", clusterobj.leader)
+	}
+	clusterobj.started = time.Now().Add(-time.Minute)
+	if !cluster_update_leader() || super_is_leader() || clusterobj.leaderUrl != "http://127.0.0.1:1" {
+		t.Fatalf("leader %q, expect super1 with the lower Priority", clusterobj.leader)
+	}
+	clusterobj.members["super1"].LastSeen = time.Now().Add(-time.Minute)
+	if !cluster_update_leader() || !super_is_leader() {
+		t.Fatalf("leader %q, expect super2 once super1 timed out", clusterobj.leader)
+	}
+	cluster_member_seen("super3", "", 1)
+	if cluster_update_leader() || !super_is_leader() {
+		t.Fatalf("leader %q, expect super2 to stay, the lower NodeName wins on the same Priority", clusterobj.leader)
+	}
+}
+
+func TestClusterSnapshot(t *testing.T) {
+	snap, body := cluster_test_leader_snapshot(t)
+	if !snap.Leader || len(snap.Edges) != 2 || len(snap.NhTableStr) == 0 || snap.PeerInfo_hash == "" {
+		t.Fatalf("leader snapshot: %+v", snap)
+	}
+
+	// The follower has only peer 1 in its config file
+	sconfig := cluster_test_config(t, "super2", 1)
+	sconfig.Peers = sconfig.Peers[:1]
+	super_test_init(t, sconfig)
+	clusterobj.leader = "super1"
+	configbytes, _ := ioutil.ReadFile(httpobj.http_sconfig_path)
+
+	w := cluster_test_sync(cluster_test_secret, "super1", body, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("sync: %v %v", w.Code, w.Body.String())
+	}
+	var ack cluster_member
+	if err := json.Unmarshal(w.Body.Bytes(), &ack); err != nil || ack.Name != "super2" || ack.Priority != 1 {
+		t.Errorf("ack %+v, %v", ack, err)
+	}
+	if len(httpobj.http_PeerID2Info) != 2 || len(httpobj.http_sconfig.Peers) != 2 {
+		t.Errorf("peers %v, expect the 2 of the leader", httpobj.http_PeerID2Info)
+	}
+	if !bytes.Equal(httpobj.http_NhTableStr, snap.NhTableStr) || httpobj.http_NhTable_Hash != snap.NhTable_Hash {
+		t.Errorf("NhTable %s, expect %s", httpobj.http_NhTableStr, snap.NhTableStr)
+	}
+	if httpobj.http_PeerInfo_hash != snap.PeerInfo_hash {
+		t.Errorf("PeerInfo hash %v, expect %v", httpobj.http_PeerInfo_hash, snap.PeerInfo_hash)
+	}
+	peerstate := httpobj.http_PeerState[httpobj.http_PeerID2Info[1].PubKey]
+	if peerstate.httpPostCount.Load().(uint64) != 7 || peerstate.JETSecret.Load().(mtypes.JWTSecret) != (mtypes.JWTSecret{1, 2, 3}) {
+		t.Errorf("peer state not merged")
+	}
+	if edges := httpobj.http_graph.ExportEdges(); len(edges) != 2 {
+		t.Errorf("edges %v, expect the 2 of the leader", edges)
+	}
+	if after, _ := ioutil.ReadFile(httpobj.http_sconfig_path); !bytes.Equal(after, configbytes) {
+		t.Errorf("the config file of the follower was rewritten")
+	}
+}
+
+func TestClusterSyncAuth(t *testing.T) {
+	_, body := cluster_test_leader_snapshot(t)
+	super_test_init(t, cluster_test_config(t, "super2", 1))
+	clusterobj.leader = "super1"
+
+	if w := cluster_test_sync("wrong secret", "super1", body, body); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong secret: %v %v", w.Code, w.Body.String())
+	}
+	if w := cluster_test_sync(cluster_test_secret, "super1", body, append([]byte{0}, body...)); w.Code != http.StatusBadRequest {
+		t.Errorf("tampered body: %v %v", w.Code, w.Body.String())
+	}
+	if w := cluster_test_sync(cluster_test_secret, "super3", body, body); w.Code != http.StatusBadRequest {
+		t.Errorf("snapshot of another member: %v %v", w.Code, w.Body.String())
+	}
+	if len(httpobj.http_PeerID2Info) != 2 || len(httpobj.http_graph.ExportEdges()) != 0 {
+		t.Errorf("a rejected snapshot was applied")
+	}
+
+	// A follower tells the leader only to the ones who may delete
+	peerdel := func(password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		manage_peerdel(w, httptest.NewRequest("GET", "/manage/peer/del?NodeID=1&Password="+password, nil))
+		return w
+	}
+	if w := peerdel("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("peerdel with a wrong password: %v %v", w.Code, w.Body.String())
+	}
+	if w := peerdel(httpobj.http_passwords.DelPeer); w.Code != http.StatusConflict {
+		t.Errorf("peerdel on a follower: %v %v", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// NAT traversal
+//
+// The edges classify their NAT with NATProbes, like STUN. The devices of the supernode answer them on ListenPort,
+// and a plain UDP socket answers them on DetectPort, so an edge sees whether its NAT maps both ports the same way.
+// The edges report the result in API_report_peerinfo.
+// Every PunchInterval the leader picks the pairs of edges that can't reach each other and pushes a PunchHole to both,
+// so they send to each other at the same time and each NAT lets the other one in.
+
+func super_check_nat_traversal(info mtypes.SuperNATTraversalInfo, ListenPort int) error {
+	if info.DetectPort < 0 || info.DetectPort > 65535 {
+		return fmt.Errorf("NATTraversal.DetectPort must in 0-65535 : %v", info.DetectPort)
+	}
+	if info.DetectPort != 0 && info.DetectPort == ListenPort {
+		return errors.New("NATTraversal.DetectPort must not be ListenPort")
+	}
+	if info.PunchInterval < 0 {
+		return fmt.Errorf("NATTraversal.PunchInterval must >= 0 : %v", info.PunchInterval)
+	}
+	if info.PunchDelay < 0 || info.PunchDelay > device.PunchDelayMax {
+		return fmt.Errorf("NATTraversal.PunchDelay must in 0-%v : %v", device.PunchDelayMax, info.PunchDelay)
+	}
+	return nil
+}
+
+// super_listen_nat_detect opens DetectPort for each enabled address family. The probes are obfuscated by obfs like the ones to ListenPort, nil if Obfuscation is off.
+func super_listen_nat_detect(port int, EnabledAf conn.EnabledAf, obfs *conn.ObfsBind) error {
+	networks := map[string]bool{"udp4": EnabledAf.IPv4, "udp6": EnabledAf.IPv6}
+	for network, enabled := range networks {
+		if !enabled {
+			continue
+		}
+		udpconn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+		if err != nil {
+			return fmt.Errorf("NATTraversal.DetectPort: %v", err)
+		}
+		go RoutineAnswerNATProbe(udpconn, obfs)
+	}
+	return nil
+}
+
+func RoutineAnswerNATProbe(udpconn *net.UDPConn, obfs *conn.ObfsBind) {
+	bufsize := device.NATProbeSize + 1 // a larger packet is not a NATProbe
+	if obfs != nil {
+		bufsize += obfs.Overhead()
+	}
+	buf := make([]byte, bufsize)
+	for {
+		n, addr, err := udpconn.ReadFromUDP(buf)
+		if err != nil {
+			elog.Error(elog.Internal, "NATTraversal.DetectPort closed", "err", err)
+			return
+		}
+		if obfs != nil {
+			var ok bool
+			if n, ok = obfs.Deobfuscate(buf[:n]); !ok {
+				continue
+			}
+		}
+		if reply := device.MakeNATProbeReply(buf[:n], addr); reply != nil {
+			if obfs != nil {
+				reply = obfs.Obfuscate(nil, reply)
+			}
+			udpconn.WriteToUDP(reply, addr)
+		}
+	}
+}
+
+func RoutinePunchHole() {
+	for {
+		// Read it every time, it may be changed by a config reload
+		httpobj.RLock()
+		interval := httpobj.http_sconfig.NATTraversal.PunchInterval
+		httpobj.RUnlock()
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(mtypes.S2TD(interval))
+		httpobj.RLock()
+		if super_is_leader() {
+			super_punch_holes()
+		}
+		httpobj.RUnlock()
+	}
+}
+
+// super_punch_holes pushes a PunchHole to both sides of every pair of alive edges that can't reach each other,
+// unless both are behind a symmetric NAT, which no punching gets through
+func super_punch_holes() {
+	// No lock, lock before call me
+	type punchable struct {
+		peerinfo mtypes.SuperPeerInfo
+		endpoint string
+		nat      mtypes.NATType
+	}
+	var edges []punchable
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		peerstate, has := httpobj.http_PeerState[peerinfo.PubKey]
+		if !has {
+			continue
+		}
+		if !peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now()) {
+			continue
+		}
+		nat := peerstate.NATType.Load().(mtypes.NATType)
+		endpoint := httpobj.http_device4.GetConnurl(peerinfo.NodeID)
+		if nat == mtypes.NATType_Unknown || endpoint == "" || conn.IsStreamURL(endpoint) { // an edge that doesn't detect may not know PunchHole either
+			continue
+		}
+		edges = append(edges, punchable{peerinfo, endpoint, nat})
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].peerinfo.NodeID < edges[j].peerinfo.NodeID })
+	delay := httpobj.http_sconfig.NATTraversal.PunchDelay
+	for i, a := range edges {
+		for _, b := range edges[i+1:] {
+			if a.nat == mtypes.NATType_Symmetric && b.nat == mtypes.NATType_Symmetric {
+				continue
+			}
+			if httpobj.http_graph.Weight(a.peerinfo.NodeID, b.peerinfo.NodeID, false) < mtypes.Infinity ||
+				httpobj.http_graph.Weight(b.peerinfo.NodeID, a.peerinfo.NodeID, false) < mtypes.Infinity {
+				continue
+			}
+			elog.Info(elog.Control, "Punch hole", "a", a.peerinfo.NodeID, "a_nat", a.nat.ToString(), "b", b.peerinfo.NodeID, "b_nat", b.nat.ToString())
+			super_send_PunchHole(a.peerinfo, b.peerinfo.NodeID, b.endpoint, delay)
+			super_send_PunchHole(b.peerinfo, a.peerinfo.NodeID, a.endpoint, delay)
+		}
+	}
+}
+
+func super_send_PunchHole(to mtypes.SuperPeerInfo, NodeID mtypes.Vertex, endpoint string, delay float64) {
+	// No lock
+	params, _ := json.Marshal(mtypes.PunchHoleParams{
+		NodeID:   NodeID,
+		Endpoint: endpoint,
+		Delay:    delay,
+	})
+	super_send_ServerUpdate(to.PubKey, to.NodeID, mtypes.ServerUpdateMsg{
+		Node_id: mtypes.NodeID_SuperNode,
+		Action:  mtypes.PunchHole,
+		Code:    0,
+		Params:  string(params),
+	})
+}
@@ -0,0 +1,41 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Relay
+//
+// With Relay.Enabled, every edge that registers gets a link to the supernode and back in the graph, each costs half
+// of Relay.AdditionalCost and lives as long as the edge is alive. A path through the supernode costs AdditionalCost,
+// so the NhTable only takes it if there is no direct or transit path cheaper than that.
+
+// super_apply_relay hands the relay and the ACL, which the devices check on the relayed packets, to both devices
+func super_apply_relay() {
+	// No lock
+	relay, _ := device.CheckRelay(httpobj.http_sconfig.Relay) // checked by super_check_config
+	for _, the_device := range []*device.Device{httpobj.http_device4, httpobj.http_device6} {
+		the_device.SetRelay(relay)
+		the_device.SetACL(httpobj.http_sconfig.ACL)
+	}
+}
+
+// super_relay_link refreshes the links between the supernode and an edge that registered. Returns true if the NhTable changed.
+func super_relay_link(NodeID mtypes.Vertex) bool {
+	// No lock, lock before call me
+	if !httpobj.http_sconfig.Relay.Enabled {
+		return false
+	}
+	cost := httpobj.http_sconfig.Relay.AdditionalCost / 2 // a relayed path takes two of them
+	alive := httpobj.http_sconfig.PeerAliveTimeout
+	return httpobj.http_graph.UpdateLatencyMulti([]mtypes.PongMsg{
+		{Src_nodeID: NodeID, Dst_nodeID: mtypes.NodeID_SuperNode, AdditionalCost: cost, TimeToAlive: alive},
+		{Src_nodeID: mtypes.NodeID_SuperNode, Dst_nodeID: NodeID, AdditionalCost: cost, TimeToAlive: alive},
+	}, true, true)
+}
@@ -0,0 +1,203 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// super_reload reads the config file again and applies it to the running supernode.
+//
+// The peer list is diffed and applied with super_peeradd/super_peerdel. Passwords,
+// GraphRecalculateSetting, NextHopTable, EdgeTemplate and the intervals are updated in place,
+// then the edges are notified. Listen ports, keys and Cluster/StateStore need a restart.
+func super_reload(configPath string) error {
+	var newconf mtypes.SuperConfig
+	err := mtypes.ReadYaml(configPath, &newconf)
+	if err != nil {
+		return err
+	}
+	EnabledAf := newconf.DisableAf.Disalbed2Enabled()
+	if !EnabledAf.IPv4 {
+		newconf.PrivKeyV4 = ""
+	}
+	if !EnabledAf.IPv6 {
+		newconf.PrivKeyV6 = ""
+	}
+
+	// Validate everything before touching the running supernode
+	if err = super_check_config(&newconf); err != nil {
+		return err
+	}
+	pubkeys := make(map[string]bool, len(newconf.Peers))
+	ids := make(map[mtypes.Vertex]bool, len(newconf.Peers))
+	for _, peerconf := range newconf.Peers {
+		if _, err := device.Str2PubKey(peerconf.PubKey); err != nil {
+			return fmt.Errorf("error decode base64 %v: %v", peerconf.PubKey, err)
+		}
+		if peerconf.PSKey != "" {
+			if _, err := device.Str2PSKey(peerconf.PSKey); err != nil {
+				return fmt.Errorf("peer %v: error decode base64 :%v", peerconf.NodeID, err)
+			}
+		}
+		if peerconf.NodeID.IsSpecial() {
+			return fmt.Errorf("peer %v: ID %v is a special NodeID", peerconf.PubKey, peerconf.NodeID)
+		}
+		if pubkeys[peerconf.PubKey] || ids[peerconf.NodeID] {
+			return fmt.Errorf("duplicate peer: %v %v", peerconf.NodeID, peerconf.PubKey)
+		}
+		pubkeys[peerconf.PubKey] = true
+		ids[peerconf.NodeID] = true
+	}
+	if err = elog.Setup(newconf.LogLevel); err != nil {
+		return err
+	}
+	econfig_tmp, _ := gencfg.GetExampleEdgeConf(newconf.EdgeTemplate, true)
+
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	sconfig := httpobj.http_sconfig
+	super_reload_keep_static(sconfig, &newconf)
+
+	if sconfig.Cluster.Enabled() && !super_is_leader() {
+		// Followers take them from the leader, they will be overwritten by the next sync anyway
+		elog.Info(elog.Internal, "Reload: not the cluster leader, Peers and SuperParams are taken from the leader")
+		newconf.Peers = sconfig.Peers
+		newconf.PeerAliveTimeout = sconfig.PeerAliveTimeout
+		newconf.SendPingInterval = sconfig.SendPingInterval
+		newconf.HttpPostInterval = sconfig.HttpPostInterval
+		newconf.DampingFilterRadius = sconfig.DampingFilterRadius
+		newconf.ACL = sconfig.ACL
+	}
+
+	// Settings that only live in the config
+	sconfig.LogLevel = newconf.LogLevel
+	sconfig.RePushConfigInterval = newconf.RePushConfigInterval
+	sconfig.ResetEndPointInterval = newconf.ResetEndPointInterval
+	sconfig.UsePSKForInterEdge = newconf.UsePSKForInterEdge
+	sconfig.NATTraversal = newconf.NATTraversal
+	if sconfig.Relay.Enabled && !newconf.Relay.Enabled {
+		httpobj.http_graph.RemoveVirt(mtypes.NodeID_SuperNode, true, false)
+	}
+	sconfig.Relay = newconf.Relay
+	sconfig.EdgeTemplate = newconf.EdgeTemplate
+	httpobj.http_econfig_tmp = &econfig_tmp
+	sconfig.Passwords = newconf.Passwords
+	httpobj.http_passwords = newconf.Passwords
+
+	// SuperParams, pushed to the edges by the state hash
+	params_changed := sconfig.PeerAliveTimeout != newconf.PeerAliveTimeout ||
+		sconfig.SendPingInterval != newconf.SendPingInterval ||
+		sconfig.HttpPostInterval != newconf.HttpPostInterval ||
+		sconfig.DampingFilterRadius != newconf.DampingFilterRadius ||
+		!reflect.DeepEqual(sconfig.ACL, newconf.ACL)
+	sconfig.PeerAliveTimeout = newconf.PeerAliveTimeout
+	sconfig.SendPingInterval = newconf.SendPingInterval
+	sconfig.HttpPostInterval = newconf.HttpPostInterval
+	sconfig.DampingFilterRadius = newconf.DampingFilterRadius
+	sconfig.ACL = newconf.ACL
+	super_apply_relay()
+
+	peers_changed, err := super_apply_peers(newconf.Peers)
+	if err != nil {
+		elog.Error(elog.Internal, "Reload: apply peer list failed, retry later", "err", err)
+		go super_reload_retry_peers()
+	}
+	if params_changed || peers_changed {
+		for _, peerinfo := range httpobj.http_PeerID2Info {
+			httpobj.http_PeerState[peerinfo.PubKey].SuperParamState.Store(super_SuperParamState(peerinfo))
+		}
+	}
+
+	if !reflect.DeepEqual(sconfig.GraphRecalculateSetting, newconf.GraphRecalculateSetting) {
+		sconfig.GraphRecalculateSetting = newconf.GraphRecalculateSetting
+		httpobj.http_graph.UpdateSetting(sconfig.GraphRecalculateSetting)
+	}
+	nh_changed := !reflect.DeepEqual(sconfig.NextHopTable, newconf.NextHopTable)
+	sconfig.NextHopTable = newconf.NextHopTable
+	if nh_changed && sconfig.GraphRecalculateSetting.StaticMode {
+		httpobj.http_graph.SetNHTable(sconfig.NextHopTable)
+	}
+
+	if super_is_leader() {
+		super_update_NhTableStr()
+		httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, _ = get_api_peers(httpobj.http_PeerInfo_hash)
+		PushNhTable(false)
+		PushPeerinfo(false)
+		PushServerParams(false)
+	}
+	elog.Info(elog.Internal, "Reload: done", "path", configPath, "peers_changed", peers_changed, "params_changed", params_changed)
+	return nil
+}
+
+// super_reload_retry_peers applies the peer list again after super_peerdel_notify released the
+// old peers, so that a peer whose key changed can take its NodeID back.
+func super_reload_retry_peers() {
+	time.Sleep(mtypes.S2TD(2))
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	changed, err := super_apply_peers(httpobj.http_sconfig.Peers)
+	if err != nil {
+		elog.Error(elog.Internal, "Reload: apply peer list failed", "err", err)
+	}
+	if !changed {
+		return
+	}
+	for _, peerinfo := range httpobj.http_PeerID2Info {
+		httpobj.http_PeerState[peerinfo.PubKey].SuperParamState.Store(super_SuperParamState(peerinfo))
+	}
+	if super_is_leader() {
+		httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, _ = get_api_peers(httpobj.http_PeerInfo_hash)
+		PushPeerinfo(false)
+		PushServerParams(false)
+	}
+}
+
+// super_reload_keep_static reverts the settings that can't be changed at runtime, and tells the user about it
+func super_reload_keep_static(sconfig *mtypes.SuperConfig, newconf *mtypes.SuperConfig) {
+	keep := func(name string, running interface{}, loaded interface{}) {
+		if !reflect.DeepEqual(running, loaded) {
+			elog.Error(elog.Internal, "Reload: changing "+name+" requires restart, ignored")
+			reflect.ValueOf(loaded).Elem().Set(reflect.ValueOf(running).Elem())
+		}
+	}
+	keep("NodeName", &sconfig.NodeName, &newconf.NodeName)
+	keep("PostScript", &sconfig.PostScript, &newconf.PostScript)
+	keep("PrivKeyV4", &sconfig.PrivKeyV4, &newconf.PrivKeyV4)
+	keep("PrivKeyV6", &sconfig.PrivKeyV6, &newconf.PrivKeyV6)
+	keep("ListenPort", &sconfig.ListenPort, &newconf.ListenPort)
+	keep("ListenPort_TCP", &sconfig.ListenPort_TCP, &newconf.ListenPort_TCP)
+	keep("ListenPort_EdgeAPI", &sconfig.ListenPort_EdgeAPI, &newconf.ListenPort_EdgeAPI)
+	keep("WebSocket", &sconfig.WebSocket, &newconf.WebSocket)
+	keep("Obfuscation", &sconfig.Obfuscation, &newconf.Obfuscation)
+	keep("ListenPort_ManageAPI", &sconfig.ListenPort_ManageAPI, &newconf.ListenPort_ManageAPI)
+	keep("ListenPort_Metrics", &sconfig.ListenPort_Metrics, &newconf.ListenPort_Metrics)
+	keep("FwMark", &sconfig.FwMark, &newconf.FwMark)
+	keep("DisabledAf", &sconfig.DisableAf, &newconf.DisableAf)
+	keep("API_Prefix", &sconfig.API_Prefix, &newconf.API_Prefix)
+	keep("Cluster", &sconfig.Cluster, &newconf.Cluster)
+	keep("StateStore", &sconfig.StateStore, &newconf.StateStore)
+	keep("NATTraversal.DetectPort", &sconfig.NATTraversal.DetectPort, &newconf.NATTraversal.DetectPort)
+	if (sconfig.ResetEndPointInterval > 0.01) != (newconf.ResetEndPointInterval > 0.01) {
+		elog.Error(elog.Internal, "Reload: enabling or disabling ResetEndPointInterval requires restart, ignored")
+		newconf.ResetEndPointInterval = sconfig.ResetEndPointInterval
+	}
+	if (sconfig.NATTraversal.PunchInterval > 0) != (newconf.NATTraversal.PunchInterval > 0) {
+		elog.Error(elog.Internal, "Reload: enabling or disabling NATTraversal.PunchInterval requires restart, ignored")
+		newconf.NATTraversal.PunchInterval = sconfig.NATTraversal.PunchInterval
+	}
+	if sconfig.GraphRecalculateSetting.StaticMode != newconf.GraphRecalculateSetting.StaticMode {
+		elog.Error(elog.Internal, "Reload: changing GraphRecalculateSetting.StaticMode requires restart, ignored")
+		newconf.GraphRecalculateSetting.StaticMode = sconfig.GraphRecalculateSetting.StaticMode
+	}
+}
@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestSuperReloadKeepStatic(t *testing.T) {
+	sconfig := super_test_config(t)
+	newconf := sconfig
+	newconf.ListenPort = sconfig.ListenPort + 1
+	newconf.Cluster = mtypes.SuperClusterInfo{Members: []string{"http://127.0.0.1:1"}, Secret: "cluster secret"}
+	newconf.StateStore.Path = "/tmp/state.json"
+	newconf.NATTraversal.DetectPort = sconfig.ListenPort + 2
+	newconf.NATTraversal.PunchInterval = 0 // disabling it needs a restart, a new interval does not
+	newconf.Passwords.ShowState = "new password"
+	super_reload_keep_static(&sconfig, &newconf)
+	if newconf.ListenPort != sconfig.ListenPort {
+		t.Errorf("ListenPort %v, expect %v", newconf.ListenPort, sconfig.ListenPort)
+	}
+	if !reflect.DeepEqual(newconf.Cluster, sconfig.Cluster) || !reflect.DeepEqual(newconf.StateStore, sconfig.StateStore) {
+		t.Errorf("Cluster %+v and StateStore %+v changed", newconf.Cluster, newconf.StateStore)
+	}
+	if newconf.NATTraversal.DetectPort != sconfig.NATTraversal.DetectPort || newconf.NATTraversal.PunchInterval != sconfig.NATTraversal.PunchInterval {
+		t.Errorf("NATTraversal %+v, expect %+v", newconf.NATTraversal, sconfig.NATTraversal)
+	}
+	if newconf.Passwords.ShowState != "new password" {
+		t.Errorf("Passwords.ShowState reverted, it can be reloaded")
+	}
+}
+
+func TestSuperReload(t *testing.T) {
+	sconfig := super_test_config(t)
+	super_test_init(t, sconfig)
+	oldstate := httpobj.http_PeerState[sconfig.Peers[0].PubKey].SuperParamState.Load().(string)
+
+	newconf := sconfig
+	newconf.ListenPort = sconfig.ListenPort + 10
+	newconf.PeerAliveTimeout = sconfig.PeerAliveTimeout + 10
+	newconf.Passwords.ShowState = "new password"
+	newPubKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))
+	newconf.Peers = append(append([]mtypes.SuperPeerInfo{}, sconfig.Peers...), mtypes.SuperPeerInfo{NodeID: 3, Name: "Node_03", PubKey: newPubKey})
+	newconf.Peers[0].AdditionalCost = 20
+	super_test_write_config(t, newconf)
+	if err := super_reload(httpobj.http_sconfig_path); err != nil {
+		t.Fatal(err)
+	}
+	running := httpobj.http_sconfig
+	if running.ListenPort != sconfig.ListenPort {
+		t.Errorf("ListenPort %v, it requires restart", running.ListenPort)
+	}
+	if running.PeerAliveTimeout != newconf.PeerAliveTimeout || httpobj.http_passwords.ShowState != "new password" {
+		t.Errorf("PeerAliveTimeout %v and Passwords not reloaded", running.PeerAliveTimeout)
+	}
+	if _, has := httpobj.http_PeerState[newPubKey]; !has || len(httpobj.http_PeerID2Info) != 3 {
+		t.Errorf("peer 3 not added: %v", httpobj.http_PeerID2Info)
+	}
+	if cost := httpobj.http_PeerID2Info[1].AdditionalCost; cost != 20 {
+		t.Errorf("AdditionalCost of peer 1 is %v, expect 20", cost)
+	}
+	if httpobj.http_PeerState[sconfig.Peers[0].PubKey].SuperParamState.Load().(string) == oldstate {
+		t.Errorf("the SuperParams of peer 1 are not pushed again")
+	}
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+const superStateFileVersion = 1
+
+// SuperStateFile is what the supernode keeps on disk between restarts.
+// State hashes are not saved, they are salted per process and edges just download again.
+type SuperStateFile struct {
+	Version   int
+	SavedAt   time.Time
+	PeerState map[string]PeerStateSnapshot
+	PeerIPs   map[string]HttpPeerLocalIP
+	Edges     []path.EdgeState
+}
+
+func super_save_state() error {
+	filepath := httpobj.http_sconfig.StateStore.Path
+	httpobj.RLock()
+	state := SuperStateFile{
+		Version: superStateFileVersion,
+		SavedAt: time.Now(),
+		Edges:   httpobj.http_graph.ExportEdges(),
+	}
+	state.PeerState, state.PeerIPs = super_get_peerstates()
+	httpobj.RUnlock()
+	statebytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first, a crash while saving must not destroy the last good state
+	tmppath := filepath + ".tmp"
+	if err := ioutil.WriteFile(tmppath, statebytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmppath, filepath)
+}
+
+// super_load_state restores the state saved by super_save_state.
+// The whole file is ignored if it is older than MaxAge, single edges expire with their own TimeToAlive.
+func super_load_state() error {
+	// No lock, call me before the supernode starts
+	sstore := httpobj.http_sconfig.StateStore
+	statebytes, err := ioutil.ReadFile(sstore.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state SuperStateFile
+	if err := json.Unmarshal(statebytes, &state); err != nil {
+		return fmt.Errorf("%v: %v", sstore.Path, err)
+	}
+	if state.Version != superStateFileVersion {
+		return fmt.Errorf("%v: unsupported state version %v", sstore.Path, state.Version)
+	}
+	if sstore.MaxAge > 0 && time.Since(state.SavedAt) > mtypes.S2TD(sstore.MaxAge) {
+		elog.Info(elog.Internal, "State file is too old, ignored", "saved_at", state.SavedAt)
+		return nil
+	}
+	restored := 0
+	for PubKey, saved := range state.PeerState {
+		peerstate, has := httpobj.http_PeerState[PubKey]
+		if !has {
+			continue // removed from config since
+		}
+		peerstate.JETSecret.Store(saved.JWTSecret)
+		peerstate.httpPostCount.Store(saved.HttpPostCount)
+		peerstate.LastSeen.Store(saved.LastSeen)
+		peerstate.WireCodecs.Store(saved.WireCodecs)
+		if peerips, has := state.PeerIPs[PubKey]; has {
+			httpobj.http_PeerIPs[PubKey] = &peerips
+		}
+		restored++
+	}
+	super_update_WireCodec()
+	edges := httpobj.http_graph.ImportEdges(state.Edges)
+	httpobj.http_graph.RecalculateNhTable(false)
+	super_update_NhTableStr()
+	elog.Info(elog.Internal, "State restored", "peers", restored, "edges", edges, "path", sstore.Path)
+	return nil
+}
+
+func RoutineSaveState(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := super_save_state(); err != nil {
+			elog.Error(elog.Internal, "Save state failed", "err", err)
+		}
+	}
+}
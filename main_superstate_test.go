@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// state_test_config is the demo config with a state file in a temp dir
+func state_test_config(t *testing.T) mtypes.SuperConfig {
+	sconfig := super_test_config(t)
+	sconfig.StateStore = mtypes.SuperStateStoreInfo{
+		Path:         filepath.Join(t.TempDir(), "state.json"),
+		SaveInterval: 60,
+		MaxAge:       3600,
+	}
+	return sconfig
+}
+
+func TestSuperStateRoundTrip(t *testing.T) {
+	sconfig := state_test_config(t)
+	super_test_init(t, sconfig)
+	httpobj.http_graph.UpdateLatencyMulti([]mtypes.PongMsg{
+		{Src_nodeID: 1, Dst_nodeID: 2, Timediff: 0.010, TimeToAlive: 60},
+		{Src_nodeID: 2, Dst_nodeID: 1, Timediff: 0.012, TimeToAlive: 60},
+	}, true, false)
+	PubKey := httpobj.http_PeerID2Info[1].PubKey
+	peerstate := httpobj.http_PeerState[PubKey]
+	peerstate.httpPostCount.Store(uint64(5))
+	peerstate.LastSeen.Store(time.Now())
+	peerstate.JETSecret.Store(mtypes.JWTSecret{4, 5, 6})
+	httpobj.http_PeerIPs[PubKey].LocalIPv4 = map[string]float64{"192.168.1.11:3001": 100}
+	saved, savedIPs := super_get_peerstates()
+	savedEdges := httpobj.http_graph.ExportEdges()
+	if err := super_save_state(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sconfig.StateStore.Path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+
+	super_test_init(t, sconfig)
+	if err := super_load_state(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, loadedIPs := super_get_peerstates()
+	for PubKey, want := range saved {
+		got := loaded[PubKey]
+		if got.HttpPostCount != want.HttpPostCount || got.JWTSecret != want.JWTSecret || !got.LastSeen.Equal(want.LastSeen) || got.WireCodecs != want.WireCodecs {
+			t.Errorf("peer %v: loaded %+v, saved %+v", PubKey, got, want)
+		}
+	}
+	if !reflect.DeepEqual(loadedIPs, savedIPs) {
+		t.Errorf("peer IPs: loaded %v, saved %v", loadedIPs, savedIPs)
+	}
+	loadedEdges := httpobj.http_graph.ExportEdges()
+	if len(loadedEdges) != len(savedEdges) {
+		t.Fatalf("edges: loaded %v, saved %v", loadedEdges, savedEdges)
+	}
+	for _, e := range loadedEdges {
+		if e.Ping <= 0 || e.ValidUntil.Before(time.Now()) {
+			t.Errorf("edge %+v not restored", e)
+		}
+	}
+	if len(httpobj.http_NhTableStr) == 0 {
+		t.Errorf("NhTable not calculated from the restored edges")
+	}
+}
+
+func TestSuperStateBadFile(t *testing.T) {
+	sconfig := state_test_config(t)
+	super_test_init(t, sconfig)
+	restored := func() bool {
+		for _, peerstate := range httpobj.http_PeerState {
+			if peerstate.httpPostCount.Load().(uint64) != 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A fresh supernode has no state file yet
+	if err := super_load_state(); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+
+	write := func(state interface{}) {
+		t.Helper()
+		statebytes, _ := json.Marshal(state)
+		if err := ioutil.WriteFile(sconfig.StateStore.Path, statebytes, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(sconfig.StateStore.Path, []byte(`{"Version":1,"PeerState":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := super_load_state(); err == nil {
+		t.Errorf("corrupt file loaded")
+	}
+	peerstates := map[string]PeerStateSnapshot{
+		httpobj.http_PeerID2Info[1].PubKey: {HttpPostCount: 9, LastSeen: time.Now(), WireCodecs: mtypes.WireCodecsSupported},
+	}
+	write(SuperStateFile{Version: superStateFileVersion + 1, SavedAt: time.Now(), PeerState: peerstates})
+	if err := super_load_state(); err == nil {
+		t.Errorf("unsupported version loaded")
+	}
+	write(SuperStateFile{Version: superStateFileVersion, SavedAt: time.Now().Add(-2 * time.Hour), PeerState: peerstates})
+	if err := super_load_state(); err != nil || restored() {
+		t.Errorf("state older than MaxAge: %v, restored %v", err, restored())
+	}
+	write(SuperStateFile{Version: superStateFileVersion, SavedAt: time.Now(), PeerState: peerstates})
+	if err := super_load_state(); err != nil || !restored() {
+		t.Errorf("good state: %v, restored %v", err, restored())
+	}
+}
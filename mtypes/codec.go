@@ -0,0 +1,353 @@
+package mtypes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// WireCodec selects how the body of a control message is serialized.
+//
+// WireCodec_Gob is the legacy encoding/gob stream. WireCodec_TLV is a compact
+// tagged format that does not depend on Go type information:
+//
+//	+------+---------+--------------------------------------+
+//	| 0xE6 | version | field, field, field, ...             |
+//	+------+---------+--------------------------------------+
+//
+//	field = uvarint(tag << 3 | wiretype) value
+//	wiretype 0: uvarint
+//	wiretype 1: 8 bytes little endian (float64 bits, unix nanoseconds)
+//	wiretype 2: uvarint(length) bytes (strings, byte arrays, nested messages)
+//
+// Tags are never reused. Decoders skip tags they do not know, so a newer node
+// can add fields without breaking older ones. The version byte is only bumped
+// for changes that an older decoder cannot skip over.
+//
+// 0xE6 can never start a gob stream: gob prefixes every message with its
+// length, whose first byte is either below 0x80 or at least 0xF8. That lets
+// every Parse* function accept both encodings without knowing which one the
+// sender picked.
+type WireCodec uint8
+
+const (
+	WireCodec_Gob WireCodec = iota
+	WireCodec_TLV
+)
+
+const (
+	wireMagic   = 0xE6
+	wireVersion = 1
+)
+
+func (c WireCodec) ToString() string {
+	switch c {
+	case WireCodec_Gob:
+		return "gob"
+	case WireCodec_TLV:
+		return "tlv"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// ProtocolVersion is bumped on a change of the control messages that older nodes can't follow.
+// A supernode accepts the edges from ProtocolVersionMin to its own ProtocolVersion, whatever their release is.
+const (
+	ProtocolVersion    = 1
+	ProtocolVersionMin = 1
+)
+
+// ProtocolCompatible tells if a node that speaks protocol v works with us. Nodes before protocol versions send 0, which is not.
+func ProtocolCompatible(v uint32) bool {
+	return v >= ProtocolVersionMin && v <= ProtocolVersion
+}
+
+// WireCodecSet is a bitmask of the codecs a node is able to decode.
+// The zero value means "gob only", which is what nodes without codec negotiation send.
+type WireCodecSet uint32
+
+const WireCodecsSupported = WireCodecSet(1<<WireCodec_Gob | 1<<WireCodec_TLV)
+
+func (s WireCodecSet) Has(c WireCodec) bool {
+	if c == WireCodec_Gob {
+		return true
+	}
+	return s&(1<<c) != 0
+}
+
+// Intersect returns the codecs both sides can decode. Gob is always included.
+func (s WireCodecSet) Intersect(o WireCodecSet) WireCodecSet {
+	return (s & o) | 1<<WireCodec_Gob
+}
+
+// Best returns the preferred codec in the set.
+func (s WireCodecSet) Best() WireCodec {
+	if s == 0 {
+		return WireCodec_Gob
+	}
+	return WireCodec(bits.Len32(uint32(s)) - 1)
+}
+
+// WireMessage is implemented by every control message that can be sent with WireCodec_TLV.
+type WireMessage interface {
+	marshalWire(w *wireWriter)
+	unmarshalWire(tag uint64, f wireField) error
+}
+
+// EncodeMsg serializes msg with the given codec.
+func EncodeMsg(codec WireCodec, msg WireMessage) ([]byte, error) {
+	switch codec {
+	case WireCodec_Gob:
+		return GetByte(msg)
+	case WireCodec_TLV:
+		w := wireWriter{buf: []byte{wireMagic, wireVersion}}
+		msg.marshalWire(&w)
+		return w.buf, nil
+	default:
+		return nil, fmt.Errorf("unsupported wire codec %v", codec.ToString())
+	}
+}
+
+// DetectCodec reports which codec produced bin.
+func DetectCodec(bin []byte) WireCodec {
+	if len(bin) >= 2 && bin[0] == wireMagic {
+		return WireCodec_TLV
+	}
+	return WireCodec_Gob
+}
+
+func decodeMsg(bin []byte, msg WireMessage) error {
+	if DetectCodec(bin) == WireCodec_Gob {
+		var b bytes.Buffer
+		b.Write(bin)
+		d := gob.NewDecoder(&b)
+		return d.Decode(msg)
+	}
+	if bin[1] != wireVersion {
+		return fmt.Errorf("unsupported wire version %v", bin[1])
+	}
+	return decodeFields(bin[2:], msg.unmarshalWire)
+}
+
+type wireType uint8
+
+const (
+	wireVarint  wireType = 0
+	wireFixed64 wireType = 1
+	wireBytes   wireType = 2
+)
+
+var errWireTruncated = errors.New("wire: truncated message")
+
+type wireWriter struct {
+	buf []byte
+}
+
+func (w *wireWriter) key(tag uint64, t wireType) {
+	w.buf = appendUvarint(w.buf, tag<<3|uint64(t))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(b, tmp[:n]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(b, tmp[:]...)
+}
+
+// Zero values are omitted, a missing field decodes as its zero value.
+
+func (w *wireWriter) Uint(tag uint64, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.key(tag, wireVarint)
+	w.buf = appendUvarint(w.buf, v)
+}
+
+func (w *wireWriter) Int(tag uint64, v int64) {
+	if v == 0 {
+		return
+	}
+	w.key(tag, wireVarint)
+	w.buf = appendUvarint(w.buf, uint64(v<<1)^uint64(v>>63))
+}
+
+func (w *wireWriter) Float(tag uint64, v float64) {
+	if v == 0 {
+		return
+	}
+	w.key(tag, wireFixed64)
+	w.buf = appendUint64(w.buf, math.Float64bits(v))
+}
+
+func (w *wireWriter) Time(tag uint64, v time.Time) {
+	if v.IsZero() {
+		return
+	}
+	w.key(tag, wireFixed64)
+	w.buf = appendUint64(w.buf, uint64(v.UnixNano()))
+}
+
+func (w *wireWriter) Bytes(tag uint64, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	w.key(tag, wireBytes)
+	w.buf = appendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *wireWriter) String(tag uint64, v string) {
+	w.Bytes(tag, []byte(v))
+}
+
+func (w *wireWriter) Msg(tag uint64, m WireMessage) {
+	sub := wireWriter{}
+	m.marshalWire(&sub)
+	w.key(tag, wireBytes)
+	w.buf = appendUvarint(w.buf, uint64(len(sub.buf)))
+	w.buf = append(w.buf, sub.buf...)
+}
+
+func (w *wireWriter) FloatMap(tag uint64, m map[string]float64) {
+	for k, v := range m {
+		w.Msg(tag, &wireMapEntry{Key: k, Val: v})
+	}
+}
+
+type wireField struct {
+	t     wireType
+	num   uint64
+	bytes []byte
+}
+
+func (f wireField) Uint() (uint64, error) {
+	if f.t != wireVarint {
+		return 0, fmt.Errorf("wire: expect varint, got type %v", f.t)
+	}
+	return f.num, nil
+}
+
+func (f wireField) Int() (int64, error) {
+	u, err := f.Uint()
+	// zigzag, same as binary.PutVarint
+	return int64(u>>1) ^ -int64(u&1), err
+}
+
+func (f wireField) Float() (float64, error) {
+	if f.t != wireFixed64 {
+		return 0, fmt.Errorf("wire: expect fixed64, got type %v", f.t)
+	}
+	return math.Float64frombits(f.num), nil
+}
+
+func (f wireField) Time() (time.Time, error) {
+	if f.t != wireFixed64 {
+		return time.Time{}, fmt.Errorf("wire: expect fixed64, got type %v", f.t)
+	}
+	return time.Unix(0, int64(f.num)), nil
+}
+
+func (f wireField) Bytes() ([]byte, error) {
+	if f.t != wireBytes {
+		return nil, fmt.Errorf("wire: expect bytes, got type %v", f.t)
+	}
+	return f.bytes, nil
+}
+
+func (f wireField) String() (string, error) {
+	b, err := f.Bytes()
+	return string(b), err
+}
+
+func (f wireField) Msg(m WireMessage) error {
+	b, err := f.Bytes()
+	if err != nil {
+		return err
+	}
+	return decodeFields(b, m.unmarshalWire)
+}
+
+func (f wireField) FloatMapEntry(m *map[string]float64) error {
+	var e wireMapEntry
+	if err := f.Msg(&e); err != nil {
+		return err
+	}
+	if *m == nil {
+		*m = make(map[string]float64)
+	}
+	(*m)[e.Key] = e.Val
+	return nil
+}
+
+func decodeFields(bin []byte, fn func(tag uint64, f wireField) error) error {
+	for len(bin) > 0 {
+		k, n := binary.Uvarint(bin)
+		if n <= 0 {
+			return errWireTruncated
+		}
+		if k == 0 { // tags start from 1, the rest is the zero padding of the transport
+			return nil
+		}
+		bin = bin[n:]
+		f := wireField{t: wireType(k & 7)}
+		switch f.t {
+		case wireVarint:
+			f.num, n = binary.Uvarint(bin)
+			if n <= 0 {
+				return errWireTruncated
+			}
+			bin = bin[n:]
+		case wireFixed64:
+			if len(bin) < 8 {
+				return errWireTruncated
+			}
+			f.num = binary.LittleEndian.Uint64(bin)
+			bin = bin[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(bin)
+			if n <= 0 || uint64(len(bin)-n) < l {
+				return errWireTruncated
+			}
+			f.bytes = bin[n : n+int(l)]
+			bin = bin[n+int(l):]
+		default:
+			return fmt.Errorf("wire: unknown wire type %v", f.t)
+		}
+		if err := fn(k>>3, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type wireMapEntry struct {
+	Key string
+	Val float64
+}
+
+func (c *wireMapEntry) marshalWire(w *wireWriter) {
+	w.String(1, c.Key)
+	w.Float(2, c.Val)
+}
+
+func (c *wireMapEntry) unmarshalWire(tag uint64, f wireField) (err error) {
+	switch tag {
+	case 1:
+		c.Key, err = f.String()
+	case 2:
+		c.Val, err = f.Float()
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package mtypes
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWireCodecRoundTrip(t *testing.T) {
+	now := time.Unix(1634567890, 123456789)
+	reg := RegisterMsg{
+		Node_id:             12,
+		Version:             "v0.3.5",
+		PeerStateHash:       "aabb",
+		NhStateHash:         "ccdd",
+		SuperParamStateHash: "eeff",
+		JWTSecret:           JWTSecret{1, 2, 3},
+		HttpPostCount:       7,
+		WireCodecs:          WireCodecsSupported,
+		EgHeaderVersion:     2,
+		ProtocolVersion:     ProtocolVersion,
+	}
+	update := ServerUpdateMsg{Node_id: NodeID_SuperNode, Action: ThrowError, Code: -2, Params: "bye", WireCodec: WireCodec_TLV}
+	ping := PingMsg{RequestID: 3, Src_nodeID: 2, Time: now, RequestReply: 1, WireCodecs: WireCodecsSupported}
+	pong := PongMsg{RequestID: 3, Src_nodeID: 2, Dst_nodeID: 1, Timediff: 0.012, TimeToAlive: 30, AdditionalCost: -1, Loss: 0.25, Throughput: 87.5}
+	query := QueryPeerMsg{Request_ID: 9}
+	boardcast := BoardcastPeerMsg{Request_ID: 9, NodeID: 4, PubKey: [32]byte{9, 8, 7}, ConnURL: "127.0.0.1:3001"}
+	report := API_report_peerinfo{
+		Pongs:     []PongMsg{pong, {Src_nodeID: 70000, Dst_nodeID: 1, Timediff: 0.5}},
+		LocalV4s:  map[string]float64{"192.168.1.2:3001": 100},
+		LocalV6s:  map[string]float64{"[fe80::1]:3001": 100, "[2001:db8::1]:3001": 50},
+		NATType:   NATType_Cone,
+		MappedV4s: map[string]float64{"203.0.113.9:40001": 3},
+	}
+
+	for _, codec := range []WireCodec{WireCodec_Gob, WireCodec_TLV} {
+		check := func(name string, in WireMessage, parse func([]byte) (interface{}, error)) {
+			bin, err := EncodeMsg(codec, in)
+			if err != nil {
+				t.Fatalf("%v %v: encode: %v", codec.ToString(), name, err)
+			}
+			if DetectCodec(bin) != codec {
+				t.Errorf("%v %v: detected as %v", codec.ToString(), name, DetectCodec(bin).ToString())
+			}
+			out, err := parse(bin)
+			if err != nil {
+				t.Fatalf("%v %v: decode: %v", codec.ToString(), name, err)
+			}
+			want := reflect.ValueOf(in).Elem().Interface()
+			if !reflect.DeepEqual(out, want) {
+				t.Errorf("%v %v: got %+v, want %+v", codec.ToString(), name, out, want)
+			}
+		}
+		check("RegisterMsg", &reg, func(b []byte) (interface{}, error) { return ParseRegisterMsg(b) })
+		check("ServerUpdateMsg", &update, func(b []byte) (interface{}, error) { return ParseServerUpdateMsg(b) })
+		check("PongMsg", &pong, func(b []byte) (interface{}, error) { return ParsePongMsg(b) })
+		check("QueryPeerMsg", &query, func(b []byte) (interface{}, error) { return ParseQueryPeerMsg(b) })
+		check("BoardcastPeerMsg", &boardcast, func(b []byte) (interface{}, error) { return ParseBoardcastPeerMsg(b) })
+		check("API_report_peerinfo", &report, func(b []byte) (interface{}, error) { return ParseAPI_report_peerinfo(b) })
+
+		bin, _ := EncodeMsg(codec, &ping)
+		out, err := ParsePingMsg(bin)
+		if err != nil || !out.Time.Equal(ping.Time) || out.RequestID != ping.RequestID || out.WireCodecs != ping.WireCodecs {
+			t.Errorf("%v PingMsg: got %+v, %v", codec.ToString(), out, err)
+		}
+	}
+}
+
+func TestWireCodecSkipUnknownField(t *testing.T) {
+	pong := PongMsg{RequestID: 1, Src_nodeID: 2, Dst_nodeID: 3, Timediff: 0.1}
+	bin, _ := EncodeMsg(WireCodec_TLV, &pong)
+	// fields a newer release might add
+	w := wireWriter{buf: bin}
+	w.Uint(100, 42)
+	w.String(101, "future")
+	w.Float(102, 1.5)
+	out, err := ParsePongMsg(w.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != pong {
+		t.Errorf("got %+v, want %+v", out, pong)
+	}
+}
+
+func TestWireCodecTruncated(t *testing.T) {
+	connurl := "127.0.0.1:3001"
+	bin, _ := EncodeMsg(WireCodec_TLV, &BoardcastPeerMsg{NodeID: 1, ConnURL: connurl})
+	for i := len(bin) - len(connurl) - 1; i < len(bin); i++ {
+		if _, err := ParseBoardcastPeerMsg(bin[:i]); err == nil {
+			t.Errorf("truncated at %v: expect error", i)
+		}
+	}
+	bad := append([]byte{}, bin...)
+	bad[1] = wireVersion + 1
+	if _, err := ParseBoardcastPeerMsg(bad); err == nil {
+		t.Error("unknown wire version: expect error")
+	}
+}
+
+func TestWireCodecPadding(t *testing.T) {
+	ping := PingMsg{RequestID: 1, Src_nodeID: 2, ProbeSize: 1440}
+	for _, codec := range []WireCodec{WireCodec_Gob, WireCodec_TLV} {
+		bin, _ := EncodeMsg(codec, &ping)
+		for i := 0; i < 16; i++ {
+			padded := append(append([]byte{}, bin...), make([]byte, i)...)
+			if out, err := ParsePingMsg(padded); err != nil || out.ProbeSize != ping.ProbeSize {
+				t.Errorf("%v with %v bytes of padding: got %+v, %v", codec.ToString(), i, out, err)
+			}
+		}
+	}
+}
+
+func TestWireCodecSet(t *testing.T) {
+	var legacy WireCodecSet
+	if legacy.Best() != WireCodec_Gob || WireCodecsSupported.Intersect(legacy).Best() != WireCodec_Gob {
+		t.Error("peer without codec negotiation must fall back to gob")
+	}
+	if WireCodecsSupported.Intersect(WireCodecsSupported).Best() != WireCodec_TLV {
+		t.Error("expect tlv between two current nodes")
+	}
+}
+
+func TestProtocolCompatible(t *testing.T) {
+	if !ProtocolCompatible(ProtocolVersion) || !ProtocolCompatible(ProtocolVersionMin) {
+		t.Error("our own protocol versions are not compatible")
+	}
+	if ProtocolCompatible(0) || ProtocolCompatible(ProtocolVersion+1) {
+		t.Error("compatible with a node before protocol versions or a newer protocol")
+	}
+}
@@ -4,38 +4,60 @@ import (
 	"math"
 	"strconv"
 	"sync/atomic"
+	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 )
 
 // Nonnegative integer ID of vertex
-type Vertex uint16
+type Vertex uint32
 
+// The special IDs keep the values they had when Vertex was 16 bit, so they mean the same thing
+// in a version 1 EgHeader and to older nodes. The IDs above them are normal node IDs.
 const (
 	NodeID_Broadcast Vertex = math.MaxUint16 - iota // Normal boardcast, boardcast with route table
 	NodeID_Spread    Vertex = math.MaxUint16 - iota // p2p mode: boardcast to every know peer and prevent dup. super mode: send to supernode
 	NodeID_SuperNode Vertex = math.MaxUint16 - iota
 	NodeID_Invalid   Vertex = math.MaxUint16 - iota
 	NodeID_Special   Vertex = NodeID_Invalid
+	NodeID_MaxNarrow Vertex = math.MaxUint16 // the largest ID a version 1 EgHeader and older nodes can carry
 )
 
+// IsSpecial reports whether the ID is one of the special IDs, which no node can use
+func (v Vertex) IsSpecial() bool {
+	return v >= NodeID_Special && v <= NodeID_Broadcast
+}
+
 type EdgeConfig struct {
-	Interface             InterfaceConf    `yaml:"Interface"`
-	NodeID                Vertex           `yaml:"NodeID"`
-	NodeName              string           `yaml:"NodeName"`
-	PostScript            string           `yaml:"PostScript"`
-	DefaultTTL            uint8            `yaml:"DefaultTTL"`
-	L2FIBTimeout          float64          `yaml:"L2FIBTimeout"`
-	PrivKey               string           `yaml:"PrivKey"`
-	ListenPort            int              `yaml:"ListenPort"`
-	FwMark                uint32           `yaml:"FwMark"`
-	DisableAf             conn.EnabledAf   `yaml:"DisabledAf"`
-	AfPrefer              int              `yaml:"AfPrefer"`
-	LogLevel              LoggerInfo       `yaml:"LogLevel"`
-	DynamicRoute          DynamicRouteInfo `yaml:"DynamicRoute"`
-	NextHopTable          NextHopTable     `yaml:"NextHopTable"`
-	ResetEndPointInterval float64          `yaml:"ResetEndPointInterval"`
-	Peers                 []PeerInfo       `yaml:"Peers"`
+	Interface             InterfaceConf        `yaml:"Interface"`
+	NodeID                Vertex               `yaml:"NodeID"`
+	NodeName              string               `yaml:"NodeName"`
+	PostScript            string               `yaml:"PostScript"`
+	DefaultTTL            uint8                `yaml:"DefaultTTL"`
+	L2FIBTimeout          float64              `yaml:"L2FIBTimeout"`
+	Multicast             MulticastInfo        `yaml:"Multicast"`
+	NeighborProxy         NeighborProxyInfo    `yaml:"NeighborProxy"`
+	StaticL2FIB           []StaticL2FIBEntry   `yaml:"StaticL2FIB"`
+	VLAN                  VLANInfo             `yaml:"VLAN"`
+	VirtualNetworks       []VirtualNetworkInfo `yaml:"VirtualNetworks"`
+	Firewall              FirewallInfo         `yaml:"Firewall"`
+	Shaping               ShapingInfo          `yaml:"Shaping"`
+	PMTU                  PMTUInfo             `yaml:"PMTU"`
+	PrivKey               string               `yaml:"PrivKey"`
+	ListenPort            int                  `yaml:"ListenPort"`
+	ListenPort_TCP        string               `yaml:"ListenPort_TCP"`
+	Obfuscation           ObfuscationInfo      `yaml:"Obfuscation"`
+	ListenPort_Metrics    string               `yaml:"ListenPort_Metrics"`
+	ListenPort_ManageAPI  string               `yaml:"ListenPort_ManageAPI"`
+	Password_ManageAPI    string               `yaml:"Password_ManageAPI"`
+	FwMark                uint32               `yaml:"FwMark"`
+	DisableAf             conn.EnabledAf       `yaml:"DisabledAf"`
+	AfPrefer              int                  `yaml:"AfPrefer"`
+	LogLevel              LoggerInfo           `yaml:"LogLevel"`
+	DynamicRoute          DynamicRouteInfo     `yaml:"DynamicRoute"`
+	NextHopTable          NextHopTable         `yaml:"NextHopTable"`
+	ResetEndPointInterval float64              `yaml:"ResetEndPointInterval"`
+	Peers                 []PeerInfo           `yaml:"Peers"`
 }
 
 type SuperConfig struct {
@@ -44,8 +66,12 @@ type SuperConfig struct {
 	PrivKeyV4               string                  `yaml:"PrivKeyV4"`
 	PrivKeyV6               string                  `yaml:"PrivKeyV6"`
 	ListenPort              int                     `yaml:"ListenPort"`
+	ListenPort_TCP          string                  `yaml:"ListenPort_TCP"`
 	ListenPort_EdgeAPI      string                  `yaml:"ListenPort_EdgeAPI"`
+	WebSocket               bool                    `yaml:"WebSocket"`
+	Obfuscation             ObfuscationInfo         `yaml:"Obfuscation"`
 	ListenPort_ManageAPI    string                  `yaml:"ListenPort_ManageAPI"`
+	ListenPort_Metrics      string                  `yaml:"ListenPort_Metrics"`
 	FwMark                  uint32                  `yaml:"FwMark"`
 	DisableAf               conn.EnabledAf          `yaml:"DisabledAf"`
 	API_Prefix              string                  `yaml:"API_Prefix"`
@@ -61,9 +87,44 @@ type SuperConfig struct {
 	EdgeTemplate            string                  `yaml:"EdgeTemplate"`
 	UsePSKForInterEdge      bool                    `yaml:"UsePSKForInterEdge"`
 	ResetEndPointInterval   float64                 `yaml:"ResetEndPointInterval"`
+	Cluster                 SuperClusterInfo        `yaml:"Cluster"`
+	StateStore              SuperStateStoreInfo     `yaml:"StateStore"`
+	NATTraversal            SuperNATTraversalInfo   `yaml:"NATTraversal"`
+	Relay                   SuperRelayInfo          `yaml:"Relay"`
+	ACL                     ACLInfo                 `yaml:"ACL"`
 	Peers                   []SuperPeerInfo         `yaml:"Peers"`
 }
 
+type SuperClusterInfo struct {
+	Members       []string `yaml:"Members"`
+	Secret        string   `yaml:"Secret"`
+	Priority      int      `yaml:"Priority"`
+	SyncInterval  float64  `yaml:"SyncInterval"`
+	LeaderTimeout float64  `yaml:"LeaderTimeout"`
+}
+
+func (c *SuperClusterInfo) Enabled() bool {
+	return len(c.Members) > 0
+}
+
+type SuperStateStoreInfo struct {
+	Path         string  `yaml:"Path"`
+	SaveInterval float64 `yaml:"SaveInterval"`
+	MaxAge       float64 `yaml:"MaxAge"`
+}
+
+type SuperNATTraversalInfo struct {
+	DetectPort    int     `yaml:"DetectPort"`
+	PunchInterval float64 `yaml:"PunchInterval"`
+	PunchDelay    float64 `yaml:"PunchDelay"`
+}
+
+type SuperRelayInfo struct {
+	Enabled        bool    `yaml:"Enabled"`
+	AdditionalCost float64 `yaml:"AdditionalCost"` // ms, added to every path through the supernode
+	Bandwidth      float64 `yaml:"Bandwidth"`      // Mbit/s of all relayed packets, 0 is unlimited
+}
+
 type Passwords struct {
 	ShowState   string `yaml:"ShowState"`
 	AddPeer     string `yaml:"AddPeer"`
@@ -108,13 +169,15 @@ type SuperPeerInfo struct {
 }
 
 type LoggerInfo struct {
-	LogLevel    string `yaml:"LogLevel"`
-	LogTransit  bool   `yaml:"LogTransit"`
-	LogNormal   bool   `yaml:"LogNormal"`
-	DumpNormal  bool   `yaml:"DumpNormal"`
-	LogControl  bool   `yaml:"LogControl"`
-	LogInternal bool   `yaml:"LogInternal"`
-	LogNTP      bool   `yaml:"LogNTP"`
+	LogLevel    string            `yaml:"LogLevel"`
+	LogFormat   string            `yaml:"LogFormat"`
+	LogTransit  bool              `yaml:"LogTransit"`
+	LogNormal   bool              `yaml:"LogNormal"`
+	DumpNormal  bool              `yaml:"DumpNormal"`
+	LogControl  bool              `yaml:"LogControl"`
+	LogInternal bool              `yaml:"LogInternal"`
+	LogNTP      bool              `yaml:"LogNTP"`
+	Subsystems  map[string]string `yaml:"Subsystems"`
 }
 
 func (v *Vertex) ToString() string {
@@ -128,7 +191,7 @@ func (v *Vertex) ToString() string {
 	case NodeID_Invalid:
 		return "Invalid"
 	default:
-		return strconv.Itoa(int(*v))
+		return strconv.FormatUint(uint64(*v), 10)
 	}
 }
 
@@ -140,12 +203,111 @@ type DynamicRouteInfo struct {
 	DupCheckTimeout      float64   `yaml:"DupCheckTimeout"`
 	AdditionalCost       float64   `yaml:"AdditionalCost"`
 	DampingFilterRadius  uint64    `yaml:"DampingFilterRadius"`
+	MeasureThroughput    bool      `yaml:"MeasureThroughput"`
 	SaveNewPeers         bool      `yaml:"SaveNewPeers"`
 	SuperNode            SuperInfo `yaml:"SuperNode"`
 	P2P                  P2PInfo   `yaml:"P2P"`
 	NTPConfig            NTPInfo   `yaml:"NTPConfig"`
 }
 
+type MulticastInfo struct {
+	Mode         string  `yaml:"Mode"`
+	FloodUnknown bool    `yaml:"FloodUnknown"`
+	GroupTimeout float64 `yaml:"GroupTimeout"`
+}
+
+type NeighborProxyInfo struct {
+	Enabled bool    `yaml:"Enabled"`
+	Timeout float64 `yaml:"Timeout"`
+}
+
+// StaticL2FIBEntry pins a MAC address to a node, it never ages out and isn't overwritten by learning
+type StaticL2FIBEntry struct {
+	MacAddress string `yaml:"MacAddress"`
+	VNI        uint16 `yaml:"VNI"`
+	VLAN       uint16 `yaml:"VLAN"`
+	NodeID     Vertex `yaml:"NodeID"`
+}
+
+// FirewallInfo filters the frames between the tap devices and the overlay, the first matching rule applies
+type FirewallInfo struct {
+	DefaultAction string         `yaml:"DefaultAction"` // accept or drop the frames matched by no rule, empty for accept
+	Rules         []FirewallRule `yaml:"Rules"`
+}
+
+// FirewallRule matches the fields that aren't empty or 0
+type FirewallRule struct {
+	Name      string  `yaml:"Name"`
+	Direction string  `yaml:"Direction"` // in: from the overlay to the tap device, out: from the tap device to the overlay, empty for both
+	SrcMac    string  `yaml:"SrcMac"`
+	DstMac    string  `yaml:"DstMac"` // or multicast, which matches the broadcast too
+	EtherType uint16  `yaml:"EtherType"`
+	SrcIP     string  `yaml:"SrcIP"` // CIDR
+	DstIP     string  `yaml:"DstIP"`
+	Protocol  string  `yaml:"Protocol"` // tcp, udp, icmp, icmpv6, sctp or the protocol number
+	SrcPort   string  `yaml:"SrcPort"`  // 445 or a range like 137-139
+	DstPort   string  `yaml:"DstPort"`
+	Action    string  `yaml:"Action"`    // accept, drop or ratelimit
+	RateLimit float64 `yaml:"RateLimit"` // packets per second, ratelimit only
+	Burst     int     `yaml:"Burst"`     // 0 for one second of RateLimit
+}
+
+// ShapingInfo limits the NormalPacket traffic sent by this node. The packets over the rate wait in a queue.
+type ShapingInfo struct {
+	Peers        []ShapingRule `yaml:"Peers"`        // everything sent to the peer, including the transit traffic
+	Destinations []ShapingRule `yaml:"Destinations"` // everything sent to the node, whichever peer it goes through
+}
+
+type ShapingRule struct {
+	NodeID   Vertex  `yaml:"NodeID"`
+	Rate     float64 `yaml:"Rate"`     // Mbit/s
+	Burst    int     `yaml:"Burst"`    // bytes, 0 for 10ms of Rate
+	QueueLen int     `yaml:"QueueLen"` // packets, 0 for the default
+}
+
+// PMTUInfo probes the path MTU to each peer with padded pings. The packets larger than it
+// are split into fragments, which the peer puts back together.
+type PMTUInfo struct {
+	Enabled       bool    `yaml:"Enabled"`
+	ProbeInterval float64 `yaml:"ProbeInterval"` // seconds, the PMTU is probed again after it or when the endpoint changes
+	MinSize       int     `yaml:"MinSize"`       // bytes of the smallest probe, 0 for the default
+	TooBig        bool    `yaml:"TooBig"`        // answer IP packets that must not be fragmented with ICMP/ICMPv6 too big instead
+}
+
+// ObfuscationInfo disguises the packets on the wire from DPI. Every node of the network, the supernode too, must use the same Secret.
+type ObfuscationInfo struct {
+	Enabled    bool   `yaml:"Enabled"`
+	Secret     string `yaml:"Secret"`
+	MaxPadding int    `yaml:"MaxPadding"` // most random bytes added to each packet, 0 for the default
+}
+
+// VirtualNetworkInfo is another tap device served by the same edge, isolated from the main network by its VNI
+type VirtualNetworkInfo struct {
+	VNI          uint16        `yaml:"VNI"`
+	Interface    InterfaceConf `yaml:"Interface"`
+	AllowedNodes []Vertex      `yaml:"AllowedNodes"` // empty for all nodes
+}
+
+// ACLInfo is distributed to the edges with the SuperParams. If enabled, the edges only
+// receive and forward the NormalPacket frames that a rule allows.
+type ACLInfo struct {
+	Enabled bool      `yaml:"Enabled"`
+	Rules   []ACLRule `yaml:"Rules"`
+}
+
+// ACLRule allows the frames from the Src nodes to the Dst nodes, an empty list matches all
+type ACLRule struct {
+	Src        []Vertex `yaml:"Src"`
+	Dst        []Vertex `yaml:"Dst"`
+	EtherTypes []uint16 `yaml:"EtherTypes"` // the EtherType after the VLAN tag
+	VLANs      []uint16 `yaml:"VLANs"`      // 0 for untagged frames
+}
+
+type VLANInfo struct {
+	AllowedVLANs []uint16 `yaml:"AllowedVLANs"` // 0 for untagged frames, empty for all
+	AccessVLAN   uint16   `yaml:"AccessVLAN"`   // tag the frames from the tap device with it, and untag the frames to it
+}
+
 type NTPInfo struct {
 	UseNTP           bool     `yaml:"UseNTP"`
 	MaxServerUse     int      `yaml:"MaxServerUse"`
@@ -155,16 +317,35 @@ type NTPInfo struct {
 }
 
 type SuperInfo struct {
-	UseSuperNode         bool     `yaml:"UseSuperNode"`
-	PSKey                string   `yaml:"PSKey"`
-	EndpointV4           string   `yaml:"EndpointV4"`
-	PubKeyV4             string   `yaml:"PubKeyV4"`
-	EndpointV6           string   `yaml:"EndpointV6"`
-	PubKeyV6             string   `yaml:"PubKeyV6"`
-	EndpointEdgeAPIUrl   string   `yaml:"EndpointEdgeAPIUrl"`
-	SkipLocalIP          bool     `yaml:"SkipLocalIP"`
-	AdditionalLocalIP    []string `yaml:"AdditionalLocalIP"`
-	SuperNodeInfoTimeout float64  `yaml:"SuperNodeInfoTimeout"`
+	UseSuperNode         bool              `yaml:"UseSuperNode"`
+	PSKey                string            `yaml:"PSKey"`
+	EndpointV4           string            `yaml:"EndpointV4"`
+	PubKeyV4             string            `yaml:"PubKeyV4"`
+	EndpointV6           string            `yaml:"EndpointV6"`
+	PubKeyV6             string            `yaml:"PubKeyV6"`
+	EndpointEdgeAPIUrl   string            `yaml:"EndpointEdgeAPIUrl"`
+	SkipLocalIP          bool              `yaml:"SkipLocalIP"`
+	AdditionalLocalIP    []string          `yaml:"AdditionalLocalIP"`
+	SuperNodeInfoTimeout float64           `yaml:"SuperNodeInfoTimeout"`
+	NATDetectInterval    float64           `yaml:"NATDetectInterval"`
+	PortMapping          PortMappingInfo   `yaml:"PortMapping"`
+	Backups              []SuperBackupInfo `yaml:"Backups"`
+}
+
+// PortMappingInfo asks the router to forward ListenPort to us, the mapped address is sent to the supernode as a candidate
+type PortMappingInfo struct {
+	Enabled   bool     `yaml:"Enabled"`
+	Protocols []string `yaml:"Protocols"` // pcp, natpmp or upnp, tried in order. Empty for all of them
+	Gateway   string   `yaml:"Gateway"`   // IPv4 address of the router, empty for the default gateway
+	Lifetime  float64  `yaml:"Lifetime"`  // seconds, renewed at half of it
+}
+
+type SuperBackupInfo struct {
+	EndpointV4         string `yaml:"EndpointV4"`
+	PubKeyV4           string `yaml:"PubKeyV4"`
+	EndpointV6         string `yaml:"EndpointV6"`
+	PubKeyV6           string `yaml:"PubKeyV6"`
+	EndpointEdgeAPIUrl string `yaml:"EndpointEdgeAPIUrl"`
 }
 
 type P2PInfo struct {
@@ -180,11 +361,19 @@ type GraphRecalculateSetting struct {
 	JitterToleranceMultiplier float64   `yaml:"JitterToleranceMultiplier"`
 	TimeoutCheckInterval      float64   `yaml:"TimeoutCheckInterval"`
 	RecalculateCoolDown       float64   `yaml:"RecalculateCoolDown"`
+	RouteSolver               string    `yaml:"RouteSolver"`
+	ECMPTolerance             float64   `yaml:"ECMPTolerance"`
+	LinkMetric                string    `yaml:"LinkMetric"`
+	LossPenalty               float64   `yaml:"LossPenalty"`
+	ReferenceBandwidth        float64   `yaml:"ReferenceBandwidth"`
 }
 
 type DistTable map[Vertex]map[Vertex]float64
 type NextHopTable map[Vertex]map[Vertex]Vertex
 
+// NextHopSets lists all next hops within ECMPTolerance of the shortest path, the one in NextHopTable first
+type NextHopSets map[Vertex]map[Vertex][]Vertex
+
 type API_connurl struct {
 	ExternalV4 map[string]float64
 	ExternalV6 map[string]float64
@@ -229,12 +418,20 @@ type API_Peerinfo struct {
 	Connurl *API_connurl
 }
 
+// API_NhTable is returned by /edge/nhtable if the edge asks for ECMP
+type API_NhTable struct {
+	NhTable NextHopTable
+	NhSets  NextHopSets
+}
+
 type API_SuperParams struct {
 	SendPingInterval    float64
 	HttpPostInterval    float64
 	PeerAliveTimeout    float64
 	DampingFilterRadius uint64
 	AdditionalCost      float64
+	ACL                 ACLInfo
+	NATDetectPort       int // the second port of the supernode that answers NAT probes, 0 if none
 }
 
 type StateHash struct {
@@ -243,6 +440,16 @@ type StateHash struct {
 	NhTable    atomic.Value //[32]byte
 }
 
+// API_L2FIBEntry is an entry of the L2FIB, returned by the manage API of the edge
+type API_L2FIBEntry struct {
+	MacAddress string
+	VNI        uint16
+	VLAN       uint16
+	NodeID     Vertex
+	Kind       string // learned, static or pinned
+	LastSeen   time.Time
+}
+
 type API_Peers map[string]API_Peerinfo // map[PubKey]API_Peerinfo
 
 type JWTSecret [32]byte
@@ -25,7 +25,7 @@ func String2Float64(s string) (float64, error) {
 }
 
 func String2NodeID(s string) (Vertex, error) {
-	ret, err := strconv.ParseUint(s, 10, 16)
+	ret, err := strconv.ParseUint(s, 10, 32)
 	return Vertex(ret), err
 }
 
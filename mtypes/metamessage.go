@@ -13,8 +13,8 @@ import (
 func GetByte(structIn interface{}) (bb []byte, err error) {
 	var b bytes.Buffer
 	e := gob.NewEncoder(&b)
-	if err := e.Encode(structIn); err != nil {
-		panic(err)
+	if err = e.Encode(structIn); err != nil {
+		return nil, err
 	}
 	bb = b.Bytes()
 	return
@@ -30,6 +30,9 @@ type RegisterMsg struct {
 	SuperParamStateHash string
 	JWTSecret           JWTSecret
 	HttpPostCount       uint64
+	WireCodecs          WireCodecSet
+	EgHeaderVersion     uint8  // highest EgHeader version the edge can decode, 0 from edges before version 2
+	ProtocolVersion     uint32 // 0 from edges before protocol versions, they must run our release
 }
 
 func Hash2Str(h string) string {
@@ -41,14 +44,57 @@ func Hash2Str(h string) string {
 }
 
 func (c *RegisterMsg) ToString() string {
-	return fmt.Sprint("RegisterMsg Node_id:"+c.Node_id.ToString(), " Version:"+c.Version, " PeerHash:"+Hash2Str(c.PeerStateHash), " NhHash:"+Hash2Str(c.NhStateHash), " SuperParamHash:"+Hash2Str(c.SuperParamStateHash))
+	return fmt.Sprint("RegisterMsg Node_id:"+c.Node_id.ToString(), " Version:"+c.Version, " PeerHash:"+Hash2Str(c.PeerStateHash), " NhHash:"+Hash2Str(c.NhStateHash), " SuperParamHash:"+Hash2Str(c.SuperParamStateHash), " Codecs:"+strconv.FormatUint(uint64(c.WireCodecs), 2), " EgHeader:"+strconv.Itoa(int(c.EgHeaderVersion)), " Protocol:"+strconv.FormatUint(uint64(c.ProtocolVersion), 10))
+}
+
+func (c *RegisterMsg) marshalWire(w *wireWriter) {
+	w.Uint(1, uint64(c.Node_id))
+	w.String(2, c.Version)
+	w.String(3, c.PeerStateHash)
+	w.String(4, c.NhStateHash)
+	w.String(5, c.SuperParamStateHash)
+	w.Bytes(6, c.JWTSecret[:])
+	w.Uint(7, c.HttpPostCount)
+	w.Uint(8, uint64(c.WireCodecs))
+	w.Uint(9, uint64(c.EgHeaderVersion))
+	w.Uint(10, uint64(c.ProtocolVersion))
+}
+
+func (c *RegisterMsg) unmarshalWire(tag uint64, f wireField) (err error) {
+	var u uint64
+	var b []byte
+	switch tag {
+	case 1:
+		u, err = f.Uint()
+		c.Node_id = Vertex(u)
+	case 2:
+		c.Version, err = f.String()
+	case 3:
+		c.PeerStateHash, err = f.String()
+	case 4:
+		c.NhStateHash, err = f.String()
+	case 5:
+		c.SuperParamStateHash, err = f.String()
+	case 6:
+		b, err = f.Bytes()
+		copy(c.JWTSecret[:], b)
+	case 7:
+		c.HttpPostCount, err = f.Uint()
+	case 8:
+		u, err = f.Uint()
+		c.WireCodecs = WireCodecSet(u)
+	case 9:
+		u, err = f.Uint()
+		c.EgHeaderVersion = uint8(u)
+	case 10:
+		u, err = f.Uint()
+		c.ProtocolVersion = uint32(u)
+	}
+	return
 }
 
 func ParseRegisterMsg(bin []byte) (StructPlace RegisterMsg, err error) {
-	var b bytes.Buffer
-	b.Write(bin)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(&StructPlace)
+	err = decodeMsg(bin, &StructPlace)
 	return
 }
 
@@ -62,6 +108,7 @@ const (
 	UpdatePeer
 	UpdateNhTable
 	UpdateSuperParams
+	PunchHole // Params is a PunchHoleParams in JSON
 )
 
 func (a *ServerCommand) ToString() string {
@@ -78,28 +125,66 @@ func (a *ServerCommand) ToString() string {
 		return "UpdateNhTable"
 	case UpdateSuperParams:
 		return "UpdateSuperParams"
+	case PunchHole:
+		return "PunchHole"
 	default:
 		return "Unknown"
 	}
 }
 
 type ServerUpdateMsg struct {
-	Node_id Vertex
-	Action  ServerCommand
-	Code    int
-	Params  string
+	Node_id   Vertex
+	Action    ServerCommand
+	Code      int
+	Params    string
+	WireCodec WireCodec // codec the edge should use for control messages, chosen by the supernode
+}
+
+// PunchHoleParams tells an edge to send pings to a peer after Delay seconds.
+// The supernode sends it to both sides at once, so their NATs open the mapping at the same time.
+type PunchHoleParams struct {
+	NodeID   Vertex
+	Endpoint string  // the address of the peer, as seen by the supernode
+	Delay    float64 // seconds
 }
 
 func ParseServerUpdateMsg(bin []byte) (StructPlace ServerUpdateMsg, err error) {
-	var b bytes.Buffer
-	b.Write(bin)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(&StructPlace)
+	err = decodeMsg(bin, &StructPlace)
 	return
 }
 
 func (c *ServerUpdateMsg) ToString() string {
-	return "ServerUpdateMsg Node_id:" + c.Node_id.ToString() + " Action:" + c.Action.ToString() + " Code:" + strconv.Itoa(int(c.Code)) + " Params: " + c.Params
+	return "ServerUpdateMsg Node_id:" + c.Node_id.ToString() + " Action:" + c.Action.ToString() + " Code:" + strconv.Itoa(int(c.Code)) + " Params: " + c.Params + " Codec:" + c.WireCodec.ToString()
+}
+
+func (c *ServerUpdateMsg) marshalWire(w *wireWriter) {
+	w.Uint(1, uint64(c.Node_id))
+	w.Int(2, int64(c.Action))
+	w.Int(3, int64(c.Code))
+	w.String(4, c.Params)
+	w.Uint(5, uint64(c.WireCodec))
+}
+
+func (c *ServerUpdateMsg) unmarshalWire(tag uint64, f wireField) (err error) {
+	var u uint64
+	var i int64
+	switch tag {
+	case 1:
+		u, err = f.Uint()
+		c.Node_id = Vertex(u)
+	case 2:
+		i, err = f.Int()
+		c.Action = ServerCommand(i)
+	case 3:
+		i, err = f.Int()
+		c.Code = int(i)
+	case 4:
+		c.Params, err = f.String()
+	case 5:
+		u, err = f.Uint()
+		c.WireCodec = WireCodec(u)
+	}
+	return
 }
 
 type PingMsg struct {
@@ -107,17 +192,50 @@ type PingMsg struct {
 	Src_nodeID   Vertex
 	Time         time.Time
 	RequestReply int
+	WireCodecs   WireCodecSet
+	ProbeSize    int // a PMTU probe padded to this size, answered by a PongMsg to the sender only
 }
 
 func (c *PingMsg) ToString() string {
 	return "PingMsg SID:" + c.Src_nodeID.ToString() + " Time:" + c.Time.String() + " RequestID:" + strconv.Itoa(int(c.RequestID))
 }
 
+func (c *PingMsg) marshalWire(w *wireWriter) {
+	w.Uint(1, uint64(c.RequestID))
+	w.Uint(2, uint64(c.Src_nodeID))
+	w.Time(3, c.Time)
+	w.Int(4, int64(c.RequestReply))
+	w.Uint(5, uint64(c.WireCodecs))
+	w.Int(6, int64(c.ProbeSize))
+}
+
+func (c *PingMsg) unmarshalWire(tag uint64, f wireField) (err error) {
+	var u uint64
+	var i int64
+	switch tag {
+	case 1:
+		u, err = f.Uint()
+		c.RequestID = uint32(u)
+	case 2:
+		u, err = f.Uint()
+		c.Src_nodeID = Vertex(u)
+	case 3:
+		c.Time, err = f.Time()
+	case 4:
+		i, err = f.Int()
+		c.RequestReply = int(i)
+	case 5:
+		u, err = f.Uint()
+		c.WireCodecs = WireCodecSet(u)
+	case 6:
+		i, err = f.Int()
+		c.ProbeSize = int(i)
+	}
+	return
+}
+
 func ParsePingMsg(bin []byte) (StructPlace PingMsg, err error) {
-	var b bytes.Buffer
-	b.Write(bin)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(&StructPlace)
+	err = decodeMsg(bin, &StructPlace)
 	return
 }
 
@@ -128,17 +246,59 @@ type PongMsg struct {
 	Timediff       float64
 	TimeToAlive    float64
 	AdditionalCost float64
+	Loss           float64 // ratio of the pings from Src_nodeID missed by Dst_nodeID
+	Throughput     float64 // Mbit/s received from Src_nodeID, 0 if not measured
+	ProbeSize      int     // the ProbeSize of the PingMsg it answers
 }
 
 func (c *PongMsg) ToString() string {
-	return "PongMsg SID:" + c.Src_nodeID.ToString() + " DID:" + c.Dst_nodeID.ToString() + " Timediff:" + S2TD(c.Timediff).String() + " TTL:" + S2TD(c.TimeToAlive).String() + " RequestID:" + strconv.Itoa(int(c.RequestID))
+	return "PongMsg SID:" + c.Src_nodeID.ToString() + " DID:" + c.Dst_nodeID.ToString() + " Timediff:" + S2TD(c.Timediff).String() + " TTL:" + S2TD(c.TimeToAlive).String() + " Loss:" + strconv.FormatFloat(c.Loss, 'f', 3, 64) + " RequestID:" + strconv.Itoa(int(c.RequestID))
+}
+
+func (c *PongMsg) marshalWire(w *wireWriter) {
+	w.Uint(1, uint64(c.RequestID))
+	w.Uint(2, uint64(c.Src_nodeID))
+	w.Uint(3, uint64(c.Dst_nodeID))
+	w.Float(4, c.Timediff)
+	w.Float(5, c.TimeToAlive)
+	w.Float(6, c.AdditionalCost)
+	w.Float(7, c.Loss)
+	w.Float(8, c.Throughput)
+	w.Int(9, int64(c.ProbeSize))
+}
+
+func (c *PongMsg) unmarshalWire(tag uint64, f wireField) (err error) {
+	var u uint64
+	var i int64
+	switch tag {
+	case 1:
+		u, err = f.Uint()
+		c.RequestID = uint32(u)
+	case 2:
+		u, err = f.Uint()
+		c.Src_nodeID = Vertex(u)
+	case 3:
+		u, err = f.Uint()
+		c.Dst_nodeID = Vertex(u)
+	case 4:
+		c.Timediff, err = f.Float()
+	case 5:
+		c.TimeToAlive, err = f.Float()
+	case 6:
+		c.AdditionalCost, err = f.Float()
+	case 7:
+		c.Loss, err = f.Float()
+	case 8:
+		c.Throughput, err = f.Float()
+	case 9:
+		i, err = f.Int()
+		c.ProbeSize = int(i)
+	}
+	return
 }
 
 func ParsePongMsg(bin []byte) (StructPlace PongMsg, err error) {
-	var b bytes.Buffer
-	b.Write(bin)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(&StructPlace)
+	err = decodeMsg(bin, &StructPlace)
 	return
 }
 
@@ -150,11 +310,22 @@ func (c *QueryPeerMsg) ToString() string {
 	return "QueryPeerMsg Request_ID:" + strconv.Itoa(int(c.Request_ID))
 }
 
+func (c *QueryPeerMsg) marshalWire(w *wireWriter) {
+	w.Uint(1, uint64(c.Request_ID))
+}
+
+func (c *QueryPeerMsg) unmarshalWire(tag uint64, f wireField) (err error) {
+	var u uint64
+	switch tag {
+	case 1:
+		u, err = f.Uint()
+		c.Request_ID = uint32(u)
+	}
+	return
+}
+
 func ParseQueryPeerMsg(bin []byte) (StructPlace QueryPeerMsg, err error) {
-	var b bytes.Buffer
-	b.Write(bin)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(&StructPlace)
+	err = decodeMsg(bin, &StructPlace)
 	return
 }
 
@@ -169,25 +340,101 @@ func (c *BoardcastPeerMsg) ToString() string {
 	return "BoardcastPeerMsg Request_ID:" + strconv.Itoa(int(c.Request_ID)) + " NodeID:" + c.NodeID.ToString() + " ConnURL:" + c.ConnURL
 }
 
+func (c *BoardcastPeerMsg) marshalWire(w *wireWriter) {
+	w.Uint(1, uint64(c.Request_ID))
+	w.Uint(2, uint64(c.NodeID))
+	w.Bytes(3, c.PubKey[:])
+	w.String(4, c.ConnURL)
+}
+
+func (c *BoardcastPeerMsg) unmarshalWire(tag uint64, f wireField) (err error) {
+	var u uint64
+	var b []byte
+	switch tag {
+	case 1:
+		u, err = f.Uint()
+		c.Request_ID = uint32(u)
+	case 2:
+		u, err = f.Uint()
+		c.NodeID = Vertex(u)
+	case 3:
+		b, err = f.Bytes()
+		copy(c.PubKey[:], b)
+	case 4:
+		c.ConnURL, err = f.String()
+	}
+	return
+}
+
 func ParseBoardcastPeerMsg(bin []byte) (StructPlace BoardcastPeerMsg, err error) {
-	var b bytes.Buffer
-	b.Write(bin)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(&StructPlace)
+	err = decodeMsg(bin, &StructPlace)
 	return
 }
 
+// NATType is the behavior of the NAT in front of an edge, found by the NAT probes to the supernode
+type NATType uint8
+
+const (
+	NATType_Unknown   NATType = iota // not detected, or the supernode has no DetectPort
+	NATType_Open                     // the edge has a public address
+	NATType_Cone                     // the same mapping is used for every destination
+	NATType_Symmetric                // every destination gets another mapping, hole punching only works with a cone on the other side
+)
+
+func (t NATType) ToString() string {
+	switch t {
+	case NATType_Open:
+		return "Open"
+	case NATType_Cone:
+		return "Cone"
+	case NATType_Symmetric:
+		return "Symmetric"
+	default:
+		return "Unknown"
+	}
+}
+
 type API_report_peerinfo struct {
-	Pongs    []PongMsg
-	LocalV4s map[string]float64
-	LocalV6s map[string]float64
+	Pongs     []PongMsg
+	LocalV4s  map[string]float64
+	LocalV6s  map[string]float64
+	NATType   NATType
+	MappedV4s map[string]float64 // mapped by the router with PortMapping, reachable from outside
+}
+
+func (c *API_report_peerinfo) marshalWire(w *wireWriter) {
+	for i := range c.Pongs {
+		w.Msg(1, &c.Pongs[i])
+	}
+	w.FloatMap(2, c.LocalV4s)
+	w.FloatMap(3, c.LocalV6s)
+	w.Uint(4, uint64(c.NATType))
+	w.FloatMap(5, c.MappedV4s)
+}
+
+func (c *API_report_peerinfo) unmarshalWire(tag uint64, f wireField) (err error) {
+	switch tag {
+	case 1:
+		var pong PongMsg
+		if err = f.Msg(&pong); err == nil {
+			c.Pongs = append(c.Pongs, pong)
+		}
+	case 2:
+		err = f.FloatMapEntry(&c.LocalV4s)
+	case 3:
+		err = f.FloatMapEntry(&c.LocalV6s)
+	case 4:
+		var u uint64
+		u, err = f.Uint()
+		c.NATType = NATType(u)
+	case 5:
+		err = f.FloatMapEntry(&c.MappedV4s)
+	}
+	return
 }
 
 func ParseAPI_report_peerinfo(bin []byte) (StructPlace API_report_peerinfo, err error) {
-	var b bytes.Buffer
-	b.Write(bin)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(&StructPlace)
+	err = decodeMsg(bin, &StructPlace)
 	return
 }
 
@@ -197,6 +444,12 @@ type API_report_peerinfo_jwt_claims struct {
 	jwt.StandardClaims
 }
 
+type API_cluster_sync_jwt_claims struct {
+	Node     string
+	BodyHash string
+	jwt.StandardClaims
+}
+
 type SUPER_Events struct {
 	Event_server_pong     chan PongMsg
 	Event_server_register chan RegisterMsg
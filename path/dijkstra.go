@@ -0,0 +1,153 @@
+package path
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	RouteSolverFloyd    = "floyd"
+	RouteSolverDijkstra = "dijkstra"
+)
+
+func CheckRouteSolver(solver string) error {
+	switch solver {
+	case "", RouteSolverFloyd, RouteSolverDijkstra:
+		return nil
+	}
+	return fmt.Errorf("unknown RouteSolver: %v, must be %v or %v", solver, RouteSolverFloyd, RouteSolverDijkstra)
+}
+
+// solve calculates all pairs shortest path with the RouteSolver in the setting
+func (g *IG) solve() (dist mtypes.DistTable, dist_noAC mtypes.DistTable, next mtypes.NextHopTable, err error) {
+	if g.gsetting.RouteSolver == RouteSolverDijkstra {
+		return g.Dijkstra()
+	}
+	return g.FloydWarshall(false)
+}
+
+type dijkstra_edge struct {
+	to   int
+	w    float64 // with AdditionalCost
+	w_na float64 // without AdditionalCost
+}
+
+type dijkstra_item struct {
+	node int
+	dist float64
+}
+
+type dijkstra_queue []dijkstra_item
+
+func (q dijkstra_queue) Len() int            { return len(q) }
+func (q dijkstra_queue) Less(i, j int) bool  { return q[i].dist < q[j].dist }
+func (q dijkstra_queue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *dijkstra_queue) Push(x interface{}) { *q = append(*q, x.(dijkstra_item)) }
+func (q *dijkstra_queue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Dijkstra runs Dijkstra's algorithm from every vertex, O(V*E*logV) instead of O(V^3) of FloydWarshall.
+// The result is the same as FloydWarshall. Dijkstra can't handle negative weights,
+// it falls back to FloydWarshall if there are any.
+func (g *IG) Dijkstra() (dist mtypes.DistTable, dist_noAC mtypes.DistTable, next mtypes.NextHopTable, err error) {
+	elog.Info(elog.Internal, "Start Dijkstra algorithm")
+	// Take a snapshot of the adjacency lists, so we hold the lock only once
+	g.edgelock.Lock()
+	now := time.Now()
+	verts := make([]mtypes.Vertex, 0, len(g.Vert))
+	index := make(map[mtypes.Vertex]int, len(g.Vert))
+	for v := range g.Vert {
+		index[v] = len(verts)
+		verts = append(verts, v)
+	}
+	adj := make([][]dijkstra_edge, len(verts))
+	negative := false
+	for u, dsts := range g.edges {
+		ui, ok := index[u]
+		if !ok {
+			continue
+		}
+		for v, e := range dsts {
+			if u == v {
+				continue
+			}
+			w := e.weight(now, true)
+			wo := e.weight(now, false)
+			e.ping_old = wo
+			if w >= mtypes.Infinity {
+				continue
+			}
+			if w < 0 {
+				negative = true
+			}
+			if vi, ok := index[v]; ok {
+				adj[ui] = append(adj[ui], dijkstra_edge{to: vi, w: w, w_na: wo})
+			}
+		}
+	}
+	g.edgelock.Unlock()
+	if negative {
+		elog.Info(elog.Internal, "Negative weight found, fallback to Floyd Warshall algorithm")
+		return g.FloydWarshall(false)
+	}
+
+	dist = make(mtypes.DistTable, len(verts))
+	dist_noAC = make(mtypes.DistTable, len(verts))
+	next = make(mtypes.NextHopTable, len(verts))
+	d := make([]float64, len(verts))
+	d_na := make([]float64, len(verts))
+	first := make([]int, len(verts))
+	done := make([]bool, len(verts))
+	queue := make(dijkstra_queue, 0, len(verts))
+	for si, src := range verts {
+		for i := range d {
+			d[i] = mtypes.Infinity
+			d_na[i] = mtypes.Infinity
+			first[i] = -1
+			done[i] = false
+		}
+		d[si] = 0
+		d_na[si] = 0
+		queue = append(queue[:0], dijkstra_item{node: si})
+		for queue.Len() > 0 {
+			item := heap.Pop(&queue).(dijkstra_item)
+			u := item.node
+			if done[u] {
+				continue
+			}
+			done[u] = true
+			for _, e := range adj[u] {
+				nd := d[u] + e.w
+				if nd < d[e.to] {
+					d[e.to] = nd
+					d_na[e.to] = d_na[u] + e.w_na
+					if u == si {
+						first[e.to] = e.to
+					} else {
+						first[e.to] = first[u]
+					}
+					heap.Push(&queue, dijkstra_item{node: e.to, dist: nd})
+				}
+			}
+		}
+		dist[src] = make(map[mtypes.Vertex]float64, len(verts))
+		dist_noAC[src] = make(map[mtypes.Vertex]float64, len(verts))
+		next[src] = make(map[mtypes.Vertex]mtypes.Vertex)
+		for i, dst := range verts {
+			dist[src][dst] = d[i]
+			dist_noAC[src][dst] = d_na[i]
+			if first[i] >= 0 {
+				next[src][dst] = verts[first[i]]
+			}
+		}
+	}
+	return
+}
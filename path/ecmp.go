@@ -0,0 +1,77 @@
+package path
+
+import (
+	"sort"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// calcNextHopSets finds all next hops within ECMPTolerance of the shortest path.
+//
+// A neighbor n of u is a next hop to v if w(u,n)+dist[n][v] <= dist[u][v]+ECMPTolerance.
+// It must also be strictly closer to v than u, so every hop makes progress and
+// the packets can't loop even if each node picks a different path.
+func (g *IG) calcNextHopSets(dist mtypes.DistTable, next mtypes.NextHopTable) mtypes.NextHopSets {
+	tolerance := g.gsetting.ECMPTolerance / 1000 // ms to s
+	if tolerance <= 0 {
+		return nil
+	}
+	type neighbor struct {
+		id mtypes.Vertex
+		w  float64
+	}
+	g.edgelock.RLock()
+	now := time.Now()
+	neighbors := make(map[mtypes.Vertex][]neighbor, len(g.edges))
+	for u, dsts := range g.edges {
+		for n, e := range dsts {
+			if w := e.weight(now, true); u != n && w < mtypes.Infinity {
+				neighbors[u] = append(neighbors[u], neighbor{n, w})
+			}
+		}
+		sort.Slice(neighbors[u], func(i, j int) bool { return neighbors[u][i].id < neighbors[u][j].id })
+	}
+	g.edgelock.RUnlock()
+
+	sets := make(mtypes.NextHopSets, len(next))
+	for u, dsts := range next {
+		for v, best := range dsts {
+			d := dist[u][v]
+			set := []mtypes.Vertex{best}
+			for _, n := range neighbors[u] {
+				if n.id == best {
+					continue
+				}
+				dn, ok := dist[n.id][v]
+				if !ok || dn >= d || n.w+dn > d+tolerance {
+					continue
+				}
+				set = append(set, n.id)
+			}
+			if len(set) > 1 {
+				if sets[u] == nil {
+					sets[u] = make(map[mtypes.Vertex][]mtypes.Vertex)
+				}
+				sets[u][v] = set
+			}
+		}
+	}
+	return sets
+}
+
+// NextHopSet returns the equal cost next hops from u to v, the same as Next() first.
+// It returns nil if there is only one path.
+func (g *IG) NextHopSet(u, v mtypes.Vertex) []mtypes.Vertex {
+	return g.nhSets[u][v]
+}
+
+func (g *IG) SetNHSets(sets mtypes.NextHopSets) { // set nhSets from supernode
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	g.nhSets = sets
+}
+
+func (g *IG) GetNHSets() mtypes.NextHopSets {
+	return g.nhSets
+}
@@ -7,7 +7,18 @@ import (
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 )
 
-const EgHeaderLen = 4
+// The EgHeader carries the destination and the source node ID.
+// Version 1 has 16 bit IDs, version 2 has 32 bit IDs. In memory every packet has a version 2 header,
+// it is shortened to version 1 on the wire whenever both IDs fit, so older nodes keep working.
+// A version 2 header is marked by EgHeaderV2Flag in the usage byte of the transport header.
+const (
+	EgHeaderLen     = 8
+	EgHeaderLenV1   = 4
+	EgHeaderV2Flag  = 0x80
+	EgHeaderVersion = 2 // the highest version this node is able to decode
+)
+
+const EgVNILen = 2 // the VNI after the EgHeader of a NormalPacketVNI
 
 type EgHeader struct {
 	buf []byte
@@ -30,10 +41,17 @@ const (
 	PongPacket //Send to everyone, include server
 	QueryPeer
 	BroadcastPeer
+
+	NormalPacketVNI // NormalPacket of a virtual network other than the main one
+	Fragment        // a piece of a packet larger than the PMTU, put back together by the peer
+
+	// Not encrypted and not an EgType, like the STUN binding request and response
+	NATProbe      // asks the supernode for the address it sees
+	NATProbeReply // the address, sent back from the port that received the probe
 )
 
 func (v Usage) IsValid_EgType() bool {
-	if v >= NormalPacket && v <= BroadcastPeer {
+	if v >= NormalPacket && v <= Fragment {
 		return true
 	}
 	return false
@@ -63,13 +81,50 @@ func (v Usage) ToString() string {
 		return "QueryPeer"
 	case BroadcastPeer:
 		return "BroadcastPeer"
+	case NormalPacketVNI:
+		return "NormalPacketVNI"
+	case Fragment:
+		return "Fragment"
+	case NATProbe:
+		return "NATProbe"
+	case NATProbeReply:
+		return "NATProbeReply"
 	default:
 		return "Unknown:" + string(uint8(v))
 	}
 }
 
 func (v Usage) IsNormal() bool {
-	return v == NormalPacket
+	return v == NormalPacket || v == NormalPacketVNI
+}
+
+// FrameOffset returns where the ethernet frame starts in a normal packet
+func (v Usage) FrameOffset() int {
+	if v == NormalPacketVNI {
+		return EgHeaderLen + EgVNILen
+	}
+	return EgHeaderLen
+}
+
+// NormalUsage returns the usage of the normal packets of a virtual network, VNI 0 is the main network
+func NormalUsage(vni uint16) Usage {
+	if vni == 0 {
+		return NormalPacket
+	}
+	return NormalPacketVNI
+}
+
+// GetVNI returns the VNI of a normal packet
+func GetVNI(usage Usage, packet []byte) uint16 {
+	if usage != NormalPacketVNI || len(packet) < EgHeaderLen+EgVNILen {
+		return 0
+	}
+	return binary.BigEndian.Uint16(packet[EgHeaderLen : EgHeaderLen+EgVNILen])
+}
+
+// SetVNI writes the VNI of a NormalPacketVNI
+func SetVNI(packet []byte, vni uint16) {
+	binary.BigEndian.PutUint16(packet[EgHeaderLen:EgHeaderLen+EgVNILen], vni)
 }
 
 func (v Usage) IsControl() bool {
@@ -136,15 +191,43 @@ func NewEgHeader(pac []byte, mtu uint16) (e EgHeader, err error) {
 }
 
 func (e EgHeader) GetDst() mtypes.Vertex {
-	return mtypes.Vertex(binary.BigEndian.Uint16(e.buf[0:2]))
+	return mtypes.Vertex(binary.BigEndian.Uint32(e.buf[0:4]))
 }
 func (e EgHeader) SetDst(node_ID mtypes.Vertex) {
-	binary.BigEndian.PutUint16(e.buf[0:2], uint16(node_ID))
+	binary.BigEndian.PutUint32(e.buf[0:4], uint32(node_ID))
 }
 
 func (e EgHeader) GetSrc() mtypes.Vertex {
-	return mtypes.Vertex(binary.BigEndian.Uint16(e.buf[2:4]))
+	return mtypes.Vertex(binary.BigEndian.Uint32(e.buf[4:8]))
 }
 func (e EgHeader) SetSrc(node_ID mtypes.Vertex) {
-	binary.BigEndian.PutUint16(e.buf[2:4], uint16(node_ID))
+	binary.BigEndian.PutUint32(e.buf[4:8], uint32(node_ID))
+}
+
+// FitsV1 reports whether both IDs fit in a version 1 EgHeader
+func (e EgHeader) FitsV1() bool {
+	return e.GetDst() <= mtypes.NodeID_MaxNarrow && e.GetSrc() <= mtypes.NodeID_MaxNarrow
+}
+
+// ToV1 shortens the EgHeader of a packet to version 1 in place.
+// The returned packet starts EgHeaderLen-EgHeaderLenV1 bytes later in the same buffer.
+func ToV1(packet []byte) []byte {
+	e := EgHeader{packet[:EgHeaderLen]}
+	dst, src := e.GetDst(), e.GetSrc()
+	packet = packet[EgHeaderLen-EgHeaderLenV1:]
+	binary.BigEndian.PutUint16(packet[0:2], uint16(dst))
+	binary.BigEndian.PutUint16(packet[2:4], uint16(src))
+	return packet
+}
+
+// FromV1 widens the version 1 EgHeader of buf[offset:] to version 2 in place.
+// buf must have EgHeaderLen-EgHeaderLenV1 bytes in front of offset, the returned packet starts that much earlier.
+func FromV1(buf []byte, offset int) []byte {
+	dst := binary.BigEndian.Uint16(buf[offset : offset+2])
+	src := binary.BigEndian.Uint16(buf[offset+2 : offset+4])
+	packet := buf[offset-(EgHeaderLen-EgHeaderLenV1):]
+	e := EgHeader{packet[:EgHeaderLen]}
+	e.SetDst(mtypes.Vertex(dst))
+	e.SetSrc(mtypes.Vertex(src))
+	return packet
 }
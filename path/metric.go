@@ -0,0 +1,60 @@
+package path
+
+import (
+	"fmt"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	LinkMetricLatency   = "latency"
+	LinkMetricComposite = "composite"
+)
+
+// CheckGraphSetting validates the GraphRecalculateSetting before it is used by NewGraph or UpdateSetting
+func CheckGraphSetting(setting mtypes.GraphRecalculateSetting) error {
+	if err := CheckRouteSolver(setting.RouteSolver); err != nil {
+		return err
+	}
+	switch setting.LinkMetric {
+	case "", LinkMetricLatency, LinkMetricComposite:
+	default:
+		return fmt.Errorf("unknown LinkMetric: %v, must be %v or %v", setting.LinkMetric, LinkMetricLatency, LinkMetricComposite)
+	}
+	if setting.LossPenalty < 0 {
+		return fmt.Errorf("LossPenalty must >= 0: %v", setting.LossPenalty)
+	}
+	if setting.ReferenceBandwidth < 0 {
+		return fmt.Errorf("ReferenceBandwidth must >= 0: %v", setting.ReferenceBandwidth)
+	}
+	return nil
+}
+
+// linkMetric turns the latency, packet loss and throughput of a link into the weight of the edge.
+//
+// With the composite LinkMetric, LossPenalty ms is added for each percent of packet loss,
+// and ReferenceBandwidth/Throughput ms is added if the throughput was measured, like the OSPF cost.
+// A slow link costs at most as much as a link that loses every packet, if LossPenalty is set.
+// No lock, lock before call me
+func (g *IG) linkMetric(latency float64, loss float64, throughput float64) float64 {
+	if g.gsetting.LinkMetric != LinkMetricComposite || latency >= mtypes.Infinity {
+		return latency
+	}
+	if loss < 0 {
+		loss = 0
+	} else if loss > 1 {
+		loss = 1
+	}
+	w := latency + g.gsetting.LossPenalty*loss*100/1000 // ms to s
+	if g.gsetting.ReferenceBandwidth > 0 && throughput > 0 {
+		bw := g.gsetting.ReferenceBandwidth / throughput
+		if limit := g.gsetting.LossPenalty * 100; limit > 0 && bw > limit {
+			bw = limit
+		}
+		w += bw / 1000 // ms to s
+	}
+	if w >= mtypes.Infinity {
+		return mtypes.Infinity
+	}
+	return w
+}
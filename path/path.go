@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/elog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	orderedmap "github.com/KusakabeSi/EtherGuard-VPN/orderdmap"
 	yaml "gopkg.in/yaml.v2"
@@ -25,6 +28,31 @@ type Latency struct {
 	validUntil     time.Time
 }
 
+func (l *Latency) weight(now time.Time, withAC bool) (ret float64) {
+	if now.After(l.validUntil) {
+		return mtypes.Infinity
+	}
+	ret = l.ping
+	if withAC {
+		ret += l.additionalCost
+	}
+	if ret >= mtypes.Infinity {
+		return mtypes.Infinity
+	}
+	return
+}
+
+func (l *Latency) oldWeight(withAC bool) (ret float64) {
+	ret = l.ping_old
+	if withAC {
+		ret += l.additionalCost
+	}
+	if ret >= mtypes.Infinity {
+		return mtypes.Infinity
+	}
+	return
+}
+
 type Fullroute struct {
 	Next      mtypes.NextHopTable `yaml:"NextHopTable"`
 	Dist      mtypes.DistTable    `yaml:"DistanceTable"`
@@ -33,7 +61,7 @@ type Fullroute struct {
 
 // IG is a graph of integers that satisfies the Graph interface.
 type IG struct {
-	Vert                 map[mtypes.Vertex]bool
+	Vert                 map[mtypes.Vertex]bool // protected by edgelock, like edges
 	edges                map[mtypes.Vertex]map[mtypes.Vertex]*Latency
 	edgelock             *sync.RWMutex
 	gsetting             mtypes.GraphRecalculateSetting
@@ -44,11 +72,18 @@ type IG struct {
 	dlTable              mtypes.DistTable
 	dlTable_noAC         mtypes.DistTable
 	nhTable              mtypes.NextHopTable
+	nhSets               mtypes.NextHopSets
 	changed              bool
 	NhTableExpire        time.Time
 	IsSuperMode          bool
 	loglevel             mtypes.LoggerInfo
 
+	recalculate_stats struct {
+		count    uint64
+		total_ns int64
+		last_ns  int64
+	}
+
 	ntp_wg      sync.WaitGroup
 	ntp_info    mtypes.NTPInfo
 	ntp_init_t  time.Time
@@ -57,6 +92,9 @@ type IG struct {
 }
 
 func NewGraph(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateSetting, ntpinfo mtypes.NTPInfo, loglevel mtypes.LoggerInfo) (*IG, error) {
+	if err := CheckGraphSetting(theconfig); err != nil {
+		return nil, err
+	}
 	g := IG{
 		edgelock:             &sync.RWMutex{},
 		gsetting:             theconfig,
@@ -72,6 +110,19 @@ func NewGraph(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateS
 	return &g, nil
 }
 
+// UpdateSetting replaces the recalculate setting, used by config reload
+func (g *IG) UpdateSetting(theconfig mtypes.GraphRecalculateSetting) error {
+	if err := CheckGraphSetting(theconfig); err != nil {
+		return err
+	}
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	g.gsetting = theconfig
+	g.RecalculateCoolDown = mtypes.S2TD(theconfig.RecalculateCoolDown)
+	g.TimeoutCheckInterval = mtypes.S2TD(theconfig.TimeoutCheckInterval)
+	return nil
+}
+
 func (g *IG) GetWeightType(x float64) (y float64) {
 	x = math.Abs(x)
 	y = x
@@ -109,18 +160,29 @@ func (g *IG) ShouldUpdate(oldval float64, newval float64, withCooldown bool) boo
 }
 
 func (g *IG) CheckAnyShouldUpdate(withCooldown bool) bool {
-	vert := g.Vertices()
-	for u := range vert {
-		for v := range vert {
-			if u != v {
-				newVal := g.Weight(u, v, false)
-				oldVal := g.OldWeight(u, v, false)
-				if g.ShouldUpdate(oldVal, newVal, withCooldown) {
-					return true
-				}
+	// Walk the edges under one lock, instead of Weight() and OldWeight() for each of the V^2 pairs
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	now := time.Now()
+	pairs := 0
+	for u, dsts := range g.edges {
+		if !g.Vert[u] {
+			continue
+		}
+		for v, e := range dsts {
+			if u == v || !g.Vert[v] {
+				continue
+			}
+			pairs++
+			if g.ShouldUpdate(e.oldWeight(false), e.weight(now, false), withCooldown) {
+				return true
 			}
 		}
 	}
+	if pairs < len(g.Vert)*(len(g.Vert)-1) {
+		// The pairs without an edge, both weights are Infinity
+		return g.ShouldUpdate(mtypes.Infinity, mtypes.Infinity, withCooldown)
+	}
 	return false
 }
 
@@ -134,10 +196,21 @@ func (g *IG) RecalculateNhTable(checkchange bool) (changed bool) {
 	if !g.CheckAnyShouldUpdate(true) {
 		return
 	}
+	return g.recalculateNhTable(checkchange)
+}
 
-	dist, dist_noAC, next, _ := g.FloydWarshall(false)
+// recalculateNhTable solves the graph without checking whether any weight changed
+func (g *IG) recalculateNhTable(checkchange bool) (changed bool) {
+	start := time.Now()
+	dist, dist_noAC, next, _ := g.solve()
+	duration := int64(time.Since(start))
+	atomic.AddUint64(&g.recalculate_stats.count, 1)
+	atomic.AddInt64(&g.recalculate_stats.total_ns, duration)
+	atomic.StoreInt64(&g.recalculate_stats.last_ns, duration)
+	sets := g.calcNextHopSets(dist, next)
 	changed = false
 	if checkchange {
+		changed = !reflect.DeepEqual(sets, g.nhSets)
 	CheckLoop:
 		for src, dsts := range next {
 			for dst, old_next := range dsts {
@@ -149,12 +222,20 @@ func (g *IG) RecalculateNhTable(checkchange bool) (changed bool) {
 			}
 		}
 	}
-	g.dlTable, g.dlTable_noAC, g.nhTable = dist, dist_noAC, next
+	g.dlTable, g.dlTable_noAC, g.nhTable, g.nhSets = dist, dist_noAC, next, sets
 	g.recalculateTime = time.Now()
 
 	return
 }
 
+// RecalculateStats returns how many times the NhTable was recalculated and how long it took
+func (g *IG) RecalculateStats() (count uint64, total time.Duration, last time.Duration) {
+	count = atomic.LoadUint64(&g.recalculate_stats.count)
+	total = time.Duration(atomic.LoadInt64(&g.recalculate_stats.total_ns))
+	last = time.Duration(atomic.LoadInt64(&g.recalculate_stats.last_ns))
+	return
+}
+
 func (g *IG) RemoveVirt(v mtypes.Vertex, recalculate bool, checkchange bool) (changed bool) { //Waiting for test
 	g.edgelock.Lock()
 	delete(g.Vert, v)
@@ -165,7 +246,11 @@ func (g *IG) RemoveVirt(v mtypes.Vertex, recalculate bool, checkchange bool) (ch
 	g.edgelock.Unlock()
 	g.changed = true
 	if recalculate {
-		changed = g.RecalculateNhTable(checkchange)
+		if g.gsetting.StaticMode {
+			changed = g.RecalculateNhTable(checkchange)
+		} else {
+			changed = g.recalculateNhTable(checkchange) // no weight changed, the vertex is gone
+		}
 	}
 	return
 }
@@ -187,23 +272,31 @@ func (g *IG) UpdateLatencyMulti(pong_info []mtypes.PongMsg, recalculate bool, ch
 		u := pong_msg.Src_nodeID
 		v := pong_msg.Dst_nodeID
 		newval := pong_msg.Timediff
+		manual := false
 		if dst_latency, ok := g.gsetting.ManualLatency[mtypes.NodeID_Broadcast]; ok {
 			if _, ok := dst_latency[mtypes.NodeID_Broadcast]; ok {
 				newval = dst_latency[mtypes.NodeID_Broadcast] / 1000 // s to ms
+				manual = true
 			}
 			if _, ok := dst_latency[v]; ok {
 				newval = dst_latency[v] / 1000 // s to ms
+				manual = true
 			}
 		}
 		if dst_latency, ok := g.gsetting.ManualLatency[u]; ok {
 			if _, ok := dst_latency[mtypes.NodeID_Broadcast]; ok {
 				newval = dst_latency[mtypes.NodeID_Broadcast] / 1000 // s to ms
+				manual = true
 			}
 			if _, ok := dst_latency[v]; ok {
 				newval = dst_latency[v] / 1000 // s to ms
+				manual = true
 			}
 		}
 		w := newval
+		if !manual { // ManualLatency overrides the whole weight
+			w = g.linkMetric(newval, pong_msg.Loss, pong_msg.Throughput)
+		}
 		additionalCost := pong_msg.AdditionalCost
 		if additionalCost < 0 {
 			additionalCost = 0
@@ -278,17 +371,7 @@ func (g *IG) Weight(u, v mtypes.Vertex, withAC bool) (ret float64) {
 	if _, ok := g.edges[u][v]; !ok {
 		return mtypes.Infinity
 	}
-	if time.Now().After(g.edges[u][v].validUntil) {
-		return mtypes.Infinity
-	}
-	ret = g.edges[u][v].ping
-	if withAC {
-		ret += g.edges[u][v].additionalCost
-	}
-	if ret >= mtypes.Infinity {
-		return mtypes.Infinity
-	}
-	return
+	return g.edges[u][v].weight(time.Now(), withAC)
 }
 
 func (g *IG) OldWeight(u, v mtypes.Vertex, withAC bool) (ret float64) {
@@ -303,14 +386,7 @@ func (g *IG) OldWeight(u, v mtypes.Vertex, withAC bool) (ret float64) {
 	if _, ok := g.edges[u][v]; !ok {
 		return mtypes.Infinity
 	}
-	ret = g.edges[u][v].ping_old
-	if withAC {
-		ret += g.edges[u][v].additionalCost
-	}
-	if ret >= mtypes.Infinity {
-		return mtypes.Infinity
-	}
-	return
+	return g.edges[u][v].oldWeight(withAC)
 }
 
 func (g *IG) SetWeight(u, v mtypes.Vertex, weight float64) {
@@ -342,9 +418,7 @@ func (g *IG) RemoveAllNegativeValue() {
 	for u := range vert {
 		for v := range vert {
 			if g.Weight(u, v, true) < 0 {
-				if g.loglevel.LogInternal {
-					fmt.Printf("Internal: Remove negative value : edge[%v][%v] = 0\n", u, v)
-				}
+				elog.Info(elog.Internal, "Remove negative value", "src", u, "dst", v)
 				g.SetWeight(u, v, 0)
 			}
 		}
@@ -352,13 +426,10 @@ func (g *IG) RemoveAllNegativeValue() {
 }
 
 func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, dist_noAC mtypes.DistTable, next mtypes.NextHopTable, err error) {
-	if g.loglevel.LogInternal {
-		if !again {
-			fmt.Println("Internal: Start Floyd Warshall algorithm")
-		} else {
-			fmt.Println("Internal: Start Floyd Warshall algorithm again")
-
-		}
+	if !again {
+		elog.Info(elog.Internal, "Start Floyd Warshall algorithm")
+	} else {
+		elog.Info(elog.Internal, "Start Floyd Warshall algorithm again")
 	}
 	vert := g.Vertices()
 	dist = make(mtypes.DistTable)
@@ -402,9 +473,7 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, dist_noAC mtypes.
 	for i := range dist {
 		if dist[i][i] < 0 {
 			if !again {
-				if g.loglevel.LogInternal {
-					fmt.Println("Internal: Error: Negative cycle detected")
-				}
+				elog.Error(elog.Internal, "Negative cycle detected")
 				g.RemoveAllNegativeValue()
 				err = errors.New("negative cycle detected")
 				dist, dist_noAC, next, _ = g.FloydWarshall(true)
@@ -414,9 +483,7 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, dist_noAC mtypes.
 				dist_noAC = make(mtypes.DistTable)
 				next = make(mtypes.NextHopTable)
 				err = errors.New("negative cycle detected again")
-				if g.loglevel.LogInternal {
-					fmt.Println("Internal: Error: Negative cycle detected again")
-				}
+				elog.Error(elog.Internal, "Negative cycle detected again")
 				return
 			}
 		}
@@ -488,6 +555,73 @@ func (g *IG) GetEdges(isOld bool, withAC bool) (edges map[mtypes.Vertex]map[mtyp
 	return
 }
 
+// EdgeState is the raw latency entry between two vertices, used to carry the
+// graph to another supernode or to disk.
+type EdgeState struct {
+	Src            mtypes.Vertex
+	Dst            mtypes.Vertex
+	Ping           float64
+	AdditionalCost float64
+	ValidUntil     time.Time
+}
+
+func (g *IG) ExportEdges() (edges []EdgeState) {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	now := time.Now()
+	for u, dsts := range g.edges {
+		for v, l := range dsts {
+			if now.After(l.validUntil) {
+				continue
+			}
+			edges = append(edges, EdgeState{
+				Src:            u,
+				Dst:            v,
+				Ping:           l.ping,
+				AdditionalCost: l.additionalCost,
+				ValidUntil:     l.validUntil,
+			})
+		}
+	}
+	return
+}
+
+// ImportEdges merges edges into the graph. An edge is only taken if it is still
+// valid and lives longer than the one we already have. Returns the number of edges taken.
+func (g *IG) ImportEdges(edges []EdgeState) (imported int) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	now := time.Now()
+	for _, e := range edges {
+		if now.After(e.ValidUntil) || e.Src.IsSpecial() || e.Dst.IsSpecial() {
+			continue
+		}
+		if _, ok := g.edges[e.Src]; !ok {
+			g.recalculateTime = time.Time{}
+			g.edges[e.Src] = make(map[mtypes.Vertex]*Latency)
+		}
+		if l, ok := g.edges[e.Src][e.Dst]; ok {
+			if !e.ValidUntil.After(l.validUntil) {
+				continue
+			}
+			l.ping = e.Ping
+			l.additionalCost = e.AdditionalCost
+			l.validUntil = e.ValidUntil
+		} else {
+			g.edges[e.Src][e.Dst] = &Latency{
+				ping:           e.Ping,
+				ping_old:       mtypes.Infinity,
+				additionalCost: e.AdditionalCost,
+				validUntil:     e.ValidUntil,
+			}
+		}
+		g.Vert[e.Src] = true
+		g.Vert[e.Dst] = true
+		imported++
+	}
+	return
+}
+
 func (g *IG) GetBoardcastList(id mtypes.Vertex) (tosend map[mtypes.Vertex]bool) {
 	tosend = make(map[mtypes.Vertex]bool)
 	for _, element := range g.nhTable[id] {
@@ -0,0 +1,205 @@
+package path
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// newRandomGraph makes a graph of n vertices, each has about degree outgoing edges.
+// Some edges are already timed out.
+func newRandomGraph(tb testing.TB, n int, degree int, seed int64) *IG {
+	g, err := NewGraph(n, true, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(seed))
+	var pongs []mtypes.PongMsg
+	for u := 0; u < n; u++ {
+		for i := 0; i < degree; i++ {
+			v := r.Intn(n)
+			if u == v {
+				continue
+			}
+			ttl := 60.0
+			if r.Intn(20) == 0 {
+				ttl = -1
+			}
+			pongs = append(pongs, mtypes.PongMsg{
+				Src_nodeID:     mtypes.Vertex(u),
+				Dst_nodeID:     mtypes.Vertex(v),
+				Timediff:       0.001 + r.Float64()/10,
+				AdditionalCost: float64(r.Intn(20)),
+				TimeToAlive:    ttl,
+			})
+		}
+	}
+	g.UpdateLatencyMulti(pongs, false, false)
+	return g
+}
+
+func checkSameRoute(t *testing.T, name string, g *IG) {
+	dist, dist_noAC, next, err := g.FloydWarshall(false)
+	if err != nil {
+		t.Fatalf("%v: FloydWarshall: %v", name, err)
+	}
+	dist2, dist_noAC2, next2, err := g.Dijkstra()
+	if err != nil {
+		t.Fatalf("%v: Dijkstra: %v", name, err)
+	}
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) < 1e-9
+	}
+	for u := range g.Vertices() {
+		for v := range g.Vertices() {
+			if !near(dist[u][v], dist2[u][v]) || !near(dist_noAC[u][v], dist_noAC2[u][v]) {
+				t.Errorf("%v: dist %v->%v: FloydWarshall %v/%v, Dijkstra %v/%v", name, u, v, dist[u][v], dist_noAC[u][v], dist2[u][v], dist_noAC2[u][v])
+			}
+			nh, has := next[u][v]
+			nh2, has2 := next2[u][v]
+			if nh != nh2 || has != has2 {
+				t.Errorf("%v: next %v->%v: FloydWarshall %v %v, Dijkstra %v %v", name, u, v, nh, has, nh2, has2)
+			}
+		}
+	}
+}
+
+func TestDijkstraSameAsFloydWarshall(t *testing.T) {
+	for _, c := range []struct{ n, degree int }{{1, 1}, {2, 1}, {5, 2}, {30, 3}, {60, 10}} {
+		for seed := int64(0); seed < 5; seed++ {
+			checkSameRoute(t, fmt.Sprintf("n=%v degree=%v seed=%v", c.n, c.degree, seed), newRandomGraph(t, c.n, c.degree, seed))
+		}
+	}
+
+	// Negative weight without negative cycle, Dijkstra must fall back to FloydWarshall
+	g := newRandomGraph(t, 10, 3, 42)
+	g.UpdateLatency(1, 2, -0.0005, 60, 0, false, false)
+	g.UpdateLatency(2, 1, 0.01, 60, 0, false, false)
+	checkSameRoute(t, "negative", g)
+}
+
+func BenchmarkRouteSolver(b *testing.B) {
+	for _, n := range []int{50, 200} {
+		g := newRandomGraph(b, n, 8, 1)
+		b.Run(fmt.Sprintf("FloydWarshall/n=%v", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				g.FloydWarshall(false)
+			}
+		})
+		b.Run(fmt.Sprintf("Dijkstra/n=%v", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				g.Dijkstra()
+			}
+		})
+	}
+}
+
+func TestNextHopSets(t *testing.T) {
+	setting := mtypes.GraphRecalculateSetting{ECMPTolerance: 2}
+	g, _ := NewGraph(4, true, setting, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	// 1 -> 2 -> 4 costs 20ms, 1 -> 3 -> 4 costs 21ms, 1 -> 4 costs 30ms
+	g.UpdateLatency(1, 2, 0.010, 60, 0, false, false)
+	g.UpdateLatency(2, 4, 0.010, 60, 0, false, false)
+	g.UpdateLatency(1, 3, 0.010, 60, 0, false, false)
+	g.UpdateLatency(3, 4, 0.011, 60, 0, false, false)
+	g.UpdateLatency(1, 4, 0.030, 60, 0, false, false)
+	g.RecalculateNhTable(false)
+	if set := g.NextHopSet(1, 4); !reflect.DeepEqual(set, []mtypes.Vertex{2, 3}) {
+		t.Errorf("NextHopSet(1,4) = %v, expect [2 3]", set)
+	}
+	if set := g.NextHopSet(1, 2); set != nil {
+		t.Errorf("NextHopSet(1,2) = %v, expect nil", set)
+	}
+
+	// Every next hop must be closer to the destination, or the packets may loop
+	g = newRandomGraph(t, 40, 6, 7)
+	setting.ECMPTolerance = 50
+	g.UpdateSetting(setting)
+	dist, _, next, _ := g.FloydWarshall(false)
+	sets := g.calcNextHopSets(dist, next)
+	if len(sets) == 0 {
+		t.Fatal("expect some equal cost paths")
+	}
+	for u, dsts := range sets {
+		for v, set := range dsts {
+			if set[0] != next[u][v] {
+				t.Errorf("%v->%v: %v doesn't start with the best next hop %v", u, v, set, next[u][v])
+			}
+			for _, n := range set {
+				if n != v && dist[n][v] >= dist[u][v] {
+					t.Errorf("%v->%v: next hop %v is not closer to the destination", u, v, n)
+				}
+			}
+		}
+	}
+}
+
+func TestLinkMetric(t *testing.T) {
+	setting := mtypes.GraphRecalculateSetting{LinkMetric: LinkMetricComposite, LossPenalty: 10, ReferenceBandwidth: 100}
+	g, _ := NewGraph(3, true, setting, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	// 1 -> 2 is fast but drops 20% of the pings, 1 -> 3 -> 2 is clean
+	g.UpdateLatencyMulti([]mtypes.PongMsg{
+		{Src_nodeID: 1, Dst_nodeID: 2, Timediff: 0.010, TimeToAlive: 60, Loss: 0.2},
+		{Src_nodeID: 1, Dst_nodeID: 3, Timediff: 0.020, TimeToAlive: 60},
+		{Src_nodeID: 3, Dst_nodeID: 2, Timediff: 0.020, TimeToAlive: 60, Throughput: 50},
+	}, false, false)
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) < 1e-9
+	}
+	if w := g.Weight(1, 2, false); !near(w, 0.010+0.2) {
+		t.Errorf("Weight(1,2) = %v, expect 0.21", w)
+	}
+	if w := g.Weight(3, 2, false); !near(w, 0.020+0.002) {
+		t.Errorf("Weight(3,2) = %v, expect 0.022", w)
+	}
+	g.RecalculateNhTable(false)
+	if nh := g.Next(1, 2); nh != 3 {
+		t.Errorf("Next(1,2) = %v, expect 3", nh)
+	}
+	// A link that carried only pings costs no more than losing them all
+	g.UpdateLatencyMulti([]mtypes.PongMsg{{Src_nodeID: 3, Dst_nodeID: 2, Timediff: 0.020, TimeToAlive: 60, Throughput: 0.001}}, false, false)
+	if w := g.Weight(3, 2, false); !near(w, 0.020+1) {
+		t.Errorf("Weight(3,2) = %v, expect 1.02", w)
+	}
+
+	// The latency metric ignores the loss
+	setting.LinkMetric = LinkMetricLatency
+	g.UpdateSetting(setting)
+	g.UpdateLatencyMulti([]mtypes.PongMsg{{Src_nodeID: 1, Dst_nodeID: 2, Timediff: 0.010, TimeToAlive: 60, Loss: 0.2}}, false, false)
+	if w := g.Weight(1, 2, false); !near(w, 0.010) {
+		t.Errorf("Weight(1,2) = %v, expect 0.01", w)
+	}
+	if err := g.UpdateSetting(mtypes.GraphRecalculateSetting{LinkMetric: "bandwidth"}); err == nil {
+		t.Error("expect error for unknown LinkMetric")
+	}
+}
+
+func TestEgHeaderV1(t *testing.T) {
+	buf := make([]byte, 10+EgHeaderLen+4)
+	packet := buf[10:]
+	copy(packet[EgHeaderLen:], []byte{1, 2, 3, 4})
+	header, _ := NewEgHeader(packet[:EgHeaderLen], 0)
+	header.SetDst(mtypes.NodeID_Broadcast)
+	header.SetSrc(70000)
+	if header.FitsV1() {
+		t.Fatal("ID 70000 fits in a version 1 header")
+	}
+	header.SetSrc(3)
+	if !header.FitsV1() {
+		t.Fatal("ID 3 doesn't fit in a version 1 header")
+	}
+	want := append([]byte{}, packet...)
+
+	v1 := ToV1(packet)
+	if !reflect.DeepEqual(v1, []byte{0xff, 0xff, 0, 3, 1, 2, 3, 4}) {
+		t.Fatalf("wrong version 1 packet: %x", v1)
+	}
+	offset := len(buf) - len(v1)
+	if got := FromV1(buf, offset); !reflect.DeepEqual(got, want) {
+		t.Fatalf("FromV1() = %x, want %x", got, want)
+	}
+}
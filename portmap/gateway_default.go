@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import "net"
+
+// DefaultGateway is only known on Linux, set the Gateway of the Mapper elsewhere
+func DefaultGateway() (net.IP, error) {
+	return nil, ErrNoGateway
+}
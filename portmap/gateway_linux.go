@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// DefaultGateway returns the IPv4 default gateway from the routing table of the kernel
+func DefaultGateway() (net.IP, error) {
+	content, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	return parseProcNetRoute(string(content))
+}
+
+// parseProcNetRoute finds the default route in /proc/net/route, the addresses are hex in host byte order
+func parseProcNetRoute(content string) (net.IP, error) {
+	for _, line := range strings.Split(content, "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		gateway := make(net.IP, 4)
+		binary.BigEndian.PutUint32(gateway, binary.LittleEndian.Uint32(raw))
+		if !gateway.IsUnspecified() {
+			return gateway, nil
+		}
+	}
+	return nil, ErrNoGateway
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseProcNetRoute(t *testing.T) {
+	route := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"
+	gateway, err := parseProcNetRoute(route)
+	if err != nil || !gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("gateway %v %v", gateway, err)
+	}
+	if _, err := parseProcNetRoute(route[:len(route)-60]); err != ErrNoGateway {
+		t.Errorf("found a gateway without a default route: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// NAT-PMP, RFC 6886
+
+const (
+	natpmpVersion     = 0
+	natpmpOpAddress   = 0
+	natpmpOpMapUDP    = 1
+	natpmpReplyOffset = 128
+)
+
+func (mp *Mapper) mapNATPMP(gateway net.IP, port int, lifetime time.Duration) (*Mapping, error) {
+	reply, err := mp.exchange(gateway, []byte{natpmpVersion, natpmpOpAddress}, func(reply []byte) bool {
+		return len(reply) >= 12 && reply[0] == natpmpVersion && reply[1] == natpmpReplyOffset+natpmpOpAddress
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := natpmpResult(reply); err != nil {
+		return nil, err
+	}
+	m, err := mp.requestNATPMP(gateway, port, port, uint32(lifetime/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	m.External.IP = net.IP(append([]byte{}, reply[8:12]...))
+	return m, nil
+}
+
+// requestNATPMP maps the internal port to the suggested one, or deletes the mapping if lifetime is 0
+func (mp *Mapper) requestNATPMP(gateway net.IP, internal int, suggested int, lifetime uint32) (*Mapping, error) {
+	request := make([]byte, 12)
+	request[0] = natpmpVersion
+	request[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(request[4:6], uint16(internal))
+	binary.BigEndian.PutUint16(request[6:8], uint16(suggested))
+	binary.BigEndian.PutUint32(request[8:12], lifetime)
+	reply, err := mp.exchange(gateway, request, func(reply []byte) bool {
+		return len(reply) >= 16 && reply[0] == natpmpVersion && reply[1] == natpmpReplyOffset+natpmpOpMapUDP &&
+			binary.BigEndian.Uint16(reply[8:10]) == uint16(internal)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := natpmpResult(reply); err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Protocol:     ProtocolNATPMP,
+		InternalPort: internal,
+		External:     &net.UDPAddr{Port: int(binary.BigEndian.Uint16(reply[10:12]))},
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(reply[12:16])) * time.Second,
+		gateway:      gateway,
+	}, nil
+}
+
+func natpmpResult(reply []byte) error {
+	if code := binary.BigEndian.Uint16(reply[2:4]); code != 0 {
+		return fmt.Errorf("NAT-PMP result code %v", code)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PCP, RFC 6887. Only the MAP opcode, for IPv4.
+
+const (
+	pcpVersion     = 2
+	pcpOpMap       = 1
+	pcpResponseBit = 0x80
+	pcpMapSize     = 60 // common header 24, MAP 36
+	pcpProtoUDP    = 17
+)
+
+func (mp *Mapper) mapPCP(gateway net.IP, port int, lifetime time.Duration) (*Mapping, error) {
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return mp.requestPCP(gateway, port, port, uint32(lifetime/time.Second), nonce)
+}
+
+// requestPCP maps the internal port to the suggested one, or deletes the mapping if lifetime is 0.
+// The nonce must be the same for the renewals and the deletion of a mapping.
+func (mp *Mapper) requestPCP(gateway net.IP, internal int, suggested int, lifetime uint32, nonce [12]byte) (*Mapping, error) {
+	local, err := localIPTo(gateway)
+	if err != nil {
+		return nil, err
+	}
+	request := makePCPMap(local, internal, suggested, lifetime, nonce)
+	reply, err := mp.exchange(gateway, request, func(reply []byte) bool {
+		if len(reply) >= 4 && reply[0] == natpmpVersion {
+			return true // a NAT-PMP server telling that it doesn't know PCP
+		}
+		return len(reply) >= pcpMapSize && reply[0] == pcpVersion && reply[1] == pcpResponseBit|pcpOpMap &&
+			bytes.Equal(reply[24:36], nonce[:])
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply[0] != pcpVersion {
+		return nil, errors.New("the gateway only speaks NAT-PMP")
+	}
+	if reply[3] != 0 {
+		return nil, fmt.Errorf("PCP result code %v", reply[3])
+	}
+	return &Mapping{
+		Protocol:     ProtocolPCP,
+		InternalPort: internal,
+		External: &net.UDPAddr{
+			IP:   net.IP(append([]byte{}, reply[44:60]...)).To4(),
+			Port: int(binary.BigEndian.Uint16(reply[42:44])),
+		},
+		Lifetime: time.Duration(binary.BigEndian.Uint32(reply[4:8])) * time.Second,
+		gateway:  gateway,
+		nonce:    nonce,
+	}, nil
+}
+
+func makePCPMap(local net.IP, internal int, suggested int, lifetime uint32, nonce [12]byte) []byte {
+	request := make([]byte, pcpMapSize)
+	request[0] = pcpVersion
+	request[1] = pcpOpMap
+	binary.BigEndian.PutUint32(request[4:8], lifetime)
+	copy(request[8:24], local.To16())
+	copy(request[24:36], nonce[:])
+	request[36] = pcpProtoUDP
+	binary.BigEndian.PutUint16(request[40:42], uint16(internal))
+	binary.BigEndian.PutUint16(request[42:44], uint16(suggested))
+	copy(request[44:60], net.IPv4zero.To16()) // any external IPv4 address
+	return request
+}
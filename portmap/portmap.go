@@ -0,0 +1,212 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+// Package portmap asks the router for a UDP port mapping with PCP, NAT-PMP or UPnP-IGD
+package portmap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	ProtocolPCP    = "pcp"
+	ProtocolNATPMP = "natpmp"
+	ProtocolUPnP   = "upnp"
+
+	ServerPort = 5351 // PCP and NAT-PMP
+)
+
+// Protocols are tried in this order if none is given, PCP replaces NAT-PMP and both are cheaper than UPnP
+var Protocols = []string{ProtocolPCP, ProtocolNATPMP, ProtocolUPnP}
+
+var ErrNoGateway = errors.New("portmap: can't find the default gateway")
+
+// CheckProtocols validates the protocols of the config
+func CheckProtocols(protocols []string) error {
+	for _, p := range protocols {
+		switch p {
+		case ProtocolPCP, ProtocolNATPMP, ProtocolUPnP:
+		default:
+			return fmt.Errorf("unknown port mapping protocol: %v, must be %v, %v or %v", p, ProtocolPCP, ProtocolNATPMP, ProtocolUPnP)
+		}
+	}
+	return nil
+}
+
+// Mapping is a UDP port mapping on the router
+type Mapping struct {
+	Protocol     string
+	InternalPort int
+	External     *net.UDPAddr
+	Lifetime     time.Duration // granted by the router, renew it before
+
+	gateway    net.IP
+	nonce      [12]byte // PCP
+	controlURL string   // UPnP
+	service    string   // UPnP
+}
+
+func (m *Mapping) String() string {
+	return m.Protocol + " " + m.External.String() + " -> " + strconv.Itoa(m.InternalPort)
+}
+
+// Mapper maps a UDP port of ours on the router
+type Mapper struct {
+	Gateway   net.IP   // nil for the default gateway
+	Protocols []string // tried in order, empty for Protocols
+	Timeout   time.Duration
+
+	serverPort int    // PCP and NAT-PMP, 0 for ServerPort
+	ssdpAddr   string // UPnP, "" for ssdpMulticast
+	last       string // the protocol that worked last time, tried first
+}
+
+// Map asks the router to forward the same external port to port, with protocol that works.
+// It is called again to renew the mapping.
+func (mp *Mapper) Map(port int, lifetime time.Duration) (*Mapping, error) {
+	protocols := mp.Protocols
+	if len(protocols) == 0 {
+		protocols = Protocols
+	}
+	if mp.last != "" {
+		protocols = append([]string{mp.last}, protocols...)
+	}
+	gateway := mp.Gateway
+	if gateway == nil {
+		var err error
+		if gateway, err = DefaultGateway(); err != nil {
+			return nil, err
+		}
+	}
+	var errs []string
+	tried := map[string]bool{}
+	for _, protocol := range protocols {
+		if tried[protocol] {
+			continue
+		}
+		tried[protocol] = true
+		m, err := mp.mapWith(protocol, gateway, port, lifetime)
+		if err == nil {
+			mp.last = protocol
+			return m, nil
+		}
+		errs = append(errs, protocol+": "+err.Error())
+	}
+	mp.last = ""
+	return nil, fmt.Errorf("portmap: %v", errs)
+}
+
+func (mp *Mapper) mapWith(protocol string, gateway net.IP, port int, lifetime time.Duration) (*Mapping, error) {
+	switch protocol {
+	case ProtocolPCP:
+		return mp.mapPCP(gateway, port, lifetime)
+	case ProtocolNATPMP:
+		return mp.mapNATPMP(gateway, port, lifetime)
+	case ProtocolUPnP:
+		return mp.mapUPnP(gateway, port, lifetime)
+	}
+	return nil, fmt.Errorf("unknown protocol")
+}
+
+// Renew extends the mapping with the same external port, PCP needs the nonce of the mapping for it.
+// It maps the port again if the router forgot the mapping.
+func (mp *Mapper) Renew(m *Mapping, lifetime time.Duration) (*Mapping, error) {
+	var renewed *Mapping
+	var err error
+	switch m.Protocol {
+	case ProtocolPCP:
+		renewed, err = mp.requestPCP(m.gateway, m.InternalPort, m.External.Port, uint32(lifetime/time.Second), m.nonce)
+	case ProtocolNATPMP:
+		if renewed, err = mp.requestNATPMP(m.gateway, m.InternalPort, m.External.Port, uint32(lifetime/time.Second)); err == nil {
+			renewed.External.IP = m.External.IP
+		}
+	case ProtocolUPnP:
+		renewed, err = mp.addUPnP(m.controlURL, m.service, m.InternalPort, lifetime)
+	default:
+		err = fmt.Errorf("unknown protocol")
+	}
+	if err != nil {
+		return mp.Map(m.InternalPort, lifetime)
+	}
+	return renewed, nil
+}
+
+// Delete removes the mapping from the router
+func (mp *Mapper) Delete(m *Mapping) error {
+	switch m.Protocol {
+	case ProtocolPCP:
+		_, err := mp.requestPCP(m.gateway, m.InternalPort, m.External.Port, 0, m.nonce)
+		return err
+	case ProtocolNATPMP:
+		_, err := mp.requestNATPMP(m.gateway, m.InternalPort, m.External.Port, 0)
+		return err
+	case ProtocolUPnP:
+		return mp.deleteUPnP(m)
+	}
+	return nil
+}
+
+func (mp *Mapper) timeout() time.Duration {
+	if mp.Timeout <= 0 {
+		return time.Second * 3
+	}
+	return mp.Timeout
+}
+
+// exchange sends the request to the PCP/NAT-PMP server of the gateway until a reply that passes check arrives
+func (mp *Mapper) exchange(gateway net.IP, request []byte, check func(reply []byte) bool) ([]byte, error) {
+	udpconn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gateway, Port: mp.port()})
+	if err != nil {
+		return nil, err
+	}
+	defer udpconn.Close()
+	deadline := time.Now().Add(mp.timeout())
+	wait := time.Millisecond * 250 // RFC 6886 starts with 250ms and doubles it
+	buf := make([]byte, 1100)
+	for time.Now().Before(deadline) {
+		if _, err := udpconn.Write(request); err != nil {
+			return nil, err
+		}
+		next := time.Now().Add(wait)
+		if next.After(deadline) {
+			next = deadline
+		}
+		udpconn.SetReadDeadline(next)
+		for {
+			n, err := udpconn.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			} else if err != nil {
+				return nil, err // ICMP port unreachable, nothing listens there
+			}
+			if check(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		wait *= 2
+	}
+	return nil, errors.New("no reply from " + gateway.String())
+}
+
+func (mp *Mapper) port() int {
+	if mp.serverPort == 0 {
+		return ServerPort
+	}
+	return mp.serverPort
+}
+
+// localIPTo returns our address on the way to the gateway, UDP doesn't send anything to find it
+func localIPTo(gateway net.IP) (net.IP, error) {
+	udpconn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gateway, Port: ServerPort})
+	if err != nil {
+		return nil, err
+	}
+	defer udpconn.Close()
+	return udpconn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,182 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var loopback = net.IPv4(127, 0, 0, 1)
+
+// fakeServer answers each request on a loopback UDP port with answer, nil drops it
+func fakeServer(t *testing.T, answer func(request []byte) []byte) (port int, requests chan []byte) {
+	udpconn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udpconn.Close() })
+	requests = make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := udpconn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			request := append([]byte{}, buf[:n]...)
+			requests <- request
+			if reply := answer(request); reply != nil {
+				udpconn.WriteToUDP(reply, from)
+			}
+		}
+	}()
+	return udpconn.LocalAddr().(*net.UDPAddr).Port, requests
+}
+
+func TestNATPMP(t *testing.T) {
+	port, requests := fakeServer(t, func(request []byte) []byte {
+		if request[1] == natpmpOpAddress {
+			return []byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 9}
+		}
+		reply := make([]byte, 16)
+		reply[1] = 128 + natpmpOpMapUDP
+		copy(reply[8:10], request[4:6])
+		binary.BigEndian.PutUint16(reply[10:12], 40001)
+		copy(reply[12:16], request[8:12])
+		return reply
+	})
+	mp := &Mapper{Gateway: loopback, Protocols: []string{ProtocolNATPMP}, Timeout: time.Second, serverPort: port}
+	m, err := mp.Map(3001, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.External.String() != "203.0.113.9:40001" || m.InternalPort != 3001 || m.Lifetime != time.Hour {
+		t.Errorf("mapped %v for %v", m, m.Lifetime)
+	}
+	<-requests
+	if request := <-requests; binary.BigEndian.Uint16(request[6:8]) != 3001 {
+		t.Errorf("suggested port %v", binary.BigEndian.Uint16(request[6:8]))
+	}
+	if m, err = mp.Renew(m, time.Hour); err != nil || m.External.String() != "203.0.113.9:40001" {
+		t.Fatalf("renewed %v: %v", m, err)
+	}
+	if request := <-requests; binary.BigEndian.Uint16(request[6:8]) != 40001 {
+		t.Errorf("renewed with suggested port %v", binary.BigEndian.Uint16(request[6:8]))
+	}
+	if err := mp.Delete(m); err != nil {
+		t.Error(err)
+	}
+	if request := <-requests; binary.BigEndian.Uint16(request[6:8]) != 40001 || binary.BigEndian.Uint32(request[8:12]) != 0 {
+		t.Errorf("deleted with %v", request)
+	}
+}
+
+func TestPCP(t *testing.T) {
+	var natpmpOnly int32
+	port, requests := fakeServer(t, func(request []byte) []byte {
+		if atomic.LoadInt32(&natpmpOnly) == 1 {
+			return []byte{0, 128 + request[1], 0, 1}
+		}
+		reply := make([]byte, pcpMapSize)
+		copy(reply, request)
+		reply[1] = pcpResponseBit | pcpOpMap
+		binary.BigEndian.PutUint16(reply[42:44], 40002)
+		copy(reply[44:60], net.IPv4(203, 0, 113, 10).To16())
+		return reply
+	})
+	mp := &Mapper{Gateway: loopback, Protocols: []string{ProtocolPCP}, Timeout: time.Second, serverPort: port}
+	m, err := mp.Map(3001, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.External.String() != "203.0.113.10:40002" || m.Lifetime != time.Hour {
+		t.Errorf("mapped %v for %v", m, m.Lifetime)
+	}
+	if request := <-requests; !net.IP(request[8:24]).Equal(loopback) || binary.BigEndian.Uint16(request[40:42]) != 3001 {
+		t.Errorf("client %v port %v", net.IP(request[8:24]), binary.BigEndian.Uint16(request[40:42]))
+	}
+	if _, err := mp.Renew(m, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-requests; string(request[24:36]) != string(m.nonce[:]) {
+		t.Error("renewed with another nonce")
+	}
+	mp.Delete(m)
+	if request := <-requests; string(request[24:36]) != string(m.nonce[:]) || binary.BigEndian.Uint32(request[4:8]) != 0 {
+		t.Error("deleted with another nonce or a lifetime")
+	}
+
+	atomic.StoreInt32(&natpmpOnly, 1)
+	start := time.Now()
+	if _, err := mp.Map(3001, time.Hour); err == nil || time.Since(start) > time.Second/2 {
+		t.Errorf("a NAT-PMP server took %v: %v", time.Since(start), err)
+	}
+}
+
+func TestUPnP(t *testing.T) {
+	const service = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	var lock sync.Mutex
+	var actions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/desc.xml":
+			fmt.Fprintf(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><deviceList><device>
+<serviceList><service><serviceType>%v</serviceType><controlURL>/ctl/IPConn</controlURL></service></serviceList>
+</device></deviceList></device></deviceList></device></root>`, service)
+		case "/ctl/IPConn":
+			body, _ := ioutil.ReadAll(r.Body)
+			action := strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("SOAPAction"), `"`+service+"#"), `"`)
+			lock.Lock()
+			actions = append(actions, action)
+			lock.Unlock()
+			switch {
+			case action == "AddPortMapping" && strings.Contains(string(body), "<NewLeaseDuration>3600<"):
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `<s:Envelope><s:Body><s:Fault><detail><UPnPError><errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			case action == "GetExternalIPAddress":
+				fmt.Fprint(w, `<s:Envelope><s:Body><u:GetExternalIPAddressResponse><NewExternalIPAddress>203.0.113.11</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	port, _ := fakeServer(t, func(request []byte) []byte {
+		if !strings.HasPrefix(string(request), "M-SEARCH") {
+			return nil
+		}
+		return []byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nLocation: " + srv.URL + "/desc.xml\r\n\r\n")
+	})
+
+	mp := &Mapper{Gateway: loopback, Protocols: []string{ProtocolUPnP}, Timeout: time.Second, ssdpAddr: fmt.Sprintf("127.0.0.1:%v", port)}
+	m, err := mp.Map(3001, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.External.String() != "203.0.113.11:3001" || m.Lifetime != time.Hour || m.controlURL != srv.URL+"/ctl/IPConn" {
+		t.Errorf("mapped %v for %v at %v", m, m.Lifetime, m.controlURL)
+	}
+	if err := mp.Delete(m); err != nil {
+		t.Error(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(actions, ",") != "AddPortMapping,AddPortMapping,GetExternalIPAddress,DeletePortMapping" {
+		t.Errorf("called %v", actions)
+	}
+}
@@ -0,0 +1,319 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UPnP-IGD, the WANIPConnection or WANPPPConnection service of an InternetGatewayDevice
+
+const (
+	ssdpMulticast = "239.255.255.250:1900"
+
+	upnpDescription             = "EtherGuard"
+	upnpOnlyPermanentLeases     = 725
+	upnpServiceWANIPConnection  = "urn:schemas-upnp-org:service:WANIPConnection:"
+	upnpServiceWANPPPConnection = "urn:schemas-upnp-org:service:WANPPPConnection:"
+)
+
+var upnpSearchTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// UPnPError is the UPnPError of a SOAP fault
+type UPnPError struct {
+	Code        int
+	Description string
+}
+
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("UPnP error %v: %v", e.Code, e.Description)
+}
+
+func (mp *Mapper) mapUPnP(gateway net.IP, port int, lifetime time.Duration) (*Mapping, error) {
+	location, err := mp.discoverUPnP(gateway)
+	if err != nil {
+		return nil, err
+	}
+	controlURL, service, err := mp.upnpControlURL(location)
+	if err != nil {
+		return nil, err
+	}
+	return mp.addUPnP(controlURL, service, port, lifetime)
+}
+
+// discoverUPnP finds the description URL of the IGD with SSDP, the one on the gateway if more answer
+func (mp *Mapper) discoverUPnP(gateway net.IP) (string, error) {
+	ssdpAddr := mp.ssdpAddr
+	if ssdpAddr == "" {
+		ssdpAddr = ssdpMulticast
+	}
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	udpconn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer udpconn.Close()
+	for _, st := range upnpSearchTargets {
+		search := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpMulticast + "\r\n" +
+			"ST: " + st + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n\r\n"
+		if _, err := udpconn.WriteToUDP([]byte(search), dst); err != nil {
+			return "", err
+		}
+	}
+	udpconn.SetReadDeadline(time.Now().Add(mp.timeout()))
+	var found string
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := udpconn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		location := ssdpLocation(buf[:n])
+		if location == "" {
+			continue
+		}
+		if from.IP.Equal(gateway) {
+			return location, nil
+		}
+		if found == "" {
+			found = location
+		}
+	}
+	if found == "" {
+		return "", errors.New("no InternetGatewayDevice answered")
+	}
+	return found, nil
+}
+
+// ssdpLocation returns the LOCATION header of an SSDP response
+func ssdpLocation(response []byte) string {
+	lines := strings.Split(string(response), "\r\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "HTTP/1.1 200") {
+		return ""
+	}
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), "LOCATION") {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+// upnpControlURL reads the device description at location and returns the control URL of the WAN connection
+func (mp *Mapper) upnpControlURL(location string) (controlURL string, service string, err error) {
+	client := &http.Client{Timeout: mp.timeout()}
+	resp, err := client.Get(location)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("GET %v: %v", location, resp.Status)
+	}
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return "", "", err
+	}
+	svc := findUPnPService(root.Device)
+	if svc == nil {
+		return "", "", errors.New("no WANIPConnection or WANPPPConnection in " + location)
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return "", "", err
+		}
+	}
+	ref, err := url.Parse(strings.TrimSpace(svc.ControlURL))
+	if err != nil {
+		return "", "", err
+	}
+	return base.ResolveReference(ref).String(), strings.TrimSpace(svc.ServiceType), nil
+}
+
+func findUPnPService(device upnpDevice) *upnpService {
+	for i, svc := range device.Services {
+		t := strings.TrimSpace(svc.ServiceType)
+		if strings.HasPrefix(t, upnpServiceWANIPConnection) || strings.HasPrefix(t, upnpServiceWANPPPConnection) {
+			return &device.Services[i]
+		}
+	}
+	for _, sub := range device.Devices {
+		if svc := findUPnPService(sub); svc != nil {
+			return svc
+		}
+	}
+	return nil
+}
+
+func (mp *Mapper) addUPnP(controlURL string, service string, port int, lifetime time.Duration) (*Mapping, error) {
+	u, err := url.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+	host := net.ParseIP(u.Hostname())
+	if host == nil {
+		return nil, errors.New("the control URL is not an IP address: " + controlURL)
+	}
+	local, err := localIPTo(host)
+	if err != nil {
+		return nil, err
+	}
+	lease := int(lifetime / time.Second)
+	add := func(lease int) error {
+		_, err := mp.soap(controlURL, service, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(port)},
+			{"NewProtocol", "UDP"},
+			{"NewInternalPort", strconv.Itoa(port)},
+			{"NewInternalClient", local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", upnpDescription},
+			{"NewLeaseDuration", strconv.Itoa(lease)},
+		})
+		return err
+	}
+	err = add(lease)
+	if e, ok := err.(*UPnPError); ok && e.Code == upnpOnlyPermanentLeases {
+		lease = 0 // deleted by Delete, and renewed all the same
+		err = add(lease)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply, err := mp.soap(controlURL, service, "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	external := net.ParseIP(reply["NewExternalIPAddress"])
+	if external == nil {
+		return nil, errors.New("no NewExternalIPAddress in the reply")
+	}
+	m := &Mapping{
+		Protocol:     ProtocolUPnP,
+		InternalPort: port,
+		External:     &net.UDPAddr{IP: external, Port: port},
+		Lifetime:     time.Duration(lease) * time.Second,
+		controlURL:   controlURL,
+		service:      service,
+	}
+	if lease == 0 {
+		m.Lifetime = lifetime
+	}
+	return m, nil
+}
+
+func (mp *Mapper) deleteUPnP(m *Mapping) error {
+	_, err := mp.soap(m.controlURL, m.service, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(m.External.Port)},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
+
+// soap calls the action of the service and returns the elements of the reply by name
+func (mp *Mapper) soap(controlURL string, service string, action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%v xmlns:u="%v">`, action, service)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%v>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%v>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%v></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+service+"#"+action+`"`)
+	client := &http.Client{Timeout: mp.timeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	reply := soapElements(content)
+	if resp.StatusCode != http.StatusOK {
+		if code, err := strconv.Atoi(reply["errorCode"]); err == nil {
+			return nil, &UPnPError{Code: code, Description: reply["errorDescription"]}
+		}
+		return nil, fmt.Errorf("%v: %v", action, resp.Status)
+	}
+	return reply, nil
+}
+
+// soapElements returns the text of every element without children by its local name
+func soapElements(content []byte) map[string]string {
+	ret := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	var name string
+	var text []byte
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ret
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name, text = t.Name.Local, nil
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			if t.Name.Local == name {
+				ret[name] = strings.TrimSpace(string(text))
+			}
+			name = ""
+		}
+	}
+}
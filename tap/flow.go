@@ -0,0 +1,69 @@
+package tap
+
+import "encoding/binary"
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+func fnv1a(h uint32, b []byte) uint32 {
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= fnvPrime32
+	}
+	return h
+}
+
+// FlowHash hashes the MAC addresses, VLAN IDs, IP addresses, protocol and ports of an ethernet frame.
+// Frames of the same flow get the same hash, so they can stay on the same path and in order.
+// IP fragments are hashed without ports, so they stay with each other.
+func FlowHash(frame []byte) uint32 {
+	if len(frame) < 14 {
+		return fnv1a(fnvOffset32, frame)
+	}
+	h := fnv1a(fnvOffset32, frame[0:12])
+	ethertype := binary.BigEndian.Uint16(frame[12:14])
+	l3 := frame[14:]
+	for (ethertype == 0x8100 || ethertype == 0x88a8) && len(l3) >= 4 { // 802.1Q, 802.1ad
+		h = fnv1a(h, l3[0:2])
+		ethertype = binary.BigEndian.Uint16(l3[2:4])
+		l3 = l3[4:]
+	}
+	var proto byte
+	var l4 []byte
+	switch ethertype {
+	case 0x0800: // IPv4
+		if len(l3) < 20 {
+			return h
+		}
+		ihl := int(l3[0]&0x0f) * 4
+		if ihl < 20 || len(l3) < ihl {
+			return h
+		}
+		proto = l3[9]
+		h = fnv1a(h, l3[9:10])
+		h = fnv1a(h, l3[12:20])
+		if binary.BigEndian.Uint16(l3[6:8])&0x3fff != 0 { // more fragments or fragment offset
+			return h
+		}
+		l4 = l3[ihl:]
+	case 0x86dd: // IPv6
+		if len(l3) < 40 {
+			return h
+		}
+		proto = l3[6]
+		h = fnv1a(h, l3[6:7])
+		h = fnv1a(h, l3[8:40])
+		l4 = l3[40:]
+	default:
+		return h
+	}
+	switch proto {
+	case 6, 17, 132, 136: // TCP, UDP, SCTP, UDP-Lite
+		if len(l4) >= 4 {
+			h = fnv1a(h, l4[0:4])
+		}
+	}
+	return h ^ h>>16
+}
@@ -0,0 +1,71 @@
+package tap
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// FrameHeader is the addresses, protocol and ports of an ethernet frame. The IP addresses point into the frame.
+type FrameHeader struct {
+	DstMac    MacAddress
+	SrcMac    MacAddress
+	EtherType uint16 // after the VLAN tags
+	SrcIP     net.IP // nil if it isn't an IPv4 or IPv6 packet
+	DstIP     net.IP
+	Protocol  uint8 // the next header of the fixed IPv6 header, extension headers aren't followed
+	HasPorts  bool  // TCP, UDP, SCTP or UDP-Lite, and not a later IP fragment
+	SrcPort   uint16
+	DstPort   uint16
+}
+
+// ParseFrameHeader parses the headers of an ethernet frame as far as they are present
+func ParseFrameHeader(frame []byte) (h FrameHeader, ok bool) {
+	if len(frame) < 14 {
+		return h, false
+	}
+	h.DstMac = GetDstMacAddr(frame)
+	h.SrcMac = GetSrcMacAddr(frame)
+	h.EtherType = binary.BigEndian.Uint16(frame[12:14])
+	l3 := frame[14:]
+	for (h.EtherType == 0x8100 || h.EtherType == 0x88a8) && len(l3) >= 4 { // 802.1Q, 802.1ad
+		h.EtherType = binary.BigEndian.Uint16(l3[2:4])
+		l3 = l3[4:]
+	}
+	var l4 []byte
+	switch h.EtherType {
+	case 0x0800: // IPv4
+		if len(l3) < 20 {
+			return h, true
+		}
+		ihl := int(l3[0]&0x0f) * 4
+		if ihl < 20 || len(l3) < ihl {
+			return h, true
+		}
+		h.Protocol = l3[9]
+		h.SrcIP = net.IP(l3[12:16])
+		h.DstIP = net.IP(l3[16:20])
+		if binary.BigEndian.Uint16(l3[6:8])&0x1fff != 0 { // fragment offset
+			return h, true
+		}
+		l4 = l3[ihl:]
+	case 0x86dd: // IPv6
+		if len(l3) < 40 {
+			return h, true
+		}
+		h.Protocol = l3[6]
+		h.SrcIP = net.IP(l3[8:24])
+		h.DstIP = net.IP(l3[24:40])
+		l4 = l3[40:]
+	default:
+		return h, true
+	}
+	switch h.Protocol {
+	case 6, 17, 132, 136: // TCP, UDP, SCTP, UDP-Lite
+		if len(l4) >= 4 {
+			h.HasPorts = true
+			h.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+			h.DstPort = binary.BigEndian.Uint16(l4[2:4])
+		}
+	}
+	return h, true
+}
@@ -0,0 +1,113 @@
+package tap
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// MakeICMPTooBig makes the ICMP fragmentation needed or ICMPv6 packet too big that answers frame,
+// as if it was sent by the destination, so the sender keeps its frames within maxFrame bytes.
+// It returns nil if frame is not an IP packet that must not be fragmented, or is an ICMP error itself.
+func MakeICMPTooBig(frame []byte, maxFrame int) []byte {
+	if len(frame) < 14 {
+		return nil
+	}
+	ethertype := binary.BigEndian.Uint16(frame[12:14])
+	l3 := frame[14:]
+	for (ethertype == 0x8100 || ethertype == 0x88a8) && len(l3) >= 4 { // 802.1Q, 802.1ad
+		ethertype = binary.BigEndian.Uint16(l3[2:4])
+		l3 = l3[4:]
+	}
+	vlans := frame[12 : len(frame)-len(l3)-2]
+	mtu := maxFrame - (len(frame) - len(l3))
+	var reply []byte
+	switch ethertype {
+	case 0x0800:
+		reply = makeICMPv4TooBig(l3, mtu)
+	case 0x86dd:
+		reply = makeICMPv6TooBig(l3, mtu)
+	}
+	if reply == nil {
+		return nil
+	}
+	ret := make([]byte, 0, 14+len(vlans)+len(reply))
+	ret = append(ret, frame[6:12]...)
+	ret = append(ret, frame[0:6]...)
+	ret = append(ret, vlans...)
+	ret = append(ret, byte(ethertype>>8), byte(ethertype))
+	return append(ret, reply...)
+}
+
+func makeICMPv4TooBig(ip []byte, mtu int) []byte {
+	if len(ip) < 20 || ip[0]>>4 != 4 || mtu < 68 {
+		return nil
+	}
+	ihl := int(ip[0]&0x0f) * 4
+	if ihl < 20 || len(ip) < ihl+8 {
+		return nil
+	}
+	if ip[6]&0x40 == 0 { // DF not set, it can be fragmented
+		return nil
+	}
+	if ip[9] == 1 && ip[ihl] != 0 && ip[ihl] != 8 { // only echo and echo reply are answered
+		return nil
+	}
+	quote := ip[:ihl+8]
+	l3 := make([]byte, 20+8+len(quote))
+	l3[0] = 0x45
+	binary.BigEndian.PutUint16(l3[2:4], uint16(len(l3)))
+	l3[8] = 64
+	l3[9] = 1
+	copy(l3[12:16], ip[16:20])
+	copy(l3[16:20], ip[12:16])
+	binary.BigEndian.PutUint16(l3[10:12], ipChecksum(l3[:20]))
+	icmp := l3[20:]
+	icmp[0], icmp[1] = 3, 4 // destination unreachable, fragmentation needed
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+	copy(icmp[8:], quote)
+	binary.BigEndian.PutUint16(icmp[2:4], ipChecksum(icmp))
+	return l3
+}
+
+func makeICMPv6TooBig(ip []byte, mtu int) []byte {
+	if len(ip) < 40 || ip[0]>>4 != 6 || mtu < 1280 { // the hosts can't go below the minimum MTU of IPv6
+		return nil
+	}
+	if src := net.IP(ip[8:24]); src.IsUnspecified() || src.IsMulticast() {
+		return nil
+	}
+	if ip[6] == 58 && len(ip) > 40 && ip[40] < 128 { // an ICMPv6 error
+		return nil
+	}
+	quote := ip
+	if max := 1280 - 40 - 8; len(quote) > max {
+		quote = quote[:max]
+	}
+	l3 := make([]byte, 40+8+len(quote))
+	l3[0] = 0x60
+	binary.BigEndian.PutUint16(l3[4:6], uint16(8+len(quote)))
+	l3[6] = 58
+	l3[7] = 64
+	copy(l3[8:24], ip[24:40])
+	copy(l3[24:40], ip[8:24])
+	icmp := l3[40:]
+	icmp[0] = 2 // packet too big
+	binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+	copy(icmp[8:], quote)
+	binary.BigEndian.PutUint16(icmp[2:4], icmp6Checksum(l3[8:24], l3[24:40], icmp))
+	return l3
+}
+
+func ipChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
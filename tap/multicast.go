@@ -0,0 +1,170 @@
+package tap
+
+import "encoding/binary"
+
+type McastAction int
+
+const (
+	McastJoin McastAction = iota
+	McastLeave
+)
+
+// McastReport is a group membership change found in an IGMP or MLD report
+type McastReport struct {
+	Group  MacAddress
+	Action McastAction
+}
+
+var BroadcastMac = MacAddress{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// IsSnoopableMcast reports whether the frames to this MAC address can be forwarded to the subscribers only.
+// 224.0.0.0/24 is always flooded (RFC 4541 2.1.2), hosts don't have to report it, so is every group on the same MAC.
+// All-nodes, all-routers and the MLDv2 report group are always flooded too.
+func IsSnoopableMcast(mac MacAddress) bool {
+	switch {
+	case mac[0] == 0x01 && mac[1] == 0x00 && mac[2] == 0x5e && mac[3]&0x80 == 0: // IPv4 multicast
+		return !(mac[3] == 0 && mac[4] == 0)
+	case mac[0] == 0x33 && mac[1] == 0x33: // IPv6 multicast
+		return !(mac[2] == 0 && mac[3] == 0 && mac[4] == 0 && (mac[5] == 0x01 || mac[5] == 0x02 || mac[5] == 0x16))
+	}
+	return false
+}
+
+func mcastMacV4(group []byte) MacAddress {
+	return MacAddress{0x01, 0x00, 0x5e, group[1] & 0x7f, group[2], group[3]}
+}
+
+func mcastMacV6(group []byte) MacAddress {
+	return MacAddress{0x33, 0x33, group[12], group[13], group[14], group[15]}
+}
+
+// ParseMcastMembership finds the group membership changes in an IGMP or MLD frame.
+// isControl is true for any IGMP or MLD message, they must be flooded so every node can snoop them.
+func ParseMcastMembership(frame []byte) (reports []McastReport, isControl bool) {
+	if len(frame) < 14 {
+		return nil, false
+	}
+	ethertype := binary.BigEndian.Uint16(frame[12:14])
+	l3 := frame[14:]
+	for (ethertype == 0x8100 || ethertype == 0x88a8) && len(l3) >= 4 { // 802.1Q, 802.1ad
+		ethertype = binary.BigEndian.Uint16(l3[2:4])
+		l3 = l3[4:]
+	}
+	switch ethertype {
+	case 0x0800:
+		return parseIGMP(l3)
+	case 0x86dd:
+		return parseMLD(l3)
+	}
+	return nil, false
+}
+
+// add appends a report if the group can be snooped
+func (r *McastReport) add(reports []McastReport) []McastReport {
+	if !IsSnoopableMcast(r.Group) {
+		return reports
+	}
+	return append(reports, *r)
+}
+
+// v3RecordAction converts the record type of IGMPv3/MLDv2. Source filters are not tracked,
+// a node subscribed to any source of the group gets all of them.
+func v3RecordAction(rtype byte, nsrc uint16) (McastAction, bool) {
+	switch rtype {
+	case 2, 4: // MODE_IS_EXCLUDE, CHANGE_TO_EXCLUDE_MODE
+		return McastJoin, true
+	case 1, 3, 5: // MODE_IS_INCLUDE, CHANGE_TO_INCLUDE_MODE, ALLOW_NEW_SOURCES
+		if nsrc > 0 {
+			return McastJoin, true
+		}
+		if rtype == 3 { // TO_IN{}, the same as leave
+			return McastLeave, true
+		}
+	}
+	return 0, false
+}
+
+func parseIGMP(l3 []byte) (reports []McastReport, isControl bool) {
+	if len(l3) < 20 || l3[9] != 2 { // IGMP
+		return nil, false
+	}
+	ihl := int(l3[0]&0x0f) * 4
+	if ihl < 20 || len(l3) < ihl+8 {
+		return nil, false
+	}
+	igmp := l3[ihl:]
+	switch igmp[0] {
+	case 0x12, 0x16: // v1, v2 membership report
+		r := McastReport{mcastMacV4(igmp[4:8]), McastJoin}
+		reports = r.add(reports)
+	case 0x17: // v2 leave group
+		r := McastReport{mcastMacV4(igmp[4:8]), McastLeave}
+		reports = r.add(reports)
+	case 0x22: // v3 membership report
+		nrec := int(binary.BigEndian.Uint16(igmp[6:8]))
+		rec := igmp[8:]
+		for i := 0; i < nrec && len(rec) >= 8; i++ {
+			nsrc := binary.BigEndian.Uint16(rec[2:4])
+			if action, ok := v3RecordAction(rec[0], nsrc); ok {
+				r := McastReport{mcastMacV4(rec[4:8]), action}
+				reports = r.add(reports)
+			}
+			reclen := 8 + int(nsrc)*4 + int(rec[1])*4
+			if len(rec) < reclen {
+				break
+			}
+			rec = rec[reclen:]
+		}
+	}
+	return reports, true
+}
+
+func parseMLD(l3 []byte) (reports []McastReport, isControl bool) {
+	if len(l3) < 40 {
+		return nil, false
+	}
+	next := l3[6]
+	l4 := l3[40:]
+	for next == 0 && len(l4) >= 8 { // MLD comes after the hop-by-hop options with router alert
+		hdrlen := 8 + int(l4[1])*8
+		if len(l4) < hdrlen {
+			return nil, false
+		}
+		next = l4[0]
+		l4 = l4[hdrlen:]
+	}
+	if next != 58 || len(l4) < 8 { // ICMPv6
+		return nil, false
+	}
+	switch l4[0] {
+	case 130: // query
+		return nil, true
+	case 131, 132: // v1 report, done
+		if len(l4) < 24 {
+			return nil, true
+		}
+		r := McastReport{mcastMacV6(l4[8:24]), McastJoin}
+		if l4[0] == 132 {
+			r.Action = McastLeave
+		}
+		reports = r.add(reports)
+	case 143: // v2 report
+		nrec := int(binary.BigEndian.Uint16(l4[6:8]))
+		rec := l4[8:]
+		for i := 0; i < nrec && len(rec) >= 20; i++ {
+			nsrc := binary.BigEndian.Uint16(rec[2:4])
+			if action, ok := v3RecordAction(rec[0], nsrc); ok {
+				r := McastReport{mcastMacV6(rec[4:20]), action}
+				reports = r.add(reports)
+			}
+			reclen := 20 + int(nsrc)*16 + int(rec[1])*4
+			if len(rec) < reclen {
+				break
+			}
+			rec = rec[reclen:]
+		}
+	default:
+		return nil, false
+	}
+	return reports, true
+}
@@ -0,0 +1,186 @@
+package tap
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+type NeighborOp int
+
+const (
+	NeighborRequest NeighborOp = iota // ARP request, IPv6 neighbor solicitation
+	NeighborReply                     // ARP reply, IPv6 neighbor advertisement
+)
+
+// NeighborMsg is an ARP or IPv6 neighbor discovery message
+type NeighborMsg struct {
+	Op       NeighborOp
+	TargetIP net.IP // the address being resolved, or advertised by a reply
+	// The binding it tells us: ARP sender, NS source and its link-layer address, NA target and its link-layer address
+	SenderIP  net.IP
+	SenderMAC MacAddress
+	IsRouter  bool // the router flag of a NA
+
+	srcIP  net.IP // IP and MAC to answer to
+	srcMAC MacAddress
+	vlans  []byte // 802.1Q tags, copied to the reply
+}
+
+// HasBinding reports whether the message carries a usable IP/MAC binding, probes and DAD don't
+func (m *NeighborMsg) HasBinding() bool {
+	return m.SenderIP != nil && !m.SenderIP.IsUnspecified()
+}
+
+// CanProxy reports whether a request can be answered on behalf of the target. Gratuitous ARP and DAD can't.
+func (m *NeighborMsg) CanProxy() bool {
+	return m.Op == NeighborRequest && m.HasBinding() && !m.TargetIP.Equal(m.SenderIP)
+}
+
+// ParseNeighborMsg parses an ARP or IPv6 NS/NA frame
+func ParseNeighborMsg(frame []byte) (msg NeighborMsg, ok bool) {
+	if len(frame) < 14 {
+		return
+	}
+	ethertype := binary.BigEndian.Uint16(frame[12:14])
+	l3 := frame[14:]
+	for (ethertype == 0x8100 || ethertype == 0x88a8) && len(l3) >= 4 { // 802.1Q, 802.1ad
+		ethertype = binary.BigEndian.Uint16(l3[2:4])
+		l3 = l3[4:]
+	}
+	msg.vlans = append([]byte{}, frame[12:len(frame)-len(l3)-2]...)
+	copy(msg.srcMAC[:], frame[6:12])
+	switch ethertype {
+	case 0x0806:
+		ok = msg.parseARP(l3)
+	case 0x86dd:
+		ok = msg.parseND(l3)
+	}
+	return
+}
+
+func (m *NeighborMsg) parseARP(arp []byte) bool {
+	// Ethernet/IPv4 only
+	if len(arp) < 28 || binary.BigEndian.Uint16(arp[0:2]) != 1 || binary.BigEndian.Uint16(arp[2:4]) != 0x0800 || arp[4] != 6 || arp[5] != 4 {
+		return false
+	}
+	switch binary.BigEndian.Uint16(arp[6:8]) {
+	case 1:
+		m.Op = NeighborRequest
+	case 2:
+		m.Op = NeighborReply
+	default:
+		return false
+	}
+	copy(m.SenderMAC[:], arp[8:14])
+	m.SenderIP = net.IP(append([]byte{}, arp[14:18]...))
+	m.TargetIP = net.IP(append([]byte{}, arp[24:28]...))
+	m.srcIP = m.SenderIP
+	m.srcMAC = m.SenderMAC
+	return true
+}
+
+func (m *NeighborMsg) parseND(ip6 []byte) bool {
+	if len(ip6) < 40+24 || ip6[6] != 58 || ip6[7] != 255 { // ICMPv6, hop limit must be 255
+		return false
+	}
+	icmp := ip6[40:]
+	if plen := int(binary.BigEndian.Uint16(ip6[4:6])); plen < len(icmp) {
+		icmp = icmp[:plen]
+	}
+	if len(icmp) < 24 || icmp[1] != 0 {
+		return false
+	}
+	m.srcIP = net.IP(append([]byte{}, ip6[8:24]...))
+	m.TargetIP = net.IP(append([]byte{}, icmp[8:24]...))
+	var lla MacAddress
+	hasLLA := false
+	for opts := icmp[24:]; len(opts) >= 8 && opts[1] != 0 && len(opts) >= int(opts[1])*8; opts = opts[int(opts[1])*8:] {
+		if (opts[0] == 1 && icmp[0] == 135) || (opts[0] == 2 && icmp[0] == 136) { // source / target link-layer address
+			copy(lla[:], opts[2:8])
+			hasLLA = true
+		}
+	}
+	switch icmp[0] {
+	case 135:
+		m.Op = NeighborRequest
+		if !m.srcIP.IsUnspecified() && hasLLA {
+			m.SenderIP = m.srcIP
+			m.SenderMAC = lla
+			m.srcMAC = lla
+		}
+	case 136:
+		m.Op = NeighborReply
+		m.IsRouter = icmp[4]&0x80 != 0
+		m.SenderIP = m.TargetIP
+		m.SenderMAC = m.srcMAC
+		if hasLLA {
+			m.SenderMAC = lla
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// MakeNeighborReply makes the ARP reply or NA that answers req, as if it was sent by mac
+func MakeNeighborReply(req *NeighborMsg, mac MacAddress, isRouter bool) []byte {
+	var l3 []byte
+	var ethertype uint16
+	if ip4 := req.TargetIP.To4(); ip4 != nil {
+		ethertype = 0x0806
+		l3 = make([]byte, 28)
+		binary.BigEndian.PutUint16(l3[0:2], 1)
+		binary.BigEndian.PutUint16(l3[2:4], 0x0800)
+		l3[4], l3[5] = 6, 4
+		binary.BigEndian.PutUint16(l3[6:8], 2)
+		copy(l3[8:14], mac[:])
+		copy(l3[14:18], ip4)
+		copy(l3[18:24], req.srcMAC[:])
+		copy(l3[24:28], req.srcIP.To4())
+	} else {
+		ethertype = 0x86dd
+		l3 = make([]byte, 40+32)
+		l3[0] = 0x60
+		binary.BigEndian.PutUint16(l3[4:6], 32)
+		l3[6] = 58
+		l3[7] = 255
+		copy(l3[8:24], req.TargetIP.To16())
+		copy(l3[24:40], req.srcIP.To16())
+		icmp := l3[40:]
+		icmp[0] = 136
+		icmp[4] = 0x60 // solicited, override
+		if isRouter {
+			icmp[4] |= 0x80
+		}
+		copy(icmp[8:24], req.TargetIP.To16())
+		icmp[24], icmp[25] = 2, 1 // target link-layer address
+		copy(icmp[26:32], mac[:])
+		binary.BigEndian.PutUint16(icmp[2:4], icmp6Checksum(l3[8:24], l3[24:40], icmp))
+	}
+	frame := make([]byte, 0, 14+len(req.vlans)+len(l3))
+	frame = append(frame, req.srcMAC[:]...)
+	frame = append(frame, mac[:]...)
+	frame = append(frame, req.vlans...)
+	frame = append(frame, byte(ethertype>>8), byte(ethertype))
+	return append(frame, l3...)
+}
+
+func icmp6Checksum(src []byte, dst []byte, icmp []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src)
+	add(dst)
+	sum += uint32(len(icmp)) + 58
+	add(icmp)
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -85,10 +85,14 @@ func GetIP(version int, netcidr string, uid uint32) (net.IP, net.IPMask, error)
 }
 
 func GetMacAddr(prefix string, uid uint32) (mac MacAddress, err error) {
-	macprefix, _, err := prefixStr2prefix(prefix)
+	macprefix, maxID, err := prefixStr2prefix(prefix)
 	if err != nil {
 		return
 	}
+	if uid > maxID {
+		err = fmt.Errorf("NodeID %v doesn't fit in the %v bytes after the MacAddrPrefix %v, use a shorter prefix", uid, 6-len(macprefix), prefix)
+		return
+	}
 	idbuf := make([]byte, 4)
 	binary.BigEndian.PutUint32(idbuf, uid)
 	copy(mac[2:], idbuf)
@@ -0,0 +1,53 @@
+package tap
+
+import "encoding/binary"
+
+const VlanTagLen = 4
+
+// GetVlanID returns the VLAN ID of the outer 802.1Q or 802.1ad tag, 0 if the frame is untagged or priority tagged
+func GetVlanID(frame []byte) uint16 {
+	if !IsVlanTagged(frame) {
+		return 0
+	}
+	return binary.BigEndian.Uint16(frame[14:16]) & 0x0fff
+}
+
+// PushVlanTag inserts an 802.1Q tag after the MAC addresses.
+// The frame is extended in place, it must have VlanTagLen bytes of spare capacity.
+func PushVlanTag(frame []byte, vid uint16) []byte {
+	frame = frame[:len(frame)+VlanTagLen]
+	copy(frame[12+VlanTagLen:], frame[12:len(frame)-VlanTagLen])
+	binary.BigEndian.PutUint16(frame[12:14], 0x8100)
+	binary.BigEndian.PutUint16(frame[14:16], vid&0x0fff)
+	return frame
+}
+
+// IsVlanTagged reports whether the frame has an 802.1Q or 802.1ad tag
+func IsVlanTagged(frame []byte) bool {
+	if len(frame) < 14+VlanTagLen {
+		return false
+	}
+	ethertype := binary.BigEndian.Uint16(frame[12:14])
+	return ethertype == 0x8100 || ethertype == 0x88a8
+}
+
+// PopVlanTag removes the outer VLAN tag in place by moving the MAC addresses forward,
+// the returned frame starts VlanTagLen bytes later in the same buffer.
+func PopVlanTag(frame []byte) []byte {
+	if !IsVlanTagged(frame) {
+		return frame
+	}
+	copy(frame[VlanTagLen:12+VlanTagLen], frame[:12])
+	return frame[VlanTagLen:]
+}
+
+// GetEtherType returns the EtherType after the outer VLAN tag, 0 if the frame is too short
+func GetEtherType(frame []byte) uint16 {
+	if IsVlanTagged(frame) {
+		return binary.BigEndian.Uint16(frame[12+VlanTagLen : 14+VlanTagLen])
+	}
+	if len(frame) < 14 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(frame[12:14])
+}